@@ -0,0 +1,509 @@
+// Package client is a Go client for encaya's HTTP API.  It takes care of
+// parsing the responses into certificates, pinning the encaya listen
+// certificate, and retrying failed requests.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default retry settings, used when Config leaves them zero.
+const (
+	DefaultRetries = 2
+	DefaultBackoff = 500 * time.Millisecond
+)
+
+// maxResponseSize bounds the responses we read; encaya's responses are a few
+// certificates at most.
+const maxResponseSize = 1 << 20
+
+var (
+	// ErrNotFound is returned when encaya has no such CA or certificate.
+	ErrNotFound = errors.New("not found")
+
+	// ErrSPKIPinMismatch is returned when none of the certificates
+	// presented by encaya match a pinned SPKI hash.
+	ErrSPKIPinMismatch = errors.New("encaya's certificate chain doesn't match any pinned SPKI hash")
+
+	// ErrNoPEM is returned when a response contains no PEM data.
+	ErrNoPEM = errors.New("no PEM data found")
+)
+
+// StatusError is returned when encaya responds with an unexpected HTTP
+// status.  Code, Message and Retryable are taken from the JSON error object
+// in the response, if any.
+type StatusError struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Retryable  bool   `json:"retryable"`
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("encaya responded with HTTP %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+	}
+
+	return fmt.Sprintf("encaya responded with HTTP %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// newStatusError returns the StatusError for a response.
+func newStatusError(resp *http.Response, body []byte) *StatusError {
+	statusErr := &StatusError{}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		// A body that isn't an error object just leaves the
+		// fields empty.
+		_ = json.Unmarshal(body, statusErr)
+	}
+
+	statusErr.StatusCode = resp.StatusCode
+
+	return statusErr
+}
+
+// Config configures a Client.
+type Config struct {
+	// URL of the encaya instance, e.g. "https://127.127.127.127" or
+	// "http://127.127.127.127:8080".
+	URL string
+
+	// Trust encaya's HTTPS listener if its certificate chain contains a
+	// certificate with one of these SHA-256 SubjectPublicKeyInfo hashes,
+	// instead of validating the chain.  Pinning the TLD CA (rather than
+	// the listen certificate itself) survives listen certificate renewal.
+	PinnedSPKI [][]byte
+
+	// Validate encaya's HTTPS listener against these roots (e.g. the
+	// encaya root CA), unless PinnedSPKI is set.  If nil, the system
+	// roots are used.
+	RootCAs *x509.CertPool
+
+	// Bearer token for the key endpoints (KeyEndpointsToken).
+	Token string
+
+	// Client certificate for the key endpoints (KeyEndpointsClientCA).
+	ClientCert *tls.Certificate
+
+	// Requests with different isolation keys never share encaya's cached
+	// results.
+	Isolation string
+
+	// Retry failed requests this many times (DefaultRetries if 0; use a
+	// negative value to disable retries), waiting Backoff (DefaultBackoff
+	// if 0) before the first retry and doubling it each time.
+	Retries int
+	Backoff time.Duration
+
+	// Timeout of each attempt.  If 0, only ctx applies.
+	Timeout time.Duration
+}
+
+// Client makes requests to an encaya instance.  It is safe for concurrent
+// use.
+type Client struct {
+	cfg  Config
+	base *url.URL
+	http *http.Client
+}
+
+// New returns a Client for cfg.
+func New(cfg Config) (*Client, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encaya URL: %w", err)
+	}
+
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultRetries
+	}
+
+	if cfg.Backoff == 0 {
+		cfg.Backoff = DefaultBackoff
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    cfg.RootCAs,
+	}
+
+	if cfg.ClientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cfg.ClientCert}
+	}
+
+	if len(cfg.PinnedSPKI) > 0 {
+		pins := cfg.PinnedSPKI
+
+		// The pins replace chain validation.
+		tlsConfig.InsecureSkipVerify = true //nolint:gosec // Verified below
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifySPKIPins(rawCerts, pins)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &Client{
+		cfg:  cfg,
+		base: base,
+		http: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+		},
+	}, nil
+}
+
+// verifySPKIPins checks that some certificate in the presented chain matches
+// one of pins.
+func verifySPKIPins(rawCerts [][]byte, pins [][]byte) error {
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return fmt.Errorf("unable to parse encaya's certificate: %w", err)
+		}
+
+		spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+		for _, pin := range pins {
+			if bytes.Equal(spkiHash[:], pin) {
+				return nil
+			}
+		}
+	}
+
+	return ErrSPKIPinMismatch
+}
+
+// lookupResult is the JSON representation of a cert returned by /lookup.
+type lookupResult struct {
+	DER []byte `json:"der"`
+}
+
+// Lookup returns the certificates encaya generates for domain from its TLSA
+// records.  Passing "Namecoin Root CA" or a TLD CA's name (e.g. ".bit TLD
+// CA") returns that CA instead.
+func (c *Client) Lookup(ctx context.Context, domain string) ([]*x509.Certificate, error) {
+	params := url.Values{
+		"domain": {domain},
+		"format": {"json"},
+	}
+
+	body, err := c.do(ctx, http.MethodGet, "/lookup", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []lookupResult
+
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse lookup response: %w", err)
+	}
+
+	certs := make([]*x509.Certificate, 0, len(results))
+
+	for _, result := range results {
+		cert, err := x509.ParseCertificate(result.DER)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// AIA returns the domain AIA parent CA of domain whose SubjectPublicKeyInfo
+// has the SHA-256 hash pubSHA256.
+func (c *Client) AIA(ctx context.Context, domain string, pubSHA256 []byte) (*x509.Certificate, error) {
+	params := url.Values{
+		"domain":    {domain},
+		"pubsha256": {hex.EncodeToString(pubSHA256)},
+	}
+
+	body, err := c.do(ctx, http.MethodGet, "/aia", params)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return x509.ParseCertificate(body)
+}
+
+// NewNegativeCA asks encaya to generate a TLD exclusion CA for tld (or the
+// first configured TLD, if empty), returning it with its private key.  This
+// requires the key endpoints to be enabled.
+func (c *Client) NewNegativeCA(ctx context.Context, tld string) (*x509.Certificate, crypto.Signer, error) {
+	params := url.Values{}
+	if tld != "" {
+		params.Set("tld", tld)
+	}
+
+	body, err := c.do(ctx, http.MethodPost, "/get-new-negative-ca", params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, rest := pem.Decode(body)
+	keyBlock, _ := pem.Decode(rest)
+
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, ErrNoPEM
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := parsePrivateKey(keyBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+// CrossSignCA asks encaya to cross-sign toSign with signerCert and
+// signerKey.  This requires the key endpoints to be enabled.
+func (c *Client) CrossSignCA(ctx context.Context, toSign, signerCert *x509.Certificate,
+	signerKey crypto.Signer) (*x509.Certificate, error) {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(signerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{
+		"to-sign":     {string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: toSign.Raw}))},
+		"signer-cert": {string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signerCert.Raw}))},
+		"signer-key":  {string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}))},
+	}
+
+	body, err := c.do(ctx, http.MethodPost, "/cross-sign-ca", params)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseFirstCert(body)
+}
+
+// CrossSignCSR asks encaya to issue a CA certificate for the subject, public
+// key and requested extensions of csr, signed by signerCert and signerKey.
+// This requires the key endpoints to be enabled.
+func (c *Client) CrossSignCSR(ctx context.Context, csr *x509.CertificateRequest, signerCert *x509.Certificate,
+	signerKey crypto.Signer) (*x509.Certificate, error) {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(signerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{
+		"to-sign":     {string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))},
+		"signer-cert": {string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signerCert.Raw}))},
+		"signer-key":  {string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}))},
+	}
+
+	body, err := c.do(ctx, http.MethodPost, "/cross-sign-ca", params)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseFirstCert(body)
+}
+
+// OriginalFromSerial returns the certificate that encaya cross-signed into
+// the certificate with the given serial number.
+func (c *Client) OriginalFromSerial(ctx context.Context, serial *big.Int) (*x509.Certificate, error) {
+	params := url.Values{
+		"serial": {serial.String()},
+	}
+
+	return c.original(ctx, "/original-from-serial", params)
+}
+
+// OriginalFromFingerprint returns the certificate that encaya cross-signed
+// into the certificate with the given SHA-256 fingerprint.
+func (c *Client) OriginalFromFingerprint(ctx context.Context, fingerprint []byte) (*x509.Certificate, error) {
+	params := url.Values{
+		"sha256": {hex.EncodeToString(fingerprint)},
+	}
+
+	return c.original(ctx, "/original-from-fingerprint", params)
+}
+
+// OriginalFromSKID returns the certificate that encaya cross-signed into a
+// certificate with the given Subject Key Identifier.
+func (c *Client) OriginalFromSKID(ctx context.Context, skid []byte) (*x509.Certificate, error) {
+	params := url.Values{
+		"skid": {hex.EncodeToString(skid)},
+	}
+
+	return c.original(ctx, "/original-from-skid", params)
+}
+
+func (c *Client) original(ctx context.Context, path string, params url.Values) (*x509.Certificate, error) {
+	body, err := c.do(ctx, http.MethodGet, path, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return parseFirstCert(body)
+}
+
+func parseFirstCert(body []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, ErrNoPEM
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var (
+		priv interface{}
+		err  error
+	)
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
+	}
+
+	return signer, nil
+}
+
+// do makes a request, retrying network errors, HTTP 5xx and HTTP 429 with
+// exponential backoff (or the server's Retry-After), and returns the
+// response body.
+func (c *Client) do(ctx context.Context, method, path string, params url.Values) ([]byte, error) {
+	if c.cfg.Isolation != "" {
+		params.Set("isolation", c.cfg.Isolation)
+	}
+
+	backoff := c.cfg.Backoff
+
+	for attempt := 0; ; attempt++ {
+		body, retryAfter, err := c.doOnce(ctx, method, path, params)
+		if err == nil || retryAfter < 0 || attempt >= c.cfg.Retries {
+			return body, err
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+	}
+}
+
+// doOnce makes a single attempt.  retryAfter is negative if the error isn't
+// worth retrying, and positive if the server said how long to wait.
+func (c *Client) doOnce(ctx context.Context, method, path string,
+	params url.Values) (body []byte, retryAfter time.Duration, err error) {
+	endpoint := *c.base
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + path
+
+	var req *http.Request
+
+	if method == http.MethodPost {
+		req, err = http.NewRequestWithContext(ctx, method, endpoint.String(), strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		endpoint.RawQuery = params.Encode()
+		req, err = http.NewRequestWithContext(ctx, method, endpoint.String(), nil)
+	}
+
+	if err != nil {
+		return nil, -1, err
+	}
+
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, -1, ctx.Err()
+		}
+
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return body, 0, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, -1, ErrNotFound
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		statusErr := newStatusError(resp, body)
+		if statusErr.Code != "" && !statusErr.Retryable {
+			return nil, -1, statusErr
+		}
+
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+
+		return nil, time.Duration(seconds) * time.Second, statusErr
+	default:
+		return nil, -1, newStatusError(resp, body)
+	}
+}
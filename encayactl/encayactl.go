@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hlandau/xlog"
+
+	"github.com/namecoin/encaya/client"
+)
+
+var log, _ = xlog.New("encayactl")
+
+// Output formats selected by -format.
+const (
+	formatPEM  = "pem"
+	formatDER  = "der"
+	formatJSON = "json"
+)
+
+var errUsage = errors.New("invalid arguments")
+
+const usage = `Usage: encayactl [flags] <command> [args]
+
+Commands:
+  lookup <domain>                   Print the certs encaya generates for a domain
+  root                              Print the root CA
+  tld <tld>                         Print a TLD CA, e.g. "tld bit"
+  aia <domain> <pubsha256>          Print a domain's AIA parent CA
+  negative-ca [tld]                 Request a TLD exclusion CA and its private key
+  cross-sign <to-sign> <signer-cert> <signer-key>
+                                    Cross-sign a CA, or issue one for a CSR
+                                    (arguments are PEM files)
+  original <serial>                 Print the original of a cross-signed CA
+  original-fingerprint <sha256>     Same, by the cross-signed CA's SHA-256 fingerprint
+  original-skid <skid>              Same, by the cross-signed CA's Subject Key Identifier
+
+Flags:
+`
+
+// options holds the command-line flags.
+type options struct {
+	url       string
+	format    string
+	out       string
+	token     string
+	pins      string
+	caFile    string
+	isolation string
+	timeout   time.Duration
+}
+
+func main() {
+	opts := options{}
+
+	flags := flag.NewFlagSet("encayactl", flag.ExitOnError)
+	flags.StringVar(&opts.url, "url", "http://127.127.127.127", "URL of the encaya instance")
+	flags.StringVar(&opts.format, "format", formatPEM, "Output format: pem, der or json")
+	flags.StringVar(&opts.out, "out", "", "Write the output to this file instead of stdout")
+	flags.StringVar(&opts.token, "token", "", "Bearer token for the key endpoints (KeyEndpointsToken)")
+	flags.StringVar(&opts.pins, "pin", "", "Comma-separated base64 SHA-256 SPKI hashes to pin encaya's HTTPS certificate chain to")
+	flags.StringVar(&opts.caFile, "ca", "", "Validate encaya's HTTPS certificate against the CAs in this PEM file")
+	flags.StringVar(&opts.isolation, "isolation", "", "Isolation key for encaya's caches")
+	flags.DurationVar(&opts.timeout, "timeout", 30*time.Second, "Give up after this long")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(os.Args[1:])
+
+	err := run(opts, flags.Args())
+	if errors.Is(err, errUsage) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatale(err)
+	}
+}
+
+func run(opts options, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	if opts.format != formatPEM && opts.format != formatDER && opts.format != formatJSON {
+		return fmt.Errorf("%w: unknown format %q", errUsage, opts.format)
+	}
+
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	var (
+		certs []*x509.Certificate
+		key   crypto.Signer
+	)
+
+	command, args := args[0], args[1:]
+
+	switch {
+	case command == "lookup" && len(args) == 1:
+		certs, err = c.Lookup(ctx, args[0])
+	case command == "root" && len(args) == 0:
+		certs, err = c.Lookup(ctx, "Namecoin Root CA")
+	case command == "tld" && len(args) == 1:
+		certs, err = c.Lookup(ctx, "."+strings.TrimPrefix(args[0], ".")+" TLD CA")
+	case command == "aia" && len(args) == 2:
+		var pubSHA256 []byte
+
+		pubSHA256, err = hex.DecodeString(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid public key hash: %w", err)
+		}
+
+		certs, err = oneCert(c.AIA(ctx, args[0], pubSHA256))
+	case command == "negative-ca" && len(args) <= 1:
+		var cert *x509.Certificate
+
+		cert, key, err = c.NewNegativeCA(ctx, strings.Join(args, ""))
+		certs = []*x509.Certificate{cert}
+	case command == "cross-sign" && len(args) == 3:
+		certs, err = crossSign(ctx, c, args[0], args[1], args[2])
+	case command == "original" && len(args) == 1:
+		serial, ok := new(big.Int).SetString(args[0], 10)
+		if !ok {
+			return fmt.Errorf("invalid serial number %q", args[0])
+		}
+
+		certs, err = oneCert(c.OriginalFromSerial(ctx, serial))
+	case command == "original-fingerprint" && len(args) == 1:
+		var fingerprint []byte
+
+		fingerprint, err = hex.DecodeString(strings.ReplaceAll(args[0], ":", ""))
+		if err != nil {
+			return fmt.Errorf("invalid fingerprint: %w", err)
+		}
+
+		certs, err = oneCert(c.OriginalFromFingerprint(ctx, fingerprint))
+	case command == "original-skid" && len(args) == 1:
+		var skid []byte
+
+		skid, err = hex.DecodeString(strings.ReplaceAll(args[0], ":", ""))
+		if err != nil {
+			return fmt.Errorf("invalid Subject Key Identifier: %w", err)
+		}
+
+		certs, err = oneCert(c.OriginalFromSKID(ctx, skid))
+	default:
+		return errUsage
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(opts, certs, key)
+}
+
+func newClient(opts options) (*client.Client, error) {
+	cfg := client.Config{
+		URL:       opts.url,
+		Token:     opts.token,
+		Isolation: opts.isolation,
+	}
+
+	if opts.pins != "" {
+		for _, pin := range strings.Split(opts.pins, ",") {
+			pinBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pin))
+			if err != nil {
+				return nil, fmt.Errorf("invalid SPKI pin %s: %w", pin, err)
+			}
+
+			cfg.PinnedSPKI = append(cfg.PinnedSPKI, pinBytes)
+		}
+	}
+
+	if opts.caFile != "" {
+		caPem, err := ioutil.ReadFile(opts.caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.caFile)
+		}
+	}
+
+	return client.New(cfg)
+}
+
+func oneCert(cert *x509.Certificate, err error) ([]*x509.Certificate, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return []*x509.Certificate{cert}, nil
+}
+
+func crossSign(ctx context.Context, c *client.Client, toSignFile, signerCertFile,
+	signerKeyFile string) ([]*x509.Certificate, error) {
+	toSignPem, err := ioutil.ReadFile(toSignFile)
+	if err != nil {
+		return nil, err
+	}
+
+	toSignBlock, _ := pem.Decode(toSignPem)
+	if toSignBlock == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", toSignFile)
+	}
+
+	signerCert, err := readCert(signerCertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	signerKeyPem, err := ioutil.ReadFile(signerKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(signerKeyPem)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", signerKeyFile)
+	}
+
+	signerKey, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if toSignBlock.Type == "CERTIFICATE REQUEST" || toSignBlock.Type == "NEW CERTIFICATE REQUEST" {
+		csr, err := x509.ParseCertificateRequest(toSignBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return oneCert(c.CrossSignCSR(ctx, csr, signerCert, signerKey))
+	}
+
+	toSign, err := x509.ParseCertificate(toSignBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return oneCert(c.CrossSignCA(ctx, toSign, signerCert, signerKey))
+}
+
+func readCert(path string) (*x509.Certificate, error) {
+	certPem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var (
+		priv interface{}
+		err  error
+	)
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
+	}
+
+	return signer, nil
+}
+
+// jsonCert is the -format json representation of a certificate.
+type jsonCert struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serial_number"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	DNSNames     []string  `json:"dns_names,omitempty"`
+	PEM          string    `json:"pem"`
+}
+
+type jsonOutput struct {
+	Certificates []jsonCert `json:"certificates"`
+	PrivateKey   string     `json:"private_key,omitempty"`
+}
+
+func writeOutput(opts options, certs []*x509.Certificate, key crypto.Signer) error {
+	out := io.Writer(os.Stdout)
+
+	if opts.out != "" {
+		// The output may contain a private key.
+		f, err := os.OpenFile(opts.out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		out = f
+	}
+
+	var keyPem []byte
+
+	if key != nil {
+		keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+
+		keyPem = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	}
+
+	switch opts.format {
+	case formatDER:
+		if key != nil {
+			return fmt.Errorf("%w: the der format can't hold a private key", errUsage)
+		}
+
+		for _, cert := range certs {
+			_, err := out.Write(cert.Raw)
+			if err != nil {
+				return err
+			}
+		}
+	case formatJSON:
+		output := jsonOutput{
+			Certificates: []jsonCert{},
+			PrivateKey:   string(keyPem),
+		}
+
+		for _, cert := range certs {
+			output.Certificates = append(output.Certificates, jsonCert{
+				Subject:      cert.Subject.String(),
+				Issuer:       cert.Issuer.String(),
+				SerialNumber: cert.SerialNumber.String(),
+				NotBefore:    cert.NotBefore,
+				NotAfter:     cert.NotAfter,
+				DNSNames:     cert.DNSNames,
+				PEM:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+			})
+		}
+
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(output)
+	default:
+		for _, cert := range certs {
+			err := pem.Encode(out, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := out.Write(keyPem)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// © 2014-2021 Namecoin Developers    GPLv3 or later
@@ -1,27 +1,45 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"os"
 	"path/filepath"
 
 	"github.com/hlandau/dexlogconfig"
+	"github.com/hlandau/xlog"
 	"gopkg.in/hlandau/easyconfig.v1"
 
 	"github.com/namecoin/encaya/server"
 )
 
+var log, _ = xlog.New("encayagen")
+
 func main() {
-	cfg := server.Config{}
+	// The flags that aren't encaya options are those of the logging
+	// package, which easyconfig parses.
+	args, rest := server.SplitArgs(os.Args[1:])
+	os.Args = append(os.Args[:1], rest...)
 
 	config := easyconfig.Configurator{
 		ProgramName: "encaya",
 	}
-	config.ParseFatal(&cfg)
+	config.ParseFatal(nil)
 	dexlogconfig.Init()
 
-	// We use the configPath to resolve paths relative to the config file.
-	cfg.ConfigDir = filepath.Dir(config.ConfigFilePath())
+	cfg, err := server.LoadConfig(args, os.Environ(), filepath.Dir(config.ConfigFilePath()))
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 
-	server.GenerateCerts(&cfg)
+	if err != nil {
+		log.Fatale(err)
+	}
+
+	err = server.GenerateCerts(cfg)
+	if err != nil {
+		log.Fatale(err)
+	}
 }
 
 // © 2014-2021 Namecoin Developers    GPLv3 or later
@@ -0,0 +1,5 @@
+// Package encayapb contains the protobuf messages and gRPC service
+// definitions of encaya's gRPC API, generated from encaya.proto.
+package encayapb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative encaya.proto
@@ -0,0 +1,1088 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11-devel
+// 	protoc        (unknown)
+// source: encaya.proto
+
+package encayapb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type LookupRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Domain string                 `protobuf:"bytes,1,opt,name=domain,proto3" json:"domain,omitempty"`
+	// The TLSA service to look up; 0 and "" mean 443 and tcp.
+	Port     uint32 `protobuf:"varint,2,opt,name=port,proto3" json:"port,omitempty"`
+	Protocol string `protobuf:"bytes,3,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	// Requests with different isolation keys never share cached results.
+	Isolation string `protobuf:"bytes,4,opt,name=isolation,proto3" json:"isolation,omitempty"`
+	// DER certificates to match hashed TLSA records (matching types 1 and 2)
+	// against.
+	Candidates    [][]byte `protobuf:"bytes,5,rep,name=candidates,proto3" json:"candidates,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LookupRequest) Reset() {
+	*x = LookupRequest{}
+	mi := &file_encaya_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LookupRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LookupRequest) ProtoMessage() {}
+
+func (x *LookupRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LookupRequest.ProtoReflect.Descriptor instead.
+func (*LookupRequest) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LookupRequest) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *LookupRequest) GetPort() uint32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *LookupRequest) GetProtocol() string {
+	if x != nil {
+		return x.Protocol
+	}
+	return ""
+}
+
+func (x *LookupRequest) GetIsolation() string {
+	if x != nil {
+		return x.Isolation
+	}
+	return ""
+}
+
+func (x *LookupRequest) GetCandidates() [][]byte {
+	if x != nil {
+		return x.Candidates
+	}
+	return nil
+}
+
+type LookupResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Certificates  []*Certificate         `protobuf:"bytes,1,rep,name=certificates,proto3" json:"certificates,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LookupResponse) Reset() {
+	*x = LookupResponse{}
+	mi := &file_encaya_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LookupResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LookupResponse) ProtoMessage() {}
+
+func (x *LookupResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LookupResponse.ProtoReflect.Descriptor instead.
+func (*LookupResponse) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *LookupResponse) GetCertificates() []*Certificate {
+	if x != nil {
+		return x.Certificates
+	}
+	return nil
+}
+
+type Certificate struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Der   []byte                 `protobuf:"bytes,1,opt,name=der,proto3" json:"der,omitempty"`
+	Pem   string                 `protobuf:"bytes,2,opt,name=pem,proto3" json:"pem,omitempty"`
+	// The TLSA record the certificate was derived from, if any.
+	Tlsa      *TLSA                  `protobuf:"bytes,3,opt,name=tlsa,proto3" json:"tlsa,omitempty"`
+	NotBefore *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=not_before,json=notBefore,proto3" json:"not_before,omitempty"`
+	NotAfter  *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=not_after,json=notAfter,proto3" json:"not_after,omitempty"`
+	// One of "root", "tld", "dns" (generated for this request) or "cache".
+	Source        string                 `protobuf:"bytes,6,opt,name=source,proto3" json:"source,omitempty"`
+	CachedUntil   *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=cached_until,json=cachedUntil,proto3" json:"cached_until,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Certificate) Reset() {
+	*x = Certificate{}
+	mi := &file_encaya_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Certificate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Certificate) ProtoMessage() {}
+
+func (x *Certificate) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Certificate.ProtoReflect.Descriptor instead.
+func (*Certificate) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Certificate) GetDer() []byte {
+	if x != nil {
+		return x.Der
+	}
+	return nil
+}
+
+func (x *Certificate) GetPem() string {
+	if x != nil {
+		return x.Pem
+	}
+	return ""
+}
+
+func (x *Certificate) GetTlsa() *TLSA {
+	if x != nil {
+		return x.Tlsa
+	}
+	return nil
+}
+
+func (x *Certificate) GetNotBefore() *timestamppb.Timestamp {
+	if x != nil {
+		return x.NotBefore
+	}
+	return nil
+}
+
+func (x *Certificate) GetNotAfter() *timestamppb.Timestamp {
+	if x != nil {
+		return x.NotAfter
+	}
+	return nil
+}
+
+func (x *Certificate) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *Certificate) GetCachedUntil() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CachedUntil
+	}
+	return nil
+}
+
+type TLSA struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Usage        uint32                 `protobuf:"varint,1,opt,name=usage,proto3" json:"usage,omitempty"`
+	Selector     uint32                 `protobuf:"varint,2,opt,name=selector,proto3" json:"selector,omitempty"`
+	MatchingType uint32                 `protobuf:"varint,3,opt,name=matching_type,json=matchingType,proto3" json:"matching_type,omitempty"`
+	// Hex-encoded certificate association data.
+	Certificate   string `protobuf:"bytes,4,opt,name=certificate,proto3" json:"certificate,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TLSA) Reset() {
+	*x = TLSA{}
+	mi := &file_encaya_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TLSA) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TLSA) ProtoMessage() {}
+
+func (x *TLSA) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TLSA.ProtoReflect.Descriptor instead.
+func (*TLSA) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *TLSA) GetUsage() uint32 {
+	if x != nil {
+		return x.Usage
+	}
+	return 0
+}
+
+func (x *TLSA) GetSelector() uint32 {
+	if x != nil {
+		return x.Selector
+	}
+	return 0
+}
+
+func (x *TLSA) GetMatchingType() uint32 {
+	if x != nil {
+		return x.MatchingType
+	}
+	return 0
+}
+
+func (x *TLSA) GetCertificate() string {
+	if x != nil {
+		return x.Certificate
+	}
+	return ""
+}
+
+type AIARequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Domain string                 `protobuf:"bytes,1,opt,name=domain,proto3" json:"domain,omitempty"`
+	// SHA-256 hash of the requested CA's SubjectPublicKeyInfo.
+	Pubsha256 []byte `protobuf:"bytes,2,opt,name=pubsha256,proto3" json:"pubsha256,omitempty"`
+	// "previous" selects the previous root CA during a rotation.
+	Generation string `protobuf:"bytes,3,opt,name=generation,proto3" json:"generation,omitempty"`
+	Port       uint32 `protobuf:"varint,4,opt,name=port,proto3" json:"port,omitempty"`
+	Protocol   string `protobuf:"bytes,5,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	Isolation  string `protobuf:"bytes,6,opt,name=isolation,proto3" json:"isolation,omitempty"`
+	// DER certificates to match hashed TLSA records against.
+	Candidates    [][]byte `protobuf:"bytes,7,rep,name=candidates,proto3" json:"candidates,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AIARequest) Reset() {
+	*x = AIARequest{}
+	mi := &file_encaya_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AIARequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AIARequest) ProtoMessage() {}
+
+func (x *AIARequest) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AIARequest.ProtoReflect.Descriptor instead.
+func (*AIARequest) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *AIARequest) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *AIARequest) GetPubsha256() []byte {
+	if x != nil {
+		return x.Pubsha256
+	}
+	return nil
+}
+
+func (x *AIARequest) GetGeneration() string {
+	if x != nil {
+		return x.Generation
+	}
+	return ""
+}
+
+func (x *AIARequest) GetPort() uint32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *AIARequest) GetProtocol() string {
+	if x != nil {
+		return x.Protocol
+	}
+	return ""
+}
+
+func (x *AIARequest) GetIsolation() string {
+	if x != nil {
+		return x.Isolation
+	}
+	return ""
+}
+
+func (x *AIARequest) GetCandidates() [][]byte {
+	if x != nil {
+		return x.Candidates
+	}
+	return nil
+}
+
+type AIAResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Der   []byte                 `protobuf:"bytes,1,opt,name=der,proto3" json:"der,omitempty"`
+	// der followed by its issuers, up to the root CA.
+	Chain         [][]byte `protobuf:"bytes,2,rep,name=chain,proto3" json:"chain,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AIAResponse) Reset() {
+	*x = AIAResponse{}
+	mi := &file_encaya_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AIAResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AIAResponse) ProtoMessage() {}
+
+func (x *AIAResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AIAResponse.ProtoReflect.Descriptor instead.
+func (*AIAResponse) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *AIAResponse) GetDer() []byte {
+	if x != nil {
+		return x.Der
+	}
+	return nil
+}
+
+func (x *AIAResponse) GetChain() [][]byte {
+	if x != nil {
+		return x.Chain
+	}
+	return nil
+}
+
+type CrossSignRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// PEM-encoded certificate (or CSR) to cross-sign, and the signing CA's
+	// certificate and private key.
+	ToSign        string `protobuf:"bytes,1,opt,name=to_sign,json=toSign,proto3" json:"to_sign,omitempty"`
+	SignerCert    string `protobuf:"bytes,2,opt,name=signer_cert,json=signerCert,proto3" json:"signer_cert,omitempty"`
+	SignerKey     string `protobuf:"bytes,3,opt,name=signer_key,json=signerKey,proto3" json:"signer_key,omitempty"`
+	Isolation     string `protobuf:"bytes,4,opt,name=isolation,proto3" json:"isolation,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CrossSignRequest) Reset() {
+	*x = CrossSignRequest{}
+	mi := &file_encaya_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CrossSignRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CrossSignRequest) ProtoMessage() {}
+
+func (x *CrossSignRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CrossSignRequest.ProtoReflect.Descriptor instead.
+func (*CrossSignRequest) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *CrossSignRequest) GetToSign() string {
+	if x != nil {
+		return x.ToSign
+	}
+	return ""
+}
+
+func (x *CrossSignRequest) GetSignerCert() string {
+	if x != nil {
+		return x.SignerCert
+	}
+	return ""
+}
+
+func (x *CrossSignRequest) GetSignerKey() string {
+	if x != nil {
+		return x.SignerKey
+	}
+	return ""
+}
+
+func (x *CrossSignRequest) GetIsolation() string {
+	if x != nil {
+		return x.Isolation
+	}
+	return ""
+}
+
+type CrossSignResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Pem           string                 `protobuf:"bytes,1,opt,name=pem,proto3" json:"pem,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CrossSignResponse) Reset() {
+	*x = CrossSignResponse{}
+	mi := &file_encaya_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CrossSignResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CrossSignResponse) ProtoMessage() {}
+
+func (x *CrossSignResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CrossSignResponse.ProtoReflect.Descriptor instead.
+func (*CrossSignResponse) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *CrossSignResponse) GetPem() string {
+	if x != nil {
+		return x.Pem
+	}
+	return ""
+}
+
+type GetNegativeCARequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Defaults to the first configured TLD.
+	Tld           string `protobuf:"bytes,1,opt,name=tld,proto3" json:"tld,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetNegativeCARequest) Reset() {
+	*x = GetNegativeCARequest{}
+	mi := &file_encaya_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetNegativeCARequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetNegativeCARequest) ProtoMessage() {}
+
+func (x *GetNegativeCARequest) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetNegativeCARequest.ProtoReflect.Descriptor instead.
+func (*GetNegativeCARequest) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *GetNegativeCARequest) GetTld() string {
+	if x != nil {
+		return x.Tld
+	}
+	return ""
+}
+
+type GetNegativeCAResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	CertPem       string                 `protobuf:"bytes,1,opt,name=cert_pem,json=certPem,proto3" json:"cert_pem,omitempty"`
+	KeyPem        string                 `protobuf:"bytes,2,opt,name=key_pem,json=keyPem,proto3" json:"key_pem,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetNegativeCAResponse) Reset() {
+	*x = GetNegativeCAResponse{}
+	mi := &file_encaya_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetNegativeCAResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetNegativeCAResponse) ProtoMessage() {}
+
+func (x *GetNegativeCAResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetNegativeCAResponse.ProtoReflect.Descriptor instead.
+func (*GetNegativeCAResponse) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *GetNegativeCAResponse) GetCertPem() string {
+	if x != nil {
+		return x.CertPem
+	}
+	return ""
+}
+
+func (x *GetNegativeCAResponse) GetKeyPem() string {
+	if x != nil {
+		return x.KeyPem
+	}
+	return ""
+}
+
+type OriginalFromSerialRequest struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Serial    string                 `protobuf:"bytes,1,opt,name=serial,proto3" json:"serial,omitempty"`
+	Isolation string                 `protobuf:"bytes,2,opt,name=isolation,proto3" json:"isolation,omitempty"`
+	// The domain, and TLSA service (0 and "" mean 443 and tcp), whose TLSA
+	// records may publish the original.
+	Domain        string `protobuf:"bytes,3,opt,name=domain,proto3" json:"domain,omitempty"`
+	Port          uint32 `protobuf:"varint,4,opt,name=port,proto3" json:"port,omitempty"`
+	Protocol      string `protobuf:"bytes,5,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OriginalFromSerialRequest) Reset() {
+	*x = OriginalFromSerialRequest{}
+	mi := &file_encaya_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OriginalFromSerialRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OriginalFromSerialRequest) ProtoMessage() {}
+
+func (x *OriginalFromSerialRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OriginalFromSerialRequest.ProtoReflect.Descriptor instead.
+func (*OriginalFromSerialRequest) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *OriginalFromSerialRequest) GetSerial() string {
+	if x != nil {
+		return x.Serial
+	}
+	return ""
+}
+
+func (x *OriginalFromSerialRequest) GetIsolation() string {
+	if x != nil {
+		return x.Isolation
+	}
+	return ""
+}
+
+func (x *OriginalFromSerialRequest) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *OriginalFromSerialRequest) GetPort() uint32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *OriginalFromSerialRequest) GetProtocol() string {
+	if x != nil {
+		return x.Protocol
+	}
+	return ""
+}
+
+type OriginalFromSerialResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Pem           string                 `protobuf:"bytes,1,opt,name=pem,proto3" json:"pem,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OriginalFromSerialResponse) Reset() {
+	*x = OriginalFromSerialResponse{}
+	mi := &file_encaya_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OriginalFromSerialResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OriginalFromSerialResponse) ProtoMessage() {}
+
+func (x *OriginalFromSerialResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OriginalFromSerialResponse.ProtoReflect.Descriptor instead.
+func (*OriginalFromSerialResponse) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *OriginalFromSerialResponse) GetPem() string {
+	if x != nil {
+		return x.Pem
+	}
+	return ""
+}
+
+// The fingerprint depends on the signer, so the original can't be
+// reconstructed from DNS.
+type OriginalFromFingerprintRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Sha256        []byte                 `protobuf:"bytes,1,opt,name=sha256,proto3" json:"sha256,omitempty"`
+	Isolation     string                 `protobuf:"bytes,2,opt,name=isolation,proto3" json:"isolation,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OriginalFromFingerprintRequest) Reset() {
+	*x = OriginalFromFingerprintRequest{}
+	mi := &file_encaya_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OriginalFromFingerprintRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OriginalFromFingerprintRequest) ProtoMessage() {}
+
+func (x *OriginalFromFingerprintRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OriginalFromFingerprintRequest.ProtoReflect.Descriptor instead.
+func (*OriginalFromFingerprintRequest) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *OriginalFromFingerprintRequest) GetSha256() []byte {
+	if x != nil {
+		return x.Sha256
+	}
+	return nil
+}
+
+func (x *OriginalFromFingerprintRequest) GetIsolation() string {
+	if x != nil {
+		return x.Isolation
+	}
+	return ""
+}
+
+type OriginalFromSKIDRequest struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Skid      []byte                 `protobuf:"bytes,1,opt,name=skid,proto3" json:"skid,omitempty"`
+	Isolation string                 `protobuf:"bytes,2,opt,name=isolation,proto3" json:"isolation,omitempty"`
+	// As in OriginalFromSerialRequest.
+	Domain        string `protobuf:"bytes,3,opt,name=domain,proto3" json:"domain,omitempty"`
+	Port          uint32 `protobuf:"varint,4,opt,name=port,proto3" json:"port,omitempty"`
+	Protocol      string `protobuf:"bytes,5,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OriginalFromSKIDRequest) Reset() {
+	*x = OriginalFromSKIDRequest{}
+	mi := &file_encaya_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OriginalFromSKIDRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OriginalFromSKIDRequest) ProtoMessage() {}
+
+func (x *OriginalFromSKIDRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_encaya_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OriginalFromSKIDRequest.ProtoReflect.Descriptor instead.
+func (*OriginalFromSKIDRequest) Descriptor() ([]byte, []int) {
+	return file_encaya_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *OriginalFromSKIDRequest) GetSkid() []byte {
+	if x != nil {
+		return x.Skid
+	}
+	return nil
+}
+
+func (x *OriginalFromSKIDRequest) GetIsolation() string {
+	if x != nil {
+		return x.Isolation
+	}
+	return ""
+}
+
+func (x *OriginalFromSKIDRequest) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *OriginalFromSKIDRequest) GetPort() uint32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *OriginalFromSKIDRequest) GetProtocol() string {
+	if x != nil {
+		return x.Protocol
+	}
+	return ""
+}
+
+var File_encaya_proto protoreflect.FileDescriptor
+
+const file_encaya_proto_rawDesc = "" +
+	"\n" +
+	"\fencaya.proto\x12\tencaya.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\x95\x01\n" +
+	"\rLookupRequest\x12\x16\n" +
+	"\x06domain\x18\x01 \x01(\tR\x06domain\x12\x12\n" +
+	"\x04port\x18\x02 \x01(\rR\x04port\x12\x1a\n" +
+	"\bprotocol\x18\x03 \x01(\tR\bprotocol\x12\x1c\n" +
+	"\tisolation\x18\x04 \x01(\tR\tisolation\x12\x1e\n" +
+	"\n" +
+	"candidates\x18\x05 \x03(\fR\n" +
+	"candidates\"L\n" +
+	"\x0eLookupResponse\x12:\n" +
+	"\fcertificates\x18\x01 \x03(\v2\x16.encaya.v1.CertificateR\fcertificates\"\xa1\x02\n" +
+	"\vCertificate\x12\x10\n" +
+	"\x03der\x18\x01 \x01(\fR\x03der\x12\x10\n" +
+	"\x03pem\x18\x02 \x01(\tR\x03pem\x12#\n" +
+	"\x04tlsa\x18\x03 \x01(\v2\x0f.encaya.v1.TLSAR\x04tlsa\x129\n" +
+	"\n" +
+	"not_before\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\tnotBefore\x127\n" +
+	"\tnot_after\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\bnotAfter\x12\x16\n" +
+	"\x06source\x18\x06 \x01(\tR\x06source\x12=\n" +
+	"\fcached_until\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\vcachedUntil\"\x7f\n" +
+	"\x04TLSA\x12\x14\n" +
+	"\x05usage\x18\x01 \x01(\rR\x05usage\x12\x1a\n" +
+	"\bselector\x18\x02 \x01(\rR\bselector\x12#\n" +
+	"\rmatching_type\x18\x03 \x01(\rR\fmatchingType\x12 \n" +
+	"\vcertificate\x18\x04 \x01(\tR\vcertificate\"\xd0\x01\n" +
+	"\n" +
+	"AIARequest\x12\x16\n" +
+	"\x06domain\x18\x01 \x01(\tR\x06domain\x12\x1c\n" +
+	"\tpubsha256\x18\x02 \x01(\fR\tpubsha256\x12\x1e\n" +
+	"\n" +
+	"generation\x18\x03 \x01(\tR\n" +
+	"generation\x12\x12\n" +
+	"\x04port\x18\x04 \x01(\rR\x04port\x12\x1a\n" +
+	"\bprotocol\x18\x05 \x01(\tR\bprotocol\x12\x1c\n" +
+	"\tisolation\x18\x06 \x01(\tR\tisolation\x12\x1e\n" +
+	"\n" +
+	"candidates\x18\a \x03(\fR\n" +
+	"candidates\"5\n" +
+	"\vAIAResponse\x12\x10\n" +
+	"\x03der\x18\x01 \x01(\fR\x03der\x12\x14\n" +
+	"\x05chain\x18\x02 \x03(\fR\x05chain\"\x89\x01\n" +
+	"\x10CrossSignRequest\x12\x17\n" +
+	"\ato_sign\x18\x01 \x01(\tR\x06toSign\x12\x1f\n" +
+	"\vsigner_cert\x18\x02 \x01(\tR\n" +
+	"signerCert\x12\x1d\n" +
+	"\n" +
+	"signer_key\x18\x03 \x01(\tR\tsignerKey\x12\x1c\n" +
+	"\tisolation\x18\x04 \x01(\tR\tisolation\"%\n" +
+	"\x11CrossSignResponse\x12\x10\n" +
+	"\x03pem\x18\x01 \x01(\tR\x03pem\"(\n" +
+	"\x14GetNegativeCARequest\x12\x10\n" +
+	"\x03tld\x18\x01 \x01(\tR\x03tld\"K\n" +
+	"\x15GetNegativeCAResponse\x12\x19\n" +
+	"\bcert_pem\x18\x01 \x01(\tR\acertPem\x12\x17\n" +
+	"\akey_pem\x18\x02 \x01(\tR\x06keyPem\"\x99\x01\n" +
+	"\x19OriginalFromSerialRequest\x12\x16\n" +
+	"\x06serial\x18\x01 \x01(\tR\x06serial\x12\x1c\n" +
+	"\tisolation\x18\x02 \x01(\tR\tisolation\x12\x16\n" +
+	"\x06domain\x18\x03 \x01(\tR\x06domain\x12\x12\n" +
+	"\x04port\x18\x04 \x01(\rR\x04port\x12\x1a\n" +
+	"\bprotocol\x18\x05 \x01(\tR\bprotocol\".\n" +
+	"\x1aOriginalFromSerialResponse\x12\x10\n" +
+	"\x03pem\x18\x01 \x01(\tR\x03pem\"V\n" +
+	"\x1eOriginalFromFingerprintRequest\x12\x16\n" +
+	"\x06sha256\x18\x01 \x01(\fR\x06sha256\x12\x1c\n" +
+	"\tisolation\x18\x02 \x01(\tR\tisolation\"\x93\x01\n" +
+	"\x17OriginalFromSKIDRequest\x12\x12\n" +
+	"\x04skid\x18\x01 \x01(\fR\x04skid\x12\x1c\n" +
+	"\tisolation\x18\x02 \x01(\tR\tisolation\x12\x16\n" +
+	"\x06domain\x18\x03 \x01(\tR\x06domain\x12\x12\n" +
+	"\x04port\x18\x04 \x01(\rR\x04port\x12\x1a\n" +
+	"\bprotocol\x18\x05 \x01(\tR\bprotocol2\xc8\x04\n" +
+	"\x06Encaya\x12=\n" +
+	"\x06Lookup\x12\x18.encaya.v1.LookupRequest\x1a\x19.encaya.v1.LookupResponse\x124\n" +
+	"\x03AIA\x12\x15.encaya.v1.AIARequest\x1a\x16.encaya.v1.AIAResponse\x12F\n" +
+	"\tCrossSign\x12\x1b.encaya.v1.CrossSignRequest\x1a\x1c.encaya.v1.CrossSignResponse\x12R\n" +
+	"\rGetNegativeCA\x12\x1f.encaya.v1.GetNegativeCARequest\x1a .encaya.v1.GetNegativeCAResponse\x12a\n" +
+	"\x12OriginalFromSerial\x12$.encaya.v1.OriginalFromSerialRequest\x1a%.encaya.v1.OriginalFromSerialResponse\x12k\n" +
+	"\x17OriginalFromFingerprint\x12).encaya.v1.OriginalFromFingerprintRequest\x1a%.encaya.v1.OriginalFromSerialResponse\x12]\n" +
+	"\x10OriginalFromSKID\x12\".encaya.v1.OriginalFromSKIDRequest\x1a%.encaya.v1.OriginalFromSerialResponseB%Z#github.com/namecoin/encaya/encayapbb\x06proto3"
+
+var (
+	file_encaya_proto_rawDescOnce sync.Once
+	file_encaya_proto_rawDescData []byte
+)
+
+func file_encaya_proto_rawDescGZIP() []byte {
+	file_encaya_proto_rawDescOnce.Do(func() {
+		file_encaya_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_encaya_proto_rawDesc), len(file_encaya_proto_rawDesc)))
+	})
+	return file_encaya_proto_rawDescData
+}
+
+var file_encaya_proto_msgTypes = make([]protoimpl.MessageInfo, 14)
+var file_encaya_proto_goTypes = []any{
+	(*LookupRequest)(nil),                  // 0: encaya.v1.LookupRequest
+	(*LookupResponse)(nil),                 // 1: encaya.v1.LookupResponse
+	(*Certificate)(nil),                    // 2: encaya.v1.Certificate
+	(*TLSA)(nil),                           // 3: encaya.v1.TLSA
+	(*AIARequest)(nil),                     // 4: encaya.v1.AIARequest
+	(*AIAResponse)(nil),                    // 5: encaya.v1.AIAResponse
+	(*CrossSignRequest)(nil),               // 6: encaya.v1.CrossSignRequest
+	(*CrossSignResponse)(nil),              // 7: encaya.v1.CrossSignResponse
+	(*GetNegativeCARequest)(nil),           // 8: encaya.v1.GetNegativeCARequest
+	(*GetNegativeCAResponse)(nil),          // 9: encaya.v1.GetNegativeCAResponse
+	(*OriginalFromSerialRequest)(nil),      // 10: encaya.v1.OriginalFromSerialRequest
+	(*OriginalFromSerialResponse)(nil),     // 11: encaya.v1.OriginalFromSerialResponse
+	(*OriginalFromFingerprintRequest)(nil), // 12: encaya.v1.OriginalFromFingerprintRequest
+	(*OriginalFromSKIDRequest)(nil),        // 13: encaya.v1.OriginalFromSKIDRequest
+	(*timestamppb.Timestamp)(nil),          // 14: google.protobuf.Timestamp
+}
+var file_encaya_proto_depIdxs = []int32{
+	2,  // 0: encaya.v1.LookupResponse.certificates:type_name -> encaya.v1.Certificate
+	3,  // 1: encaya.v1.Certificate.tlsa:type_name -> encaya.v1.TLSA
+	14, // 2: encaya.v1.Certificate.not_before:type_name -> google.protobuf.Timestamp
+	14, // 3: encaya.v1.Certificate.not_after:type_name -> google.protobuf.Timestamp
+	14, // 4: encaya.v1.Certificate.cached_until:type_name -> google.protobuf.Timestamp
+	0,  // 5: encaya.v1.Encaya.Lookup:input_type -> encaya.v1.LookupRequest
+	4,  // 6: encaya.v1.Encaya.AIA:input_type -> encaya.v1.AIARequest
+	6,  // 7: encaya.v1.Encaya.CrossSign:input_type -> encaya.v1.CrossSignRequest
+	8,  // 8: encaya.v1.Encaya.GetNegativeCA:input_type -> encaya.v1.GetNegativeCARequest
+	10, // 9: encaya.v1.Encaya.OriginalFromSerial:input_type -> encaya.v1.OriginalFromSerialRequest
+	12, // 10: encaya.v1.Encaya.OriginalFromFingerprint:input_type -> encaya.v1.OriginalFromFingerprintRequest
+	13, // 11: encaya.v1.Encaya.OriginalFromSKID:input_type -> encaya.v1.OriginalFromSKIDRequest
+	1,  // 12: encaya.v1.Encaya.Lookup:output_type -> encaya.v1.LookupResponse
+	5,  // 13: encaya.v1.Encaya.AIA:output_type -> encaya.v1.AIAResponse
+	7,  // 14: encaya.v1.Encaya.CrossSign:output_type -> encaya.v1.CrossSignResponse
+	9,  // 15: encaya.v1.Encaya.GetNegativeCA:output_type -> encaya.v1.GetNegativeCAResponse
+	11, // 16: encaya.v1.Encaya.OriginalFromSerial:output_type -> encaya.v1.OriginalFromSerialResponse
+	11, // 17: encaya.v1.Encaya.OriginalFromFingerprint:output_type -> encaya.v1.OriginalFromSerialResponse
+	11, // 18: encaya.v1.Encaya.OriginalFromSKID:output_type -> encaya.v1.OriginalFromSerialResponse
+	12, // [12:19] is the sub-list for method output_type
+	5,  // [5:12] is the sub-list for method input_type
+	5,  // [5:5] is the sub-list for extension type_name
+	5,  // [5:5] is the sub-list for extension extendee
+	0,  // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_encaya_proto_init() }
+func file_encaya_proto_init() {
+	if File_encaya_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_encaya_proto_rawDesc), len(file_encaya_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   14,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_encaya_proto_goTypes,
+		DependencyIndexes: file_encaya_proto_depIdxs,
+		MessageInfos:      file_encaya_proto_msgTypes,
+	}.Build()
+	File_encaya_proto = out.File
+	file_encaya_proto_goTypes = nil
+	file_encaya_proto_depIdxs = nil
+}
@@ -0,0 +1,397 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: encaya.proto
+
+package encayapb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Encaya_Lookup_FullMethodName                  = "/encaya.v1.Encaya/Lookup"
+	Encaya_AIA_FullMethodName                     = "/encaya.v1.Encaya/AIA"
+	Encaya_CrossSign_FullMethodName               = "/encaya.v1.Encaya/CrossSign"
+	Encaya_GetNegativeCA_FullMethodName           = "/encaya.v1.Encaya/GetNegativeCA"
+	Encaya_OriginalFromSerial_FullMethodName      = "/encaya.v1.Encaya/OriginalFromSerial"
+	Encaya_OriginalFromFingerprint_FullMethodName = "/encaya.v1.Encaya/OriginalFromFingerprint"
+	Encaya_OriginalFromSKID_FullMethodName        = "/encaya.v1.Encaya/OriginalFromSKID"
+)
+
+// EncayaClient is the client API for Encaya service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Encaya offers the operations of encaya's HTTP API to typed clients.  It is
+// served on GRPCPort, and shares its backend (and its caches, rate limits and
+// access controls) with the HTTP handlers.
+type EncayaClient interface {
+	// Lookup returns the certificates for a domain, or for the root or a TLD
+	// CA when domain is its common name (like /lookup).
+	Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*LookupResponse, error)
+	// AIA returns the domain AIA parent CA whose public key hash matches
+	// pubsha256 (like /aia).
+	AIA(ctx context.Context, in *AIARequest, opts ...grpc.CallOption) (*AIAResponse, error)
+	// CrossSign cross-signs a CA certificate (like /cross-sign-ca).  It is
+	// subject to the KeyEndpoints access controls.
+	CrossSign(ctx context.Context, in *CrossSignRequest, opts ...grpc.CallOption) (*CrossSignResponse, error)
+	// GetNegativeCA generates a TLD exclusion CA and its private key (like
+	// /get-new-negative-ca).  It is subject to the KeyEndpoints access
+	// controls.
+	GetNegativeCA(ctx context.Context, in *GetNegativeCARequest, opts ...grpc.CallOption) (*GetNegativeCAResponse, error)
+	// OriginalFromSerial returns the certificate that was cross-signed into
+	// the certificate with the given serial number (like
+	// /original-from-serial).  If it isn't known and domain is set, it's
+	// reconstructed from the full certificates in the domain's TLSA records.
+	OriginalFromSerial(ctx context.Context, in *OriginalFromSerialRequest, opts ...grpc.CallOption) (*OriginalFromSerialResponse, error)
+	// OriginalFromFingerprint returns the certificate that was cross-signed
+	// into the certificate with the given SHA-256 fingerprint (like
+	// /original-from-fingerprint).
+	OriginalFromFingerprint(ctx context.Context, in *OriginalFromFingerprintRequest, opts ...grpc.CallOption) (*OriginalFromSerialResponse, error)
+	// OriginalFromSKID returns the certificate that was cross-signed into a
+	// certificate with the given Subject Key Identifier (like
+	// /original-from-skid), reconstructing it from DNS like
+	// OriginalFromSerial.
+	OriginalFromSKID(ctx context.Context, in *OriginalFromSKIDRequest, opts ...grpc.CallOption) (*OriginalFromSerialResponse, error)
+}
+
+type encayaClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEncayaClient(cc grpc.ClientConnInterface) EncayaClient {
+	return &encayaClient{cc}
+}
+
+func (c *encayaClient) Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*LookupResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LookupResponse)
+	err := c.cc.Invoke(ctx, Encaya_Lookup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *encayaClient) AIA(ctx context.Context, in *AIARequest, opts ...grpc.CallOption) (*AIAResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AIAResponse)
+	err := c.cc.Invoke(ctx, Encaya_AIA_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *encayaClient) CrossSign(ctx context.Context, in *CrossSignRequest, opts ...grpc.CallOption) (*CrossSignResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CrossSignResponse)
+	err := c.cc.Invoke(ctx, Encaya_CrossSign_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *encayaClient) GetNegativeCA(ctx context.Context, in *GetNegativeCARequest, opts ...grpc.CallOption) (*GetNegativeCAResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetNegativeCAResponse)
+	err := c.cc.Invoke(ctx, Encaya_GetNegativeCA_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *encayaClient) OriginalFromSerial(ctx context.Context, in *OriginalFromSerialRequest, opts ...grpc.CallOption) (*OriginalFromSerialResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(OriginalFromSerialResponse)
+	err := c.cc.Invoke(ctx, Encaya_OriginalFromSerial_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *encayaClient) OriginalFromFingerprint(ctx context.Context, in *OriginalFromFingerprintRequest, opts ...grpc.CallOption) (*OriginalFromSerialResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(OriginalFromSerialResponse)
+	err := c.cc.Invoke(ctx, Encaya_OriginalFromFingerprint_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *encayaClient) OriginalFromSKID(ctx context.Context, in *OriginalFromSKIDRequest, opts ...grpc.CallOption) (*OriginalFromSerialResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(OriginalFromSerialResponse)
+	err := c.cc.Invoke(ctx, Encaya_OriginalFromSKID_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// EncayaServer is the server API for Encaya service.
+// All implementations must embed UnimplementedEncayaServer
+// for forward compatibility.
+//
+// Encaya offers the operations of encaya's HTTP API to typed clients.  It is
+// served on GRPCPort, and shares its backend (and its caches, rate limits and
+// access controls) with the HTTP handlers.
+type EncayaServer interface {
+	// Lookup returns the certificates for a domain, or for the root or a TLD
+	// CA when domain is its common name (like /lookup).
+	Lookup(context.Context, *LookupRequest) (*LookupResponse, error)
+	// AIA returns the domain AIA parent CA whose public key hash matches
+	// pubsha256 (like /aia).
+	AIA(context.Context, *AIARequest) (*AIAResponse, error)
+	// CrossSign cross-signs a CA certificate (like /cross-sign-ca).  It is
+	// subject to the KeyEndpoints access controls.
+	CrossSign(context.Context, *CrossSignRequest) (*CrossSignResponse, error)
+	// GetNegativeCA generates a TLD exclusion CA and its private key (like
+	// /get-new-negative-ca).  It is subject to the KeyEndpoints access
+	// controls.
+	GetNegativeCA(context.Context, *GetNegativeCARequest) (*GetNegativeCAResponse, error)
+	// OriginalFromSerial returns the certificate that was cross-signed into
+	// the certificate with the given serial number (like
+	// /original-from-serial).  If it isn't known and domain is set, it's
+	// reconstructed from the full certificates in the domain's TLSA records.
+	OriginalFromSerial(context.Context, *OriginalFromSerialRequest) (*OriginalFromSerialResponse, error)
+	// OriginalFromFingerprint returns the certificate that was cross-signed
+	// into the certificate with the given SHA-256 fingerprint (like
+	// /original-from-fingerprint).
+	OriginalFromFingerprint(context.Context, *OriginalFromFingerprintRequest) (*OriginalFromSerialResponse, error)
+	// OriginalFromSKID returns the certificate that was cross-signed into a
+	// certificate with the given Subject Key Identifier (like
+	// /original-from-skid), reconstructing it from DNS like
+	// OriginalFromSerial.
+	OriginalFromSKID(context.Context, *OriginalFromSKIDRequest) (*OriginalFromSerialResponse, error)
+	mustEmbedUnimplementedEncayaServer()
+}
+
+// UnimplementedEncayaServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedEncayaServer struct{}
+
+func (UnimplementedEncayaServer) Lookup(context.Context, *LookupRequest) (*LookupResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Lookup not implemented")
+}
+func (UnimplementedEncayaServer) AIA(context.Context, *AIARequest) (*AIAResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AIA not implemented")
+}
+func (UnimplementedEncayaServer) CrossSign(context.Context, *CrossSignRequest) (*CrossSignResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CrossSign not implemented")
+}
+func (UnimplementedEncayaServer) GetNegativeCA(context.Context, *GetNegativeCARequest) (*GetNegativeCAResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetNegativeCA not implemented")
+}
+func (UnimplementedEncayaServer) OriginalFromSerial(context.Context, *OriginalFromSerialRequest) (*OriginalFromSerialResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method OriginalFromSerial not implemented")
+}
+func (UnimplementedEncayaServer) OriginalFromFingerprint(context.Context, *OriginalFromFingerprintRequest) (*OriginalFromSerialResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method OriginalFromFingerprint not implemented")
+}
+func (UnimplementedEncayaServer) OriginalFromSKID(context.Context, *OriginalFromSKIDRequest) (*OriginalFromSerialResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method OriginalFromSKID not implemented")
+}
+func (UnimplementedEncayaServer) mustEmbedUnimplementedEncayaServer() {}
+func (UnimplementedEncayaServer) testEmbeddedByValue()                {}
+
+// UnsafeEncayaServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to EncayaServer will
+// result in compilation errors.
+type UnsafeEncayaServer interface {
+	mustEmbedUnimplementedEncayaServer()
+}
+
+func RegisterEncayaServer(s grpc.ServiceRegistrar, srv EncayaServer) {
+	// If the following call pancis, it indicates UnimplementedEncayaServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Encaya_ServiceDesc, srv)
+}
+
+func _Encaya_Lookup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EncayaServer).Lookup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Encaya_Lookup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EncayaServer).Lookup(ctx, req.(*LookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Encaya_AIA_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AIARequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EncayaServer).AIA(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Encaya_AIA_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EncayaServer).AIA(ctx, req.(*AIARequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Encaya_CrossSign_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CrossSignRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EncayaServer).CrossSign(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Encaya_CrossSign_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EncayaServer).CrossSign(ctx, req.(*CrossSignRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Encaya_GetNegativeCA_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetNegativeCARequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EncayaServer).GetNegativeCA(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Encaya_GetNegativeCA_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EncayaServer).GetNegativeCA(ctx, req.(*GetNegativeCARequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Encaya_OriginalFromSerial_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OriginalFromSerialRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EncayaServer).OriginalFromSerial(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Encaya_OriginalFromSerial_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EncayaServer).OriginalFromSerial(ctx, req.(*OriginalFromSerialRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Encaya_OriginalFromFingerprint_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OriginalFromFingerprintRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EncayaServer).OriginalFromFingerprint(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Encaya_OriginalFromFingerprint_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EncayaServer).OriginalFromFingerprint(ctx, req.(*OriginalFromFingerprintRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Encaya_OriginalFromSKID_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OriginalFromSKIDRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EncayaServer).OriginalFromSKID(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Encaya_OriginalFromSKID_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EncayaServer).OriginalFromSKID(ctx, req.(*OriginalFromSKIDRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Encaya_ServiceDesc is the grpc.ServiceDesc for Encaya service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Encaya_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "encaya.v1.Encaya",
+	HandlerType: (*EncayaServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Lookup",
+			Handler:    _Encaya_Lookup_Handler,
+		},
+		{
+			MethodName: "AIA",
+			Handler:    _Encaya_AIA_Handler,
+		},
+		{
+			MethodName: "CrossSign",
+			Handler:    _Encaya_CrossSign_Handler,
+		},
+		{
+			MethodName: "GetNegativeCA",
+			Handler:    _Encaya_GetNegativeCA_Handler,
+		},
+		{
+			MethodName: "OriginalFromSerial",
+			Handler:    _Encaya_OriginalFromSerial_Handler,
+		},
+		{
+			MethodName: "OriginalFromFingerprint",
+			Handler:    _Encaya_OriginalFromFingerprint_Handler,
+		},
+		{
+			MethodName: "OriginalFromSKID",
+			Handler:    _Encaya_OriginalFromSKID_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "encaya.proto",
+}
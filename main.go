@@ -1,34 +1,117 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/hlandau/dexlogconfig"
+	"github.com/hlandau/xlog"
 	"gopkg.in/hlandau/easyconfig.v1"
 	"gopkg.in/hlandau/service.v2"
 
 	"github.com/namecoin/encaya/server"
 )
 
+var log, _ = xlog.New("encaya")
+
 func main() {
-	cfg := server.Config{}
+	// The flags that aren't encaya options are those of the service and
+	// logging packages, which easyconfig parses.
+	args, rest := server.SplitArgs(os.Args[1:])
+	os.Args = append(os.Args[:1], rest...)
 
 	config := easyconfig.Configurator{
 		ProgramName: "encaya",
 	}
-	config.ParseFatal(&cfg)
+	config.ParseFatal(nil)
 	dexlogconfig.Init()
 
-	// We use the configPath to resolve paths relative to the config file.
-	cfg.ConfigDir = filepath.Dir(config.ConfigFilePath())
+	// Without -conf or -configdir, encaya.conf is read from the directory
+	// in which easyconfig found its config file.
+	defaultDir := filepath.Dir(config.ConfigFilePath())
+
+	cfg, err := server.LoadConfig(args, os.Environ(), defaultDir)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 
+	if err != nil {
+		log.Fatale(err)
+	}
+
+	// On Windows, service.Main registers and runs encaya as an NT service
+	// under Name, stopping it on service control requests.
 	service.Main(&service.Info{
+		Name:          "encaya",
+		Title:         "Encaya",
 		Description:   "Namecoin to AIA Daemon",
 		DefaultChroot: service.EmptyChrootPath,
-		NewFunc: func() (service.Runnable, error) {
-			return server.New(&cfg)
+		RunFunc: func(smgr service.Manager) error {
+			return run(smgr, cfg, args)
 		},
 	})
 }
 
+// run serves until the service manager asks us to stop or a listener fails.
+func run(smgr service.Manager, cfg *server.Config, args []string) error {
+	srv, err := server.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = smgr.DropPrivileges()
+	if err != nil {
+		return err
+	}
+
+	err = srv.Start()
+	if err != nil {
+		return err
+	}
+
+	go reloadOnSIGHUP(srv, args)
+
+	smgr.SetStarted()
+
+	select {
+	case <-smgr.StopChan():
+	case err = <-srv.Failed():
+		log.Errore(err, "Listener failed; shutting down")
+	}
+
+	stopErr := srv.Stop()
+	if err == nil {
+		err = stopErr
+	}
+
+	return err
+}
+
+// reloadOnSIGHUP re-reads the config file, and the keys and certs it names,
+// whenever SIGHUP is received.  The config is rebuilt from the same command
+// line, so the environment and command line still take precedence over the
+// file.
+func reloadOnSIGHUP(srv *server.Server, args []string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	for range sighup {
+		cfg, err := srv.LoadConfig(args, os.Environ())
+		if err != nil {
+			log.Errore(err, "Unable to reload config file")
+
+			continue
+		}
+
+		err = srv.Reload(cfg)
+		if err != nil {
+			log.Errore(err, "Unable to reload; keeping the previous configuration")
+		}
+	}
+}
+
 // © 2014-2021 Namecoin Developers    GPLv3 or later
@@ -0,0 +1,1065 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The ACME server (RFC 8555) lets standard clients such as certbot and lego
+// obtain a cert for a web server's key without any other integration.
+// Instead of completing a challenge, the domain owner proves control by
+// publishing a DANE-EE TLSA record for the key at _443._tcp, so
+// authorizations are valid from the start and the records are checked when
+// the order is finalized.  Clients must therefore reuse the key that the
+// record refers to (e.g. certbot --reuse-key, or lego --csr).
+
+// ACME problem types (RFC 8555 section 6.7).
+const (
+	acmeErrAccountDoesNotExist   = "accountDoesNotExist"
+	acmeErrBadCSR                = "badCSR"
+	acmeErrBadNonce              = "badNonce"
+	acmeErrBadSignatureAlgorithm = "badSignatureAlgorithm"
+	acmeErrMalformed             = "malformed"
+	acmeErrOrderNotReady         = "orderNotReady"
+	acmeErrRejectedIdentifier    = "rejectedIdentifier"
+	acmeErrServerInternal        = "serverInternal"
+	acmeErrUnauthorized          = "unauthorized"
+	acmeErrUnsupportedIdentifier = "unsupportedIdentifier"
+	acmeErrDNS                   = "dns"
+)
+
+// ACME object statuses (RFC 8555 section 7.1.6).
+const (
+	acmeStatusReady      = "ready"
+	acmeStatusProcessing = "processing"
+	acmeStatusValid      = "valid"
+	acmeStatusInvalid    = "invalid"
+)
+
+const (
+	// acmeService is where the DANE-EE records proving control of a
+	// domain are looked up.
+	acmeService = "_443._tcp"
+
+	acmeNonceLifetime = time.Hour
+	acmeMaxNonces     = 10000
+	acmeOrderLifetime = 24 * time.Hour
+	acmeMaxOrders     = 10000
+	acmeMaxAccounts   = 10000
+
+	// maxACMERequestSize bounds JWS request bodies, the largest of which
+	// carry a CSR.
+	maxACMERequestSize = 65536
+)
+
+// storeBucketACMEAccount maps ACME account IDs to their JWK, so that
+// accounts survive restarts if Store is set.  Only accounts that have been
+// issued a cert are stored, so that registering keys doesn't fill the store.
+var storeBucketACMEAccount = []byte("acme-account")
+
+// ErrACMEProof is returned when a domain doesn't publish a DANE-EE record
+// for the key in an ACME order's CSR.
+var ErrACMEProof = errors.New("no DANE-EE record for the CSR's key")
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func newACMEProblem(status int, problemType, detail string) *acmeProblem {
+	return &acmeProblem{
+		Type:   "urn:ietf:params:acme:error:" + problemType,
+		Detail: detail,
+		Status: status,
+	}
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// acmeAccount is identified by the thumbprint of its key, so that a client
+// registering the same key again gets the same account.
+type acmeAccount struct {
+	id  string
+	key crypto.PublicKey
+
+	// jwk is saved to the store once the account has a valid order.
+	jwk   json.RawMessage
+	saved bool
+}
+
+type acmeOrder struct {
+	id          string
+	accountID   string
+	status      string
+	expires     time.Time
+	identifiers []acmeIdentifier
+	authzIDs    []string
+	certID      string
+	problem     *acmeProblem
+}
+
+type acmeAuthz struct {
+	id         string
+	accountID  string
+	identifier acmeIdentifier
+	expires    time.Time
+}
+
+type acmeNonce struct {
+	value   string
+	expires time.Time
+}
+
+type acmeCert struct {
+	accountID string
+	chain     string
+	expires   time.Time
+}
+
+// acmeState holds the ACME objects.  Apart from accounts, which may be
+// persisted, they only live as long as an order.
+type acmeState struct {
+	mu sync.Mutex
+
+	// nonceOrder holds the *acmeNonce elements of nonces, oldest first.
+	nonces     map[string]*list.Element
+	nonceOrder *list.List
+
+	accounts map[string]*acmeAccount
+	orders   map[string]*acmeOrder
+	authzs   map[string]*acmeAuthz
+	certs    map[string]*acmeCert
+}
+
+func newACMEState() *acmeState {
+	return &acmeState{
+		nonces:     map[string]*list.Element{},
+		nonceOrder: list.New(),
+		accounts:   map[string]*acmeAccount{},
+		orders:     map[string]*acmeOrder{},
+		authzs:     map[string]*acmeAuthz{},
+		certs:      map[string]*acmeCert{},
+	}
+}
+
+func acmeRandomID() string {
+	id := make([]byte, 16)
+
+	_, err := rand.Read(id)
+	if err != nil {
+		// crypto/rand doesn't fail on supported platforms.
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// newNonce issues a nonce, forgetting the expired ones and, if there are
+// too many, the oldest unused ones.
+func (a *acmeState) newNonce() string {
+	nonce := &acmeNonce{
+		value:   acmeRandomID(),
+		expires: time.Now().Add(acmeNonceLifetime),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for element := a.nonceOrder.Front(); element != nil; element = a.nonceOrder.Front() {
+		oldest := element.Value.(*acmeNonce)
+		if time.Now().Before(oldest.expires) && len(a.nonces) < acmeMaxNonces {
+			break
+		}
+
+		a.nonceOrder.Remove(element)
+		delete(a.nonces, oldest.value)
+	}
+
+	a.nonces[nonce.value] = a.nonceOrder.PushBack(nonce)
+
+	return nonce.value
+}
+
+// useNonce reports whether nonce was issued and not used yet, and uses it.
+func (a *acmeState) useNonce(nonce string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	element, ok := a.nonces[nonce]
+	if !ok {
+		return false
+	}
+
+	a.nonceOrder.Remove(element)
+	delete(a.nonces, nonce)
+
+	return time.Now().Before(element.Value.(*acmeNonce).expires)
+}
+
+// pruneAccounts forgets the accounts that can be forgotten: stored ones,
+// which are loaded again when needed, and unstored ones without a current
+// order.  The caller must hold a.mu.
+func (a *acmeState) pruneAccounts() {
+	ordering := map[string]bool{}
+	for _, order := range a.orders {
+		ordering[order.accountID] = true
+	}
+
+	for id, account := range a.accounts {
+		if account.saved || !ordering[id] {
+			delete(a.accounts, id)
+		}
+	}
+}
+
+// prune forgets expired orders along with their authorizations and certs.
+// The caller must hold a.mu.
+func (a *acmeState) prune(now time.Time) {
+	for id, order := range a.orders {
+		if now.After(order.expires) {
+			delete(a.orders, id)
+		}
+	}
+
+	for id, authz := range a.authzs {
+		if now.After(authz.expires) {
+			delete(a.authzs, id)
+		}
+	}
+
+	for id, cert := range a.certs {
+		if now.After(cert.expires) {
+			delete(a.certs, id)
+		}
+	}
+}
+
+// acmeBaseURL returns the URL under which the ACME objects are served.
+// Clients sign the URL of each request, so it must be the one they use.
+func (s *Server) acmeBaseURL(req *http.Request) string {
+	if s.cfg.ACMEURL != "" {
+		return strings.TrimSuffix(s.cfg.ACMEURL, "/")
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + req.Host + "/acme"
+}
+
+// writeACMEProblem responds with an ACME problem document.
+func writeACMEProblem(w http.ResponseWriter, problem *acmeProblem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+
+	err := json.NewEncoder(w).Encode(problem)
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
+
+func writeACMEJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
+
+// acmeRequest is an authenticated ACME POST.
+type acmeRequest struct {
+	base    string
+	payload []byte
+
+	// Set for requests signed by an existing account
+	account *acmeAccount
+
+	// Set for new-account requests, which carry their key
+	jwk        json.RawMessage
+	key        crypto.PublicKey
+	thumbprint string
+}
+
+// acmeHandler serves the ACME directory and the objects under /acme/.
+func (s *Server) acmeHandler(w http.ResponseWriter, req *http.Request) {
+	base := s.acmeBaseURL(req)
+	path := strings.TrimPrefix(req.URL.Path, "/acme/")
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Link", "<"+base+"/directory>;rel=\"index\"")
+
+	// Nonces are only handed out where RFC 8555 section 7.2 requires them,
+	// so that fetching the directory doesn't fill the nonce store.
+	if path == "new-nonce" || req.Method == http.MethodPost {
+		w.Header().Set("Replay-Nonce", s.acme.newNonce())
+	}
+
+	switch path {
+	case "directory":
+		writeACMEJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   base + "/new-nonce",
+			"newAccount": base + "/new-account",
+			"newOrder":   base + "/new-order",
+		})
+
+		return
+	case "new-nonce":
+		if req.Method == http.MethodHead {
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeACMEProblem(w, newACMEProblem(http.StatusMethodNotAllowed, acmeErrMalformed, "use POST"))
+
+		return
+	}
+
+	acmeReq, problem := s.acmeAuthenticate(req, base, path == "new-account")
+	if problem != nil {
+		writeACMEProblem(w, problem)
+
+		return
+	}
+
+	kind, id, _ := strings.Cut(path, "/")
+
+	switch {
+	case path == "new-account":
+		s.acmeNewAccount(w, acmeReq)
+	case path == "new-order":
+		s.acmeNewOrder(w, acmeReq)
+	case kind == "account" && id == acmeReq.account.id:
+		s.acmeAccountJSON(w, http.StatusOK, acmeReq, acmeReq.account)
+	case kind == "account" && id == acmeReq.account.id+"/orders":
+		s.acmeAccountOrders(w, acmeReq)
+	case kind == "order" && strings.HasSuffix(id, "/finalize"):
+		s.acmeFinalize(req.Context(), w, acmeReq, strings.TrimSuffix(id, "/finalize"))
+	case kind == "order":
+		s.acmeOrderObject(w, acmeReq, id)
+	case kind == "authz":
+		s.acmeAuthzObject(w, acmeReq, id)
+	case kind == "cert":
+		s.acmeCertObject(w, acmeReq, id)
+	default:
+		writeACMEProblem(w, newACMEProblem(http.StatusNotFound, acmeErrMalformed, "no such object"))
+	}
+}
+
+// acmeAuthenticate checks the JWS of an ACME POST (RFC 8555 section 6.2).
+// Requests to new-account are signed with a new key, and all others with an
+// account's key.
+func (s *Server) acmeAuthenticate(req *http.Request, base string, newAccount bool) (*acmeRequest,
+	*acmeProblem) {
+	if mediaType, _, _ := strings.Cut(req.Header.Get("Content-Type"), ";"); mediaType != "application/jose+json" {
+		return nil, newACMEProblem(http.StatusUnsupportedMediaType, acmeErrMalformed,
+			"requests must be application/jose+json")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxACMERequestSize+1))
+	if err != nil {
+		return nil, newACMEProblem(http.StatusBadRequest, acmeErrMalformed, err.Error())
+	}
+
+	if len(body) > maxACMERequestSize {
+		return nil, newACMEProblem(http.StatusRequestEntityTooLarge, acmeErrMalformed, "request too large")
+	}
+
+	jws, header, err := parseACMEJWS(body)
+	if err != nil {
+		return nil, newACMEProblem(http.StatusBadRequest, acmeErrMalformed, err.Error())
+	}
+
+	if !s.acme.useNonce(header.Nonce) {
+		return nil, newACMEProblem(http.StatusBadRequest, acmeErrBadNonce, "unknown or reused nonce")
+	}
+
+	if header.URL != base+strings.TrimPrefix(req.URL.Path, "/acme") {
+		return nil, newACMEProblem(http.StatusUnauthorized, acmeErrUnauthorized,
+			"signed URL doesn't match the request URL")
+	}
+
+	acmeReq := &acmeRequest{base: base}
+
+	var key crypto.PublicKey
+
+	if newAccount {
+		if len(header.JWK) == 0 {
+			return nil, newACMEProblem(http.StatusBadRequest, acmeErrMalformed, "new-account requests carry a jwk")
+		}
+
+		acmeReq.key, acmeReq.thumbprint, err = parseJWK(header.JWK)
+		if err != nil {
+			return nil, newACMEProblem(http.StatusBadRequest, acmeErrBadSignatureAlgorithm, err.Error())
+		}
+
+		acmeReq.jwk = header.JWK
+		key = acmeReq.key
+	} else {
+		if header.KID == "" {
+			return nil, newACMEProblem(http.StatusBadRequest, acmeErrMalformed, "requests must carry a kid")
+		}
+
+		acmeReq.account = s.acmeAccount(strings.TrimPrefix(header.KID, base+"/account/"))
+		if acmeReq.account == nil || header.KID != base+"/account/"+acmeReq.account.id {
+			return nil, newACMEProblem(http.StatusBadRequest, acmeErrAccountDoesNotExist, "no such account")
+		}
+
+		key = acmeReq.account.key
+	}
+
+	err = jws.verify(header.Alg, key)
+	if errors.Is(err, ErrJWSAlgorithm) {
+		return nil, newACMEProblem(http.StatusBadRequest, acmeErrBadSignatureAlgorithm, err.Error())
+	} else if err != nil {
+		return nil, newACMEProblem(http.StatusUnauthorized, acmeErrUnauthorized, err.Error())
+	}
+
+	acmeReq.payload, err = jws.payload()
+	if err != nil {
+		return nil, newACMEProblem(http.StatusBadRequest, acmeErrMalformed, err.Error())
+	}
+
+	return acmeReq, nil
+}
+
+// acmeAccount returns the account with the given ID, loading it from the
+// store if needed, or nil if there is none.
+func (s *Server) acmeAccount(id string) *acmeAccount {
+	s.acme.mu.Lock()
+	account := s.acme.accounts[id]
+	s.acme.mu.Unlock()
+
+	if account != nil {
+		return account
+	}
+
+	jwk, found := s.loadStored(storeBucketACMEAccount, id)
+	if !found {
+		return nil
+	}
+
+	key, thumbprint, err := parseJWK(json.RawMessage(jwk))
+	if err != nil || thumbprint != id {
+		log.Warnf("Ignoring stored ACME account %s", id)
+
+		return nil
+	}
+
+	account = &acmeAccount{id: id, key: key, saved: true}
+
+	s.acme.mu.Lock()
+	s.acme.accounts[id] = account
+	s.acme.mu.Unlock()
+
+	return account
+}
+
+func (s *Server) acmeAccountJSON(w http.ResponseWriter, status int, acmeReq *acmeRequest, account *acmeAccount) {
+	w.Header().Set("Location", acmeReq.base+"/account/"+account.id)
+	writeACMEJSON(w, status, map[string]string{
+		"status": acmeStatusValid,
+		"orders": acmeReq.base + "/account/" + account.id + "/orders",
+	})
+}
+
+// acmeNewAccount serves new-account.  Contact addresses and terms of service
+// agreement are accepted but not kept, since there's nobody to contact.  New
+// accounts are only kept in memory until they have a valid order.
+func (s *Server) acmeNewAccount(w http.ResponseWriter, acmeReq *acmeRequest) {
+	var payload struct {
+		OnlyReturnExisting bool `json:"onlyReturnExisting"`
+	}
+
+	err := json.Unmarshal(acmeReq.payload, &payload)
+	if err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, acmeErrMalformed, err.Error()))
+
+		return
+	}
+
+	account := s.acmeAccount(acmeReq.thumbprint)
+	if account != nil {
+		s.acmeAccountJSON(w, http.StatusOK, acmeReq, account)
+
+		return
+	}
+
+	if payload.OnlyReturnExisting {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, acmeErrAccountDoesNotExist, "no such account"))
+
+		return
+	}
+
+	account = &acmeAccount{id: acmeReq.thumbprint, key: acmeReq.key, jwk: acmeReq.jwk}
+
+	s.acme.mu.Lock()
+
+	if len(s.acme.accounts) >= acmeMaxAccounts {
+		s.acme.prune(time.Now())
+		s.acme.pruneAccounts()
+	}
+
+	if len(s.acme.accounts) >= acmeMaxAccounts {
+		s.acme.mu.Unlock()
+		writeACMEProblem(w, newACMEProblem(http.StatusServiceUnavailable, acmeErrServerInternal,
+			"too many pending accounts"))
+
+		return
+	}
+
+	s.acme.accounts[account.id] = account
+	s.acme.mu.Unlock()
+
+	s.acmeAccountJSON(w, http.StatusCreated, acmeReq, account)
+}
+
+// acmeAccountOrders lists the account's current orders.
+func (s *Server) acmeAccountOrders(w http.ResponseWriter, acmeReq *acmeRequest) {
+	orders := []string{}
+
+	s.acme.mu.Lock()
+
+	for id, order := range s.acme.orders {
+		if order.accountID == acmeReq.account.id && time.Now().Before(order.expires) {
+			orders = append(orders, acmeReq.base+"/order/"+id)
+		}
+	}
+
+	s.acme.mu.Unlock()
+
+	sort.Strings(orders)
+	writeACMEJSON(w, http.StatusOK, map[string][]string{"orders": orders})
+}
+
+// acmeNewOrder serves new-order.  Every identifier must be a domain that we
+// may issue certs for, and all of them must be under the same TLD.
+func (s *Server) acmeNewOrder(w http.ResponseWriter, acmeReq *acmeRequest) {
+	var payload struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+
+	err := json.Unmarshal(acmeReq.payload, &payload)
+	if err != nil || len(payload.Identifiers) == 0 {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, acmeErrMalformed, "missing identifiers"))
+
+		return
+	}
+
+	names, problem := s.acmeOrderNames(payload.Identifiers)
+	if problem != nil {
+		writeACMEProblem(w, problem)
+
+		return
+	}
+
+	now := time.Now()
+	order := &acmeOrder{
+		id:        acmeRandomID(),
+		accountID: acmeReq.account.id,
+		status:    acmeStatusReady,
+		expires:   now.Add(acmeOrderLifetime),
+	}
+
+	s.acme.mu.Lock()
+
+	s.acme.prune(now)
+
+	if len(s.acme.orders) >= acmeMaxOrders {
+		s.acme.mu.Unlock()
+		writeACMEProblem(w, newACMEProblem(http.StatusServiceUnavailable, acmeErrServerInternal,
+			"too many pending orders"))
+
+		return
+	}
+
+	for _, name := range names {
+		authz := &acmeAuthz{
+			id:         acmeRandomID(),
+			accountID:  order.accountID,
+			identifier: acmeIdentifier{Type: "dns", Value: name},
+			expires:    order.expires,
+		}
+
+		s.acme.authzs[authz.id] = authz
+		order.identifiers = append(order.identifiers, authz.identifier)
+		order.authzIDs = append(order.authzIDs, authz.id)
+	}
+
+	s.acme.orders[order.id] = order
+	response := s.acmeOrderJSON(acmeReq.base, order)
+
+	s.acme.mu.Unlock()
+
+	w.Header().Set("Location", acmeReq.base+"/order/"+order.id)
+	writeACMEJSON(w, http.StatusCreated, response)
+}
+
+// acmeOrderNames checks the identifiers of a new order, returning their
+// sorted, deduplicated domains.
+func (s *Server) acmeOrderNames(identifiers []acmeIdentifier) ([]string, *acmeProblem) {
+	var tld *tldCA
+
+	seen := map[string]bool{}
+	names := []string{}
+
+	for _, identifier := range identifiers {
+		if identifier.Type != "dns" {
+			return nil, newACMEProblem(http.StatusBadRequest, acmeErrUnsupportedIdentifier,
+				"only dns identifiers are supported")
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(identifier.Value, "."))
+		if _, ok := dns.IsDomainName(name); !ok || strings.HasPrefix(name, "*.") {
+			return nil, newACMEProblem(http.StatusBadRequest, acmeErrRejectedIdentifier,
+				fmt.Sprintf("%q isn't a domain we issue certs for", identifier.Value))
+		}
+
+		nameTLD := s.tldForDomain(name)
+		if nameTLD == nil || (tld != nil && nameTLD != tld) {
+			return nil, newACMEProblem(http.StatusBadRequest, acmeErrRejectedIdentifier,
+				fmt.Sprintf("%s isn't under the TLD of the order's other identifiers", name))
+		}
+
+		tld = nameTLD
+
+		err := s.policy.check(name)
+		if err != nil {
+			return nil, newACMEProblem(http.StatusBadRequest, acmeErrRejectedIdentifier, err.Error())
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// acmeOrderJSON returns the ACME representation of order.  The caller must
+// hold s.acme.mu.
+func (s *Server) acmeOrderJSON(base string, order *acmeOrder) interface{} {
+	authorizations := make([]string, 0, len(order.authzIDs))
+	for _, id := range order.authzIDs {
+		authorizations = append(authorizations, base+"/authz/"+id)
+	}
+
+	response := struct {
+		Status         string           `json:"status"`
+		Expires        string           `json:"expires"`
+		Identifiers    []acmeIdentifier `json:"identifiers"`
+		Authorizations []string         `json:"authorizations"`
+		Finalize       string           `json:"finalize"`
+		Certificate    string           `json:"certificate,omitempty"`
+		Error          *acmeProblem     `json:"error,omitempty"`
+	}{
+		Status:         order.status,
+		Expires:        order.expires.UTC().Format(time.RFC3339),
+		Identifiers:    order.identifiers,
+		Authorizations: authorizations,
+		Finalize:       base + "/order/" + order.id + "/finalize",
+		Error:          order.problem,
+	}
+
+	if order.certID != "" {
+		response.Certificate = base + "/cert/" + order.certID
+	}
+
+	return response
+}
+
+// acmeOrder returns the account's order with the given ID, or writes a
+// problem and returns nil.  The caller must hold s.acme.mu.
+func (s *Server) acmeOrder(w http.ResponseWriter, acmeReq *acmeRequest, id string) *acmeOrder {
+	order := s.acme.orders[id]
+	if order == nil || time.Now().After(order.expires) {
+		writeACMEProblem(w, newACMEProblem(http.StatusNotFound, acmeErrMalformed, "no such order"))
+
+		return nil
+	}
+
+	if order.accountID != acmeReq.account.id {
+		writeACMEProblem(w, newACMEProblem(http.StatusForbidden, acmeErrUnauthorized,
+			"the order belongs to another account"))
+
+		return nil
+	}
+
+	return order
+}
+
+func (s *Server) acmeOrderObject(w http.ResponseWriter, acmeReq *acmeRequest, id string) {
+	s.acme.mu.Lock()
+	defer s.acme.mu.Unlock()
+
+	order := s.acmeOrder(w, acmeReq, id)
+	if order == nil {
+		return
+	}
+
+	writeACMEJSON(w, http.StatusOK, s.acmeOrderJSON(acmeReq.base, order))
+}
+
+// acmeAuthzObject serves an authorization.  It has no challenges, since
+// control is proven by the DANE-EE records checked at finalization.
+func (s *Server) acmeAuthzObject(w http.ResponseWriter, acmeReq *acmeRequest, id string) {
+	s.acme.mu.Lock()
+	defer s.acme.mu.Unlock()
+
+	authz := s.acme.authzs[id]
+	if authz == nil || time.Now().After(authz.expires) {
+		writeACMEProblem(w, newACMEProblem(http.StatusNotFound, acmeErrMalformed, "no such authorization"))
+
+		return
+	}
+
+	if authz.accountID != acmeReq.account.id {
+		writeACMEProblem(w, newACMEProblem(http.StatusForbidden, acmeErrUnauthorized,
+			"the authorization belongs to another account"))
+
+		return
+	}
+
+	writeACMEJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     acmeStatusValid,
+		"expires":    authz.expires.UTC().Format(time.RFC3339),
+		"identifier": authz.identifier,
+		"challenges": []interface{}{},
+	})
+}
+
+func (s *Server) acmeCertObject(w http.ResponseWriter, acmeReq *acmeRequest, id string) {
+	s.acme.mu.Lock()
+	cert := s.acme.certs[id]
+	s.acme.mu.Unlock()
+
+	if cert == nil || time.Now().After(cert.expires) {
+		writeACMEProblem(w, newACMEProblem(http.StatusNotFound, acmeErrMalformed, "no such certificate"))
+
+		return
+	}
+
+	if cert.accountID != acmeReq.account.id {
+		writeACMEProblem(w, newACMEProblem(http.StatusForbidden, acmeErrUnauthorized,
+			"the certificate belongs to another account"))
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+
+	_, err := io.WriteString(w, cert.chain)
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
+
+// acmeFinalize serves an order's finalize URL: the CSR must be for exactly
+// the order's domains, and each of them must publish a DANE-EE record for
+// the CSR's key.
+func (s *Server) acmeFinalize(ctx context.Context, w http.ResponseWriter, acmeReq *acmeRequest, id string) {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+
+	err := json.Unmarshal(acmeReq.payload, &payload)
+	if err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, acmeErrMalformed, err.Error()))
+
+		return
+	}
+
+	s.acme.mu.Lock()
+
+	order := s.acmeOrder(w, acmeReq, id)
+	if order == nil {
+		s.acme.mu.Unlock()
+
+		return
+	}
+
+	if order.status != acmeStatusReady {
+		s.acme.mu.Unlock()
+		writeACMEProblem(w, newACMEProblem(http.StatusForbidden, acmeErrOrderNotReady,
+			"the order is "+order.status))
+
+		return
+	}
+
+	// Concurrent finalizations of the order see it as processing.
+	order.status = acmeStatusProcessing
+	identifiers := order.identifiers
+
+	s.acme.mu.Unlock()
+
+	chain, problem := s.acmeIssue(ctx, identifiers, payload.CSR)
+
+	s.acme.mu.Lock()
+	defer s.acme.mu.Unlock()
+
+	switch {
+	case problem != nil && problem.Status == http.StatusInternalServerError:
+		// Let the client try again.
+		order.status = acmeStatusReady
+	case problem != nil:
+		order.status = acmeStatusInvalid
+		order.problem = problem
+	default:
+		order.status = acmeStatusValid
+		order.certID = acmeRandomID()
+		s.acme.certs[order.certID] = &acmeCert{
+			accountID: order.accountID,
+			chain:     chain,
+			expires:   order.expires,
+		}
+
+		account := s.acme.accounts[order.accountID]
+		if account != nil && !account.saved {
+			account.saved = true
+			s.saveStored(storeBucketACMEAccount, account.id, string(account.jwk))
+		}
+	}
+
+	if problem != nil {
+		writeACMEProblem(w, problem)
+
+		return
+	}
+
+	w.Header().Set("Location", acmeReq.base+"/order/"+order.id)
+	writeACMEJSON(w, http.StatusOK, s.acmeOrderJSON(acmeReq.base, order))
+}
+
+// acmeIssue checks an order's CSR against the DANE-EE records of its
+// domains and issues the cert, returning the PEM chain up to the TLD CA.
+func (s *Server) acmeIssue(ctx context.Context, identifiers []acmeIdentifier, csrParam string) (string,
+	*acmeProblem) {
+	csrDER, err := base64.RawURLEncoding.DecodeString(csrParam)
+	if err != nil {
+		return "", newACMEProblem(http.StatusBadRequest, acmeErrBadCSR, err.Error())
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+
+	if err != nil {
+		return "", newACMEProblem(http.StatusBadRequest, acmeErrBadCSR, err.Error())
+	}
+
+	names := make([]string, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		names = append(names, identifier.Value)
+	}
+
+	if !csrNamesMatch(csr, names) {
+		return "", newACMEProblem(http.StatusBadRequest, acmeErrBadCSR,
+			"the CSR must be for exactly the order's identifiers")
+	}
+
+	// The configuration may have been reloaded since the order was
+	// created.
+	tld := s.tldForDomain(names[0])
+	if tld == nil {
+		return "", newACMEProblem(http.StatusBadRequest, acmeErrRejectedIdentifier,
+			names[0]+" isn't a domain we issue certs for")
+	}
+
+	proofs := make([]*dns.TLSA, len(names))
+
+	for i, name := range names {
+		err = s.policy.check(name)
+		if err != nil {
+			return "", newACMEProblem(http.StatusBadRequest, acmeErrRejectedIdentifier, err.Error())
+		}
+
+		proofs[i], err = s.acmeProof(ctx, name, csr.RawSubjectPublicKeyInfo)
+		if errors.Is(err, ErrACMEProof) {
+			return "", newACMEProblem(http.StatusForbidden, acmeErrUnauthorized, err.Error())
+		} else if err != nil {
+			return "", newACMEProblem(http.StatusBadRequest, acmeErrDNS, err.Error())
+		}
+	}
+
+	der, err := s.issueACMECert(ctx, names, csr.PublicKey, proofs, tld)
+	if err != nil {
+		log.Errore(err, "Unable to issue ACME cert")
+
+		return "", newACMEProblem(http.StatusInternalServerError, acmeErrServerInternal, "unable to issue cert")
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return string(chain) + tld.certPemString, nil
+}
+
+// csrNamesMatch reports whether csr is for exactly names (sorted and
+// lower-case).  The common name, if any, must be one of them.
+func csrNamesMatch(csr *x509.CertificateRequest, names []string) bool {
+	seen := map[string]bool{}
+
+	for _, name := range csr.DNSNames {
+		seen[strings.ToLower(strings.TrimSuffix(name, "."))] = true
+	}
+
+	if cn := csr.Subject.CommonName; cn != "" && !seen[strings.ToLower(strings.TrimSuffix(cn, "."))] {
+		return false
+	}
+
+	if len(seen) != len(names) || len(csr.IPAddresses) != 0 || len(csr.EmailAddresses) != 0 ||
+		len(csr.URIs) != 0 {
+		return false
+	}
+
+	for _, name := range names {
+		if !seen[name] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// acmeProof returns the DANE-EE record at domain that refers to the key
+// whose SubjectPublicKeyInfo is spki.  Only authenticated records count.
+func (s *Server) acmeProof(ctx context.Context, domain string, spki []byte) (*dns.TLSA, error) {
+	records, wildcard, err := s.trustedTLSA(ctx, domain, acmeService)
+	if err != nil {
+		return nil, err
+	}
+
+	// The records at *.domain apply to every subdomain, so they don't prove
+	// control of domain itself.
+	if wildcard {
+		records = nil
+	}
+
+	for _, record := range records {
+		if record.Usage != tlsaUsageDANEEE {
+			continue
+		}
+
+		data, err := hex.DecodeString(record.Certificate)
+		if err != nil {
+			continue
+		}
+
+		if record.Selector == tlsaSelectorCert && record.MatchingType == tlsaMatchingFull {
+			cert, err := x509.ParseCertificate(data)
+			if err == nil && bytes.Equal(cert.RawSubjectPublicKeyInfo, spki) {
+				return record, nil
+			}
+
+			continue
+		}
+
+		if record.Selector != tlsaSelectorSPKI {
+			continue
+		}
+
+		hash := spki
+		if record.MatchingType != tlsaMatchingFull {
+			var ok bool
+
+			hash, ok = tlsaHash(spki, record.MatchingType)
+			if !ok {
+				continue
+			}
+		}
+
+		if bytes.Equal(hash, data) {
+			return record, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w at %s.%s", ErrACMEProof, acmeService, domain)
+}
+
+// issueACMECert issues a cert for pub, valid for names, and remembers it
+// for OCSP and in the logs like issueDomainCert does.  proofs are the
+// DANE-EE records that proved control of each of names; the cert is
+// remembered under each of them, so that it's revoked when any is removed.
+func (s *Server) issueACMECert(ctx context.Context, names []string, pub interface{}, proofs []*dns.TLSA,
+	tld *tldCA) (der []byte, err error) {
+	event := newAuditEvent(ctx, auditIssueACMECert, time.Now())
+	event.Domain = strings.Join(names, ",")
+	event.Service = acmeService
+	event.setTLSA(proofs[0])
+
+	_, span := s.startSpan(ctx, "cert.sign", attrDomain.String(names[0]), attrService.String(acmeService))
+
+	defer func() {
+		event.finish(err)
+		s.audit(event)
+		endSpan(span, err)
+	}()
+
+	der, err = s.issueLeafCert(names, pub, tld)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err = s.finishDomainCert(der, tld)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(attrSerial.String(parsed.SerialNumber.String()))
+	event.setCert(der)
+
+	err = s.logIssued(der, tld.cert)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, name := range names {
+		s.issuedCertCache.add(tld.name+"/"+parsed.SerialNumber.String(), cachedCert{
+			domain:  name,
+			service: acmeService,
+			certDer: der,
+			tlsa:    proofs[i],
+		})
+	}
+
+	return der, nil
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCSRNamesMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		csr   x509.CertificateRequest
+		names []string
+		want  bool
+	}{
+		{
+			name:  "exact",
+			csr:   x509.CertificateRequest{DNSNames: []string{"www.example.bit", "example.bit"}},
+			names: []string{"example.bit", "www.example.bit"},
+			want:  true,
+		},
+		{
+			name:  "case and trailing dot",
+			csr:   x509.CertificateRequest{DNSNames: []string{"Example.BIT."}},
+			names: []string{"example.bit"},
+			want:  true,
+		},
+		{
+			name: "common name among the names",
+			csr: x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "example.bit"},
+				DNSNames: []string{"example.bit"},
+			},
+			names: []string{"example.bit"},
+			want:  true,
+		},
+		{
+			name: "common name not among the names",
+			csr: x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "other.bit"},
+				DNSNames: []string{"example.bit"},
+			},
+			names: []string{"example.bit"},
+			want:  false,
+		},
+		{
+			name:  "missing name",
+			csr:   x509.CertificateRequest{DNSNames: []string{"example.bit"}},
+			names: []string{"example.bit", "www.example.bit"},
+			want:  false,
+		},
+		{
+			name:  "extra name",
+			csr:   x509.CertificateRequest{DNSNames: []string{"example.bit", "www.example.bit"}},
+			names: []string{"example.bit"},
+			want:  false,
+		},
+		{
+			name:  "different name",
+			csr:   x509.CertificateRequest{DNSNames: []string{"example.bit"}},
+			names: []string{"other.bit"},
+			want:  false,
+		},
+		{
+			name: "IP address",
+			csr: x509.CertificateRequest{
+				DNSNames:    []string{"example.bit"},
+				IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+			},
+			names: []string{"example.bit"},
+			want:  false,
+		},
+		{
+			name: "email address",
+			csr: x509.CertificateRequest{
+				DNSNames:       []string{"example.bit"},
+				EmailAddresses: []string{"admin@example.bit"},
+			},
+			names: []string{"example.bit"},
+			want:  false,
+		},
+		{
+			name: "URI",
+			csr: x509.CertificateRequest{
+				DNSNames: []string{"example.bit"},
+				URIs:     []*url.URL{{Scheme: "https", Host: "example.bit"}},
+			},
+			names: []string{"example.bit"},
+			want:  false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			csr := test.csr
+
+			got := csrNamesMatch(&csr, test.names)
+			if got != test.want {
+				t.Errorf("csrNamesMatch = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestACMENonces(t *testing.T) {
+	a := newACMEState()
+
+	first := a.newNonce()
+	second := a.newNonce()
+
+	if !a.useNonce(first) {
+		t.Error("issued nonce rejected")
+	}
+
+	if a.useNonce(first) {
+		t.Error("reused nonce accepted")
+	}
+
+	if a.useNonce("unknown") {
+		t.Error("unknown nonce accepted")
+	}
+
+	// Once the store is full, the oldest nonce makes room for the newest.
+	for len(a.nonces) < acmeMaxNonces {
+		a.newNonce()
+	}
+
+	third := a.newNonce()
+
+	if a.useNonce(second) {
+		t.Error("evicted nonce accepted")
+	}
+
+	if !a.useNonce(third) {
+		t.Error("newest nonce rejected")
+	}
+}
+
+func TestACMEHandlerNonces(t *testing.T) {
+	s := &Server{acme: newACMEState()}
+
+	tests := []struct {
+		method    string
+		path      string
+		wantNonce bool
+	}{
+		{http.MethodGet, "/acme/directory", false},
+		{http.MethodGet, "/acme/order/unknown", false},
+		{http.MethodHead, "/acme/new-nonce", true},
+		{http.MethodGet, "/acme/new-nonce", true},
+		{http.MethodPost, "/acme/new-order", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.acmeHandler(w, httptest.NewRequest(test.method, test.path, nil))
+
+			nonce := w.Header().Get("Replay-Nonce")
+			if (nonce != "") != test.wantNonce {
+				t.Errorf("Replay-Nonce is %q, want one: %v", nonce, test.wantNonce)
+			}
+		})
+	}
+
+	if len(s.acme.nonces) != 3 {
+		t.Errorf("%d nonces stored, want 3", len(s.acme.nonces))
+	}
+}
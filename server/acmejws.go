@@ -0,0 +1,253 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// ErrJWS is returned when an ACME request isn't a valid JWS.
+var ErrJWS = errors.New("invalid JWS")
+
+// ErrJWSAlgorithm is returned when an ACME request is signed with an
+// unsupported algorithm or key.
+var ErrJWSAlgorithm = errors.New("unsupported JWS algorithm")
+
+// minACMERSABits is the smallest RSA account key accepted.
+const minACMERSABits = 2048
+
+// acmeJWS is the flattened JSON serialization that ACME requests use (RFC
+// 8555 section 6.2).
+type acmeJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type acmeJWSHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+	JWK   json.RawMessage `json:"jwk"`
+	KID   string          `json:"kid"`
+}
+
+// acmeJWK is the subset of RFC 7517 used for account keys.
+type acmeJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// parseACMEJWS decodes a request body, returning the JWS and its protected
+// header.  The signature isn't checked yet.
+func parseACMEJWS(body []byte) (*acmeJWS, *acmeJWSHeader, error) {
+	var jws acmeJWS
+
+	err := json.Unmarshal(body, &jws)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrJWS, err.Error())
+	}
+
+	protected, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: protected header: %s", ErrJWS, err.Error())
+	}
+
+	var header acmeJWSHeader
+
+	err = json.Unmarshal(protected, &header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: protected header: %s", ErrJWS, err.Error())
+	}
+
+	if (len(header.JWK) == 0) == (header.KID == "") {
+		return nil, nil, fmt.Errorf("%w: exactly one of jwk and kid must be set", ErrJWS)
+	}
+
+	return &jws, &header, nil
+}
+
+// payload returns the decoded payload; POST-as-GET requests have an empty
+// one.
+func (jws *acmeJWS) payload() ([]byte, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: payload: %s", ErrJWS, err.Error())
+	}
+
+	return payload, nil
+}
+
+// verify checks the signature with key, which must suit alg.
+func (jws *acmeJWS) verify(alg string, key crypto.PublicKey) error {
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: signature: %s", ErrJWS, err.Error())
+	}
+
+	signingInput := []byte(jws.Protected + "." + jws.Payload)
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		var hashed []byte
+
+		switch {
+		case alg == "ES256" && key.Curve == elliptic.P256():
+			digest := sha256.Sum256(signingInput)
+			hashed = digest[:]
+		case alg == "ES384" && key.Curve == elliptic.P384():
+			digest := sha512.Sum384(signingInput)
+			hashed = digest[:]
+		case alg == "ES512" && key.Curve == elliptic.P521():
+			digest := sha512.Sum512(signingInput)
+			hashed = digest[:]
+		default:
+			return fmt.Errorf("%w: %s with an ECDSA key", ErrJWSAlgorithm, alg)
+		}
+
+		// JWS uses the fixed-size R || S encoding.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("%w: malformed ECDSA signature", ErrJWS)
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		sig := new(big.Int).SetBytes(signature[size:])
+
+		if !ecdsa.Verify(key, hashed, r, sig) {
+			return fmt.Errorf("%w: bad signature", ErrJWS)
+		}
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("%w: %s with an RSA key", ErrJWSAlgorithm, alg)
+		}
+
+		digest := sha256.Sum256(signingInput)
+
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return fmt.Errorf("%w: bad signature", ErrJWS)
+		}
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("%w: %s with an Ed25519 key", ErrJWSAlgorithm, alg)
+		}
+
+		if !ed25519.Verify(key, signingInput, signature) {
+			return fmt.Errorf("%w: bad signature", ErrJWS)
+		}
+	default:
+		return fmt.Errorf("%w: key type %T", ErrJWSAlgorithm, key)
+	}
+
+	return nil
+}
+
+func decodeJWKInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(decoded) == 0 {
+		return nil, fmt.Errorf("%w: malformed key parameter", ErrJWS)
+	}
+
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+// parseJWK returns the public key in raw and its RFC 7638 thumbprint, which
+// identifies the account.
+func parseJWK(raw json.RawMessage) (crypto.PublicKey, string, error) {
+	var jwk acmeJWK
+
+	err := json.Unmarshal(raw, &jwk)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: jwk: %s", ErrJWS, err.Error())
+	}
+
+	// The members that the thumbprint covers, in lexicographic order.
+	// They only contain base64url characters, so %q quotes them as JSON
+	// would.
+	var (
+		key       crypto.PublicKey
+		canonical string
+	)
+
+	switch jwk.Kty {
+	case "EC":
+		var curve elliptic.Curve
+
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, "", fmt.Errorf("%w: curve %q", ErrJWSAlgorithm, jwk.Crv)
+		}
+
+		x, err := decodeJWKInt(jwk.X)
+		if err != nil {
+			return nil, "", err
+		}
+
+		y, err := decodeJWKInt(jwk.Y)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, "", fmt.Errorf("%w: point isn't on the curve", ErrJWS)
+		}
+
+		key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk.Crv, jwk.X, jwk.Y)
+	case "RSA":
+		n, err := decodeJWKInt(jwk.N)
+		if err != nil {
+			return nil, "", err
+		}
+
+		e, err := decodeJWKInt(jwk.E)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if n.BitLen() < minACMERSABits || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, "", fmt.Errorf("%w: RSA keys must have at least %d bits", ErrJWSAlgorithm, minACMERSABits)
+		}
+
+		key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, "", fmt.Errorf("%w: curve %q", ErrJWSAlgorithm, jwk.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, "", fmt.Errorf("%w: malformed Ed25519 key", ErrJWS)
+		}
+
+		key = ed25519.PublicKey(x)
+		canonical = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":%q}`, jwk.X)
+	default:
+		return nil, "", fmt.Errorf("%w: key type %q", ErrJWSAlgorithm, jwk.Kty)
+	}
+
+	thumbprint := sha256.Sum256([]byte(canonical))
+
+	return key, base64.RawURLEncoding.EncodeToString(thumbprint[:]), nil
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseJWKThumbprint(t *testing.T) {
+	tests := []struct {
+		name string
+		jwk  string
+		want string
+	}{
+		{
+			// RFC 7638 section 3.1
+			name: "RSA",
+			jwk: `{"kty":"RSA","e":"AQAB","alg":"RS256","kid":"2011-04-29","n":"` +
+				`0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjB` +
+				`ZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8` +
+				`KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_` +
+				`xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw"}`,
+			want: "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		},
+		{
+			// RFC 8037 appendix A.3
+			name: "Ed25519",
+			jwk:  `{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`,
+			want: "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, thumbprint, err := parseJWK(json.RawMessage(test.jwk))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if thumbprint != test.want {
+				t.Errorf("thumbprint is %s, want %s", thumbprint, test.want)
+			}
+		})
+	}
+}
+
+func TestParseJWKRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		jwk  string
+		want error
+	}{
+		{"malformed", `{"kty":`, ErrJWS},
+		{"unknown key type", `{"kty":"oct","k":"AAAA"}`, ErrJWSAlgorithm},
+		{"unknown curve", `{"kty":"EC","crv":"P-192","x":"AQ","y":"AQ"}`, ErrJWSAlgorithm},
+		{"point not on curve", `{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}`, ErrJWS},
+		{"short RSA key", `{"kty":"RSA","e":"AQAB","n":"AQAB"}`, ErrJWSAlgorithm},
+		{"short Ed25519 key", `{"kty":"OKP","crv":"Ed25519","x":"AQAB"}`, ErrJWS},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := parseJWK(json.RawMessage(test.jwk))
+			if !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// signTestJWS returns a JWS of payload signed with key using alg.
+func signTestJWS(t *testing.T, alg string, key crypto.Signer, payload string) *acmeJWS {
+	t.Helper()
+
+	jws := &acmeJWS{
+		Protected: base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `"}`)),
+		Payload:   base64.RawURLEncoding.EncodeToString([]byte(payload)),
+	}
+	signingInput := []byte(jws.Protected + "." + jws.Payload)
+
+	var (
+		signature []byte
+		err       error
+	)
+
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(signingInput)
+
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(signingInput)
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, signingInput)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws.Signature = base64.RawURLEncoding.EncodeToString(signature)
+
+	return jws
+}
+
+func TestACMEJWSVerify(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherECKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := func(jws *acmeJWS) {
+		jws.Payload = base64.RawURLEncoding.EncodeToString([]byte("{}"))
+	}
+
+	tests := []struct {
+		name      string
+		signAlg   string
+		signKey   crypto.Signer
+		verifyAlg string
+		verifyKey crypto.PublicKey
+		modify    func(*acmeJWS)
+		want      error
+	}{
+		{"ES256", "ES256", ecKey, "ES256", ecKey.Public(), nil, nil},
+		{"RS256", "RS256", rsaKey, "RS256", rsaKey.Public(), nil, nil},
+		{"EdDSA", "EdDSA", edKey, "EdDSA", edKey.Public(), nil, nil},
+		{"ES256 tampered", "ES256", ecKey, "ES256", ecKey.Public(), tamper, ErrJWS},
+		{"RS256 tampered", "RS256", rsaKey, "RS256", rsaKey.Public(), tamper, ErrJWS},
+		{"EdDSA tampered", "EdDSA", edKey, "EdDSA", edKey.Public(), tamper, ErrJWS},
+		{"wrong key", "ES256", ecKey, "ES256", otherECKey.Public(), nil, ErrJWS},
+		{"ES384 with a P-256 key", "ES256", ecKey, "ES384", ecKey.Public(), nil, ErrJWSAlgorithm},
+		{"ES256 with an RSA key", "RS256", rsaKey, "ES256", rsaKey.Public(), nil, ErrJWSAlgorithm},
+		{"none", "EdDSA", edKey, "none", edKey.Public(), nil, ErrJWSAlgorithm},
+		{"truncated ECDSA signature", "ES256", ecKey, "ES256", ecKey.Public(), func(jws *acmeJWS) {
+			jws.Signature = jws.Signature[:40]
+		}, ErrJWS},
+		{"signature not base64url", "ES256", ecKey, "ES256", ecKey.Public(), func(jws *acmeJWS) {
+			jws.Signature = "!"
+		}, ErrJWS},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jws := signTestJWS(t, test.signAlg, test.signKey, `{"identifiers":[]}`)
+			if test.modify != nil {
+				test.modify(jws)
+			}
+
+			err := jws.verify(test.verifyAlg, test.verifyKey)
+			if test.want == nil && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/activation"
+)
+
+// Socket names (FileDescriptorName= in the .socket unit) that are served
+// over TLS.  All other activated sockets are served as plain HTTP, except for
+// the one named activationGRPCName.
+var activationTLSNames = []string{"https", "tls"}
+
+// activationGRPCName is the socket name that serves the gRPC API.
+const activationGRPCName = "grpc"
+
+// loadActivatedListeners takes over the sockets passed by systemd, if any.
+// When encaya is socket-activated, systemd binds the ports (so encaya needs
+// neither root nor CAP_NET_BIND_SERVICE), and ListenIP is ignored.
+func (s *Server) loadActivatedListeners() error {
+	listeners, err := activation.ListenersWithNames()
+	if err != nil {
+		return err
+	}
+
+	for name, namedListeners := range listeners {
+		isTLS := false
+
+		for _, tlsName := range activationTLSNames {
+			if strings.EqualFold(name, tlsName) {
+				isTLS = true
+			}
+		}
+
+		for _, listener := range namedListeners {
+			if listener == nil {
+				// Not a stream socket
+				continue
+			}
+
+			switch {
+			case strings.EqualFold(name, activationGRPCName):
+				s.listeners.grpc = append(s.listeners.grpc, listener)
+			case isTLS:
+				s.listeners.tls = append(s.listeners.tls, listener)
+			default:
+				s.listeners.http = append(s.listeners.http, listener)
+			}
+		}
+	}
+
+	if len(s.listeners.http) > 0 || len(s.listeners.tls) > 0 || len(s.listeners.grpc) > 0 {
+		s.activated = true
+
+		log.Infof("Using %d HTTP, %d HTTPS and %d gRPC sockets from systemd",
+			len(s.listeners.http), len(s.listeners.tls), len(s.listeners.grpc))
+	}
+
+	return nil
+}
+
+// socketActivated reports whether systemd passed us any sockets.
+func (s *Server) socketActivated() bool {
+	return s.activated
+}
+
+// servesTLS reports whether there are any HTTPS (or HTTP/3, or gRPC over
+// TLS) listeners.
+func (s *Server) servesTLS() bool {
+	return len(s.listeners.tls) > 0 || len(s.listeners.http3) > 0 || (len(s.listeners.grpc) > 0 && s.cfg.GRPCTLS)
+}
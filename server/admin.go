@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Cache kinds accepted by /admin/cache/flush.
+const (
+	cacheKindDomain   = "domain"
+	cacheKindNegative = "negative"
+	cacheKindOriginal = "original"
+)
+
+// adminCache is a certificate cache that the admin endpoints can inspect and
+// flush, with the store bucket backing it, if any.
+type adminCache struct {
+	cache  *certCache
+	bucket []byte
+
+	// Reports whether an (unisolated) cache key belongs to the key
+	// parameter of a flush request
+	match func(name, key string) bool
+}
+
+func (s *Server) adminCaches() map[string]adminCache {
+	exact := func(name, key string) bool {
+		return name == key
+	}
+
+	return map[string]adminCache{
+		cacheKindDomain:   {cache: s.domainCertCache, match: matchDomainCacheKey},
+		cacheKindNegative: {cache: s.negativeCertCache, bucket: storeBucketNegative, match: exact},
+		cacheKindOriginal: {cache: s.originalCertCache, bucket: storeBucketOriginal, match: exact},
+	}
+}
+
+// splitIsolatedKey reverses isolatedKey.
+func splitIsolatedKey(key string) (string, string) {
+	i := strings.IndexByte(key, 0)
+	if i < 0 {
+		return "", key
+	}
+
+	return key[:i], key[i+1:]
+}
+
+// matchDomainCacheKey reports whether a domain cert cache key (the TLSA
+// owner name, e.g. _443._tcp.example.bit) is for domain, on any service.
+func matchDomainCacheKey(name, domain string) bool {
+	parts := strings.SplitN(strings.TrimSuffix(name, wildcardCacheKeySuffix), ".", 3)
+
+	return len(parts) == 3 && strings.EqualFold(parts[2], strings.TrimSuffix(domain, "."))
+}
+
+// cacheStatsHandler reports the size, limits and entries of each cache.
+// Isolation keys are credentials of the client's Tor streams, so only
+// whether an entry is isolated is reported.
+func (s *Server) cacheStatsHandler(w http.ResponseWriter, req *http.Request) {
+	results := map[string]certCacheStats{}
+
+	for kind, cache := range s.adminCaches() {
+		stats := cache.cache.stats()
+
+		for i := range stats.Keys {
+			isolation, name := splitIsolatedKey(stats.Keys[i].Key)
+			stats.Keys[i].Key = name
+			stats.Keys[i].Isolated = isolation != ""
+		}
+
+		results[kind] = stats
+	}
+
+	writeJSON(w, results)
+}
+
+// cacheFlushHandler removes the entries of one cache (and the store bucket
+// backing it), or only those for key, for all isolation keys.  For the
+// domain cache, key is a domain name and its certs for every service are
+// removed, along with its cached DNS answers; for the others, it's the name
+// reported by /admin/cache/stats.
+func (s *Server) cacheFlushHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "use POST")
+
+		return
+	}
+
+	kind := req.FormValue("kind")
+
+	cache, ok := s.adminCaches()[kind]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "kind must be domain, negative or original")
+
+		return
+	}
+
+	key := req.FormValue("key")
+	match := func(isolatedKey string) bool {
+		_, name := splitIsolatedKey(isolatedKey)
+
+		return key == "" || cache.match(name, key)
+	}
+
+	removed := cache.cache.removeMatching(match)
+
+	dnsRemoved := 0
+
+	if kind == cacheKindDomain {
+		// Otherwise the certs would be reissued from the same
+		// records until their TTL runs out.
+		dnsRemoved = s.dnsCache.removeMatching(func(isolatedKey string) bool {
+			_, qname := splitIsolatedKey(isolatedKey)
+			qname = strings.TrimSuffix(qname, ".")
+
+			if strings.HasPrefix(qname, "*.") {
+				return key == "" || strings.EqualFold(qname[2:], strings.TrimSuffix(key, "."))
+			}
+
+			return key == "" || matchDomainCacheKey(qname, key)
+		})
+	}
+
+	storeRemoved := 0
+
+	if cache.bucket != nil && s.store != nil {
+		var err error
+
+		storeRemoved, err = s.store.deleteMatching(cache.bucket, match)
+		if err != nil {
+			log.Warne(err, "Unable to remove flushed certs from store")
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "unable to remove flushed certs from store")
+
+			return
+		}
+	}
+
+	log.Infof("Flushed %d %s cache entries, %d stored certs and %d DNS answers (key %q)",
+		removed, kind, storeRemoved, dnsRemoved, key)
+
+	writeJSON(w, map[string]int{
+		"removed":       removed,
+		"store_removed": storeRemoved,
+		"dns_removed":   dnsRemoved,
+	})
+}
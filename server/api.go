@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CertResult is a cert returned by LookupCerts.
+type CertResult struct {
+	Cert *x509.Certificate
+	PEM  string
+
+	// The TLSA record the cert was derived from, if any
+	TLSA *dns.TLSA
+
+	// Source is one of "root", "tld", "dns" (generated for this call) or
+	// "cache".
+	Source string
+
+	// When a cached cert expires from the cache; zero unless Source is
+	// "cache"
+	CachedUntil time.Time
+}
+
+// LookupOptions modify a LookupCerts call.  The zero value looks up the
+// default service (port 443 over TCP) on the shared stream.
+type LookupOptions struct {
+	// Port and Protocol select the TLSA records' service.
+	Port     int
+	Protocol string
+
+	// Isolation is the stream isolation key; see the isolation parameter
+	// of /lookup.
+	Isolation string
+
+	// Candidates are matched against hashed TLSA records.
+	Candidates []*x509.Certificate
+
+	// Wildcard asks for certs that also cover *.domain, if the domain's
+	// records apply to its subdomains.
+	Wildcard bool
+}
+
+// apiCall prepares ctx for a call into the library API the way serveLocked
+// does for HTTP requests: the caller must hold the read side of reloadMutex
+// and call the returned cancel function when done.
+func (s *Server) apiCall(ctx context.Context, method string) (context.Context, context.CancelFunc) {
+	ctx = withAuditRequest(ctx, "", method)
+
+	if s.requestTimeout != 0 {
+		return context.WithTimeout(ctx, s.requestTimeout)
+	}
+
+	return ctx, func() {}
+}
+
+// LookupCerts returns the certs that /lookup would return for domain.  Like
+// the other exported methods, it can be called without Start, so that a
+// program can use encaya's logic in-process without the HTTP round trip.
+// The errors are ErrInvalidService, ErrPolicyDenied, and DNS failures.
+func (s *Server) LookupCerts(ctx context.Context, domain string, opts *LookupOptions) ([]CertResult, error) {
+	if opts == nil {
+		opts = &LookupOptions{}
+	}
+
+	service, err := tlsaServiceName(opts.Port, opts.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+
+	ctx, cancel := s.apiCall(ctx, "LookupCerts")
+	defer cancel()
+
+	certs, err := s.lookup(ctx, domain, service, opts.Isolation, opts.Candidates, opts.Wildcard)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]CertResult, 0, len(certs))
+
+	for _, cert := range certs {
+		parsed, err := x509.ParseCertificate(cert.DER)
+		if err != nil {
+			log.Debuge(err, "Unable to parse looked up cert")
+
+			continue
+		}
+
+		result := CertResult{
+			Cert:   parsed,
+			PEM:    cert.PEM,
+			TLSA:   cert.tlsa,
+			Source: cert.Source,
+		}
+
+		if cert.CachedUntil != nil {
+			result.CachedUntil = *cert.CachedUntil
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// CrossSign cross-signs toSignPEM (a CA cert, or a CSR from which one is
+// built) with the given signer, like /cross-sign-ca, returning the PEM
+// result.  The original can then be looked up like one cross-signed over
+// HTTP.  The errors are ErrNoPEM, ErrInvalidPEM, ErrInvalidKey, ErrInvalidCSR
+// and signing failures.
+func (s *Server) CrossSign(ctx context.Context, toSignPEM, signerCertPEM, signerKeyPEM,
+	isolation string) (string, error) {
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+
+	ctx, cancel := s.apiCall(ctx, "CrossSign")
+	defer cancel()
+
+	return s.crossSignCA(ctx, toSignPEM, signerCertPEM, signerKeyPEM, isolation)
+}
+
+// NegativeCA generates a TLD exclusion CA for tld (or the first configured
+// TLD if it's empty), like /get-new-negative-ca, returning its PEM cert and
+// private key.  ErrNotFound is returned if we don't issue certs for tld.
+func (s *Server) NegativeCA(tld string) (certPEM, keyPEM string, err error) {
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+
+	return s.newNegativeCA(tld)
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Audit log event types.
+const (
+	auditIssueDomainCert = "issue-domain-cert"
+	auditCrossSignCA     = "cross-sign-ca"
+	auditIssueACMECert   = "issue-acme-cert"
+)
+
+// auditEvent is one line of the audit log.
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Client    string    `json:"client,omitempty"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+
+	Domain  string `json:"domain,omitempty"`
+	Service string `json:"service,omitempty"`
+	TLSA    string `json:"tlsa,omitempty"`
+
+	Issuer    string     `json:"issuer,omitempty"`
+	Subject   string     `json:"subject,omitempty"`
+	Serial    string     `json:"serial,omitempty"`
+	SHA256    string     `json:"sha256,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+
+	// Time without the monotonic clock reading stripped by UTC
+	start time.Time
+}
+
+// auditRequest identifies who asked for an issuance.  It's attached to the
+// request context by serveLocked and grpcInterceptor.
+type auditRequest struct {
+	client   string
+	endpoint string
+}
+
+type auditRequestKey struct{}
+
+func withAuditRequest(ctx context.Context, client, endpoint string) context.Context {
+	return context.WithValue(ctx, auditRequestKey{}, auditRequest{client: client, endpoint: endpoint})
+}
+
+// newAuditEvent starts an event of the given type for the request in ctx.
+func newAuditEvent(ctx context.Context, event string, start time.Time) auditEvent {
+	request, _ := ctx.Value(auditRequestKey{}).(auditRequest)
+
+	return auditEvent{
+		Time:      start.UTC(),
+		Event:     event,
+		Client:    request.client,
+		Endpoint:  request.endpoint,
+		RequestID: requestIDFromContext(ctx),
+		start:     start,
+	}
+}
+
+// setCert fills in the fields describing an issued cert.
+func (e *auditEvent) setCert(der []byte) {
+	fingerprint := sha256.Sum256(der)
+	e.SHA256 = hex.EncodeToString(fingerprint[:])
+
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+
+	e.Issuer = parsed.Issuer.String()
+	e.Subject = parsed.Subject.String()
+	e.Serial = parsed.SerialNumber.String()
+	e.NotBefore = &parsed.NotBefore
+	e.NotAfter = &parsed.NotAfter
+}
+
+// setTLSA records the TLSA record a cert was issued for, in presentation
+// format without the owner name and TTL.
+func (e *auditEvent) setTLSA(tlsa *dns.TLSA) {
+	e.TLSA = fmt.Sprintf("%d %d %d %s", tlsa.Usage, tlsa.Selector, tlsa.MatchingType, tlsa.Certificate)
+}
+
+// finish records how long the event took and whether it failed.
+func (e *auditEvent) finish(err error) {
+	e.DurationMS = float64(time.Since(e.start).Microseconds()) / 1000
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+}
+
+// auditLog appends issuance events to a file as JSON lines, for
+// reconstructing after an incident what was issued to whom.  The file is
+// rotated when it reaches maxSize bytes, keeping maxBackups old files named
+// path.1 (the newest) to path.N.
+type auditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openAuditLog(path string, maxSize int64, maxBackups int) (*auditLog, error) {
+	l := &auditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+
+	return nil
+}
+
+// rotateLocked shifts path.N-1 to path.N and so on, moves the current file
+// to path.1 and starts a new one.
+func (l *auditLog) rotateLocked() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if l.maxBackups == 0 {
+		err = os.Remove(l.path)
+		if err != nil {
+			return err
+		}
+
+		return l.open()
+	}
+
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err = os.Rename(l.path, l.path+".1")
+	if err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+func (l *auditLog) write(event auditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		// A previous rotation failed; try again.
+		err = l.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err = l.rotateLocked()
+		if err != nil {
+			l.file = nil
+
+			return fmt.Errorf("unable to rotate: %w", err)
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+
+	return err
+}
+
+func (l *auditLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+// audit writes event to the audit log, if enabled.  Failing to write it is
+// logged but doesn't fail the issuance.
+func (s *Server) audit(event auditEvent) {
+	if s.auditLog == nil {
+		return
+	}
+
+	err := s.auditLog.write(event)
+	if err != nil {
+		log.Errore(err, "Unable to write audit log")
+	}
+}
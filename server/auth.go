@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardingHeaders are the headers that reverse proxies add to name the
+// client they forward a request for.
+var forwardingHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Real-Ip"}
+
+// isLocalRequest reports whether req came from a loopback address or over
+// the Unix socket (whose access is controlled by file permissions).  A
+// reverse proxy on the same host makes every client look local, so requests
+// from TrustedProxies, or that were forwarded for another client, aren't.
+func (s *Server) isLocalRequest(req *http.Request) bool {
+	for _, header := range forwardingHeaders {
+		if req.Header.Get(header) != "" {
+			return false
+		}
+	}
+
+	return s.isLocalAddr(req.RemoteAddr)
+}
+
+// isLocalAddr reports whether a client address is a loopback or Unix socket
+// address, and not that of a trusted proxy.
+func (s *Server) isLocalAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Unix socket clients have no host:port address.
+		return addr == "" || addr == "@"
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback() && !s.isTrustedProxy(ip)
+}
+
+// requireKeyAccess wraps a handler that generates or accepts CA private keys,
+// enforcing the KeyEndpoints* access controls.
+func (s *Server) requireKeyAccess(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "use POST")
+
+			return
+		}
+
+		if !s.cfg.KeyEndpointsAllowRemote && !s.isLocalRequest(req) {
+			writeError(w, http.StatusForbidden, errCodeForbidden, "key endpoints are only available to local clients")
+
+			return
+		}
+
+		if s.cfg.KeyEndpointsToken != "" {
+			token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.KeyEndpointsToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "invalid bearer token")
+
+				return
+			}
+		}
+
+		if s.cfg.KeyEndpointsClientCA != "" {
+			if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+				writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "client certificate required")
+
+				return
+			}
+		}
+
+		handler(w, req)
+	}
+}
+
+// requireAdminAccess wraps an /admin/ handler, enforcing the AdminEndpoints*
+// access controls.
+func (s *Server) requireAdminAccess(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !s.cfg.AdminEndpointsAllowRemote && !s.isLocalRequest(req) {
+			writeError(w, http.StatusForbidden, errCodeForbidden, "admin endpoints are only available to local clients")
+
+			return
+		}
+
+		if s.cfg.AdminEndpointsToken != "" {
+			token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminEndpointsToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "invalid bearer token")
+
+				return
+			}
+		}
+
+		handler(w, req)
+	}
+}
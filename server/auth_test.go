@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireKeyAccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        Config
+		proxies    string
+		method     string
+		remoteAddr string
+		header     http.Header
+		tls        *tls.ConnectionState
+		want       int
+	}{
+		{
+			name:       "local",
+			remoteAddr: "127.0.0.1:1234",
+			want:       http.StatusOK,
+		},
+		{
+			name:       "local over IPv6",
+			remoteAddr: "[::1]:1234",
+			want:       http.StatusOK,
+		},
+		{
+			name:       "Unix socket",
+			remoteAddr: "@",
+			want:       http.StatusOK,
+		},
+		{
+			name:       "GET",
+			method:     http.MethodGet,
+			remoteAddr: "127.0.0.1:1234",
+			want:       http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "remote",
+			remoteAddr: "192.0.2.1:1234",
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "remote allowed",
+			cfg:        Config{KeyEndpointsAllowRemote: true},
+			remoteAddr: "192.0.2.1:1234",
+			want:       http.StatusOK,
+		},
+		{
+			name:       "forwarded by a local proxy",
+			remoteAddr: "127.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"192.0.2.1"}},
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "Forwarded header",
+			remoteAddr: "127.0.0.1:1234",
+			header:     http.Header{"Forwarded": {"for=192.0.2.1"}},
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "trusted proxy",
+			proxies:    "127.0.0.1/32",
+			remoteAddr: "127.0.0.1:1234",
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "token",
+			cfg:        Config{KeyEndpointsToken: "secret"},
+			remoteAddr: "127.0.0.1:1234",
+			header:     http.Header{"Authorization": {"Bearer secret"}},
+			want:       http.StatusOK,
+		},
+		{
+			name:       "wrong token",
+			cfg:        Config{KeyEndpointsToken: "secret"},
+			remoteAddr: "127.0.0.1:1234",
+			header:     http.Header{"Authorization": {"Bearer guess"}},
+			want:       http.StatusUnauthorized,
+		},
+		{
+			name:       "missing token",
+			cfg:        Config{KeyEndpointsToken: "secret"},
+			remoteAddr: "127.0.0.1:1234",
+			want:       http.StatusUnauthorized,
+		},
+		{
+			name:       "client cert",
+			cfg:        Config{KeyEndpointsClientCA: "client-ca.pem"},
+			remoteAddr: "127.0.0.1:1234",
+			tls:        &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}},
+			want:       http.StatusOK,
+		},
+		{
+			name:       "missing client cert",
+			cfg:        Config{KeyEndpointsClientCA: "client-ca.pem"},
+			remoteAddr: "127.0.0.1:1234",
+			tls:        &tls.ConnectionState{},
+			want:       http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{cfg: test.cfg}
+
+			var err error
+
+			s.trustedProxies, err = parseTrustedProxies(test.proxies)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler := s.requireKeyAccess(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+
+			req := httptest.NewRequest(method, "/get-new-negative-ca", nil)
+			req.RemoteAddr = test.remoteAddr
+			req.TLS = test.tls
+
+			for name, values := range test.header {
+				req.Header[name] = values
+			}
+
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			if w.Code != test.want {
+				t.Errorf("status %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// certCache is a bounded LRU cache mapping a name to a list of certs.  Each
+// cert may have an expiration; expired certs are evicted by a single timer
+// driven by a min-heap of expirations, rather than by a goroutine per cert.
+// A zero expiration means the cert never expires (but can still be evicted
+// when the cache is full).
+type certCache struct {
+	mu sync.Mutex
+
+	maxEntries int
+	maxBytes   int
+	bytes      int
+
+	// Front is most recently used
+	lru     *list.List
+	entries map[string]*list.Element
+
+	expiry expiryHeap
+	timer  *time.Timer
+}
+
+type certCacheEntry struct {
+	key   string
+	certs []cachedCert
+	size  int
+}
+
+type expiryItem struct {
+	expiration time.Time
+	key        string
+}
+
+// expiryHeap implements heap.Interface, ordered by expiration.
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiration.Before(h[j].expiration) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiryItem))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+
+	return item
+}
+
+func newCertCache(maxEntries, maxBytes int) *certCache {
+	return &certCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+func (cert *cachedCert) size() int {
+	size := len(cert.certPem) + len(cert.certDer)
+	if cert.tlsa != nil {
+		size += len(cert.tlsa.Certificate)
+	}
+
+	return size
+}
+
+// get returns a copy of the unexpired certs cached for key, and marks key as
+// recently used.
+func (c *certCache) get(key string) []cachedCert {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	c.lru.MoveToFront(element)
+
+	entry := element.Value.(*certCacheEntry)
+	now := time.Now()
+	results := make([]cachedCert, 0, len(entry.certs))
+
+	for _, cert := range entry.certs {
+		// The timer may not have fired yet.
+		if !cert.expiration.IsZero() && !cert.expiration.After(now) {
+			continue
+		}
+
+		results = append(results, cert)
+	}
+
+	return results
+}
+
+// latestExpiration returns the latest expiration of the certs cached for
+// key, without marking key as recently used.  It returns false if nothing
+// expiring is cached.
+func (c *certCache) latestExpiration(key string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	var latest time.Time
+
+	for _, cert := range element.Value.(*certCacheEntry).certs {
+		if cert.expiration.After(latest) {
+			latest = cert.expiration
+		}
+	}
+
+	return latest, !latest.IsZero()
+}
+
+// add appends cert to the certs cached for key, evicting least recently used
+// entries if the cache is over its limits.
+func (c *certCache) add(key string, cert cachedCert) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entry *certCacheEntry
+
+	element, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(element)
+		entry = element.Value.(*certCacheEntry)
+	} else {
+		entry = &certCacheEntry{
+			key:  key,
+			size: len(key),
+		}
+		c.entries[key] = c.lru.PushFront(entry)
+		c.bytes += entry.size
+	}
+
+	cert.added = time.Now()
+	entry.certs = append(entry.certs, cert)
+	entry.size += cert.size()
+	c.bytes += cert.size()
+
+	if !cert.expiration.IsZero() {
+		heap.Push(&c.expiry, expiryItem{
+			expiration: cert.expiration,
+			key:        key,
+		})
+		c.scheduleLocked()
+	}
+
+	c.enforceLimitsLocked()
+}
+
+func (c *certCache) removeLocked(element *list.Element) {
+	entry := element.Value.(*certCacheEntry)
+
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+func (c *certCache) enforceLimitsLocked() {
+	for c.lru.Len() > 0 {
+		overEntries := c.maxEntries > 0 && c.lru.Len() > c.maxEntries
+		overBytes := c.maxBytes > 0 && c.bytes > c.maxBytes
+
+		if !overEntries && !overBytes {
+			return
+		}
+
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// scheduleLocked arms the eviction timer for the earliest expiration.
+func (c *certCache) scheduleLocked() {
+	if len(c.expiry) == 0 {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+
+		return
+	}
+
+	delay := time.Until(c.expiry[0].expiration)
+
+	if c.timer == nil {
+		c.timer = time.AfterFunc(delay, c.evictExpired)
+	} else {
+		c.timer.Reset(delay)
+	}
+}
+
+func (c *certCache) evictExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	for len(c.expiry) > 0 && !c.expiry[0].expiration.After(now) {
+		item := heap.Pop(&c.expiry).(expiryItem)
+
+		// The entry may already have been evicted by the LRU policy.
+		element, ok := c.entries[item.key]
+		if !ok {
+			continue
+		}
+
+		entry := element.Value.(*certCacheEntry)
+		kept := entry.certs[:0]
+
+		for _, cert := range entry.certs {
+			if !cert.expiration.IsZero() && !cert.expiration.After(now) {
+				entry.size -= cert.size()
+				c.bytes -= cert.size()
+
+				continue
+			}
+
+			kept = append(kept, cert)
+		}
+
+		entry.certs = kept
+
+		if len(entry.certs) == 0 {
+			c.removeLocked(element)
+		}
+	}
+
+	c.scheduleLocked()
+}
+
+// flush removes all certs from the cache.
+func (c *certCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+	c.bytes = 0
+	c.expiry = nil
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// removeMatching removes the entries whose key match selects, returning how
+// many were removed.  Their pending expirations are skipped when they come
+// due, like those of entries evicted by the LRU policy.
+func (c *certCache) removeMatching(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+
+	for key, element := range c.entries {
+		if match(key) {
+			c.removeLocked(element)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// certCacheStats describes the contents of a certCache.
+type certCacheStats struct {
+	Entries    int `json:"entries"`
+	Bytes      int `json:"bytes"`
+	MaxEntries int `json:"max_entries"`
+	MaxBytes   int `json:"max_bytes"`
+
+	// Most recently used first
+	Keys []certCacheKeyStats `json:"keys"`
+}
+
+type certCacheKeyStats struct {
+	Key      string `json:"key"`
+	Isolated bool   `json:"isolated,omitempty"`
+	Certs    int    `json:"certs"`
+	Bytes    int    `json:"bytes"`
+
+	// Of the oldest cert
+	AgeSeconds int64 `json:"age_seconds"`
+
+	// Of the first cert to expire; omitted if none expire
+	ExpiresInSeconds *int64 `json:"expires_in_seconds,omitempty"`
+}
+
+// stats describes the cache's entries.
+func (c *certCache) stats() certCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	stats := certCacheStats{
+		Entries:    c.lru.Len(),
+		Bytes:      c.bytes,
+		MaxEntries: c.maxEntries,
+		MaxBytes:   c.maxBytes,
+		Keys:       make([]certCacheKeyStats, 0, c.lru.Len()),
+	}
+
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*certCacheEntry)
+		keyStats := certCacheKeyStats{
+			Key:   entry.key,
+			Certs: len(entry.certs),
+			Bytes: entry.size,
+		}
+
+		var oldest, firstExpiration time.Time
+
+		for _, cert := range entry.certs {
+			if oldest.IsZero() || cert.added.Before(oldest) {
+				oldest = cert.added
+			}
+
+			if !cert.expiration.IsZero() && (firstExpiration.IsZero() || cert.expiration.Before(firstExpiration)) {
+				firstExpiration = cert.expiration
+			}
+		}
+
+		if !oldest.IsZero() {
+			keyStats.AgeSeconds = int64(now.Sub(oldest).Seconds())
+		}
+
+		if !firstExpiration.IsZero() {
+			expiresIn := int64(firstExpiration.Sub(now).Seconds())
+			keyStats.ExpiresInSeconds = &expiresIn
+		}
+
+		stats.Keys = append(stats.Keys, keyStats)
+	}
+
+	return stats
+}
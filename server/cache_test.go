@@ -0,0 +1,137 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cacheKeys(c *certCache) []string {
+	keys := []string{}
+
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		keys = append(keys, element.Value.(*certCacheEntry).key)
+	}
+
+	return keys
+}
+
+func TestCertCacheEviction(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int
+		ops        []string // "+key" adds a 10-byte cert, "key" gets it
+		want       []string // most recently used first
+	}{
+		{
+			name:       "least recently added",
+			maxEntries: 2,
+			ops:        []string{"+a", "+b", "+c"},
+			want:       []string{"c", "b"},
+		},
+		{
+			name:       "least recently used",
+			maxEntries: 2,
+			ops:        []string{"+a", "+b", "a", "+c"},
+			want:       []string{"c", "a"},
+		},
+		{
+			name:       "adding to an entry uses it",
+			maxEntries: 2,
+			ops:        []string{"+a", "+b", "+a", "+c"},
+			want:       []string{"c", "a"},
+		},
+		{
+			// Each entry is 1 byte of key plus 10 bytes per cert.
+			name:     "bytes",
+			maxBytes: 25,
+			ops:      []string{"+a", "+b", "+c"},
+			want:     []string{"c", "b"},
+		},
+		{
+			name:     "bytes of several certs",
+			maxBytes: 25,
+			ops:      []string{"+a", "+b", "+b"},
+			want:     []string{"b"},
+		},
+		{
+			name: "unlimited",
+			ops:  []string{"+a", "+b", "+c"},
+			want: []string{"c", "b", "a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := newCertCache(test.maxEntries, test.maxBytes)
+
+			for _, op := range test.ops {
+				if strings.HasPrefix(op, "+") {
+					cache.add(op[1:], cachedCert{certPem: "0123456789"})
+				} else {
+					cache.get(op)
+				}
+			}
+
+			got := cacheKeys(cache)
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("cached %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCertCacheExpiry(t *testing.T) {
+	cache := newCertCache(0, 0)
+	defer cache.flush()
+
+	cache.add("a", cachedCert{certPem: "expired", expiration: time.Now().Add(-time.Second)})
+	cache.add("a", cachedCert{certPem: "current", expiration: time.Now().Add(time.Hour)})
+	cache.add("a", cachedCert{certPem: "permanent"})
+
+	// get skips expired certs even before the timer has evicted them.
+	certs := cache.get("a")
+
+	got := []string{}
+	for _, cert := range certs {
+		got = append(got, cert.certPem)
+	}
+
+	sort.Strings(got)
+
+	if strings.Join(got, ",") != "current,permanent" {
+		t.Errorf("got %v, want [current permanent]", got)
+	}
+
+	cache.evictExpired()
+
+	stats := cache.stats()
+	if stats.Entries != 1 || stats.Keys[0].Certs != 2 {
+		t.Errorf("got %d entries with %d certs after evicting, want 1 with 2", stats.Entries, stats.Keys[0].Certs)
+	}
+
+	if stats.Bytes != len("a")+len("current")+len("permanent") {
+		t.Errorf("got %d bytes after evicting, want %d", stats.Bytes, len("a")+len("current")+len("permanent"))
+	}
+}
+
+func TestCertCacheRemoveMatching(t *testing.T) {
+	cache := newCertCache(0, 0)
+
+	for _, key := range []string{"a.bit", "b.bit", "a.bit/isolated"} {
+		cache.add(key, cachedCert{certPem: "cert"})
+	}
+
+	removed := cache.removeMatching(func(key string) bool {
+		return strings.HasPrefix(key, "a.bit")
+	})
+	if removed != 2 {
+		t.Errorf("removed %d entries, want 2", removed)
+	}
+
+	if got := cacheKeys(cache); len(got) != 1 || got[0] != "b.bit" {
+		t.Errorf("cached %v, want [b.bit]", got)
+	}
+}
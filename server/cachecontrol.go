@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxCAResponseAge caps how long clients may cache responses containing the
+// root and TLD CAs.  They're valid for years, but a rotation or reload can
+// change which CAs we return.
+const maxCAResponseAge = 24 * time.Hour
+
+// lookupMaxAge returns how long a /lookup response containing certs may be
+// cached: until the first of the certs expires, and no longer than we cache
+// the TLSA records they were derived from (an empty response included).
+func (s *Server) lookupMaxAge(certs []lookupCert, now time.Time) time.Duration {
+	maxAge := s.domainCacheTTL
+	if len(certs) > 0 && (certs[0].Source == sourceRoot || certs[0].Source == sourceTLD) {
+		maxAge = maxCAResponseAge
+	}
+
+	for _, cert := range certs {
+		bound := cert.NotAfter.Sub(now)
+		if cert.CachedUntil != nil && cert.CachedUntil.Sub(now) < bound {
+			bound = cert.CachedUntil.Sub(now)
+		}
+
+		if bound < maxAge {
+			maxAge = bound
+		}
+	}
+
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	return maxAge
+}
+
+// lookupETag returns a weak entity tag for a /lookup response: it identifies
+// the certs and the format, but not the metadata (like Source) that the JSON
+// format includes.
+func lookupETag(certs []lookupCert, format string) string {
+	hash := sha256.New()
+
+	_, _ = fmt.Fprintf(hash, "%s\n", format)
+
+	for _, cert := range certs {
+		_, _ = hash.Write([]byte(cert.PEM))
+		_, _ = hash.Write([]byte("\n"))
+	}
+
+	return `W/"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// weak comparison (RFC 7232 section 3.2).
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeCacheHeaders sets the caching headers of a /lookup response, and
+// reports whether the client's cached copy is still current, in which case
+// it has already responded with 304 Not Modified.
+func (s *Server) writeCacheHeaders(w http.ResponseWriter, req *http.Request, certs []lookupCert,
+	format string) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Cache-Control", "no-store")
+
+		return false
+	}
+
+	etag := lookupETag(certs, format)
+	maxAge := s.lookupMaxAge(certs, time.Now())
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+	w.Header().Add("Vary", "Accept")
+
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,654 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envPrefix is the prefix of the environment variables LoadConfig reads,
+// e.g. ENCAYA_ROOTCERT.
+const envPrefix = "ENCAYA_"
+
+// defaultConfigFile is the config file in ConfigDir that LoadConfig reads
+// when none is given.
+const defaultConfigFile = "encaya.conf"
+
+var (
+	// ErrConfigOption is returned when a config file, environment
+	// variable or flag sets an option that doesn't exist or has the wrong
+	// type.
+	ErrConfigOption = errors.New("invalid config option")
+
+	// ErrInvalidConfig is returned by Validate.
+	ErrInvalidConfig = errors.New("invalid configuration")
+)
+
+// DefaultConfig returns a Config with every option set to its default.
+func DefaultConfig() Config {
+	cfg := Config{}
+	value := reflect.ValueOf(&cfg).Elem()
+
+	for i := 0; i < value.NumField(); i++ {
+		def, ok := value.Type().Field(i).Tag.Lookup("default")
+		if !ok {
+			continue
+		}
+
+		// The defaults are string literals of the right kind, so this
+		// can't fail.
+		_ = setConfigField(value.Field(i), def)
+	}
+
+	return cfg
+}
+
+// LoadConfig builds a Config from the command-line arguments args, which
+// must all be encaya options (see SplitArgs), and the environment environ.
+// Options are applied in increasing order of precedence:
+//
+//  1. the defaults in the Config struct tags;
+//  2. the TOML config file (-conf, else $ENCAYA_CONF, else encaya.conf in
+//     ConfigDir if it exists), whose "[encaya]" table (or top level) sets
+//     options by name, e.g. rootcert = "root_cert.pem";
+//  3. environment variables named ENCAYA_ followed by the option name,
+//     e.g. ENCAYA_ROOTCERT;
+//  4. command-line flags in args, e.g. -rootcert=root_cert.pem.
+//
+// Option names are case-insensitive, and ENCAYA_ variables that don't name
+// an option (e.g. one holding RootKeyPassphrase) are ignored.  ConfigDir is
+// -configdir, else $ENCAYA_CONFIGDIR, else the directory of the config file
+// named by -conf or $ENCAYA_CONF, else defaultDir (the directory in which
+// easyconfig found its config file).  The result is checked with Validate.
+//
+// A running Server reloads its config (e.g. on SIGHUP) with its LoadConfig
+// method, which reads the same config file without it overriding the
+// environment or command line.
+func LoadConfig(args []string, environ []string, defaultDir string) (*Config, error) {
+	return loadConfig(args, environ, defaultDir, nil, ioutil.ReadFile)
+}
+
+// configSource is where LoadConfig looked for the config file.
+type configSource struct {
+	dir   string
+	path  string
+	named bool // by -conf or $ENCAYA_CONF
+}
+
+// loadConfig is LoadConfig reading the config file with readFile.  If source
+// is set, ConfigDir and the config file are taken from it rather than from
+// args and environ, e.g. to reload the file found at startup.
+func loadConfig(args []string, environ []string, defaultDir string, source *configSource,
+	readFile func(string) ([]byte, error)) (*Config, error) {
+	cfg := DefaultConfig()
+	env := configEnv(environ)
+
+	flagSet, flagValues := newConfigFlagSet()
+
+	err := flagSet.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if flagSet.NArg() != 0 {
+		return nil, fmt.Errorf("%w: unexpected argument %s", ErrConfigOption, flagSet.Arg(0))
+	}
+
+	configPath, explicit := flagValues.conf, flagValues.conf != ""
+	if !explicit {
+		configPath, explicit = env["conf"], env["conf"] != ""
+	}
+
+	configDir := flagValues.configDir
+	if configDir == "" {
+		configDir = env["configdir"]
+	}
+
+	delete(env, "conf")
+	delete(env, "configdir")
+
+	if source == nil {
+		switch {
+		case configDir == "" && explicit:
+			configDir = filepath.Dir(configPath)
+		case configDir == "" && defaultDir != "":
+			configDir = defaultDir
+		case configDir == "":
+			configDir = "."
+		}
+
+		configDir, err = filepath.Abs(configDir)
+		if err != nil {
+			return nil, err
+		}
+
+		if explicit {
+			configPath, err = filepath.Abs(configPath)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			configPath = filepath.Join(configDir, defaultConfigFile)
+		}
+
+		source = &configSource{dir: configDir, path: configPath, named: explicit}
+	}
+
+	cfg.ConfigDir = source.dir
+	cfg.source = *source
+
+	contents, err := readFile(source.path)
+
+	switch {
+	case os.IsNotExist(err) && !source.named:
+		log.Warnf("No config file at %s; using the defaults, environment and command line", source.path)
+	case err != nil:
+		return nil, fmt.Errorf("%s: %w", source.path, err)
+	default:
+		err = cfg.applyConfigFile(contents)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source.path, err)
+		}
+	}
+
+	err = cfg.applyOverrides(env, flagValues.set)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// SplitArgs separates the encaya options in args (including -conf,
+// -configdir and -h), with their values, from the other arguments (e.g. the
+// flags of the service and logging packages), keeping the order of each.
+func SplitArgs(args []string) (own, rest []string) {
+	flagSet, _ := newConfigFlagSet()
+
+	return splitConfigArgs(flagSet, args)
+}
+
+// configEnv returns the values of the ENCAYA_ variables in environ, keyed by
+// the lowercased rest of their names.
+func configEnv(environ []string) map[string]string {
+	env := map[string]string{}
+
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(strings.ToUpper(parts[0]), envPrefix) {
+			continue
+		}
+
+		env[strings.ToLower(strings.TrimPrefix(strings.ToUpper(parts[0]), envPrefix))] = parts[1]
+	}
+
+	return env
+}
+
+// applyOverrides sets the options in env, then those in flags.  Variables in
+// env that don't name an option are ignored.
+func (cfg *Config) applyOverrides(env map[string]string, flags []configFlag) error {
+	value := reflect.ValueOf(cfg).Elem()
+
+	for name, option := range env {
+		if !configField(value, name).IsValid() {
+			log.Debugf("Ignoring environment variable %s%s, which isn't an option",
+				envPrefix, strings.ToUpper(name))
+
+			continue
+		}
+
+		err := cfg.setOption(name, option)
+		if err != nil {
+			return fmt.Errorf("environment: %w", err)
+		}
+	}
+
+	for _, option := range flags {
+		err := cfg.setOption(option.name, option.value)
+		if err != nil {
+			return fmt.Errorf("command line: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// splitConfigArgs separates the flags of flagSet in args, with their values,
+// from the other arguments, keeping the order of each.  The value of another
+// program's flag must be given as -flag=value if it starts with a dash.
+func splitConfigArgs(flagSet *flag.FlagSet, args []string) (own, rest []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			return own, append(rest, args[i:]...)
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if name == arg || name == "" || strings.HasPrefix(name, "-") {
+			rest = append(rest, arg)
+
+			continue
+		}
+
+		name, _, hasValue := strings.Cut(name, "=")
+
+		isBool := name == "h" || name == "help"
+
+		if !isBool {
+			option := flagSet.Lookup(name)
+			if option == nil {
+				rest = append(rest, arg)
+
+				continue
+			}
+
+			boolFlag, ok := option.Value.(interface{ IsBoolFlag() bool })
+			isBool = ok && boolFlag.IsBoolFlag()
+		}
+
+		own = append(own, arg)
+
+		if !hasValue && !isBool && i+1 < len(args) {
+			i++
+			own = append(own, args[i])
+		}
+	}
+
+	return own, rest
+}
+
+// applyConfigFile applies the settings in the TOML config file contents to
+// cfg, leaving settings that the file doesn't mention unchanged.  Like
+// easyconfig, it reads the table named after the program ("[encaya]"), or
+// the top level if there is none, and matches option names
+// case-insensitively.
+func (cfg *Config) applyConfigFile(contents []byte) error {
+	var file map[string]interface{}
+
+	err := toml.Unmarshal(contents, &file)
+	if err != nil {
+		return err
+	}
+
+	if table, ok := file["encaya"].(map[string]interface{}); ok {
+		file = table
+	}
+
+	return cfg.applyOptions(file)
+}
+
+// applyOptions sets the Config fields named (case-insensitively) by the keys
+// of options.
+func (cfg *Config) applyOptions(options map[string]interface{}) error {
+	value := reflect.ValueOf(cfg).Elem()
+
+	for name, option := range options {
+		field := configField(value, name)
+		if !field.IsValid() {
+			return fmt.Errorf("%w: unknown option %s", ErrConfigOption, name)
+		}
+
+		optionValue := reflect.ValueOf(option)
+
+		switch {
+		case optionValue.Type().AssignableTo(field.Type()):
+			field.Set(optionValue)
+		case field.Kind() == reflect.Int && optionValue.Kind() == reflect.Int64:
+			field.SetInt(optionValue.Int())
+		default:
+			return fmt.Errorf("%w: %s must be a %s", ErrConfigOption, name, field.Kind())
+		}
+	}
+
+	return nil
+}
+
+// setOption sets the Config field called name (case-insensitively) from its
+// string representation.
+func (cfg *Config) setOption(name, value string) error {
+	field := configField(reflect.ValueOf(cfg).Elem(), name)
+	if !field.IsValid() {
+		return fmt.Errorf("%w: unknown option %s", ErrConfigOption, name)
+	}
+
+	err := setConfigField(field, value)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrConfigOption, name, err)
+	}
+
+	return nil
+}
+
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported kind %s", field.Kind())
+	}
+
+	return nil
+}
+
+// configField returns the settable Config field called name, ignoring case,
+// or the zero Value if there is none.  ConfigDir decides which config file is
+// read, so it's excluded (it has its own flag and environment variable).
+func configField(value reflect.Value, name string) reflect.Value {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Name == "ConfigDir" || field.PkgPath != "" {
+			continue
+		}
+
+		fieldName := field.Name
+
+		if strings.EqualFold(fieldName, name) {
+			return value.Field(i)
+		}
+	}
+
+	return reflect.Value{}
+}
+
+type configFlag struct {
+	name  string
+	value string
+}
+
+type configFlagValues struct {
+	conf      string
+	configDir string
+	set       []configFlag
+}
+
+// configFlagValue records a flag in the order it was given, so that
+// LoadConfig can apply flags after the config file and environment.
+type configFlagValue struct {
+	name   string
+	isBool bool
+	values *configFlagValues
+}
+
+func (v *configFlagValue) String() string {
+	return ""
+}
+
+func (v *configFlagValue) Set(value string) error {
+	v.values.set = append(v.values.set, configFlag{name: v.name, value: value})
+
+	return nil
+}
+
+func (v *configFlagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+// newConfigFlagSet returns a FlagSet with a flag for each Config option
+// (lowercased), plus -conf for the config file path and -configdir for
+// ConfigDir.
+func newConfigFlagSet() (*flag.FlagSet, *configFlagValues) {
+	values := &configFlagValues{}
+	flagSet := flag.NewFlagSet("encaya", flag.ContinueOnError)
+
+	flagSet.StringVar(&values.conf, "conf", "", "Read options from this TOML config file.")
+	flagSet.StringVar(&values.configDir, "configdir", "",
+		"Resolve relative paths against this directory, and read encaya.conf from it if -conf isn't given.")
+
+	configType := reflect.TypeOf(Config{})
+
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+
+		usage, ok := field.Tag.Lookup("usage")
+		if !ok {
+			continue
+		}
+
+		flagSet.Var(&configFlagValue{
+			name:   field.Name,
+			isBool: field.Type.Kind() == reflect.Bool,
+			values: values,
+		}, strings.ToLower(field.Name), usage)
+	}
+
+	return flagSet, values
+}
+
+// Validate checks cfg for invalid or inconsistent options, and reports all
+// of the problems it finds at once.
+func (cfg *Config) Validate() error {
+	problems := []string{}
+
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(cfg.tldList()) == 0 {
+		problem("TLDs must list at least one TLD")
+	}
+
+	switch strings.ToLower(cfg.DNSTransport) {
+	case transportUDP, transportTCP:
+	case transportTLS, transportHTTPS:
+		if cfg.DNSAddress == "" {
+			problem("DNSTransport %s requires DNSAddress", cfg.DNSTransport)
+		}
+	default:
+		problem("DNSTransport must be udp, tcp, tls or https, not %q", cfg.DNSTransport)
+	}
+
+	if cfg.DNSProxy != "" {
+		if strings.EqualFold(cfg.DNSTransport, transportUDP) || cfg.DNSAddress == "" {
+			problem("DNSProxy requires DNSAddress and the tcp, tls or https transport")
+		}
+
+		_, _, err := net.SplitHostPort(cfg.DNSProxy)
+		if err != nil {
+			problem("DNSProxy must be host:port, not %q", cfg.DNSProxy)
+		}
+	}
+
+	if cfg.DNSRetries < 0 {
+		problem("DNSRetries must not be negative")
+	}
+
+	for _, port := range []struct {
+		name  string
+		value int
+	}{
+		{"DNSPort", cfg.DNSPort},
+		{"ListenPort", cfg.ListenPort},
+		{"ListenTLSPort", cfg.ListenTLSPort},
+	} {
+		if port.value < 1 || port.value > 65535 {
+			problem("%s must be between 1 and 65535, not %d", port.name, port.value)
+		}
+	}
+
+	if cfg.GRPCPort < 0 || cfg.GRPCPort > 65535 {
+		problem("GRPCPort must be 0 or between 1 and 65535, not %d", cfg.GRPCPort)
+	}
+
+	_, err := strconv.ParseUint(cfg.ListenUnixSocketMode, 8, 32)
+	if err != nil {
+		problem("ListenUnixSocketMode must be an octal file mode, not %q", cfg.ListenUnixSocketMode)
+	}
+
+	_, err = parseTLSVersion(cfg.TLSMinVersion)
+	if err != nil {
+		problem("TLSMinVersion must be 1.2 or 1.3, not %q", cfg.TLSMinVersion)
+	}
+
+	_, err = parseCipherSuites(cfg.TLSCipherSuites)
+	if err != nil {
+		problem("TLSCipherSuites: %v", err)
+	}
+
+	_, err = parseCurves(cfg.TLSCurves)
+	if err != nil {
+		problem("TLSCurves: %v", err)
+	}
+
+	if isPKCS11URI(cfg.RootKey) {
+		_, err = parsePKCS11URI(cfg.RootKey)
+		if err != nil {
+			problem("RootKey: %v", err)
+		}
+	}
+
+	err = checkPassphraseSource(cfg.RootKeyPassphrase)
+	if err != nil {
+		problem("RootKeyPassphrase: %v", err)
+	}
+
+	_, err = cfg.issuancePolicy()
+	if err != nil {
+		problem("Issuance policy: %v", err)
+	}
+
+	if cfg.PolicyMaxLabels < 0 {
+		problem("PolicyMaxLabels must not be negative")
+	}
+
+	_, err = cfg.tracingSampleRatio()
+	if err != nil {
+		problem("%v", err)
+	}
+
+	_, err = cfg.trustStoreNames()
+	if err != nil {
+		problem("TrustStores: %v", err)
+	}
+
+	if cfg.UninstallRootCA && cfg.TrustStores == "" {
+		problem("UninstallRootCA requires TrustStores")
+	}
+
+	switch strings.ToLower(cfg.KeyAlgorithm) {
+	case keyAlgorithmECDSA:
+		_, err = cfg.keyCurve()
+		if err != nil {
+			problem("KeyCurve must be P256, P384 or P521, not %q", cfg.KeyCurve)
+		}
+	case keyAlgorithmRSA:
+		if cfg.KeyBits < 2048 {
+			problem("KeyBits must be at least 2048, not %d", cfg.KeyBits)
+		}
+	case keyAlgorithmEd25519:
+	default:
+		problem("KeyAlgorithm must be ecdsa, rsa or ed25519, not %q", cfg.KeyAlgorithm)
+	}
+
+	if cfg.CacheMaxEntries < 0 || cfg.CacheMaxBytes < 0 || cfg.DNSCacheMaxEntries < 0 {
+		problem("CacheMaxEntries, CacheMaxBytes and DNSCacheMaxEntries must not be negative")
+	}
+
+	if cfg.RateLimit < 0 || cfg.MaxConcurrentLookups < 0 || cfg.MaxWatchers < 0 {
+		problem("RateLimit, MaxConcurrentLookups and MaxWatchers must not be negative")
+	}
+
+	if cfg.AuditLogMaxSize < 0 || cfg.AuditLogMaxBackups < 0 || cfg.MaxRequestSize < 0 ||
+		cfg.TransparencyLogMaxEntries < 0 {
+		problem("AuditLogMaxSize, AuditLogMaxBackups, MaxRequestSize and TransparencyLogMaxEntries must not be negative")
+	}
+
+	switch cfg.AccessLogFormat {
+	case accessLogCommon, accessLogCombined, accessLogJSON:
+	default:
+		problem("AccessLogFormat must be common, combined or json, not %q", cfg.AccessLogFormat)
+	}
+
+	if cfg.ACMEURL != "" && !strings.HasPrefix(cfg.ACMEURL, "https://") && !strings.HasPrefix(cfg.ACMEURL, "http://") {
+		problem("ACMEURL must be an http or https URL, not %q", cfg.ACMEURL)
+	}
+
+	if cfg.RateLimit > 0 && cfg.RateLimitBurst < 1 {
+		problem("RateLimitBurst must be at least 1, not %d", cfg.RateLimitBurst)
+	}
+
+	_, err = parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		problem("TrustedProxies: %v", err)
+	}
+
+	// Optional durations may be left empty.
+	for _, option := range []struct {
+		name     string
+		value    string
+		optional bool
+	}{
+		{"RotationOverlap", cfg.RotationOverlap, false},
+		{"CRLValidity", cfg.CRLValidity, false},
+		{"DomainCacheTTL", cfg.DomainCacheTTL, false},
+		{"ListenCertValidity", cfg.ListenCertValidity, false},
+		{"DomainCertValidity", cfg.DomainCertValidity, true},
+		{"ListenCertRenew", cfg.ListenCertRenew, true},
+		{"RequestTimeout", cfg.RequestTimeout, true},
+		{"DNSTimeout", cfg.DNSTimeout, true},
+		{"WatchInterval", cfg.WatchInterval, false},
+		{"TLSSessionTicketRotation", cfg.TLSSessionTicketRotation, true},
+		{"DNSCacheMaxTTL", cfg.DNSCacheMaxTTL, true},
+		{"CacheRefreshWindow", cfg.CacheRefreshWindow, true},
+		{"CacheRefreshIdle", cfg.CacheRefreshIdle, false},
+	} {
+		if option.optional && option.value == "" {
+			continue
+		}
+
+		duration, err := time.ParseDuration(option.value)
+		if err != nil || duration <= 0 {
+			problem("%s must be a positive duration such as 720h, not %q", option.name, option.value)
+		}
+	}
+
+	_, _, err = cfg.listenCertNames()
+	if err != nil {
+		problem("ListenCertNames: %v", err)
+	}
+
+	if checkSerialBits(cfg.SerialBits) != nil {
+		problem("SerialBits must be between %d and %d, not %d", minSerialBits, maxSerialBits, cfg.SerialBits)
+	}
+
+	if cfg.DomainCertSerialBits != 0 && checkSerialBits(cfg.DomainCertSerialBits) != nil {
+		problem("DomainCertSerialBits must be 0 or between %d and %d, not %d",
+			minSerialBits, maxSerialBits, cfg.DomainCertSerialBits)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(problems, "; "))
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   []string // substrings of the error; none if valid
+	}{
+		{
+			name:   "defaults",
+			modify: func(cfg *Config) {},
+		},
+		{
+			name:   "no TLDs",
+			modify: func(cfg *Config) { cfg.TLDs = "" },
+			want:   []string{"TLDs must list at least one TLD"},
+		},
+		{
+			name:   "unknown DNS transport",
+			modify: func(cfg *Config) { cfg.DNSTransport = "quic" },
+			want:   []string{`DNSTransport must be udp, tcp, tls or https, not "quic"`},
+		},
+		{
+			name:   "DNS-over-TLS without an address",
+			modify: func(cfg *Config) { cfg.DNSTransport = "tls" },
+			want:   []string{"DNSTransport tls requires DNSAddress"},
+		},
+		{
+			name: "DNS proxy over UDP",
+			modify: func(cfg *Config) {
+				cfg.DNSTransport = "udp"
+				cfg.DNSAddress = "127.0.0.1"
+				cfg.DNSProxy = "127.0.0.1:9050"
+			},
+			want: []string{"DNSProxy requires DNSAddress and the tcp, tls or https transport"},
+		},
+		{
+			name:   "port out of range",
+			modify: func(cfg *Config) { cfg.ListenPort = 65536 },
+			want:   []string{"ListenPort must be between 1 and 65535, not 65536"},
+		},
+		{
+			name:   "socket mode not octal",
+			modify: func(cfg *Config) { cfg.ListenUnixSocketMode = "0999" },
+			want:   []string{`ListenUnixSocketMode must be an octal file mode, not "0999"`},
+		},
+		{
+			name:   "short RSA keys",
+			modify: func(cfg *Config) { cfg.KeyAlgorithm = "rsa"; cfg.KeyBits = 1024 },
+			want:   []string{"KeyBits must be at least 2048, not 1024"},
+		},
+		{
+			name:   "bad duration",
+			modify: func(cfg *Config) { cfg.CRLValidity = "-1h" },
+			want:   []string{`CRLValidity must be a positive duration such as 720h, not "-1h"`},
+		},
+		{
+			name:   "optional duration left empty",
+			modify: func(cfg *Config) { cfg.DomainCertValidity = "" },
+		},
+		{
+			name:   "serial bits out of range",
+			modify: func(cfg *Config) { cfg.SerialBits = 8 },
+			want:   []string{"SerialBits must be between"},
+		},
+		{
+			name:   "rate limit without burst",
+			modify: func(cfg *Config) { cfg.RateLimit = 10; cfg.RateLimitBurst = 0 },
+			want:   []string{"RateLimitBurst must be at least 1, not 0"},
+		},
+		{
+			name:   "uninstall without trust stores",
+			modify: func(cfg *Config) { cfg.UninstallRootCA = true },
+			want:   []string{"UninstallRootCA requires TrustStores"},
+		},
+		{
+			name: "several problems at once",
+			modify: func(cfg *Config) {
+				cfg.TLDs = ""
+				cfg.AccessLogFormat = "xml"
+			},
+			want: []string{
+				"TLDs must list at least one TLD",
+				`AccessLogFormat must be common, combined or json, not "xml"`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			test.modify(&cfg)
+
+			err := cfg.Validate()
+			if len(test.want) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("got %v, want %v", err, ErrInvalidConfig)
+			}
+
+			for _, want := range test.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func writeTestConfig(t *testing.T, dir, contents string) {
+	t.Helper()
+
+	err := ioutil.WriteFile(filepath.Join(dir, defaultConfigFile), []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeTestConfig(t, dir, "[encaya]\ntlds = \"bit\"\nratelimit = 10\nlistenport = 8080\n")
+
+	otherDir := t.TempDir()
+	writeTestConfig(t, otherDir, "listenport = 9090\n")
+
+	tests := []struct {
+		name        string
+		args        []string
+		environ     []string
+		defaultDir  string
+		wantDir     string
+		wantPort    int
+		wantLimit   int
+		wantErrText string
+	}{
+		{
+			name:       "default directory",
+			defaultDir: dir,
+			wantDir:    dir,
+			wantPort:   8080,
+			wantLimit:  10,
+		},
+		{
+			name:       "configdir flag",
+			args:       []string{"-configdir", otherDir},
+			defaultDir: dir,
+			wantDir:    otherDir,
+			wantPort:   9090,
+		},
+		{
+			name:       "configdir variable",
+			environ:    []string{"ENCAYA_CONFIGDIR=" + otherDir},
+			defaultDir: dir,
+			wantDir:    otherDir,
+			wantPort:   9090,
+		},
+		{
+			name:     "conf flag",
+			args:     []string{"-conf", filepath.Join(otherDir, defaultConfigFile)},
+			wantDir:  otherDir,
+			wantPort: 9090,
+		},
+		{
+			name:       "environment over file",
+			environ:    []string{"ENCAYA_LISTENPORT=8081"},
+			defaultDir: dir,
+			wantDir:    dir,
+			wantPort:   8081,
+			wantLimit:  10,
+		},
+		{
+			name:       "flags over environment",
+			args:       []string{"-listenport=8082"},
+			environ:    []string{"ENCAYA_LISTENPORT=8081"},
+			defaultDir: dir,
+			wantDir:    dir,
+			wantPort:   8082,
+			wantLimit:  10,
+		},
+		{
+			name:       "unknown variable ignored",
+			environ:    []string{"ENCAYA_ROOT_PASSPHRASE=secret"},
+			defaultDir: dir,
+			wantDir:    dir,
+			wantPort:   8080,
+			wantLimit:  10,
+		},
+		{
+			name:       "missing default file",
+			defaultDir: t.TempDir(),
+			wantPort:   80,
+		},
+		{
+			name:        "missing named file",
+			args:        []string{"-conf", filepath.Join(t.TempDir(), defaultConfigFile)},
+			wantErrText: "no such file",
+		},
+		{
+			name:        "bad variable value",
+			environ:     []string{"ENCAYA_LISTENPORT=http"},
+			defaultDir:  dir,
+			wantErrText: "listenport",
+		},
+		{
+			name:        "positional argument",
+			args:        []string{"extra"},
+			defaultDir:  dir,
+			wantErrText: "unexpected argument extra",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := LoadConfig(test.args, test.environ, test.defaultDir)
+			if test.wantErrText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErrText) {
+					t.Fatalf("got %v, want an error mentioning %q", err, test.wantErrText)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.wantDir != "" && cfg.ConfigDir != test.wantDir {
+				t.Errorf("ConfigDir is %s, want %s", cfg.ConfigDir, test.wantDir)
+			}
+
+			if cfg.ListenPort != test.wantPort || cfg.RateLimit != test.wantLimit {
+				t.Errorf("ListenPort and RateLimit are %d and %d, want %d and %d",
+					cfg.ListenPort, cfg.RateLimit, test.wantPort, test.wantLimit)
+			}
+		})
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	own, rest := SplitArgs([]string{
+		"-conf", "encaya.conf", "-xlog.severity=debug", "-listenport=8080", "-ratelimit", "10",
+		"-daemon", "-keyendpoints",
+	})
+
+	wantOwn := []string{"-conf", "encaya.conf", "-listenport=8080", "-ratelimit", "10", "-keyendpoints"}
+	wantRest := []string{"-xlog.severity=debug", "-daemon"}
+
+	if strings.Join(own, " ") != strings.Join(wantOwn, " ") {
+		t.Errorf("own arguments are %q, want %q", own, wantOwn)
+	}
+
+	if strings.Join(rest, " ") != strings.Join(wantRest, " ") {
+		t.Errorf("other arguments are %q, want %q", rest, wantRest)
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type cachedCRL struct {
+	der        []byte
+	thisUpdate time.Time
+}
+
+// crlURL returns the CRL distribution point for certs issued by the CA of
+// tldName, or by the root CA if tldName is empty.
+func (cfg *Config) crlURL(tldName string) string {
+	if tldName == "" {
+		return cfg.CRLURL
+	}
+
+	separator := "?"
+	if strings.Contains(cfg.CRLURL, "?") {
+		separator = "&"
+	}
+
+	return cfg.CRLURL + separator + "tld=" + url.QueryEscape(tldName)
+}
+
+// allowCRLSigning makes sure a self-signed CA cert has the cRLSign key usage,
+// which is required to sign a CRL with it.
+func allowCRLSigning(der []byte, priv crypto.Signer) ([]byte, error) {
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.KeyUsage&x509.KeyUsageCRLSign != 0 {
+		return der, nil
+	}
+
+	return reissueCert(der, parsed, priv, func(template *x509.Certificate) {
+		template.KeyUsage |= x509.KeyUsageCRLSign
+	})
+}
+
+// crlHandler serves the CRL of the root CA (which covers the TLD CAs and
+// exclusion CAs), or of a TLD CA if the "tld" parameter is given (which
+// covers the domain certs it issued).  During a CA rotation, the
+// "generation=previous" parameter selects the previous root's CAs.  Since
+// none of these are ever revoked before expiry (TLSA-derived domain certs
+// are short-lived, and their status is available via OCSP), the CRLs are
+// empty; they exist because some TLS stacks refuse chains whose CAs offer no
+// revocation mechanism.
+func (s *Server) crlHandler(w http.ResponseWriter, req *http.Request) {
+	tldName := req.FormValue("tld")
+
+	if req.FormValue("generation") == generationPrevious {
+		if s.previous == nil {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "no previous root CA")
+
+			return
+		}
+
+		s.previous.crlHandler(w, withoutGeneration(req))
+
+		return
+	}
+
+	issuer := s.rootCertParsed
+	issuerPriv := s.rootPriv
+
+	if tldName != "" {
+		tld := s.tlds[tldName]
+		if tld == nil {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "unknown TLD")
+
+			return
+		}
+
+		issuer = tld.parsed
+		issuerPriv = tld.priv
+	}
+
+	crl, err := s.getCRL(tldName, issuer, issuerPriv)
+	if err != nil {
+		log.Debuge(err, "Unable to generate CRL")
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "unable to generate CRL")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+
+	_, err = w.Write(crl)
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
+
+// getCRL returns the cached CRL for tldName, regenerating it once half of its
+// validity has elapsed.
+func (s *Server) getCRL(tldName string, issuer *x509.Certificate, issuerPriv crypto.Signer) ([]byte, error) {
+	s.crlsMutex.Lock()
+	defer s.crlsMutex.Unlock()
+
+	cached := s.crls[tldName]
+	if cached != nil && time.Since(cached.thisUpdate) < s.crlValidity/2 {
+		return cached.der, nil
+	}
+
+	now := time.Now()
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		// CRL numbers must increase monotonically; a timestamp does
+		// that across restarts without persisting state.
+		Number:     big.NewInt(now.UnixNano()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(s.crlValidity),
+	}, issuer, issuerPriv)
+	if err != nil {
+		return nil, fmt.Errorf("issuer %s: %w", issuer.Subject.CommonName, err)
+	}
+
+	s.crls[tldName] = &cachedCRL{
+		der:        der,
+		thisUpdate: now,
+	}
+
+	return der, nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidCSR is returned when a certificate signing request can't be
+// parsed or isn't signed by its own key.
+var ErrInvalidCSR = errors.New("invalid certificate signing request")
+
+// Extensions of a CSR that crossSignCSR doesn't carry over, since they're
+// derived from the signer and the CA template instead.
+var csrDroppedExtensionOIDs = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14}, // Subject Key Identifier
+	{2, 5, 29, 15}, // Key Usage
+	{2, 5, 29, 19}, // Basic Constraints
+	{2, 5, 29, 35}, // Authority Key Identifier
+}
+
+// isCSRBlock reports whether a PEM block holds a PKCS#10 certificate signing
+// request.
+func isCSRBlock(block *pem.Block) bool {
+	return block.Type == "CERTIFICATE REQUEST" || block.Type == "NEW CERTIFICATE REQUEST"
+}
+
+// crossSignCSR issues a CA certificate for the subject and public key of a
+// CSR, signed by signerCert.  This is what crosssign.CrossSign does for an
+// existing CA cert, without the client having to mint a self-signed
+// placeholder first.  Other extensions requested in the CSR (such as name
+// constraints) are carried over, and the CA is valid until signerCert
+// expires.
+func (s *Server) crossSignCSR(csrDER, signerCertDER []byte, signerKey crypto.Signer) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+	}
+
+	signerCert, err := x509.ParseCertificate(signerCertDER)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse signer certificate: %w", err)
+	}
+
+	serial, err := randomSerial(s.cfg.SerialBits)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     signerCert.NotAfter,
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, ext := range csr.Extensions {
+		dropped := false
+
+		for _, oid := range csrDroppedExtensionOIDs {
+			if ext.Id.Equal(oid) {
+				dropped = true
+
+				break
+			}
+		}
+
+		if !dropped {
+			template.ExtraExtensions = append(template.ExtraExtensions, ext)
+		}
+	}
+
+	return x509.CreateCertificate(rand.Reader, template, signerCert, csr.PublicKey, signerKey)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TLSA certificate usages (RFC 7218) that certs are generated from.
+const (
+	tlsaUsageDANETA = 2
+	tlsaUsageDANEEE = 3
+)
+
+// daneEEValidity is how long leaf certs generated from DANE-EE records (or
+// issued over ACME) are valid, unless DomainCertValidity is set.
+const daneEEValidity = 90 * 24 * time.Hour
+
+// ErrDANEEERecord is returned when a DANE-EE record doesn't hold a usable
+// public key.
+var ErrDANEEERecord = errors.New("unusable DANE-EE record")
+
+// issuableUsage reports whether certs may be generated from records with
+// the given certificate usage.  DANE-TA records (the Namecoin form) always
+// qualify; DANE-EE records only if DANEEE is set.
+func (s *Server) issuableUsage(usage uint8) bool {
+	switch usage {
+	case tlsaUsageDANETA:
+		return true
+	case tlsaUsageDANEEE:
+		return s.cfg.DANEEE
+	default:
+		return false
+	}
+}
+
+// daneEECert generates a leaf cert for domain, issued by tld, for the public
+// key of a DANE-EE record.  tlsa is in full (unhashed) form, as returned by
+// issuableTLSA.  Unlike the CA certs that safetlsa generates from DANE-TA
+// records, the leaf can't issue anything itself, and it's valid for domain
+// alone, plus *.domain if wildcard is set.
+func (s *Server) daneEECert(domain string, tlsa *dns.TLSA, tld *tldCA, wildcard bool) ([]byte, error) {
+	data, err := hex.DecodeString(tlsa.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDANEEERecord, err.Error())
+	}
+
+	var pub interface{}
+
+	switch tlsa.Selector {
+	case tlsaSelectorCert:
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrDANEEERecord, err.Error())
+		}
+
+		pub = cert.PublicKey
+	case tlsaSelectorSPKI:
+		pub, err = x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrDANEEERecord, err.Error())
+		}
+	default:
+		return nil, fmt.Errorf("%w: selector %d", ErrDANEEERecord, tlsa.Selector)
+	}
+
+	names := []string{strings.TrimSuffix(domain, ".")}
+	if wildcard {
+		names = append(names, "*."+names[0])
+	}
+
+	return s.issueLeafCert(names, pub, tld)
+}
+
+// issueLeafCert generates a TLS server cert for pub, valid for names (the
+// first of which is also the common name), issued by tld.
+func (s *Server) issueLeafCert(names []string, pub interface{}, tld *tldCA) ([]byte, error) {
+	serialNumber, err := randomSerial(s.cfg.SerialBits)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate serial number: %w", err)
+	}
+
+	notAfter := time.Now().Add(daneEEValidity)
+	if notAfter.After(tld.parsed.NotAfter) {
+		notAfter = tld.parsed.NotAfter
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   names[0],
+			SerialNumber: "Namecoin TLS Certificate",
+		},
+		NotBefore: time.Now().Add(-1 * time.Hour),
+		NotAfter:  notAfter,
+
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+
+		DNSNames: names,
+	}
+
+	return x509.CreateCertificate(rand.Reader, &template, tld.parsed, pub, tld.priv)
+}
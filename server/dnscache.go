@@ -0,0 +1,234 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsCache caches upstream DNS responses by owner name (and isolation key),
+// for as long as their TTLs allow, but at most maxTTL.  It sits below the
+// cert caches, so that e.g. an /aia request for a domain whose TLSA records
+// were just fetched by /lookup doesn't query upstream again.
+//
+// Positive answers are cached for their smallest TTL, and NXDOMAIN and
+// NODATA answers for their SOA's negative TTL (RFC 2308 section 5).  Other
+// failures aren't cached.
+type dnsCache struct {
+	mu         sync.Mutex
+	maxEntries int
+
+	// Front is most recently used
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type dnsCacheEntry struct {
+	key        string
+	msg        *dns.Msg
+	added      time.Time
+	expiration time.Time
+}
+
+func newDNSCache(maxEntries int) *dnsCache {
+	return &dnsCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// get returns a copy of the unexpired response cached for key, with its TTLs
+// reduced by the time it has been cached.
+func (c *dnsCache) get(key string) *dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*dnsCacheEntry)
+
+	now := time.Now()
+	if !entry.expiration.After(now) {
+		c.removeLocked(element)
+
+		return nil
+	}
+
+	c.lru.MoveToFront(element)
+
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.added).Seconds())
+
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+
+	return msg
+}
+
+// add caches msg for key, if it's cacheable, for its TTL capped at maxTTL.
+func (c *dnsCache) add(key string, msg *dns.Msg, maxTTL time.Duration) {
+	ttl, ok := dnsResponseTTL(msg)
+	if !ok {
+		return
+	}
+
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &dnsCacheEntry{
+		key:        key,
+		msg:        msg.Copy(),
+		added:      now,
+		expiration: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+	} else {
+		c.entries[key] = c.lru.PushFront(entry)
+	}
+
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+func (c *dnsCache) removeLocked(element *list.Element) {
+	entry := element.Value.(*dnsCacheEntry)
+
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+}
+
+// removeMatching removes the responses whose key match selects, returning
+// how many were removed.
+func (c *dnsCache) removeMatching(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+
+	for key, element := range c.entries {
+		if match(key) {
+			c.removeLocked(element)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// flush removes all responses from the cache.
+func (c *dnsCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+// dnsResponseTTL returns how long msg may be cached, or false if it may not
+// be.
+func dnsResponseTTL(msg *dns.Msg) (time.Duration, bool) {
+	if msg == nil || msg.Truncated {
+		return 0, false
+	}
+
+	switch msg.Rcode {
+	case dns.RcodeSuccess:
+		if len(msg.Answer) > 0 {
+			ttl := msg.Answer[0].Header().Ttl
+
+			for _, rr := range msg.Answer[1:] {
+				if rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+
+			return time.Duration(ttl) * time.Second, true
+		}
+	case dns.RcodeNameError:
+	default:
+		return 0, false
+	}
+
+	// NXDOMAIN or NODATA: use the negative TTL of the SOA, if any.
+	for _, rr := range msg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+
+		return time.Duration(ttl) * time.Second, true
+	}
+
+	return 0, false
+}
+
+// queryNameCached is queryName with the DNS answer cache in front of it.
+// Answers are only shared between requests with the same isolation key.
+func (s *Server) queryNameCached(ctx context.Context, qname, isolation string) (msg *dns.Msg, err error) {
+	ctx, span := s.startSpan(ctx, "dns.query", attrDNSQuestion.String(qname))
+
+	defer func() {
+		if msg != nil {
+			span.SetAttributes(attrDNSRcode.String(dns.RcodeToString[msg.Rcode]))
+		}
+
+		endSpan(span, err)
+	}()
+
+	if s.dnsCache == nil || s.dnsCacheMaxTTL == 0 {
+		return s.queryName(ctx, qname, isolation)
+	}
+
+	key := isolatedKey(isolation, dns.CanonicalName(qname))
+
+	msg = s.dnsCache.get(key)
+	if msg != nil {
+		span.SetAttributes(attrCacheHit.Bool(true))
+
+		return msg, nil
+	}
+
+	span.SetAttributes(attrCacheHit.Bool(false))
+
+	msg, err = s.queryName(ctx, qname, isolation)
+	if err != nil {
+		return msg, err
+	}
+
+	s.dnsCache.add(key, msg, s.dnsCacheMaxTTL)
+
+	return msg, nil
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrEncryptedKey is returned when an encrypted private key can't be
+// decrypted, usually because the passphrase is wrong.
+var ErrEncryptedKey = errors.New("unable to decrypt private key")
+
+// encryptedKeyIterations is the PBKDF2 iteration count for keys we encrypt.
+// Decrypting the root key only happens at startup, so it can be slow.
+const encryptedKeyIterations = 600000
+
+// OIDs from RFC 8018 (PBES2, PBKDF2), RFC 7914 (scrypt) and NIST (AES).
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encryptedPrivateKeyInfo is the RFC 5958 EncryptedPrivateKeyInfo, found in
+// "ENCRYPTED PRIVATE KEY" PEM blocks.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts an EncryptedPrivateKeyInfo, returning the PKCS#8
+// PrivateKeyInfo inside it.  Only PBES2 with PBKDF2 or scrypt and AES-CBC is
+// supported, which covers what OpenSSL 1.1 and later write by default.
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrEncryptedKey, err.Error())
+	}
+
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("%w: unsupported encryption %s (only PBES2 is supported)",
+			ErrEncryptedKey, info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrEncryptedKey, err.Error())
+	}
+
+	keySize, err := aesCBCKeySize(params.EncryptionScheme.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	var iv []byte
+
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("%w: malformed AES-CBC IV", ErrEncryptedKey)
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, passphrase, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: ciphertext isn't a multiple of the block size", ErrEncryptedKey)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+
+	// A wrong passphrase is almost always caught by the padding check.
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize ||
+		!bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, fmt.Errorf("%w: incorrect passphrase", ErrEncryptedKey)
+	}
+
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// encryptPKCS8 encrypts a PKCS#8 PrivateKeyInfo with PBES2, using
+// PBKDF2-HMAC-SHA256 and AES-256-CBC, so that OpenSSL can read it.
+func encryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rand.Read(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	key := pbkdf2.Key(passphrase, salt, encryptedKeyIterations, 32, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	plaintext := append(append([]byte{}, der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: encryptedKeyIterations,
+		PRF: pkix.AlgorithmIdentifier{
+			Algorithm:  oidHMACWithSHA256,
+			Parameters: asn1.NullRawValue,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBKDF2,
+			Parameters: asn1.RawValue{FullBytes: kdfParams},
+		},
+		EncryptionScheme: pkix.AlgorithmIdentifier{
+			Algorithm:  oidAES256CBC,
+			Parameters: asn1.RawValue{FullBytes: ivParams},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBES2,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: ciphertext,
+	})
+}
+
+func aesCBCKeySize(oid asn1.ObjectIdentifier) (int, error) {
+	switch {
+	case oid.Equal(oidAES128CBC):
+		return 16, nil
+	case oid.Equal(oidAES192CBC):
+		return 24, nil
+	case oid.Equal(oidAES256CBC):
+		return 32, nil
+	default:
+		return 0, fmt.Errorf("%w: unsupported cipher %s (only AES-CBC is supported)", ErrEncryptedKey, oid)
+	}
+}
+
+// deriveKey derives a keySize byte key from passphrase with PBKDF2 or
+// scrypt.
+func deriveKey(kdf pkix.AlgorithmIdentifier, passphrase []byte, keySize int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+
+		_, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrEncryptedKey, err.Error())
+		}
+
+		if params.KeyLength != 0 && params.KeyLength != keySize {
+			return nil, fmt.Errorf("%w: key length doesn't match cipher", ErrEncryptedKey)
+		}
+
+		prf, err := pbkdf2PRF(params.PRF.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+
+		return pbkdf2.Key(passphrase, params.Salt, params.IterationCount, keySize, prf), nil
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+
+		_, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrEncryptedKey, err.Error())
+		}
+
+		if params.KeyLength != 0 && params.KeyLength != keySize {
+			return nil, fmt.Errorf("%w: key length doesn't match cipher", ErrEncryptedKey)
+		}
+
+		key, err := scrypt.Key(passphrase, params.Salt, params.CostParameter, params.BlockSize,
+			params.ParallelizationParameter, keySize)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrEncryptedKey, err.Error())
+		}
+
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key derivation %s (only PBKDF2 and scrypt are supported)",
+			ErrEncryptedKey, kdf.Algorithm)
+	}
+}
+
+func pbkdf2PRF(oid asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case len(oid) == 0 || oid.Equal(oidHMACWithSHA1):
+		// RFC 8018's default
+		return sha1.New, nil
+	case oid.Equal(oidHMACWithSHA256):
+		return sha256.New, nil
+	case oid.Equal(oidHMACWithSHA384):
+		return sha512.New384, nil
+	case oid.Equal(oidHMACWithSHA512):
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported PBKDF2 PRF %s", ErrEncryptedKey, oid)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes of the JSON error responses.
+const (
+	errCodeBadRequest       = "bad_request"
+	errCodeNotFound         = "not_found"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeForbidden        = "forbidden"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeRateLimited      = "rate_limited"
+	errCodeInvalidPEM       = "invalid_pem"
+	errCodeInvalidKey       = "invalid_key"
+	errCodeInvalidCSR       = "invalid_csr"
+	errCodeSigningFailed    = "signing_failed"
+	errCodeDNSTimeout       = "dns_timeout"
+	errCodeDNSError         = "dns_error"
+	errCodeMisdirected      = "misdirected_request"
+	errCodeDomainNotAllowed = "domain_not_allowed"
+	errCodeInternal         = "internal"
+	errCodeRequestTooLarge  = "request_too_large"
+)
+
+// apiError is the body of an error response.  Retryable tells clients
+// whether the same request may succeed later; RequestID identifies the
+// request in the access and audit logs.
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeError responds to a request with an HTTP error status and a JSON
+// error object.  Rate limiting and upstream (DNS) failures are retryable;
+// anything else will fail the same way again.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	retryable := status == http.StatusTooManyRequests ||
+		status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+
+	// The handler may already have set the headers of a successful
+	// response.
+	w.Header().Del("ETag")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(apiError{
+		Code:      code,
+		Message:   message,
+		Retryable: retryable,
+		// Set by requestIDHandler
+		RequestID: w.Header().Get(requestIDHeader),
+	})
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
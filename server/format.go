@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Values of lookupCert.Source, describing where a cert came from.
+const (
+	sourceRoot       = "root"
+	sourceTLD        = "tld"
+	sourceDNS        = "dns"
+	sourceCache      = "cache"
+	sourceRehydrated = "rehydrated"
+)
+
+// Response formats supported by /lookup.
+const (
+	formatPEM   = "pem"
+	formatJSON  = "json"
+	formatDER   = "der"
+	formatPKCS7 = "pkcs7"
+)
+
+// lookupCert is a certificate returned by /lookup.  The exported fields are
+// the JSON representation.
+type lookupCert struct {
+	PEM string `json:"pem"`
+	DER []byte `json:"der"`
+
+	// The TLSA record the cert was derived from, if any.
+	TLSA *lookupTLSA `json:"tlsa,omitempty"`
+
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+
+	// Source is one of "root", "tld", "dns" (generated for this request),
+	// "cache" or "rehydrated".
+	Source      string     `json:"source"`
+	CachedUntil *time.Time `json:"cached_until,omitempty"`
+
+	tlsa *dns.TLSA
+}
+
+type lookupTLSA struct {
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matching_type"`
+	Certificate  string `json:"certificate"`
+}
+
+func newLookupCert(der []byte, certPem, source string, tlsa *dns.TLSA) lookupCert {
+	result := lookupCert{
+		PEM:    certPem,
+		DER:    der,
+		Source: source,
+		tlsa:   tlsa,
+	}
+
+	if tlsa != nil {
+		result.TLSA = &lookupTLSA{
+			Usage:        tlsa.Usage,
+			Selector:     tlsa.Selector,
+			MatchingType: tlsa.MatchingType,
+			Certificate:  tlsa.Certificate,
+		}
+	}
+
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		log.Debuge(err, "Unable to parse cert for metadata")
+	} else {
+		result.NotBefore = parsed.NotBefore
+		result.NotAfter = parsed.NotAfter
+	}
+
+	return result
+}
+
+// responseFormat returns the response format requested via the "format" form
+// parameter, falling back to the Accept header and then to PEM.
+func responseFormat(req *http.Request) string {
+	format := req.FormValue("format")
+	if format != "" {
+		return strings.ToLower(format)
+	}
+
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err != nil {
+			continue
+		}
+
+		switch mediaType {
+		case "application/json":
+			return formatJSON
+		case "application/pkix-cert":
+			return formatDER
+		case "application/pkcs7-mime", "application/x-pkcs7-certificates":
+			return formatPKCS7
+		}
+	}
+
+	return formatPEM
+}
+
+// wantsAIAChain reports whether an /aia request asks for the cert and its
+// issuers as a PKCS#7 bundle rather than the bare cert, via the "chain"
+// form parameter or the requested format.
+func wantsAIAChain(req *http.Request) bool {
+	chain, err := strconv.ParseBool(req.FormValue("chain"))
+	if err == nil {
+		return chain
+	}
+
+	return responseFormat(req) == formatPKCS7
+}
+
+func (s *Server) writeLookupCerts(w http.ResponseWriter, req *http.Request, certs []lookupCert) {
+	var err error
+
+	format := responseFormat(req)
+
+	if s.writeCacheHeaders(w, req, certs, format) {
+		return
+	}
+
+	switch format {
+	case formatJSON:
+		if certs == nil {
+			certs = []lookupCert{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err = json.NewEncoder(w).Encode(certs)
+	case formatDER:
+		// Multiple certs are simply concatenated; each DER cert is
+		// self-delimiting.
+		w.Header().Set("Content-Type", "application/pkix-cert")
+
+		for _, cert := range certs {
+			_, err = w.Write(cert.DER)
+			if err != nil {
+				break
+			}
+		}
+	case formatPKCS7:
+		ders := make([][]byte, 0, len(certs))
+		for _, cert := range certs {
+			ders = append(ders, cert.DER)
+		}
+
+		var bundle []byte
+
+		bundle, err = certsOnlyPKCS7(ders)
+		if err != nil {
+			log.Debuge(err, "Unable to create PKCS#7 bundle")
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "unable to create PKCS#7 bundle")
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+
+		_, err = w.Write(bundle)
+	default:
+		w.Header().Set("Content-Type", "application/x-pem-file")
+
+		pems := make([]string, 0, len(certs))
+		for _, cert := range certs {
+			pems = append(pems, cert.PEM)
+		}
+
+		_, err = io.WriteString(w, strings.Join(pems, "\n\n"))
+	}
+
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
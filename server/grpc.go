@@ -0,0 +1,392 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/namecoin/encaya/encayapb"
+)
+
+// grpcService implements the gRPC API on top of the same backend as the HTTP
+// handlers.
+type grpcService struct {
+	encayapb.UnimplementedEncayaServer
+
+	s *Server
+}
+
+// startGRPC serves the gRPC API on the gRPC listeners.
+func (s *Server) startGRPC() error {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.grpcInterceptor),
+	}
+
+	if s.cfg.GRPCTLS {
+		tlsConfig, err := s.listenTLSConfig()
+		if err != nil {
+			return err
+		}
+
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	s.grpcServer = grpc.NewServer(opts...)
+	encayapb.RegisterEncayaServer(s.grpcServer, &grpcService{s: s})
+
+	for _, listener := range s.listeners.grpc {
+		go func(listener net.Listener) {
+			err := s.grpcServer.Serve(listener)
+			if err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+				s.fail(fmt.Errorf("unable to serve gRPC on %s: %w", listener.Addr(), err))
+			}
+		}(listener)
+	}
+
+	return nil
+}
+
+// stopGRPC gracefully stops the gRPC server, cutting off calls still in
+// progress when ctx is done.
+func (s *Server) stopGRPC(ctx context.Context) {
+	stopped := make(chan struct{})
+
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+	}
+}
+
+// rateLimitedGRPCMethods are the methods whose HTTP equivalents are wrapped
+// in rateLimited.
+var rateLimitedGRPCMethods = map[string]bool{
+	encayapb.Encaya_Lookup_FullMethodName:                  true,
+	encayapb.Encaya_AIA_FullMethodName:                     true,
+	encayapb.Encaya_OriginalFromSerial_FullMethodName:      true,
+	encayapb.Encaya_OriginalFromFingerprint_FullMethodName: true,
+	encayapb.Encaya_OriginalFromSKID_FullMethodName:        true,
+}
+
+// grpcInterceptor does for gRPC calls what serveLocked and rateLimited do for
+// HTTP requests.
+func (s *Server) grpcInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+
+	if s.requestTimeout != 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+	}
+
+	ctx = withAuditRequest(ctx, grpcClientIP(ctx), info.FullMethod)
+
+	requestID := newRequestID()
+	ctx = withRequestID(ctx, requestID)
+
+	err := grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(requestIDHeader), requestID))
+	if err != nil {
+		log.Debuge(err, "set request ID header")
+	}
+
+	ctx, span := s.startSpan(ctx, info.FullMethod, attrRPCMethod.String(info.FullMethod))
+	defer span.End()
+
+	if rateLimitedGRPCMethods[info.FullMethod] {
+		if s.rateLimiter != nil {
+			ok, wait := s.rateLimiter.allow(grpcClientIP(ctx), time.Now())
+			if !ok {
+				return nil, status.Errorf(codes.ResourceExhausted, "rate limited; retry in %s", wait.Round(time.Second))
+			}
+		}
+
+		if s.lookupSlots != nil {
+			select {
+			case s.lookupSlots <- struct{}{}:
+				defer func() { <-s.lookupSlots }()
+			default:
+				return nil, status.Error(codes.ResourceExhausted, "too many concurrent lookups")
+			}
+		}
+	}
+
+	return handler(ctx, req)
+}
+
+// grpcClientIP returns the host part of the peer's address.
+func grpcClientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+// isForwardedCall reports whether a gRPC call was forwarded by a proxy for
+// another client, like isLocalRequest does for HTTP.
+func isForwardedCall(md metadata.MD) bool {
+	for _, header := range forwardingHeaders {
+		if len(md.Get(header)) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireKeyAccess enforces the KeyEndpoints* access controls on a gRPC
+// call.
+func (g *grpcService) requireKeyAccess(ctx context.Context) error {
+	s := g.s
+
+	if !s.cfg.KeyEndpoints {
+		return status.Error(codes.PermissionDenied, "key endpoints are disabled")
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.PermissionDenied, "unknown peer")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if !s.cfg.KeyEndpointsAllowRemote && (!s.isLocalAddr(p.Addr.String()) || isForwardedCall(md)) {
+		return status.Error(codes.PermissionDenied, "key endpoints are only available to local clients")
+	}
+
+	if s.cfg.KeyEndpointsToken != "" {
+		token := ""
+		if values := md.Get("authorization"); len(values) > 0 {
+			token = strings.TrimPrefix(values[0], "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.KeyEndpointsToken)) != 1 {
+			return status.Error(codes.Unauthenticated, "invalid bearer token")
+		}
+	}
+
+	if s.cfg.KeyEndpointsClientCA != "" {
+		tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(tlsInfo.State.VerifiedChains) == 0 {
+			return status.Error(codes.Unauthenticated, "client certificate required")
+		}
+	}
+
+	return nil
+}
+
+// grpcError converts a backend error to a gRPC status.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrPolicyDenied):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+}
+
+func (g *grpcService) Lookup(ctx context.Context, req *encayapb.LookupRequest) (*encayapb.LookupResponse, error) {
+	service, err := tlsaServiceName(int(req.GetPort()), req.GetProtocol())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	candidates, err := parseCandidateDERs(req.GetCandidates())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	certs, err := g.s.lookup(ctx, req.GetDomain(), service, req.GetIsolation(), candidates, false)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &encayapb.LookupResponse{}
+
+	for _, cert := range certs {
+		pbCert := &encayapb.Certificate{
+			Der:       cert.DER,
+			Pem:       cert.PEM,
+			NotBefore: timestamppb.New(cert.NotBefore),
+			NotAfter:  timestamppb.New(cert.NotAfter),
+			Source:    cert.Source,
+		}
+
+		if cert.TLSA != nil {
+			pbCert.Tlsa = &encayapb.TLSA{
+				Usage:        uint32(cert.TLSA.Usage),
+				Selector:     uint32(cert.TLSA.Selector),
+				MatchingType: uint32(cert.TLSA.MatchingType),
+				Certificate:  cert.TLSA.Certificate,
+			}
+		}
+
+		if cert.CachedUntil != nil {
+			pbCert.CachedUntil = timestamppb.New(*cert.CachedUntil)
+		}
+
+		response.Certificates = append(response.Certificates, pbCert)
+	}
+
+	return response, nil
+}
+
+func (g *grpcService) AIA(ctx context.Context, req *encayapb.AIARequest) (*encayapb.AIAResponse, error) {
+	service, err := tlsaServiceName(int(req.GetPort()), req.GetProtocol())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	candidates, err := parseCandidateDERs(req.GetCandidates())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	chain, err := g.s.aia(ctx, req.GetDomain(), req.GetGeneration(), service, req.GetIsolation(),
+		req.GetPubsha256(), candidates)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	if chain == nil {
+		return nil, status.Error(codes.NotFound, "no matching TLSA record")
+	}
+
+	return &encayapb.AIAResponse{Der: chain[0], Chain: chain}, nil
+}
+
+func (g *grpcService) CrossSign(ctx context.Context, req *encayapb.CrossSignRequest) (*encayapb.CrossSignResponse, error) {
+	err := g.requireKeyAccess(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := g.s.crossSignCA(ctx, req.GetToSign(), req.GetSignerCert(), req.GetSignerKey(), req.GetIsolation())
+
+	// Like crossSignCAHandler
+	switch {
+	case errors.Is(err, ErrNoPEM) || errors.Is(err, ErrInvalidPEM) || errors.Is(err, ErrInvalidKey) ||
+		errors.Is(err, ErrInvalidCSR):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrLogFull):
+		log.Errore(err, "Unable to cross-sign CA")
+
+		return nil, status.Error(codes.Unavailable, err.Error())
+	case err != nil:
+		log.Debuge(err, "Unable to cross-sign CA")
+
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &encayapb.CrossSignResponse{Pem: strings.TrimSuffix(result, "\n\n")}, nil
+}
+
+func (g *grpcService) GetNegativeCA(ctx context.Context,
+	req *encayapb.GetNegativeCARequest) (*encayapb.GetNegativeCAResponse, error) {
+	err := g.requireKeyAccess(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	certPem, keyPem, err := g.s.newNegativeCA(req.GetTld())
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "unknown TLD")
+	}
+
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &encayapb.GetNegativeCAResponse{CertPem: certPem, KeyPem: keyPem}, nil
+}
+
+func (g *grpcService) OriginalFromSerial(ctx context.Context,
+	req *encayapb.OriginalFromSerialRequest) (*encayapb.OriginalFromSerialResponse, error) {
+	if req.GetSerial() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing serial")
+	}
+
+	return g.original(ctx, isolatedKey(req.GetIsolation(), req.GetSerial()), req.GetDomain(), req.GetPort(),
+		req.GetProtocol(), req.GetIsolation(), serialMatcher(req.GetSerial()))
+}
+
+func (g *grpcService) OriginalFromFingerprint(ctx context.Context,
+	req *encayapb.OriginalFromFingerprintRequest) (*encayapb.OriginalFromSerialResponse, error) {
+	if len(req.GetSha256()) != sha256.Size {
+		return nil, status.Errorf(codes.InvalidArgument, "sha256 must be %d bytes", sha256.Size)
+	}
+
+	return g.original(ctx, originalFingerprintKey(req.GetIsolation(), req.GetSha256()), "", 0, "",
+		req.GetIsolation(), nil)
+}
+
+func (g *grpcService) OriginalFromSKID(ctx context.Context,
+	req *encayapb.OriginalFromSKIDRequest) (*encayapb.OriginalFromSerialResponse, error) {
+	if len(req.GetSkid()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing skid")
+	}
+
+	return g.original(ctx, originalSKIDKey(req.GetIsolation(), req.GetSkid()), req.GetDomain(), req.GetPort(),
+		req.GetProtocol(), req.GetIsolation(), skidMatcher(req.GetSkid()))
+}
+
+// original returns the original cert stored under key, reconstructing it
+// from the TLSA records of domain if need be, like writeOriginal.
+func (g *grpcService) original(ctx context.Context, key, domain string, port uint32, protocol, isolation string,
+	match func(*x509.Certificate) bool) (*encayapb.OriginalFromSerialResponse, error) {
+	service := ""
+
+	if domain != "" {
+		var err error
+
+		service, err = tlsaServiceName(int(port), protocol)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	result, err := g.s.original(ctx, key, domain, service, isolation, match)
+	if errors.Is(err, ErrOriginalUnknown) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &encayapb.OriginalFromSerialResponse{Pem: strings.TrimSuffix(result, "\n\n")}, nil
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// TLSA selectors and matching types (RFC 6698 section 2.1).
+const (
+	tlsaSelectorCert = 0
+	tlsaSelectorSPKI = 1
+
+	tlsaMatchingFull   = 0
+	tlsaMatchingSHA256 = 1
+	tlsaMatchingSHA512 = 2
+)
+
+// tlsaSelectedData returns the part of cert that a TLSA record with the
+// given selector refers to.
+func tlsaSelectedData(cert *x509.Certificate, selector uint8) ([]byte, bool) {
+	switch selector {
+	case tlsaSelectorCert:
+		return cert.Raw, true
+	case tlsaSelectorSPKI:
+		return cert.RawSubjectPublicKeyInfo, true
+	default:
+		return nil, false
+	}
+}
+
+// tlsaHash hashes data as a TLSA record with the given matching type does.
+func tlsaHash(data []byte, matchingType uint8) ([]byte, bool) {
+	switch matchingType {
+	case tlsaMatchingSHA256:
+		hash := sha256.Sum256(data)
+
+		return hash[:], true
+	case tlsaMatchingSHA512:
+		hash := sha512.Sum512(data)
+
+		return hash[:], true
+	default:
+		return nil, false
+	}
+}
+
+// tlsaHashKey returns the original cert cache key under which a cert can be
+// found by the association data of a hashed TLSA record.
+func tlsaHashKey(isolation string, selector, matchingType uint8, hash []byte) string {
+	return isolatedKey(isolation, fmt.Sprintf("tlsa:%d/%d/%x", selector, matchingType, hash))
+}
+
+// rememberOriginalByHash indexes cert by each form of hashed TLSA record
+// that could refer to it, so that such records can later be resolved
+// without the client supplying the cert.
+func (s *Server) rememberOriginalByHash(isolation string, cert *x509.Certificate) {
+	certPem := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Raw,
+	}))
+
+	for _, selector := range []uint8{tlsaSelectorCert, tlsaSelectorSPKI} {
+		for _, matchingType := range []uint8{tlsaMatchingSHA256, tlsaMatchingSHA512} {
+			data, _ := tlsaSelectedData(cert, selector)
+			hash, _ := tlsaHash(data, matchingType)
+
+			s.cacheOriginalFromSerial(tlsaHashKey(isolation, selector, matchingType, hash), certPem)
+		}
+	}
+}
+
+// issuableTLSA returns the form of a published TLSA record that a domain cert
+// can be generated from.  Records with the full association data are
+// returned as is.  Hashed records (matching types 1 and 2) are matched
+// against the candidate certs supplied by the client and against the
+// originals we know of; a match is turned into an unhashed record for its
+// public key.  If nothing matches, nil is returned.
+func (s *Server) issuableTLSA(ctx context.Context, published *dns.TLSA, candidates []*x509.Certificate,
+	isolation string) *dns.TLSA {
+	_, span := s.startSpan(ctx, "tlsa.match",
+		attrTLSAUsage.Int(int(published.Usage)),
+		attrTLSASelector.Int(int(published.Selector)),
+		attrTLSAMatching.Int(int(published.MatchingType)),
+	)
+	defer span.End()
+
+	tlsa := s.matchTLSA(published, candidates, isolation)
+	span.SetAttributes(attrTLSAIssuable.Bool(tlsa != nil))
+
+	return tlsa
+}
+
+// matchTLSA implements issuableTLSA.
+func (s *Server) matchTLSA(published *dns.TLSA, candidates []*x509.Certificate, isolation string) *dns.TLSA {
+	if !s.issuableUsage(published.Usage) {
+		return nil
+	}
+
+	if published.MatchingType == tlsaMatchingFull {
+		return published
+	}
+
+	wantHash, err := hex.DecodeString(published.Certificate)
+	if err != nil {
+		// TLSA record is malformed
+		return nil
+	}
+
+	known, needRefresh := s.getCachedOriginalFromSerial(
+		tlsaHashKey(isolation, published.Selector, published.MatchingType, wantHash))
+	if !needRefresh {
+		block, _ := pem.Decode([]byte(known))
+		if block != nil {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				candidates = append([]*x509.Certificate{cert}, candidates...)
+			}
+		}
+	}
+
+	for _, cert := range candidates {
+		data, ok := tlsaSelectedData(cert, published.Selector)
+		if !ok {
+			return nil
+		}
+
+		hash, ok := tlsaHash(data, published.MatchingType)
+		if !ok {
+			return nil
+		}
+
+		if !bytes.Equal(hash, wantHash) {
+			continue
+		}
+
+		if needRefresh {
+			s.rememberOriginalByHash(isolation, cert)
+		}
+
+		return &dns.TLSA{
+			Hdr:          published.Hdr,
+			Usage:        published.Usage,
+			Selector:     tlsaSelectorSPKI,
+			MatchingType: tlsaMatchingFull,
+			Certificate:  hex.EncodeToString(cert.RawSubjectPublicKeyInfo),
+		}
+	}
+
+	return nil
+}
+
+// parseCandidates returns the certs in the request's "candidate" parameters,
+// each of which may contain several PEM certs.
+func parseCandidates(req *http.Request) ([]*x509.Certificate, error) {
+	err := req.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []*x509.Certificate{}
+
+	for _, candidatePem := range req.Form["candidate"] {
+		rest := []byte(candidatePem)
+
+		for {
+			var block *pem.Block
+
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid candidate certificate: %w", err)
+			}
+
+			candidates = append(candidates, cert)
+		}
+	}
+
+	return candidates, nil
+}
+
+// parseCandidateDERs parses candidate certs supplied in DER form.
+func parseCandidateDERs(ders [][]byte) ([]*x509.Certificate, error) {
+	candidates := make([]*x509.Certificate, 0, len(ders))
+
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid candidate certificate: %w", err)
+		}
+
+		candidates = append(candidates, cert)
+	}
+
+	return candidates, nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIssuableTLSA(t *testing.T) {
+	ca := testCert(t, "example.bit", 1, true, nil)
+	other := testCert(t, "other.bit", 2, true, nil)
+
+	spki := hex.EncodeToString(ca.parsed.RawSubjectPublicKeyInfo)
+	spkiHash, _ := tlsaHash(ca.parsed.RawSubjectPublicKeyInfo, tlsaMatchingSHA256)
+	certHash, _ := tlsaHash(ca.parsed.Raw, tlsaMatchingSHA512)
+
+	record := func(usage, selector, matchingType uint8, data string) *dns.TLSA {
+		return &dns.TLSA{
+			Hdr:          dns.RR_Header{Name: "_443._tcp.example.bit.", Rrtype: dns.TypeTLSA},
+			Usage:        usage,
+			Selector:     selector,
+			MatchingType: matchingType,
+			Certificate:  data,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		daneEE     bool
+		published  *dns.TLSA
+		candidates []*tldCA
+		want       string // SPKI of the returned record; none if nil
+	}{
+		{
+			name:      "full",
+			published: record(tlsaUsageDANETA, tlsaSelectorSPKI, tlsaMatchingFull, spki),
+			want:      spki,
+		},
+		{
+			name:       "SHA-256 of the SPKI",
+			published:  record(tlsaUsageDANETA, tlsaSelectorSPKI, tlsaMatchingSHA256, hex.EncodeToString(spkiHash)),
+			candidates: []*tldCA{other, ca},
+			want:       spki,
+		},
+		{
+			name:       "SHA-512 of the cert",
+			published:  record(tlsaUsageDANETA, tlsaSelectorCert, tlsaMatchingSHA512, hex.EncodeToString(certHash)),
+			candidates: []*tldCA{ca},
+			want:       spki,
+		},
+		{
+			name:       "no matching candidate",
+			published:  record(tlsaUsageDANETA, tlsaSelectorSPKI, tlsaMatchingSHA256, hex.EncodeToString(spkiHash)),
+			candidates: []*tldCA{other},
+		},
+		{
+			name:       "malformed hash",
+			published:  record(tlsaUsageDANETA, tlsaSelectorSPKI, tlsaMatchingSHA256, "not hex"),
+			candidates: []*tldCA{ca},
+		},
+		{
+			name:      "DANE-EE disabled",
+			published: record(tlsaUsageDANEEE, tlsaSelectorSPKI, tlsaMatchingFull, spki),
+		},
+		{
+			name:      "DANE-EE enabled",
+			daneEE:    true,
+			published: record(tlsaUsageDANEEE, tlsaSelectorSPKI, tlsaMatchingFull, spki),
+			want:      spki,
+		},
+		{
+			name:      "PKIX-TA",
+			daneEE:    true,
+			published: record(0, tlsaSelectorSPKI, tlsaMatchingFull, spki),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{originalCertCache: newCertCache(0, 0)}
+			s.cfg.DANEEE = test.daneEE
+
+			candidates := []*x509.Certificate{}
+			for _, candidate := range test.candidates {
+				candidates = append(candidates, candidate.parsed)
+			}
+
+			got := s.issuableTLSA(context.Background(), test.published, candidates, "")
+			if test.want == "" {
+				if got != nil {
+					t.Errorf("got %v, want nil", got)
+				}
+
+				return
+			}
+
+			if got == nil || got.Certificate != test.want || got.Selector != tlsaSelectorSPKI ||
+				got.MatchingType != tlsaMatchingFull || got.Usage != test.published.Usage {
+				t.Errorf("got %v, want the full SPKI", got)
+			}
+		})
+	}
+}
+
+func TestIssuableTLSARemembersOriginals(t *testing.T) {
+	ca := testCert(t, "example.bit", 1, true, nil)
+	s := &Server{originalCertCache: newCertCache(0, 0)}
+
+	spkiHash, _ := tlsaHash(ca.parsed.RawSubjectPublicKeyInfo, tlsaMatchingSHA256)
+	published := &dns.TLSA{
+		Usage:        tlsaUsageDANETA,
+		Selector:     tlsaSelectorSPKI,
+		MatchingType: tlsaMatchingSHA256,
+		Certificate:  hex.EncodeToString(spkiHash),
+	}
+
+	if s.issuableTLSA(context.Background(), published, []*x509.Certificate{ca.parsed}, "isolated") == nil {
+		t.Fatal("candidate didn't match")
+	}
+
+	// Once matched, the record resolves without candidates, but only with
+	// the same isolation key.
+	if s.issuableTLSA(context.Background(), published, nil, "isolated") == nil {
+		t.Error("remembered original didn't match")
+	}
+
+	if s.issuableTLSA(context.Background(), published, nil, "") != nil {
+		t.Error("original remembered across isolation keys")
+	}
+}
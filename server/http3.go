@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// altSvcMaxAge is how long (in seconds) clients may remember that HTTP/3 is
+// available.
+const altSvcMaxAge = 86400
+
+// bindHTTP3 binds a UDP socket on ListenTLSPort of each ListenIP for the
+// HTTP/3 listeners.
+func (s *Server) bindHTTP3() error {
+	for _, addr := range s.cfg.listenAddrs(s.cfg.ListenTLSPort) {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+
+		s.listeners.http3 = append(s.listeners.http3, conn)
+	}
+
+	return nil
+}
+
+// serveHTTP3 serves HTTP/3 on conn until Stop is called, with the same TLS
+// settings and listen certificate as the HTTPS listeners.
+func (s *Server) serveHTTP3(conn net.PacketConn, tlsConfig *tls.Config) {
+	srv := &http3.Server{
+		Handler:   s.handler,
+		TLSConfig: tlsConfig,
+
+		// 0-RTT requests can be replayed, and the key endpoints
+		// aren't idempotent.
+		QUICConfig: &quic.Config{Allow0RTT: false},
+	}
+
+	s.httpServersMutex.Lock()
+	s.http3Servers = append(s.http3Servers, srv)
+	s.httpServersMutex.Unlock()
+
+	err := srv.Serve(conn)
+	if !errors.Is(err, http.ErrServerClosed) {
+		s.fail(fmt.Errorf("unable to serve HTTP/3 on %s: %w", conn.LocalAddr(), err))
+	}
+}
+
+// altSvcHandler advertises the HTTP/3 listeners in the responses of the
+// HTTPS listeners, so that clients can switch to QUIC.
+func (s *Server) altSvcHandler(next http.Handler) http.Handler {
+	altSvc := fmt.Sprintf("h3=\":%d\"; ma=%d", s.cfg.ListenTLSPort, altSvcMaxAge)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+
+		next.ServeHTTP(w, req)
+	})
+}
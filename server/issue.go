@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/safetlsa"
+)
+
+// ErrNotSigner is returned when a CA private key can't be used for signing.
+var ErrNotSigner = errors.New("private key is not a crypto.Signer")
+
+// Extensions that x509.CreateCertificate generates from template fields.
+// Any other extension of a reissued cert is carried over verbatim.
+var templateExtensionOIDs = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14},              // Subject Key Identifier
+	{2, 5, 29, 15},              // Key Usage
+	{2, 5, 29, 17},              // Subject Alternative Name
+	{2, 5, 29, 19},              // Basic Constraints
+	{2, 5, 29, 30},              // Name Constraints
+	{2, 5, 29, 31},              // CRL Distribution Points
+	{2, 5, 29, 32},              // Certificate Policies
+	{2, 5, 29, 35},              // Authority Key Identifier
+	{2, 5, 29, 37},              // Extended Key Usage
+	{1, 3, 6, 1, 5, 5, 7, 1, 1}, // Authority Information Access
+}
+
+// asSigner returns priv as a crypto.Signer, which all of our CA keys must be
+// (whether they're in memory or on a hardware token).
+func asSigner(priv interface{}) (crypto.Signer, error) {
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrNotSigner, priv)
+	}
+
+	return signer, nil
+}
+
+// issueDomainCert generates the domain cert for a TLSA record published for
+// service at domain, applies the server's issuance settings to it, and
+// remembers it for OCSP and in the logs.  tlsa is the form of the published
+// record that the cert is generated from (see issuableTLSA).  If wildcard is
+// set, a DANE-EE leaf cert also covers *.domain.  (The CA certs generated from
+// DANE-TA records are already constrained to domain and its subdomains.)
+func (s *Server) issueDomainCert(ctx context.Context, domain, service string, published, tlsa *dns.TLSA,
+	tld *tldCA, wildcard bool) (safeCert []byte, err error) {
+	event := newAuditEvent(ctx, auditIssueDomainCert, time.Now())
+	event.Domain = domain
+	event.Service = service
+	event.setTLSA(published)
+
+	_, span := s.startSpan(ctx, "cert.sign", attrDomain.String(domain), attrService.String(service))
+
+	defer func() {
+		event.finish(err)
+		s.audit(event)
+		endSpan(span, err)
+	}()
+
+	if tlsa.Usage == tlsaUsageDANEEE {
+		safeCert, err = s.daneEECert(domain, tlsa, tld, wildcard)
+	} else {
+		safeCert, err = safetlsa.GetCertFromTLSA(domain, tlsa, tld.cert, tld.priv)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	safeCert, err = s.finishDomainCert(safeCert, tld)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := x509.ParseCertificate(safeCert)
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(attrSerial.String(parsed.SerialNumber.String()))
+	event.setCert(safeCert)
+
+	err = s.logIssued(safeCert, tld.cert)
+	if err != nil {
+		return nil, err
+	}
+
+	s.issuedCertCache.add(tld.name+"/"+parsed.SerialNumber.String(), cachedCert{
+		domain:  domain,
+		service: service,
+		certDer: safeCert,
+		tlsa:    published,
+	})
+
+	return safeCert, nil
+}
+
+// finishDomainCert adds the fields that safetlsa doesn't know about (the
+// OCSP responder URL and CRL distribution point) to a domain cert, and
+// applies the configured validity and serial number policies, re-signing it
+// with the TLD CA.
+func (s *Server) finishDomainCert(der []byte, tld *tldCA) ([]byte, error) {
+	if s.cfg.OCSPURL == "" && s.cfg.CRLURL == "" &&
+		s.domainCertValidity == 0 && s.cfg.DomainCertSerialBits == 0 {
+		return der, nil
+	}
+
+	var serial *big.Int
+
+	if s.cfg.DomainCertSerialBits != 0 {
+		var err error
+
+		serial, err = randomSerial(s.cfg.DomainCertSerialBits)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reissueCert(der, tld.parsed, tld.priv, func(template *x509.Certificate) {
+		if s.cfg.OCSPURL != "" {
+			template.OCSPServer = []string{s.cfg.OCSPURL}
+		}
+
+		if s.cfg.CRLURL != "" {
+			template.CRLDistributionPoints = []string{tld.crlURL}
+		}
+
+		if s.domainCertValidity != 0 {
+			template.NotAfter = template.NotBefore.Add(s.domainCertValidity)
+			if template.NotAfter.After(tld.parsed.NotAfter) {
+				template.NotAfter = tld.parsed.NotAfter
+			}
+		}
+
+		if serial != nil {
+			template.SerialNumber = serial
+		}
+	})
+}
+
+// reissueCert re-signs der with parent/priv, after letting modify adjust the
+// template.  The serial number, subject, key and all extensions are
+// preserved unless modify changes them.
+func reissueCert(der []byte, parent *x509.Certificate, priv crypto.Signer,
+	modify func(*x509.Certificate)) ([]byte, error) {
+	template, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse cert for reissuing: %w", err)
+	}
+
+	template.ExtraExtensions = nil
+
+	for _, ext := range template.Extensions {
+		generated := false
+
+		for _, oid := range templateExtensionOIDs {
+			if ext.Id.Equal(oid) {
+				generated = true
+
+				break
+			}
+		}
+
+		if !generated {
+			template.ExtraExtensions = append(template.ExtraExtensions, ext)
+		}
+	}
+
+	// Let x509 pick the signature algorithm matching priv.
+	template.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+
+	modify(template)
+
+	return x509.CreateCertificate(rand.Reader, template, parent, template.PublicKey, priv)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Values of Config.KeyAlgorithm.
+const (
+	keyAlgorithmECDSA   = "ecdsa"
+	keyAlgorithmRSA     = "rsa"
+	keyAlgorithmEd25519 = "ed25519"
+)
+
+var (
+	// ErrKeyAlgorithm is returned for an unknown KeyAlgorithm or
+	// KeyCurve.
+	ErrKeyAlgorithm = errors.New("unsupported key algorithm")
+
+	// ErrKeyFormat is returned when a PEM private key can't be parsed in
+	// any of the supported formats.
+	ErrKeyFormat = errors.New("unsupported private key format")
+)
+
+// generateKey generates a private key of the algorithm, curve and size
+// selected in the config.
+func (cfg *Config) generateKey() (crypto.Signer, error) {
+	switch strings.ToLower(cfg.KeyAlgorithm) {
+	case keyAlgorithmECDSA:
+		curve, err := cfg.keyCurve()
+		if err != nil {
+			return nil, err
+		}
+
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case keyAlgorithmRSA:
+		return rsa.GenerateKey(rand.Reader, cfg.KeyBits)
+	case keyAlgorithmEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+
+		return priv, err
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrKeyAlgorithm, cfg.KeyAlgorithm)
+	}
+}
+
+// keyCurve returns the elliptic curve selected by KeyCurve.
+func (cfg *Config) keyCurve() (elliptic.Curve, error) {
+	switch strings.ToUpper(strings.ReplaceAll(cfg.KeyCurve, "-", "")) {
+	case "P256":
+		return elliptic.P256(), nil
+	case "P384":
+		return elliptic.P384(), nil
+	case "P521":
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("%w: curve %s", ErrKeyAlgorithm, cfg.KeyCurve)
+	}
+}
+
+// rekeySelfSigned re-signs a self-signed CA cert with a different key,
+// keeping everything else about the cert.  This lets us keep safetlsa's root
+// CA template while choosing the key algorithm ourselves.
+func rekeySelfSigned(der []byte, priv crypto.Signer) ([]byte, error) {
+	template, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	template.PublicKey = priv.Public()
+	template.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+	// Regenerated from the new key
+	template.SubjectKeyId = nil
+	template.AuthorityKeyId = nil
+	template.ExtraExtensions = nil
+
+	return x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+}
+
+// marshalPrivateKeyPEM encodes priv as PEM.  ECDSA keys use the SEC 1 "EC
+// PRIVATE KEY" format for compatibility with existing clients; other keys use
+// PKCS#8.
+func marshalPrivateKeyPEM(priv crypto.PrivateKey) ([]byte, error) {
+	if ecPriv, ok := priv.(*ecdsa.PrivateKey); ok {
+		privBytes, err := x509.MarshalECPrivateKey(ecPriv)
+		if err != nil {
+			return nil, err
+		}
+
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: privBytes,
+		}), nil
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privBytes,
+	}), nil
+}
+
+// parsePrivateKeyBlock parses an ECDSA, RSA or Ed25519 private key from a PEM
+// block in SEC 1, PKCS#1 or PKCS#8 format.
+func parsePrivateKeyBlock(block *pem.Block) (crypto.Signer, error) {
+	var (
+		priv interface{}
+		err  error
+	)
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrKeyFormat, block.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return asSigner(priv)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"runtime/debug"
+)
+
+// pathRequestSizes overrides MaxRequestSize for endpoints whose requests
+// are always small.
+var pathRequestSizes = map[string]int64{
+	"/rehydrate": maxDehydratedSize,
+}
+
+// defaultMultipartMemory is how much of a multipart form is kept in memory
+// when MaxRequestSize is unlimited (as net/http's FormValue does).
+const defaultMultipartMemory = 32 << 20
+
+// limitHandler caps request bodies at MaxRequestSize and parses forms up
+// front, so that an oversized or malformed body gets an error response
+// instead of being silently ignored by FormValue.
+func (s *Server) limitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		limit := int64(s.cfg.MaxRequestSize)
+		if pathLimit, ok := pathRequestSizes[req.URL.Path]; ok && (limit == 0 || pathLimit < limit) {
+			limit = pathLimit
+		}
+
+		if limit != 0 {
+			req.Body = http.MaxBytesReader(w, req.Body, limit)
+		}
+
+		var err error
+
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType == "multipart/form-data" {
+			memory := limit
+			if memory == 0 {
+				memory = defaultMultipartMemory
+			}
+
+			err = req.ParseMultipartForm(memory)
+		} else {
+			// Other bodies (e.g. OCSP and ACME requests) are left
+			// for the handler to read.
+			err = req.ParseForm()
+		}
+
+		var tooLarge *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &tooLarge):
+			writeError(w, http.StatusRequestEntityTooLarge, errCodeRequestTooLarge,
+				fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+
+			return
+		case err != nil:
+			writeError(w, http.StatusBadRequest, errCodeBadRequest, "malformed request: "+err.Error())
+
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// recoverHandler turns a panicking handler into a 500 response, so that a
+// bug triggered by one request is logged instead of silently dropping the
+// connection.
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			// Used by handlers to abort a response on purpose
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			log.Errore(fmt.Errorf("%v\n%s", recovered, debug.Stack()), "Panic serving "+req.URL.Path)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "internal error")
+		}()
+
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shutdownTimeout is how long Stop waits for requests in progress.
+const shutdownTimeout = 10 * time.Second
+
+// ErrNoClientCAs is returned when the KeyEndpointsClientCA file contains no
+// certificates.
+var ErrNoClientCAs = errors.New("no certificates found")
+
+// listenAddrs returns a host:port address for each IP in the comma-separated
+// ListenIP list.  IPv6 literals may optionally be wrapped in brackets.
+func (cfg *Config) listenAddrs(port int) []string {
+	addrs := []string{}
+
+	for _, ip := range strings.Split(cfg.ListenIP, ",") {
+		ip = strings.TrimSpace(ip)
+		ip = strings.TrimPrefix(ip, "[")
+		ip = strings.TrimSuffix(ip, "]")
+
+		if ip == "" {
+			continue
+		}
+
+		addrs = append(addrs, net.JoinHostPort(ip, strconv.Itoa(port)))
+	}
+
+	return addrs
+}
+
+// listenTLSConfig returns the tls.Config for the HTTPS listeners.
+func (s *Server) listenTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: s.getListenCert,
+	}
+
+	err := s.applyTLSSettings(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cfg.KeyEndpointsClientCA != "" {
+		caPem, err := ioutil.ReadFile(s.cfg.KeyEndpointsClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, ErrNoClientCAs
+		}
+
+		// Client certs are only required by the key endpoints, which
+		// check for them explicitly.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// listenerSet holds the sockets the server accepts connections on.
+type listenerSet struct {
+	http  []net.Listener
+	tls   []net.Listener
+	grpc  []net.Listener
+	http3 []net.PacketConn
+}
+
+// close closes all of the sockets.
+func (l *listenerSet) close() {
+	for _, listeners := range [][]net.Listener{l.http, l.tls, l.grpc} {
+		for _, listener := range listeners {
+			err := listener.Close()
+			if err != nil {
+				log.Debuge(err, "Unable to close listener")
+			}
+		}
+	}
+
+	for _, conn := range l.http3 {
+		err := conn.Close()
+		if err != nil {
+			log.Debuge(err, "Unable to close listener")
+		}
+	}
+}
+
+// bindListeners binds the configured Unix socket, and the TCP listeners
+// unless systemd already passed us sockets.  This happens in New, before
+// privileges are dropped, so that ports below 1024 can be used.
+func (s *Server) bindListeners() error {
+	if s.cfg.ListenUnixSocket != "" {
+		listener, err := s.bindUnixSocket(s.cfg.ListenUnixSocket)
+		if err != nil {
+			return err
+		}
+
+		s.listeners.http = append(s.listeners.http, listener)
+	}
+
+	if s.socketActivated() {
+		return nil
+	}
+
+	for _, addr := range s.cfg.listenAddrs(s.cfg.ListenPort) {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		s.listeners.http = append(s.listeners.http, listener)
+	}
+
+	for _, addr := range s.cfg.listenAddrs(s.cfg.ListenTLSPort) {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		s.listeners.tls = append(s.listeners.tls, listener)
+	}
+
+	if s.cfg.HTTP3 {
+		err := s.bindHTTP3()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.GRPCPort != 0 {
+		for _, addr := range s.cfg.listenAddrs(s.cfg.GRPCPort) {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+
+			s.listeners.grpc = append(s.listeners.grpc, listener)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) bindUnixSocket(path string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(s.cfg.ListenUnixSocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Unix socket mode %s: %w", s.cfg.ListenUnixSocketMode, err)
+	}
+
+	// A socket left behind by an unclean shutdown would make Listen fail.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, os.FileMode(mode))
+	if err != nil {
+		listener.Close()
+
+		return nil, fmt.Errorf("unable to set permissions of %s: %w", path, err)
+	}
+
+	return listener, nil
+}
+
+// serve accepts connections on listener until Stop is called.  They're
+// served over TLS if tlsConfig isn't nil.
+func (s *Server) serve(listener net.Listener, tlsConfig *tls.Config) {
+	srv := &http.Server{
+		Handler: s.handler,
+	}
+
+	useTLS := tlsConfig != nil
+
+	if useTLS {
+		srv.TLSConfig = tlsConfig
+
+		if len(s.listeners.http3) > 0 {
+			srv.Handler = s.altSvcHandler(s.handler)
+		}
+
+		if !s.cfg.TLSHTTP2 {
+			// A non-nil TLSNextProto keeps net/http from adding h2.
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+			tlsConfig.NextProtos = []string{"http/1.1"}
+		}
+	}
+
+	s.httpServersMutex.Lock()
+	s.httpServers = append(s.httpServers, srv)
+	s.httpServersMutex.Unlock()
+
+	var err error
+
+	if useTLS {
+		// The listen certificate comes from GetCertificate, so that it
+		// can be renewed without restarting.
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		err = srv.Serve(listener)
+	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
+		s.fail(fmt.Errorf("unable to serve on %s: %w", listener.Addr(), err))
+	}
+}
+
+// shutdownListeners gracefully stops the HTTP servers, waiting up to
+// shutdownTimeout for requests in progress.
+func (s *Server) shutdownListeners() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	s.httpServersMutex.Lock()
+	servers := s.httpServers
+	s.httpServers = nil
+	http3Servers := s.http3Servers
+	s.http3Servers = nil
+	s.httpServersMutex.Unlock()
+
+	var result error
+
+	if s.grpcServer != nil {
+		s.stopGRPC(ctx)
+	}
+
+	for _, srv := range servers {
+		err := srv.Shutdown(ctx)
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+
+	for _, srv := range http3Servers {
+		err := srv.Shutdown(ctx)
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+
+	// Unlike net.Listeners, the UDP sockets aren't closed by their
+	// servers.
+	for _, conn := range s.listeners.http3 {
+		err := conn.Close()
+		if err != nil {
+			log.Debuge(err, "Unable to close HTTP/3 listener")
+		}
+	}
+
+	// After chrooting, the socket's path is out of reach.
+	if s.cfg.ListenUnixSocket != "" && s.chrootDir == "" {
+		err := os.Remove(s.cfg.ListenUnixSocket)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warne(err, "Unable to remove Unix socket")
+		}
+	}
+
+	return result
+}
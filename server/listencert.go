@@ -0,0 +1,358 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNoListenTLD is returned when no configured TLD covers the listen
+// certificate's hostname.
+var ErrNoListenTLD = fmt.Errorf("no configured TLD covers %s", aiaHostname)
+
+// ErrNoListenCert is returned by the HTTPS listeners' GetCertificate before a
+// listen certificate has been loaded.
+var ErrNoListenCert = errors.New("no listen certificate loaded")
+
+// ErrListenCertName is returned when a ListenCertNames entry is malformed or
+// isn't allowed by the name constraints of the CAs issuing the listen
+// certificate.
+var ErrListenCertName = errors.New("invalid listen certificate name")
+
+// ErrListenCertInvalid is returned when the listen certificate on disk
+// can't be served: it doesn't chain to the root CA or has expired.
+var ErrListenCertInvalid = errors.New("invalid listen certificate")
+
+// listenCertRetry is how long to wait before retrying a failed renewal.
+const listenCertRetry = 1 * time.Hour
+
+// listenCertNames returns the DNS names and IP addresses the listen
+// certificate is issued for: aiaHostname and the ListenCertNames.
+func (cfg *Config) listenCertNames() ([]string, []net.IP, error) {
+	dnsNames := []string{aiaHostname}
+	ips := []net.IP{}
+
+	for _, name := range strings.Split(cfg.ListenCertNames, ",") {
+		name = strings.TrimSpace(name)
+
+		switch {
+		case name == "":
+			continue
+		case net.ParseIP(strings.Trim(name, "[]")) != nil:
+			ips = append(ips, net.ParseIP(strings.Trim(name, "[]")))
+		default:
+			_, ok := dns.IsDomainName(name)
+			if !ok || strings.Contains(name, "*") {
+				return nil, nil, fmt.Errorf("%w: %q", ErrListenCertName, name)
+			}
+
+			dnsNames = append(dnsNames, strings.ToLower(strings.TrimSuffix(name, ".")))
+		}
+	}
+
+	return dnsNames, ips, nil
+}
+
+// listenCertCoversNames reports whether leaf is valid for all of the
+// configured listen certificate names.
+func (s *Server) listenCertCoversNames(leaf *x509.Certificate) bool {
+	dnsNames, ips, err := s.cfg.listenCertNames()
+	if err != nil {
+		return true
+	}
+
+	for _, ip := range ips {
+		dnsNames = append(dnsNames, ip.String())
+	}
+
+	for _, name := range dnsNames {
+		if leaf.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// issueListenCert generates a new listen key, and a certificate for it issued
+// by the TLD CA covering aiaHostname.  It returns the PEM-encoded chain (up
+// to the root CA) and private key.
+func (s *Server) issueListenCert() ([]byte, []byte, error) {
+	listenTLD := s.tldForDomain(aiaHostname)
+	if listenTLD == nil {
+		return nil, nil, ErrNoListenTLD
+	}
+
+	dnsNames, ips, err := s.cfg.listenCertNames()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := randomSerial(s.cfg.SerialBits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate serial number: %w", err)
+	}
+
+	listenPriv, err := s.cfg.generateKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate listening key: %w", err)
+	}
+
+	listenPrivBytes, err := x509.MarshalPKCS8PrivateKey(listenPriv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to marshal private key: %w", err)
+	}
+
+	listenTemplate := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   aiaHostname,
+			SerialNumber: "Namecoin TLS Certificate",
+		},
+		NotBefore: time.Now().Add(-1 * time.Hour),
+		NotAfter:  time.Now().Add(s.listenCertValidity),
+
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+	}
+
+	listenCert, err := x509.CreateCertificate(rand.Reader, &listenTemplate,
+		listenTLD.parsed, listenPriv.Public(), listenTLD.priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create listening cert: %w", err)
+	}
+
+	if len(dnsNames) > 1 || len(ips) > 0 {
+		err = s.verifyListenCert(listenCert, listenTLD)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	listenCertPemString := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: listenCert,
+	}))
+
+	listenPrivPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: listenPrivBytes,
+	})
+
+	listenChainPemString := listenCertPemString + "\n\n" + listenTLD.certPemString + "\n\n" + s.rootCertPemString
+
+	return []byte(listenChainPemString), listenPrivPem, nil
+}
+
+// verifyListenCert checks that clients will accept the listen certificate
+// for all of its names, which the name constraints of the TLD and root CAs
+// may not allow.
+func (s *Server) verifyListenCert(der []byte, listenTLD *tldCA) error {
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.rootCertParsed)
+
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(listenTLD.parsed)
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrListenCertName, err)
+	}
+
+	return nil
+}
+
+// loadListenCert loads the listen chain and key from disk for the HTTPS
+// listeners.  If they're missing or unusable and AutoRegenerate is set, a
+// new listen certificate is issued instead.
+func (s *Server) loadListenCert() error {
+	cert, err := s.readListenCert()
+	if err != nil && s.cfg.AutoRegenerate {
+		log.Warne(err, "Unable to use the listen certificate; regenerating it")
+
+		return s.renewListenCert()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.listenCertMutex.Lock()
+	s.listenCert = cert
+	s.listenCertMutex.Unlock()
+
+	return nil
+}
+
+// readListenCert reads the listen chain and key from disk, and checks that
+// the key matches the leaf and that the chain is valid up to the root CA
+// now.
+func (s *Server) readListenCert() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(s.cfg.ListenChain, s.cfg.ListenKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, fmt.Errorf("%w: expired at %s", ErrListenCertInvalid, cert.Leaf.NotAfter)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.rootCertParsed)
+
+	intermediates := x509.NewCertPool()
+
+	for _, der := range cert.Certificate[1:] {
+		intermediate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrListenCertInvalid, err)
+		}
+
+		intermediates.AddCert(intermediate)
+	}
+
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrListenCertInvalid, err)
+	}
+
+	return &cert, nil
+}
+
+// getListenCert is the GetCertificate callback of the HTTPS listeners, so
+// that a renewed listen certificate takes effect without restarting them.
+func (s *Server) getListenCert(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	err := s.checkServerName(hello)
+	if err != nil {
+		return nil, err
+	}
+
+	s.listenCertMutex.RLock()
+	defer s.listenCertMutex.RUnlock()
+
+	if s.listenCert == nil {
+		return nil, ErrNoListenCert
+	}
+
+	return s.listenCert, nil
+}
+
+// renewListenCert issues a new listen certificate, writes it to disk so
+// that it survives restarts, and swaps it into the running listeners.
+func (s *Server) renewListenCert() error {
+	chainPem, privPem, err := s.issueListenCert()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(chainPem, privPem)
+	if err != nil {
+		return err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(s.cfg.ListenKey, privPem, 0600)
+	if err == nil {
+		err = ioutil.WriteFile(s.cfg.ListenChain, chainPem, 0600)
+	}
+
+	if err != nil {
+		log.Warne(err, "Unable to write renewed listen certificate; it will be renewed again on restart")
+	}
+
+	s.listenCertMutex.Lock()
+	s.listenCert = &cert
+	s.listenCertMutex.Unlock()
+
+	log.Infof("Renewed listen certificate, valid until %s", cert.Leaf.NotAfter)
+
+	return nil
+}
+
+// scheduleListenCertRenewal arms a timer to renew the listen certificate
+// ListenCertRenew before it expires, replacing any timer armed earlier.
+func (s *Server) scheduleListenCertRenewal() {
+	s.listenCertMutex.Lock()
+	defer s.listenCertMutex.Unlock()
+
+	if s.listenCertTimer != nil {
+		s.listenCertTimer.Stop()
+		s.listenCertTimer = nil
+	}
+
+	if s.listenCert == nil {
+		return
+	}
+
+	namesMissing := !s.listenCertCoversNames(s.listenCert.Leaf)
+
+	if s.listenCertRenewBefore == 0 {
+		if namesMissing {
+			log.Warn("The listen certificate doesn't cover all of ListenCertNames; regenerate it with encayagen")
+		}
+
+		return
+	}
+
+	delay := time.Until(s.listenCert.Leaf.NotAfter.Add(-s.listenCertRenewBefore))
+	if namesMissing {
+		log.Info("The listen certificate doesn't cover all of ListenCertNames; renewing it")
+
+		delay = 0
+	}
+	s.listenCertTimer = time.AfterFunc(delay, s.listenCertRenewalDue)
+}
+
+func (s *Server) listenCertRenewalDue() {
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+
+	err := s.renewListenCert()
+	if err != nil {
+		log.Errore(err, "Unable to renew listen certificate")
+
+		s.listenCertMutex.Lock()
+		s.listenCertTimer = time.AfterFunc(listenCertRetry, s.listenCertRenewalDue)
+		s.listenCertMutex.Unlock()
+
+		return
+	}
+
+	s.scheduleListenCertRenewal()
+}
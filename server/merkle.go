@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// Merkle Tree Hash and proofs as defined in RFC 6962 section 2.1.
+
+func merkleLeafHash(leaf []byte) []byte {
+	hash := sha256.New()
+	_, _ = hash.Write([]byte{0})
+	_, _ = hash.Write(leaf)
+
+	return hash.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	hash := sha256.New()
+	_, _ = hash.Write([]byte{1})
+	_, _ = hash.Write(left)
+	_, _ = hash.Write(right)
+
+	return hash.Sum(nil)
+}
+
+// merkleSplit returns the largest power of two smaller than n (n > 1).
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+
+	return k
+}
+
+// merkleTree is an append-only Merkle tree that keeps the hash of every
+// complete subtree, so that the tree hash and proofs of any of its prefixes
+// take O(log n) hashes to compute instead of rehashing every leaf.
+type merkleTree struct {
+	// levels[h][i] is the hash of the complete subtree of the leaves
+	// i*2^h to (i+1)*2^h-1; levels[0] holds the leaf hashes.
+	levels [][][]byte
+}
+
+// size returns the number of leaves.
+func (t *merkleTree) size() int {
+	if len(t.levels) == 0 {
+		return 0
+	}
+
+	return len(t.levels[0])
+}
+
+// append adds a leaf, given its leaf hash.
+func (t *merkleTree) append(leafHash []byte) {
+	hash := leafHash
+
+	for height := 0; ; height++ {
+		if height == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+
+		t.levels[height] = append(t.levels[height], hash)
+
+		// A left child has no sibling yet.
+		count := len(t.levels[height])
+		if count%2 == 1 {
+			return
+		}
+
+		hash = merkleNodeHash(t.levels[height][count-2], hash)
+	}
+}
+
+// subtreeHash returns MTH(D[start:end]).  The range must be one that the
+// RFC 6962 recursion visits, i.e. start must be a multiple of the largest
+// power of two that isn't smaller than end-start.
+func (t *merkleTree) subtreeHash(start, end int) []byte {
+	n := end - start
+
+	switch {
+	case n == 0:
+		empty := sha256.Sum256(nil)
+
+		return empty[:]
+	case n&(n-1) == 0:
+		height := bits.TrailingZeros(uint(n))
+
+		return t.levels[height][start>>height]
+	}
+
+	k := merkleSplit(n)
+
+	return merkleNodeHash(t.subtreeHash(start, start+k), t.subtreeHash(start+k, end))
+}
+
+// rootHash returns MTH(D[n]), the tree hash of the first n leaves.
+func (t *merkleTree) rootHash(n int) []byte {
+	return t.subtreeHash(0, n)
+}
+
+// auditPath returns PATH(m, D[n]), the inclusion proof of leaf m in the tree
+// of the first n leaves.
+func (t *merkleTree) auditPath(m, n int) [][]byte {
+	return t.subtreeAuditPath(m, 0, n)
+}
+
+func (t *merkleTree) subtreeAuditPath(m, start, end int) [][]byte {
+	n := end - start
+	if n <= 1 {
+		return [][]byte{}
+	}
+
+	k := merkleSplit(n)
+
+	if m < k {
+		return append(t.subtreeAuditPath(m, start, start+k), t.subtreeHash(start+k, end))
+	}
+
+	return append(t.subtreeAuditPath(m-k, start+k, end), t.subtreeHash(start, start+k))
+}
+
+// consistencyProof returns PROOF(m, D[n]), proving that the tree of the
+// first m leaves is a prefix of the tree of the first n.
+func (t *merkleTree) consistencyProof(m, n int) [][]byte {
+	if m == 0 || m == n {
+		return [][]byte{}
+	}
+
+	return t.subproof(m, 0, n, true)
+}
+
+func (t *merkleTree) subproof(m, start, end int, complete bool) [][]byte {
+	n := end - start
+
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+
+		return [][]byte{t.subtreeHash(start, end)}
+	}
+
+	k := merkleSplit(n)
+
+	if m <= k {
+		return append(t.subproof(m, start, start+k, complete), t.subtreeHash(start+k, end))
+	}
+
+	return append(t.subproof(m-k, start+k, end, false), t.subtreeHash(start, start+k))
+}
@@ -0,0 +1,477 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Formats supported by AccessLogFormat.
+const (
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// uncompressedPaths are never compressed: /watch streams events that must
+// reach the client as soon as they're flushed, and the key endpoints return
+// private keys next to client-supplied input, which compression would leak
+// through the response length (BREACH).
+var uncompressedPaths = map[string]bool{
+	"/watch":               true,
+	"/get-new-negative-ca": true,
+	"/cross-sign-ca":       true,
+}
+
+// middleware wraps the API handler in the chain configured by
+// MaxRequestSize, ResponseSigning, Compression and AccessLog.  Every response
+// carries an X-Request-ID, which is also included in error bodies and audit
+// log events.
+func (s *Server) middleware(next http.Handler) http.Handler {
+	next = recoverHandler(s.limitHandler(next))
+
+	// Signatures are over the uncompressed body.
+	if s.cfg.ResponseSigning {
+		next = s.signHandler(next)
+	}
+
+	if s.cfg.Compression {
+		next = compressHandler(next)
+	}
+
+	if s.cfg.AccessLog != "" {
+		next = s.accessLogHandler(next)
+	}
+
+	return s.requestIDHandler(next)
+}
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the request ID attached by requestIDHandler
+// or grpcInterceptor, if any.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+
+	return id
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+
+	_, err := rand.Read(id)
+	if err != nil {
+		// crypto/rand doesn't fail on supported platforms.
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// validRequestID reports whether a request ID passed on by a proxy is safe
+// to echo back and write to logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestIDHandler assigns each request an ID, keeping the one set by a
+// trusted proxy so that its logs can be correlated with ours.
+func (s *Server) requestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := ""
+
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if ip := net.ParseIP(host); err == nil && ip != nil && s.isTrustedProxy(ip) {
+			id = req.Header.Get(requestIDHeader)
+		}
+
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		req.Header.Set(requestIDHeader, id)
+		w.Header().Set(requestIDHeader, id)
+
+		next.ServeHTTP(w, req.WithContext(withRequestID(req.Context(), id)))
+	})
+}
+
+// responseRecorder remembers the status code and body size written by a
+// handler.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	// Informational responses are followed by the real one.
+	if !r.wroteHeader && status >= http.StatusOK {
+		r.status = status
+		r.wroteHeader = true
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Compressors are reused, since each one allocates several hundred KiB.
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// compressor is implemented by gzip.Writer and zlib.Writer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// returning "" if the client accepts neither.
+func negotiateEncoding(header string) string {
+	deflate := false
+
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if ok {
+			value, err := strconv.ParseFloat(q, 64)
+			if err != nil || value == 0 {
+				continue
+			}
+		}
+
+		switch coding {
+		case "gzip", "x-gzip":
+			return "gzip"
+		case "deflate":
+			deflate = true
+		}
+	}
+
+	if deflate {
+		return "deflate"
+	}
+
+	return ""
+}
+
+// compressWriter compresses the body of a response, unless it turns out
+// not to have one or to be an event stream.  The compressor is only taken
+// from its pool once there's something to compress.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	decided  bool
+	compress bool
+	writer   compressor
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.decided || status < http.StatusOK {
+		c.ResponseWriter.WriteHeader(status)
+
+		return
+	}
+
+	c.decided = true
+
+	header := c.Header()
+	c.compress = status != http.StatusNoContent && status != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" &&
+		!strings.HasPrefix(header.Get("Content-Type"), "text/event-stream")
+
+	if c.compress {
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+	}
+
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.decided {
+		// net/http would sniff the compressed bytes instead.
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if !c.compress {
+		return c.ResponseWriter.Write(p)
+	}
+
+	if c.writer == nil {
+		if c.encoding == "gzip" {
+			c.writer, _ = gzipWriters.Get().(compressor)
+		} else {
+			c.writer, _ = zlibWriters.Get().(compressor)
+		}
+
+		c.writer.Reset(c.ResponseWriter)
+	}
+
+	return c.writer.Write(p)
+}
+
+func (c *compressWriter) Flush() {
+	if c.writer != nil {
+		err := c.writer.Flush()
+		if err != nil {
+			log.Debuge(err, "flush compressed response")
+		}
+	}
+
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// close finishes the compressed stream and returns the compressor to its
+// pool.
+func (c *compressWriter) close() {
+	if c.writer == nil {
+		return
+	}
+
+	err := c.writer.Close()
+	if err != nil {
+		log.Debuge(err, "finish compressed response")
+	}
+
+	if c.encoding == "gzip" {
+		gzipWriters.Put(c.writer)
+	} else {
+		zlibWriters.Put(c.writer)
+	}
+
+	c.writer = nil
+}
+
+// compressHandler compresses responses with gzip or deflate when the client
+// accepts it.  PEM bundles shrink about 4x.
+func compressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if uncompressedPaths[req.URL.Path] {
+			next.ServeHTTP(w, req)
+
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, req)
+
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+
+		next.ServeHTTP(cw, req)
+	})
+}
+
+// accessLog writes one line per HTTP request to a file or standard error.
+type accessLog struct {
+	format string
+
+	mu   sync.Mutex
+	out  io.Writer
+	file *os.File
+}
+
+func openAccessLog(path, format string) (*accessLog, error) {
+	l := &accessLog{format: format}
+
+	if path == "-" {
+		l.out = os.Stderr
+
+		return l, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	l.file = file
+	l.out = file
+
+	return l, nil
+}
+
+// accessLogEntry is one line of a json access log.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	Client     string    `json:"client"`
+	Host       string    `json:"host,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// line formats entry in the configured format, including the trailing
+// newline.
+func (l *accessLog) line(entry accessLogEntry) ([]byte, error) {
+	if l.format == accessLogJSON {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(line, '\n'), nil
+	}
+
+	size := "-"
+	if entry.Bytes != 0 {
+		size = strconv.FormatInt(entry.Bytes, 10)
+	}
+
+	line := fmt.Sprintf("%s - - [%s] %s %d %s", entry.Client, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(entry.Method+" "+entry.URI+" "+entry.Proto), entry.Status, size)
+
+	if l.format == accessLogCombined {
+		line += " " + quoteLogField(entry.Referer) + " " + quoteLogField(entry.UserAgent)
+	}
+
+	return []byte(line + "\n"), nil
+}
+
+// quoteLogField quotes a header value for the combined format, which logs
+// missing values as "-".
+func quoteLogField(value string) string {
+	if value == "" {
+		value = "-"
+	}
+
+	return strconv.Quote(value)
+}
+
+func (l *accessLog) write(entry accessLogEntry) error {
+	line, err := l.line(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.out.Write(line)
+
+	return err
+}
+
+func (l *accessLog) close() error {
+	if l.file == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
+
+// accessLogHandler logs every request once it has been served.  The log is
+// opened after the handler chain is built, so it's looked up per request.
+func (s *Server) accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := newResponseRecorder(w)
+
+		next.ServeHTTP(recorder, req)
+
+		if s.accessLog == nil {
+			return
+		}
+
+		err := s.accessLog.write(accessLogEntry{
+			Time:       start,
+			RequestID:  requestIDFromContext(req.Context()),
+			Client:     s.clientIP(req),
+			Host:       req.Host,
+			Method:     req.Method,
+			URI:        req.RequestURI,
+			Proto:      req.Proto,
+			Status:     recorder.status,
+			Bytes:      recorder.bytes,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:    req.Referer(),
+			UserAgent:  req.UserAgent(),
+		})
+		if err != nil {
+			log.Errore(err, "Unable to write access log")
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha1" //nolint:gosec // Required by OCSP's CertID
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspValidity is how long an OCSP response may be cached by clients.
+// Domain certs are only valid while their TLSA records are, so this is kept
+// short.
+const ocspValidity = 10 * time.Minute
+
+// maxOCSPRequestSize bounds POSTed OCSP requests, which are tiny in
+// practice.
+const maxOCSPRequestSize = 10000
+
+// ocspHandler implements an RFC 6960 OCSP responder for the domain certs
+// issued by our TLD CAs.  A cert is good as long as the TLSA record it was
+// derived from is still published, revoked once it isn't, and unknown if we
+// have no record of issuing it.
+func (s *Server) ocspHandler(w http.ResponseWriter, req *http.Request) {
+	requestBytes, err := readOCSPRequest(req)
+	if err != nil {
+		log.Debuge(err, "Unable to read OCSP request")
+		writeOCSPResponse(w, ocsp.MalformedRequestErrorResponse)
+
+		return
+	}
+
+	ocspReq, err := ocsp.ParseRequest(requestBytes)
+	if err != nil {
+		log.Debuge(err, "Unable to parse OCSP request")
+		writeOCSPResponse(w, ocsp.MalformedRequestErrorResponse)
+
+		return
+	}
+
+	tld := s.tldForOCSPRequest(ocspReq)
+	if tld == nil {
+		// Not one of our CAs
+		writeOCSPResponse(w, ocsp.UnauthorizedErrorResponse)
+
+		return
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: ocspReq.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(ocspValidity),
+	}
+
+	// A cert for several names is remembered once for each name, and it's
+	// only good while all of their records are still published.
+	issued := s.issuedCertCache.get(tld.name + "/" + ocspReq.SerialNumber.String())
+	for _, name := range issued {
+		stillPublished, err := s.tlsaStillPublished(req.Context(), name)
+		if err != nil {
+			log.Debuge(err, "DNS error")
+			writeOCSPResponse(w, ocsp.TryLaterErrorResponse)
+
+			return
+		}
+
+		if !stillPublished {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = now
+			template.RevocationReason = ocsp.Superseded
+
+			break
+		}
+
+		template.Status = ocsp.Good
+	}
+
+	response, err := ocsp.CreateResponse(tld.parsed, tld.parsed, template, tld.priv)
+	if err != nil {
+		log.Debuge(err, "Unable to sign OCSP response")
+		writeOCSPResponse(w, ocsp.InternalErrorErrorResponse)
+
+		return
+	}
+
+	writeOCSPResponse(w, response)
+}
+
+// readOCSPRequest extracts the DER request from either a POST body or the
+// base64 path component of a GET request (RFC 6960 appendix A.1).
+func readOCSPRequest(req *http.Request) ([]byte, error) {
+	if req.Method == http.MethodPost {
+		return io.ReadAll(io.LimitReader(req.Body, maxOCSPRequestSize))
+	}
+
+	encoded := strings.TrimPrefix(req.URL.Path, "/ocsp")
+	encoded = strings.TrimPrefix(encoded, "/")
+
+	unescaped, err := url.PathUnescape(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(unescaped)
+}
+
+func writeOCSPResponse(w http.ResponseWriter, response []byte) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+
+	_, err := w.Write(response)
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
+
+// tldForOCSPRequest returns the TLD CA identified by the request's issuer
+// name and key hashes, or nil if it isn't one of ours.
+func (s *Server) tldForOCSPRequest(ocspReq *ocsp.Request) *tldCA {
+	var newHash func() hash.Hash
+
+	switch ocspReq.HashAlgorithm {
+	case crypto.SHA1:
+		newHash = sha1.New
+	case crypto.SHA256:
+		newHash = sha256.New
+	case crypto.SHA384:
+		newHash = sha512.New384
+	case crypto.SHA512:
+		newHash = sha512.New
+	default:
+		return nil
+	}
+
+	candidates := make([]*tldCA, 0, 2*len(s.tldNames))
+	for _, tldName := range s.tldNames {
+		candidates = append(candidates, s.tlds[tldName])
+	}
+
+	if s.previous != nil {
+		// Certs issued during a rotation's overlap stay valid after it
+		// ends, so keep answering for them.
+		for _, tldName := range s.previous.tldNames {
+			candidates = append(candidates, s.previous.tlds[tldName])
+		}
+	}
+
+	for _, tld := range candidates {
+		var spki struct {
+			Algorithm pkix.AlgorithmIdentifier
+			PublicKey asn1.BitString
+		}
+
+		_, err := asn1.Unmarshal(tld.parsed.RawSubjectPublicKeyInfo, &spki)
+		if err != nil {
+			continue
+		}
+
+		nameHash := newHash()
+		nameHash.Write(tld.parsed.RawSubject)
+
+		keyHash := newHash()
+		keyHash.Write(spki.PublicKey.RightAlign())
+
+		if string(nameHash.Sum(nil)) == string(ocspReq.IssuerNameHash) &&
+			string(keyHash.Sum(nil)) == string(ocspReq.IssuerKeyHash) {
+			return tld
+		}
+	}
+
+	return nil
+}
+
+// tlsaStillPublished reports whether the TLSA record an issued cert was
+// derived from is still published by its domain.
+func (s *Server) tlsaStillPublished(ctx context.Context, issued cachedCert) (bool, error) {
+	records, _, err := s.trustedTLSA(ctx, issued.domain, issued.service)
+	if err != nil {
+		return false, err
+	}
+
+	for _, tlsa := range records {
+		if tlsa.Usage == issued.tlsa.Usage &&
+			tlsa.Selector == issued.tlsa.Selector &&
+			tlsa.MatchingType == issued.tlsa.MatchingType &&
+			strings.EqualFold(tlsa.Certificate, issued.tlsa.Certificate) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCert returns a cert for name, signed by parent (or self-signed if
+// parent is nil).
+func testCert(t *testing.T, name string, serial int64, isCA bool, parent *tldCA) *tldCA {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+
+	issuer, issuerPriv := template, interface{}(priv)
+	if parent != nil {
+		issuer, issuerPriv = parent.parsed, parent.priv
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &priv.PublicKey, issuerPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tldCA{name: name, cert: der, parsed: parsed, priv: priv}
+}
+
+func TestOCSPHandler(t *testing.T) {
+	tld := testCert(t, "bit", 1, true, nil)
+	other := testCert(t, "other", 1, true, nil)
+
+	s := &Server{
+		tlds:            map[string]*tldCA{"bit": tld},
+		tldNames:        []string{"bit"},
+		issuedCertCache: newCertCache(0, 0),
+	}
+
+	ocspRequest := func(issuer *tldCA) []byte {
+		leaf := testCert(t, "example.bit", 42, false, issuer)
+
+		request, err := ocsp.CreateRequest(leaf.parsed, issuer.parsed, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return request
+	}
+
+	ours := ocspRequest(tld)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       []byte
+		wantError  ocsp.ResponseStatus
+		wantStatus int
+	}{
+		{
+			name:       "unknown cert over POST",
+			method:     http.MethodPost,
+			target:     "/ocsp",
+			body:       ours,
+			wantStatus: ocsp.Unknown,
+		},
+		{
+			name:       "unknown cert over GET",
+			method:     http.MethodGet,
+			target:     "/ocsp/" + url.PathEscape(base64.StdEncoding.EncodeToString(ours)),
+			wantStatus: ocsp.Unknown,
+		},
+		{
+			name:      "malformed",
+			method:    http.MethodPost,
+			target:    "/ocsp",
+			body:      []byte("not an OCSP request"),
+			wantError: ocsp.Malformed,
+		},
+		{
+			name:      "GET not base64",
+			method:    http.MethodGet,
+			target:    "/ocsp/not-base64!",
+			wantError: ocsp.Malformed,
+		},
+		{
+			name:      "another issuer",
+			method:    http.MethodPost,
+			target:    "/ocsp",
+			body:      ocspRequest(other),
+			wantError: ocsp.Unauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.target, bytes.NewReader(test.body))
+			w := httptest.NewRecorder()
+			s.ocspHandler(w, req)
+
+			if contentType := w.Header().Get("Content-Type"); contentType != "application/ocsp-response" {
+				t.Errorf("Content-Type is %s", contentType)
+			}
+
+			response, err := ocsp.ParseResponse(w.Body.Bytes(), tld.parsed)
+
+			var responseError ocsp.ResponseError
+			if errors.As(err, &responseError) {
+				if responseError.Status != test.wantError {
+					t.Errorf("got error response %v, want %v", responseError.Status, test.wantError)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.wantError != ocsp.Success {
+				t.Fatalf("got status %d, want error response %v", response.Status, test.wantError)
+			}
+
+			if response.Status != test.wantStatus || response.SerialNumber.Int64() != 42 {
+				t.Errorf("got status %d for serial %s, want %d for 42",
+					response.Status, response.SerialNumber, test.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// originalFingerprintKey returns the original cert cache key for a lookup by
+// the SHA-256 fingerprint of a cross-signed cert.
+func originalFingerprintKey(isolation string, fingerprint []byte) string {
+	return isolatedKey(isolation, fmt.Sprintf("sha256:%x", fingerprint))
+}
+
+// originalSKIDKey returns the original cert cache key for a lookup by the
+// Subject Key Identifier of a cross-signed cert (which it shares with the
+// original).
+func originalSKIDKey(isolation string, skid []byte) string {
+	return isolatedKey(isolation, fmt.Sprintf("skid:%x", skid))
+}
+
+// reconstructedOriginalKey returns the original cert cache key of a cert
+// reconstructed from the TLSA records of domain for service, for a lookup
+// under key.  Anyone can publish any cert in DNS, so reconstructed originals
+// are kept apart from the ones we cross-signed: they're only returned to
+// lookups that name the same domain and service.
+func reconstructedOriginalKey(key, domain, service string) string {
+	return key + "\x00" + service + "." + domain
+}
+
+// serialMatcher matches the originals of certs with the given serial number:
+// crosssign uses the original as the template of the cross-signed cert, so
+// they share a serial number.
+func serialMatcher(serial string) func(*x509.Certificate) bool {
+	return func(cert *x509.Certificate) bool {
+		return cert.SerialNumber.String() == serial
+	}
+}
+
+// skidMatcher matches the originals of certs with the given Subject Key
+// Identifier.
+func skidMatcher(skid []byte) func(*x509.Certificate) bool {
+	return func(cert *x509.Certificate) bool {
+		return bytes.Equal(cert.SubjectKeyId, skid)
+	}
+}
+
+// ErrOriginalUnknown is returned when the original of a cross-signed cert
+// is neither known nor reconstructable.
+var ErrOriginalUnknown = errors.New("unknown cross-signed certificate")
+
+// rememberOriginal indexes the original of a cross-signed cert by the
+// cross-signed cert's serial number, SHA-256 fingerprint and Subject Key
+// Identifier.
+func (s *Server) rememberOriginal(isolation string, crossSignedDER []byte, serial string, skid []byte,
+	originalPem string) {
+	fingerprint := sha256.Sum256(crossSignedDER)
+
+	s.cacheOriginalFromSerial(isolatedKey(isolation, serial), originalPem)
+	s.cacheOriginalFromSerial(originalFingerprintKey(isolation, fingerprint[:]), originalPem)
+
+	if len(skid) > 0 {
+		s.cacheOriginalFromSerial(originalSKIDKey(isolation, skid), originalPem)
+	}
+}
+
+// parseHexParam decodes a hex form parameter, ignoring case and the colons
+// that tools often print between bytes.
+func parseHexParam(req *http.Request, name string) ([]byte, error) {
+	value := strings.ReplaceAll(req.FormValue(name), ":", "")
+	if value == "" {
+		return nil, fmt.Errorf("missing %s", name)
+	}
+
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s: %w", name, err)
+	}
+
+	return decoded, nil
+}
+
+// original returns the original cert stored under key.  If it's neither
+// cached nor in the store and domain is set, it's reconstructed from the
+// TLSA records of domain for service: the first published full cert that
+// satisfies match is returned, and remembered in memory only (see
+// reconstructedOriginalKey).  match is nil if the key can't be checked
+// against a cert (e.g. the fingerprint of the cross-signed cert, which
+// depends on the signer).
+func (s *Server) original(ctx context.Context, key, domain, service, isolation string,
+	match func(*x509.Certificate) bool) (string, error) {
+	result, needRefresh := s.getCachedOriginalFromSerial(key)
+	if !needRefresh {
+		return result, nil
+	}
+
+	if domain == "" {
+		return "", fmt.Errorf("%w; pass its domain to reconstruct the original from DNS", ErrOriginalUnknown)
+	}
+
+	if match == nil {
+		return "", fmt.Errorf("%w; only serial numbers and Subject Key Identifiers can be reconstructed from DNS",
+			ErrOriginalUnknown)
+	}
+
+	certs := s.originalCertCache.get(reconstructedOriginalKey(key, domain, service))
+	if len(certs) > 0 {
+		return certs[0].certPem + "\n\n", nil
+	}
+
+	return s.reconstructOriginal(ctx, key, domain, service, isolation, match)
+}
+
+// reconstructOriginal implements the DNS fallback of original.
+func (s *Server) reconstructOriginal(ctx context.Context, key, domain, service, isolation string,
+	match func(*x509.Certificate) bool) (string, error) {
+	if s.tldForDomain(domain) == nil {
+		return "", fmt.Errorf("%w: %s isn't under a TLD we issue for", ErrOriginalUnknown, domain)
+	}
+
+	err := s.policy.check(domain)
+	if err != nil {
+		return "", err
+	}
+
+	dnsResponse, _, err := s.queryTLSA(ctx, domain, service, isolation)
+	if err != nil {
+		return "", err
+	}
+
+	if dnsResponse.MsgHdr.Rcode != dns.RcodeSuccess && dnsResponse.MsgHdr.Rcode != dns.RcodeNameError {
+		return "", fmt.Errorf("%w: rcode %s", ErrNoDNSResponse, dns.RcodeToString[dnsResponse.MsgHdr.Rcode])
+	}
+
+	// Like lookup, only trust authenticated or authoritative records.
+	if dnsResponse.MsgHdr.Rcode == dns.RcodeNameError ||
+		(!dnsResponse.MsgHdr.AuthenticatedData && !dnsResponse.MsgHdr.Authoritative) {
+		return "", fmt.Errorf("%w: %s publishes no authenticated TLSA records for %s", ErrOriginalUnknown, domain,
+			service)
+	}
+
+	for _, rr := range dnsResponse.Answer {
+		published, ok := rr.(*dns.TLSA)
+		if !ok || published.Selector != tlsaSelectorCert || published.MatchingType != tlsaMatchingFull {
+			// Only full certs can be originals.
+			continue
+		}
+
+		der, err := hex.DecodeString(published.Certificate)
+		if err != nil {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil || !match(cert) {
+			continue
+		}
+
+		certPem := string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: der,
+		}))
+
+		s.originalCertCache.add(reconstructedOriginalKey(key, domain, service), cachedCert{certPem: certPem})
+		s.rememberOriginalByHash(isolation, cert)
+
+		return certPem + "\n\n", nil
+	}
+
+	return "", fmt.Errorf("%w: no TLSA record of %s for %s publishes a matching certificate", ErrOriginalUnknown,
+		domain, service)
+}
+
+// writeOriginal responds with the original cert stored under key (see
+// original), or a JSON error.
+func (s *Server) writeOriginal(w http.ResponseWriter, req *http.Request, key string,
+	match func(*x509.Certificate) bool) {
+	domain := req.FormValue("domain")
+
+	service := ""
+
+	if domain != "" {
+		var err error
+
+		service, err = tlsaService(req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+
+			return
+		}
+	}
+
+	result, err := s.original(req.Context(), key, domain, service, isolationKey(req), match)
+	switch {
+	case errors.Is(err, ErrOriginalUnknown):
+		writeError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+
+		return
+	case errors.Is(err, ErrPolicyDenied):
+		writePolicyError(w, err)
+
+		return
+	case err != nil:
+		writeDNSError(w, err)
+
+		return
+	}
+
+	_, err = io.WriteString(w, result)
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
+
+func (s *Server) originalFromFingerprintHandler(w http.ResponseWriter, req *http.Request) {
+	fingerprint, err := parseHexParam(req, "sha256")
+	if err == nil && len(fingerprint) != sha256.Size {
+		err = fmt.Errorf("sha256 must be %d bytes", sha256.Size)
+	}
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+
+		return
+	}
+
+	// The fingerprint depends on the signer, so it can't be matched
+	// against published certs.
+	s.writeOriginal(w, req, originalFingerprintKey(isolationKey(req), fingerprint), nil)
+}
+
+func (s *Server) originalFromSKIDHandler(w http.ResponseWriter, req *http.Request) {
+	skid, err := parseHexParam(req, "skid")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+
+		return
+	}
+
+	s.writeOriginal(w, req, originalSKIDKey(isolationKey(req), skid), skidMatcher(skid))
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// ErrPassphrase is returned when the root key passphrase can't be obtained
+// from RootKeyPassphrase.
+var ErrPassphrase = errors.New("unable to get passphrase")
+
+// ErrNoPassphrase is returned when RootKey is encrypted but
+// RootKeyPassphrase isn't set.
+var ErrNoPassphrase = errors.New("private key is encrypted, but RootKeyPassphrase isn't set")
+
+const passphrasePrompt = "prompt"
+
+// checkPassphraseSource reports whether source is a valid RootKeyPassphrase
+// without reading it.
+func checkPassphraseSource(source string) error {
+	switch {
+	case source == "" || source == passphrasePrompt:
+		return nil
+	case strings.HasPrefix(source, "env:") && len(source) > len("env:"):
+		return nil
+	case strings.HasPrefix(source, "file:") && len(source) > len("file:"):
+		return nil
+	case strings.HasPrefix(source, "fd:"):
+		_, err := strconv.ParseUint(strings.TrimPrefix(source, "fd:"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("%w: invalid file descriptor in %s", ErrPassphrase, source)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("%w: %q isn't prompt, env:VAR, fd:N or file:PATH", ErrPassphrase, source)
+	}
+}
+
+// readPassphrase reads a passphrase from source: prompt asks on the
+// terminal (twice, if confirm is set), env:VAR reads and unsets an
+// environment variable, fd:N reads an inherited file descriptor until EOF,
+// and file:PATH reads a file.  A trailing newline is removed.
+func readPassphrase(source, prompt string, confirm bool) ([]byte, error) {
+	err := checkPassphraseSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var passphrase []byte
+
+	switch {
+	case source == passphrasePrompt:
+		passphrase, err = promptPassphrase(prompt, confirm)
+		if err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: environment variable %s isn't set", ErrPassphrase, name)
+		}
+
+		// Don't leak it to anything we might start.
+		os.Unsetenv(name)
+
+		passphrase = []byte(value)
+	case strings.HasPrefix(source, "fd:"):
+		fd, _ := strconv.ParseUint(strings.TrimPrefix(source, "fd:"), 10, 32)
+
+		file := os.NewFile(uintptr(fd), source)
+		defer file.Close()
+
+		passphrase, err = ioutil.ReadAll(file)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unable to read %s: %s", ErrPassphrase, source, err.Error())
+		}
+	case strings.HasPrefix(source, "file:"):
+		passphrase, err = ioutil.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrPassphrase, err.Error())
+		}
+	}
+
+	passphrase = bytes.TrimRight(passphrase, "\r\n")
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("%w: %s is empty", ErrPassphrase, source)
+	}
+
+	return passphrase, nil
+}
+
+func promptPassphrase(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("%w: standard input isn't a terminal", ErrPassphrase)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrPassphrase, err.Error())
+	}
+
+	if !confirm {
+		return passphrase, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrPassphrase, err.Error())
+	}
+
+	if !bytes.Equal(passphrase, repeated) {
+		return nil, fmt.Errorf("%w: passphrases don't match", ErrPassphrase)
+	}
+
+	return passphrase, nil
+}
+
+// getRootKeyPassphrase returns the passphrase for RootKey (and
+// PreviousRootKey), asking RootKeyPassphrase for it the first time.  It's
+// kept for reloads, since a prompt or file descriptor can only be read once.
+func (s *Server) getRootKeyPassphrase(confirm bool) ([]byte, error) {
+	if s.rootKeyPassphrase != nil {
+		return s.rootKeyPassphrase, nil
+	}
+
+	if s.cfg.RootKeyPassphrase == "" {
+		return nil, ErrNoPassphrase
+	}
+
+	passphrase, err := readPassphrase(s.cfg.RootKeyPassphrase, "Passphrase for "+s.cfg.RootKey+": ", confirm)
+	if err != nil {
+		return nil, err
+	}
+
+	s.rootKeyPassphrase = passphrase
+
+	return passphrase, nil
+}
@@ -0,0 +1,243 @@
+//go:build cgo
+// +build cgo
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+var (
+	// ErrPKCS11KeyNotFound is returned when no token or private key
+	// matches the PKCS#11 URI.
+	ErrPKCS11KeyNotFound = errors.New("PKCS#11 key not found")
+
+	// ErrPKCS11Mechanism is returned for key types and signature schemes
+	// we don't know how to use via PKCS#11.
+	ErrPKCS11Mechanism = errors.New("unsupported PKCS#11 signature scheme")
+)
+
+// DigestInfo prefixes for RSA PKCS#1 v1.5 signatures (RFC 8017 section 9.2),
+// which CKM_RSA_PKCS expects the caller to prepend.
+var pkcs1DigestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs11Signer is a crypto.Signer backed by a private key on a PKCS#11
+// token (e.g. a YubiKey or HSM).  The public key is taken from the
+// corresponding certificate, so only the private key object needs to be on
+// the token.
+type pkcs11Signer struct {
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+func newPKCS11Signer(uri string, pub crypto.PublicKey) (crypto.Signer, error) {
+	parsed, err := parsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := pkcs11.New(parsed.modulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("unable to load PKCS#11 module %s", parsed.modulePath)
+	}
+
+	err = ctx.Initialize()
+	if err != nil {
+		ctx.Destroy()
+
+		return nil, fmt.Errorf("unable to initialize PKCS#11 module: %w", err)
+	}
+
+	signer := &pkcs11Signer{
+		ctx: ctx,
+		pub: pub,
+	}
+
+	err = signer.open(parsed)
+	if err != nil {
+		signer.Close()
+
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+func (k *pkcs11Signer) open(parsed *pkcs11URI) error {
+	slots, err := k.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("unable to list PKCS#11 slots: %w", err)
+	}
+
+	var (
+		slot  uint
+		found bool
+	)
+
+	for _, candidate := range slots {
+		info, err := k.ctx.GetTokenInfo(candidate)
+		if err != nil {
+			continue
+		}
+
+		if parsed.token != "" && strings.TrimSpace(info.Label) != parsed.token {
+			continue
+		}
+
+		if parsed.serial != "" && strings.TrimSpace(info.SerialNumber) != parsed.serial {
+			continue
+		}
+
+		slot = candidate
+		found = true
+
+		break
+	}
+
+	if !found {
+		return fmt.Errorf("%w: no matching token", ErrPKCS11KeyNotFound)
+	}
+
+	k.session, err = k.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("unable to open PKCS#11 session: %w", err)
+	}
+
+	if parsed.pin != "" {
+		err = k.ctx.Login(k.session, pkcs11.CKU_USER, parsed.pin)
+		if err != nil {
+			return fmt.Errorf("unable to log in to PKCS#11 token: %w", err)
+		}
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+
+	if parsed.object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, parsed.object))
+	}
+
+	if parsed.id != nil {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, parsed.id))
+	}
+
+	err = k.ctx.FindObjectsInit(k.session, template)
+	if err != nil {
+		return fmt.Errorf("unable to search PKCS#11 token: %w", err)
+	}
+
+	objects, _, err := k.ctx.FindObjects(k.session, 1)
+
+	finalErr := k.ctx.FindObjectsFinal(k.session)
+	if err == nil {
+		err = finalErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to search PKCS#11 token: %w", err)
+	}
+
+	if len(objects) == 0 {
+		return fmt.Errorf("%w: no matching private key", ErrPKCS11KeyNotFound)
+	}
+
+	k.key = objects[0]
+
+	return nil
+}
+
+func (k *pkcs11Signer) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var (
+		mechanism uint
+		message   []byte
+	)
+
+	switch k.pub.(type) {
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.CKM_ECDSA
+		message = digest
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, fmt.Errorf("%w: RSA-PSS", ErrPKCS11Mechanism)
+		}
+
+		prefix, ok := pkcs1DigestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("%w: hash %v", ErrPKCS11Mechanism, opts.HashFunc())
+		}
+
+		mechanism = pkcs11.CKM_RSA_PKCS
+		message = append(append([]byte{}, prefix...), digest...)
+	default:
+		return nil, fmt.Errorf("%w: key type %T", ErrPKCS11Mechanism, k.pub)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	err := k.ctx.SignInit(k.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, k.key)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 SignInit: %w", err)
+	}
+
+	sig, err := k.ctx.Sign(k.session, message)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 Sign: %w", err)
+	}
+
+	if mechanism == pkcs11.CKM_ECDSA {
+		// PKCS#11 returns r||s, but crypto.Signer callers expect an
+		// ASN.1 ECDSA-Sig-Value.
+		half := len(sig) / 2
+
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{
+			R: new(big.Int).SetBytes(sig[:half]),
+			S: new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+
+	return sig, nil
+}
+
+// Close logs out and releases the PKCS#11 module.
+func (k *pkcs11Signer) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.session != 0 {
+		_ = k.ctx.Logout(k.session)
+		_ = k.ctx.CloseSession(k.session)
+		k.session = 0
+	}
+
+	err := k.ctx.Finalize()
+	k.ctx.Destroy()
+
+	return err
+}
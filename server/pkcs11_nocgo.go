@@ -0,0 +1,17 @@
+//go:build !cgo
+// +build !cgo
+
+package server
+
+import (
+	"crypto"
+	"errors"
+)
+
+// ErrPKCS11Unsupported is returned when encaya was built without cgo, which
+// PKCS#11 support requires.
+var ErrPKCS11Unsupported = errors.New("PKCS#11 support requires building with cgo")
+
+func newPKCS11Signer(uri string, pub crypto.PublicKey) (crypto.Signer, error) {
+	return nil, ErrPKCS11Unsupported
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+const pkcs11URIPrefix = "pkcs11:"
+
+// ErrPKCS11URI is returned when a PKCS#11 URI is malformed or lacks a
+// required attribute.
+var ErrPKCS11URI = errors.New("invalid PKCS#11 URI")
+
+// ErrPKCS11Generate is returned by GenerateCerts when RootKey is a PKCS#11
+// URI.
+var ErrPKCS11Generate = errors.New(
+	"generating the root CA on a PKCS#11 token isn't supported; generate it to a file and import it")
+
+// pkcs11URI holds the RFC 7512 attributes we use to locate a private key.
+type pkcs11URI struct {
+	token  string
+	serial string
+	object string
+	id     []byte
+
+	modulePath string
+	pin        string
+}
+
+func isPKCS11URI(s string) bool {
+	return strings.HasPrefix(s, pkcs11URIPrefix)
+}
+
+func parsePKCS11URI(uri string) (*pkcs11URI, error) {
+	result := &pkcs11URI{}
+
+	rest := strings.TrimPrefix(uri, pkcs11URIPrefix)
+	path, query := rest, ""
+
+	if i := strings.Index(rest, "?"); i >= 0 {
+		path, query = rest[:i], rest[i+1:]
+	}
+
+	for _, attr := range splitPKCS11Attrs(path, ";") {
+		name, value, err := parsePKCS11Attr(attr)
+		if err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "token":
+			result.token = value
+		case "serial":
+			result.serial = value
+		case "object":
+			result.object = value
+		case "id":
+			result.id = []byte(value)
+		}
+	}
+
+	for _, attr := range splitPKCS11Attrs(query, "&") {
+		name, value, err := parsePKCS11Attr(attr)
+		if err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "module-path":
+			result.modulePath = value
+		case "pin-value":
+			result.pin = value
+		case "pin-source":
+			pinBytes, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to read PIN: %w", err)
+			}
+
+			result.pin = strings.TrimRight(string(pinBytes), "\r\n")
+		}
+	}
+
+	if result.modulePath == "" {
+		return nil, fmt.Errorf("%w: module-path is required", ErrPKCS11URI)
+	}
+
+	if result.object == "" && result.id == nil {
+		return nil, fmt.Errorf("%w: object or id is required", ErrPKCS11URI)
+	}
+
+	return result, nil
+}
+
+func splitPKCS11Attrs(s, sep string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, sep)
+}
+
+func parsePKCS11Attr(attr string) (string, string, error) {
+	parts := strings.SplitN(attr, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("%w: malformed attribute %s", ErrPKCS11URI, attr)
+	}
+
+	value, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s", ErrPKCS11URI, err.Error())
+	}
+
+	return parts[0], value, nil
+}
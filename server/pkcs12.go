@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// formatPKCS12 is the format that /get-new-negative-ca and /cross-sign-ca
+// accept besides their default PEM output.
+const formatPKCS12 = "p12"
+
+// wantsPKCS12 reports whether a key endpoint request asked for a PKCS#12
+// bundle.  If so, it returns the caller's passphrase for the bundle, or
+// responds with an error and returns ok false if there is none.
+func wantsPKCS12(w http.ResponseWriter, req *http.Request) (passphrase string, want, ok bool) {
+	if !strings.EqualFold(req.FormValue("format"), formatPKCS12) {
+		return "", false, true
+	}
+
+	passphrase = req.FormValue("passphrase")
+	if passphrase == "" {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "format=p12 requires a passphrase")
+
+		return "", true, false
+	}
+
+	return passphrase, true, true
+}
+
+// parsePEMCerts parses every CERTIFICATE block of pemData.
+func parsePEMCerts(pemData string) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	rest := []byte(pemData)
+
+	for {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, ErrNoPEM
+	}
+
+	return certs, nil
+}
+
+// negativeCAPKCS12 bundles a negative CA and its private key, as returned by
+// newNegativeCA, into a PKCS#12 file encrypted with passphrase.
+func negativeCAPKCS12(certPEM, keyPEM, passphrase string) ([]byte, error) {
+	certs, err := parsePEMCerts(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBlock, _ := pem.Decode([]byte(keyPEM))
+	if keyBlock == nil {
+		return nil, ErrNoPEM
+	}
+
+	key, err := parsePrivateKeyBlock(keyBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs12.Modern.Encode(key, certs[0], nil, passphrase)
+}
+
+// crossSignedPKCS12 bundles a cross-signed CA and the chain of its signer
+// into a PKCS#12 trust store, protected by passphrase.  There's no private
+// key to include: the caller already has the key of the CA it sent.
+func crossSignedPKCS12(resultPEM, signerCertPEM, passphrase string) ([]byte, error) {
+	certs, err := parsePEMCerts(resultPEM + signerCertPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs12.Modern.EncodeTrustStore(certs, passphrase)
+}
+
+// writePKCS12 responds with a PKCS#12 file, suggesting filename for it.
+func writePKCS12(w http.ResponseWriter, bundle []byte, filename string) {
+	w.Header().Set("Content-Type", "application/x-pkcs12")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+
+	_, err := w.Write(bundle)
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
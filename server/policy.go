@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ErrPolicyDenied is returned when the issuance policy doesn't allow
+// generating certs for a domain.
+var ErrPolicyDenied = errors.New("domain not allowed by issuance policy")
+
+// issuancePolicy restricts which domains certs are generated for.  It's
+// checked before any DNS query, so that a closed deployment doesn't even
+// look up names it won't serve.
+type issuancePolicy struct {
+	allow       []string
+	allowRegexp *regexp.Regexp
+	deny        []string
+	denyRegexp  *regexp.Regexp
+	maxLabels   int
+}
+
+// issuancePolicy compiles the Policy* settings, returning nil if they don't
+// restrict anything.
+func (cfg *Config) issuancePolicy() (*issuancePolicy, error) {
+	policy := &issuancePolicy{
+		allow:     policyPatterns(cfg.PolicyAllow),
+		deny:      policyPatterns(cfg.PolicyDeny),
+		maxLabels: cfg.PolicyMaxLabels,
+	}
+
+	for _, pattern := range append(append([]string{}, policy.allow...), policy.deny...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	var err error
+
+	policy.allowRegexp, err = compilePolicyRegexp(cfg.PolicyAllowRegexp)
+	if err != nil {
+		return nil, fmt.Errorf("PolicyAllowRegexp: %w", err)
+	}
+
+	policy.denyRegexp, err = compilePolicyRegexp(cfg.PolicyDenyRegexp)
+	if err != nil {
+		return nil, fmt.Errorf("PolicyDenyRegexp: %w", err)
+	}
+
+	if policy.allow == nil && policy.allowRegexp == nil && policy.deny == nil && policy.denyRegexp == nil &&
+		policy.maxLabels == 0 {
+		return nil, nil
+	}
+
+	return policy, nil
+}
+
+func policyPatterns(list string) []string {
+	var result []string
+
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "."))
+		if pattern != "" {
+			result = append(result, pattern)
+		}
+	}
+
+	return result
+}
+
+// compilePolicyRegexp compiles expr to match whole domain names.
+func compilePolicyRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+func matchesAny(patterns []string, domain string) bool {
+	for _, pattern := range patterns {
+		matched, _ := path.Match(pattern, domain)
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check returns ErrPolicyDenied if certs may not be generated for domain.
+// Denials take precedence over allowances; if any allowances are set, the
+// domain must match one of them.
+func (p *issuancePolicy) check(domain string) error {
+	if p == nil {
+		return nil
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if p.maxLabels != 0 && strings.Count(domain, ".")+1 > p.maxLabels {
+		return fmt.Errorf("%w: %s has more than %d labels", ErrPolicyDenied, domain, p.maxLabels)
+	}
+
+	if matchesAny(p.deny, domain) || (p.denyRegexp != nil && p.denyRegexp.MatchString(domain)) {
+		return fmt.Errorf("%w: %s is denied", ErrPolicyDenied, domain)
+	}
+
+	if p.allow == nil && p.allowRegexp == nil {
+		return nil
+	}
+
+	if matchesAny(p.allow, domain) || (p.allowRegexp != nil && p.allowRegexp.MatchString(domain)) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s isn't allowed", ErrPolicyDenied, domain)
+}
+
+// writePolicyError responds to a request for a domain denied by the
+// issuance policy.
+func writePolicyError(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusForbidden, errCodeDomainNotAllowed, err.Error())
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIssuancePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		allowed []string
+		denied  []string
+	}{
+		{
+			name:    "unrestricted",
+			allowed: []string{"example.bit", "a.b.c.example.bit"},
+		},
+		{
+			name:    "allow patterns",
+			cfg:     Config{PolicyAllow: "example.bit, *.example.bit"},
+			allowed: []string{"example.bit", "www.example.bit", "WWW.Example.BIT.", "a.www.example.bit"},
+			denied:  []string{"other.bit", "notexample.bit"},
+		},
+		{
+			name:    "allow regexp",
+			cfg:     Config{PolicyAllowRegexp: `[a-z]+\.bit`},
+			allowed: []string{"example.bit"},
+			denied:  []string{"www.example.bit", "x.example.bit.evil"},
+		},
+		{
+			name:    "deny takes precedence",
+			cfg:     Config{PolicyAllow: "*.bit", PolicyDeny: "bad.bit"},
+			allowed: []string{"good.bit"},
+			denied:  []string{"bad.bit", "Bad.bit."},
+		},
+		{
+			name:    "deny regexp without allowances",
+			cfg:     Config{PolicyDenyRegexp: `.*\.internal\.bit`},
+			allowed: []string{"example.bit", "internal.bit"},
+			denied:  []string{"host.internal.bit"},
+		},
+		{
+			name:    "max labels",
+			cfg:     Config{PolicyMaxLabels: 3},
+			allowed: []string{"example.bit", "www.example.bit"},
+			denied:  []string{"a.www.example.bit"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := test.cfg.issuancePolicy()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, domain := range test.allowed {
+				err := policy.check(domain)
+				if err != nil {
+					t.Errorf("%s denied: %v", domain, err)
+				}
+			}
+
+			for _, domain := range test.denied {
+				err := policy.check(domain)
+				if !errors.Is(err, ErrPolicyDenied) {
+					t.Errorf("%s: got %v, want %v", domain, err, ErrPolicyDenied)
+				}
+			}
+		})
+	}
+}
+
+func TestIssuancePolicyInvalid(t *testing.T) {
+	for i, cfg := range []Config{
+		{PolicyAllow: "[example.bit"},
+		{PolicyDeny: "[example.bit"},
+		{PolicyAllowRegexp: "("},
+		{PolicyDenyRegexp: "("},
+	} {
+		_, err := cfg.issuancePolicy()
+		if err == nil {
+			t.Errorf("invalid config %d accepted", i)
+		}
+	}
+}
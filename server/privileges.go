@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideChroot is returned when Chroot is set but a file the server needs
+// after dropping privileges isn't inside ConfigDir.
+var ErrOutsideChroot = errors.New("file is outside the chroot directory")
+
+// chrootPaths rewrites the (already processed) file paths in cfg to be
+// relative to root, which becomes "/" after chrooting into it.  The store and
+// Unix socket are opened before chrooting, so they may live elsewhere.
+func (cfg *Config) chrootPaths(root string) error {
+	paths := []*string{
+		&cfg.RootCert,
+		&cfg.PreviousRootCert,
+		&cfg.ListenChain,
+		&cfg.ListenKey,
+		&cfg.TLDCert,
+		&cfg.TLDKey,
+		&cfg.PreviousTLDCert,
+		&cfg.PreviousTLDKey,
+	}
+
+	if !isPKCS11URI(cfg.RootKey) {
+		paths = append(paths, &cfg.RootKey)
+	}
+
+	if !isPKCS11URI(cfg.PreviousRootKey) {
+		paths = append(paths, &cfg.PreviousRootKey)
+	}
+
+	if cfg.KeyEndpointsClientCA != "" {
+		paths = append(paths, &cfg.KeyEndpointsClientCA)
+	}
+
+	if cfg.AuditLog != "" {
+		paths = append(paths, &cfg.AuditLog)
+	}
+
+	if cfg.AccessLog != "" && cfg.AccessLog != "-" {
+		paths = append(paths, &cfg.AccessLog)
+	}
+
+	for _, path := range paths {
+		rel, err := chrootRel(root, *path)
+		if err != nil {
+			return err
+		}
+
+		*path = filepath.Join(string(filepath.Separator), rel)
+	}
+
+	cfg.ConfigDir = string(filepath.Separator)
+
+	return nil
+}
+
+// chrootRel returns path (an absolute path from outside the chroot) relative
+// to the chroot directory root.
+func chrootRel(root, path string) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", ErrOutsideChroot, path)
+	}
+
+	return rel, nil
+}
+
+// chrootReadFile returns a function reading files, given their paths from
+// outside the chroot directory root, from fsys, the file system as seen from
+// inside the chroot.
+func chrootReadFile(root string, fsys fs.FS) func(string) ([]byte, error) {
+	return func(path string) ([]byte, error) {
+		rel, err := chrootRel(root, path)
+		if err != nil {
+			return nil, err
+		}
+
+		return fs.ReadFile(fsys, filepath.ToSlash(rel))
+	}
+}
@@ -0,0 +1,119 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges chroots into ConfigDir if Chroot is set, then switches to
+// the configured Group and User.  It's called at the end of New, once the
+// listeners are bound and the store is open, so that encaya can be started
+// as root to bind ports below 1024 without serving requests as root.
+func (s *Server) dropPrivileges() error {
+	if s.cfg.User == "" && s.cfg.Group == "" && !s.cfg.Chroot {
+		return nil
+	}
+
+	// Resolve the names before chrooting, since /etc/passwd and
+	// /etc/group are usually not inside the chroot.
+	uid, gid, err := lookupUserGroup(s.cfg.User, s.cfg.Group)
+	if err != nil {
+		return err
+	}
+
+	if s.cfg.Chroot {
+		root := s.cfg.ConfigDir
+
+		err = s.cfg.chrootPaths(root)
+		if err != nil {
+			return err
+		}
+
+		if s.cfg.source.path != "" {
+			_, err = chrootRel(root, s.cfg.source.path)
+			if err != nil {
+				log.Warnf("The config file %s is outside %s, so it can't be reloaded", s.cfg.source.path, root)
+			}
+		}
+
+		err = syscall.Chroot(root)
+		if err != nil {
+			return fmt.Errorf("unable to chroot to %s: %w", root, err)
+		}
+
+		err = os.Chdir("/")
+		if err != nil {
+			return err
+		}
+
+		s.chrootDir = root
+
+		log.Infof("Chrooted to %s", root)
+	}
+
+	if gid >= 0 {
+		err = syscall.Setgroups([]int{gid})
+		if err != nil {
+			return fmt.Errorf("unable to set supplementary groups: %w", err)
+		}
+
+		err = syscall.Setgid(gid)
+		if err != nil {
+			return fmt.Errorf("unable to set group ID %d: %w", gid, err)
+		}
+	}
+
+	if uid >= 0 {
+		err = syscall.Setuid(uid)
+		if err != nil {
+			return fmt.Errorf("unable to set user ID %d: %w", uid, err)
+		}
+
+		log.Infof("Running as user %s (UID %d)", s.cfg.User, uid)
+	}
+
+	return nil
+}
+
+// lookupUserGroup returns the IDs to switch to, or -1 for those that aren't
+// configured.  If only User is set, its primary group is used.
+func lookupUserGroup(userName, groupName string) (int, int, error) {
+	uid, gid := -1, -1
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return -1, -1, err
+		}
+
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return -1, -1, err
+		}
+
+		gid, err = strconv.Atoi(u.Gid)
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return -1, -1, err
+		}
+
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package server
+
+import (
+	"errors"
+)
+
+// ErrPrivilegesUnsupported is returned when User, Group or Chroot is set on
+// Windows.  Run encaya as a service under a restricted account instead.
+var ErrPrivilegesUnsupported = errors.New("User, Group and Chroot are not supported on Windows")
+
+func (s *Server) dropPrivileges() error {
+	if s.cfg.User != "" || s.cfg.Group != "" || s.cfg.Chroot {
+		return ErrPrivilegesUnsupported
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// dnsProxyUser is the SOCKS5 username sent along with an isolation key.
+const dnsProxyUser = "encaya"
+
+// dnsProxyDialer returns a dialer that connects through DNSProxy.  If
+// DNSProxyIsolation is set and isolation isn't empty, a digest of isolation
+// is sent as the SOCKS5 password, so that Tor (which isolates streams by
+// SOCKS credentials by default) uses separate circuits for separate
+// isolation keys.
+func (s *Server) dnsProxyDialer(isolation string) (proxy.ContextDialer, error) {
+	var auth *proxy.Auth
+
+	if s.cfg.DNSProxyIsolation && isolation != "" {
+		// SOCKS5 credentials are limited to 255 bytes.
+		digest := sha256.Sum256([]byte(isolation))
+
+		auth = &proxy.Auth{
+			User:     dnsProxyUser,
+			Password: hex.EncodeToString(digest[:]),
+		}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", s.cfg.DNSProxy, auth, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use DNS proxy %s: %w", s.cfg.DNSProxy, err)
+	}
+
+	return dialer.(proxy.ContextDialer), nil
+}
+
+// queryProxied queries server over TCP or DNS-over-TLS through DNSProxy.
+// The server's name is resolved by the proxy, so nothing about the lookup
+// goes to the local network's resolver.
+func (s *Server) queryProxied(ctx context.Context, qname, isolation, server string) (*dns.Msg, error) {
+	dialer, err := s.dnsProxyDialer(isolation)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(server, strconv.Itoa(s.cfg.DNSPort)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s through DNS proxy: %w", server, err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.cfg.DNSTransport == transportTLS {
+		tlsConfig := s.dnsTLSConfig
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = server
+		}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("DNS-over-TLS error: %w", err)
+		}
+
+		conn = tlsConn
+	}
+
+	dnsConn := &dns.Conn{Conn: conn}
+	query := newTLSAQuery(qname)
+
+	err = dnsConn.WriteMsg(query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to send DNS query through proxy: %w", err)
+	}
+
+	response, err := dnsConn.ReadMsg()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read DNS response through proxy: %w", err)
+	}
+
+	if response.Id != query.Id {
+		return nil, fmt.Errorf("%w: response ID doesn't match query", ErrNoDNSResponse)
+	}
+
+	return response, nil
+}
+
+// dohClientFor returns the HTTP client for DoH queries on behalf of
+// isolation.  Neither client reuses connections, so connections aren't
+// shared between isolation keys; through DNSProxy, they're also dialed with
+// the proxy credentials of isolation.
+func (s *Server) dohClientFor(isolation string) *http.Client {
+	if s.cfg.DNSProxy == "" {
+		return s.dohClient
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialer, err := s.dnsProxyDialer(isolation)
+				if err != nil {
+					return nil, err
+				}
+
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSClientConfig:   s.dnsTLSConfig,
+			ForceAttemptHTTP2: true,
+			DisableKeepAlives: true,
+		},
+	}
+}
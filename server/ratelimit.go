@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTrustedProxy is returned for a malformed TrustedProxies entry.
+var ErrTrustedProxy = errors.New("invalid trusted proxy")
+
+// rateLimitSweepInterval is how often idle client buckets are forgotten.
+const rateLimitSweepInterval = 1 * time.Minute
+
+// rateLimiter is a token-bucket rate limiter keyed by client.  Each client's
+// bucket holds up to burst tokens and refills at rate tokens per second.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	rate  float64
+	burst float64
+
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// allow takes a token from key's bucket.  If the bucket is empty, it returns
+// false and how long until a token is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweepLocked(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{
+			tokens: l.burst,
+			last:   now,
+		}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+
+		return false, wait
+	}
+
+	bucket.tokens--
+
+	return true, 0
+}
+
+// sweepLocked forgets the buckets that have refilled completely, which
+// behave the same as new ones.
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+// parseTrustedProxies parses the comma-separated TrustedProxies list of IPs
+// and CIDR ranges.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: %s", ErrTrustedProxy, entry)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrTrustedProxy, entry)
+		}
+
+		proxies = append(proxies, ipNet)
+	}
+
+	return proxies, nil
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, proxy := range s.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP returns the address that rate limits apply to.  If the request
+// came from a trusted proxy, the X-Forwarded-For chain is followed back to
+// the first address that isn't a trusted proxy.  Unix socket clients share a
+// single key.
+func (s *Server) clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "unix"
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !s.isTrustedProxy(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Malformed; don't trust anything further back.
+			break
+		}
+
+		host = hop.String()
+
+		if !s.isTrustedProxy(hop) {
+			break
+		}
+	}
+
+	return host
+}
+
+// rateLimited wraps a handler that triggers DNS queries and signing,
+// enforcing the per-client rate limit and the global concurrency limit.
+func (s *Server) rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return s.clientRateLimited(func(w http.ResponseWriter, req *http.Request) {
+		if s.lookupSlots != nil {
+			select {
+			case s.lookupSlots <- struct{}{}:
+				defer func() { <-s.lookupSlots }()
+			default:
+				tooManyRequests(w, time.Second)
+
+				return
+			}
+		}
+
+		handler(w, req)
+	})
+}
+
+// clientRateLimited wraps a handler, enforcing only the per-client rate
+// limit.
+func (s *Server) clientRateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.rateLimiter != nil {
+			ok, wait := s.rateLimiter.allow(s.clientIP(req), time.Now())
+			if !ok {
+				tooManyRequests(w, wait)
+
+				return
+			}
+		}
+
+		handler(w, req)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, http.StatusTooManyRequests, errCodeRateLimited, "too many requests")
+}
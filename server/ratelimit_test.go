@@ -0,0 +1,84 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+
+	// One token per second, bursts of two.
+	type step struct {
+		key      string
+		after    time.Duration
+		wantOK   bool
+		wantWait time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "burst then refill",
+			steps: []step{
+				{"a", 0, true, 0},
+				{"a", 0, true, 0},
+				{"a", 0, false, time.Second},
+				{"a", 500 * time.Millisecond, false, 500 * time.Millisecond},
+				{"a", time.Second, true, 0},
+				{"a", time.Second, false, time.Second},
+			},
+		},
+		{
+			name: "clients are independent",
+			steps: []step{
+				{"a", 0, true, 0},
+				{"a", 0, true, 0},
+				{"a", 0, false, time.Second},
+				{"b", 0, true, 0},
+			},
+		},
+		{
+			name: "refill is capped at the burst",
+			steps: []step{
+				{"a", 0, true, 0},
+				{"a", time.Hour, true, 0},
+				{"a", time.Hour, true, 0},
+				{"a", time.Hour, false, time.Second},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiter(60, 2)
+
+			for i, step := range test.steps {
+				ok, wait := limiter.allow(step.key, start.Add(step.after))
+				if ok != step.wantOK || wait != step.wantWait {
+					t.Errorf("step %d: allow = %v, %v; want %v, %v", i, ok, wait, step.wantOK, step.wantWait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	limiter := newRateLimiter(60, 2)
+
+	limiter.allow("a", start)
+	limiter.allow("b", start)
+	limiter.allow("b", start)
+	limiter.allow("b", start)
+
+	// By the next sweep, a and b have refilled completely, so they're
+	// forgotten.
+	limiter.allow("c", start.Add(2*rateLimitSweepInterval))
+
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets kept after sweep, want 1", len(limiter.buckets))
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// cacheRefreshTick is how often the background refresher looks for cached
+// domain certs that are about to go stale.
+const cacheRefreshTick = time.Second
+
+// cacheRefresher tracks the domains recently served by lookup, so that
+// their cached certs can be re-resolved in the background before they go
+// stale.  Without it, the first request after half of DomainCacheTTL pays
+// for the DNS query and signing.
+type cacheRefresher struct {
+	mu sync.Mutex
+
+	// Keyed by domain cert cache key
+	domains map[string]*refreshDomain
+
+	done chan struct{}
+}
+
+type refreshDomain struct {
+	domain    string
+	service   string
+	isolation string
+	wildcard  bool
+
+	lastAccess time.Time
+
+	// When the domain was last resolved, whether or not that cached
+	// anything
+	resolved time.Time
+}
+
+func newCacheRefresher() *cacheRefresher {
+	return &cacheRefresher{
+		domains: map[string]*refreshDomain{},
+		done:    make(chan struct{}),
+	}
+}
+
+// noteLookup records that lookup served cacheKey, and whether it had to
+// resolve it to do so.  It's a no-op unless CacheRefreshWindow is set.
+func (s *Server) noteLookup(cacheKey, domain, service, isolation string, wildcard, resolved bool) {
+	if s.refresher == nil || s.cacheRefreshWindow == 0 {
+		return
+	}
+
+	r := s.refresher
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.domains[cacheKey]
+	if !ok {
+		// Don't track more domains than can be cached.
+		if s.cfg.CacheMaxEntries > 0 && len(r.domains) >= s.cfg.CacheMaxEntries {
+			return
+		}
+
+		entry = &refreshDomain{
+			domain:    domain,
+			service:   service,
+			isolation: isolation,
+			wildcard:  wildcard,
+		}
+		r.domains[cacheKey] = entry
+	}
+
+	entry.lastAccess = now
+
+	if resolved {
+		entry.resolved = now
+	}
+}
+
+// dueRefreshes returns the cache keys of the domains whose cached certs go
+// stale (i.e. would be re-resolved by the next request) within window, and
+// forgets the domains that haven't been requested within idle.
+func (s *Server) dueRefreshes(window, idle, ttl time.Duration) []string {
+	r := s.refresher
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []string
+
+	for key, entry := range r.domains {
+		if now.Sub(entry.lastAccess) > idle {
+			delete(r.domains, key)
+
+			continue
+		}
+
+		// lookup re-resolves once half of DomainCacheTTL has elapsed.
+		stale := entry.resolved.Add(ttl / 2)
+
+		expiration, ok := s.domainCertCache.latestExpiration(key)
+		if ok && expiration.Add(-ttl/2).After(stale) {
+			stale = expiration.Add(-ttl / 2)
+		}
+
+		if !now.Before(stale.Add(-window)) {
+			due = append(due, key)
+		}
+	}
+
+	return due
+}
+
+// runCacheRefresher re-resolves recently requested domains before their
+// cached certs go stale, until Stop is called.
+func (s *Server) runCacheRefresher() {
+	ticker := time.NewTicker(cacheRefreshTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.refresher.done:
+			return
+		}
+
+		s.reloadMutex.RLock()
+		window := s.cacheRefreshWindow
+		idle := s.cacheRefreshIdle
+		ttl := s.domainCacheTTL
+		s.reloadMutex.RUnlock()
+
+		if window == 0 {
+			continue
+		}
+
+		for _, key := range s.dueRefreshes(window, idle, ttl) {
+			select {
+			case <-s.refresher.done:
+				return
+			default:
+			}
+
+			s.refreshDomain(key)
+		}
+	}
+}
+
+// refreshDomain re-resolves the domain tracked under cacheKey, adding fresh
+// certs to the cache.
+func (s *Server) refreshDomain(cacheKey string) {
+	s.refresher.mu.Lock()
+	entry, ok := s.refresher.domains[cacheKey]
+
+	var (
+		domain, service, isolation string
+		wildcard                   bool
+	)
+
+	if ok {
+		domain, service, isolation, wildcard = entry.domain, entry.service, entry.isolation, entry.wildcard
+		// Even if resolving fails, don't retry before the next window.
+		entry.resolved = time.Now()
+	}
+	s.refresher.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+
+	tld := s.tldForDomain(domain)
+	if tld == nil || s.policy.check(domain) != nil {
+		return
+	}
+
+	ctx := withAuditRequest(context.Background(), "", "background-refresh")
+
+	if s.requestTimeout != 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+	}
+
+	ctx, span := s.startSpan(ctx, "encaya.refresh", attrDomain.String(domain), attrService.String(service))
+
+	_, err := s.resolveDomainCerts(ctx, domain, service, isolation, cacheKey, tld, wildcard, nil, nil)
+	if err != nil {
+		log.Debugef(err, "Unable to refresh cached certs of %s", domain)
+	}
+
+	endSpan(span, err)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/namecoin/ncdns/certdehydrate"
+)
+
+// maxDehydratedSize bounds the dehydrated certificate blob accepted by
+// /rehydrate; Namecoin values are at most a few KB.
+const maxDehydratedSize = 10000
+
+// ErrInvalidDehydrated is returned when a dehydrated certificate can't be
+// parsed or rehydrated.
+var ErrInvalidDehydrated = errors.New("invalid dehydrated certificate")
+
+// rehydrate reconstructs the DER certificate that a dehydrated certificate
+// (the JSON array published in a Namecoin name's "tls" field) rehydrates to
+// for domain.
+func rehydrate(domain string, dehydratedJSON []byte) ([]byte, error) {
+	var data interface{}
+
+	err := json.Unmarshal(dehydratedJSON, &data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDehydrated, err)
+	}
+
+	dehydrated, err := certdehydrate.ParseDehydratedCert(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDehydrated, err)
+	}
+
+	template, err := certdehydrate.RehydrateCert(dehydrated)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDehydrated, err)
+	}
+
+	der, err := certdehydrate.FillRehydratedCertTemplate(*template, domain)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDehydrated, err)
+	}
+
+	return der, nil
+}
+
+// rehydrateHandler serves POST /rehydrate, which takes a domain and a
+// dehydrated certificate and returns the certificate it rehydrates to (in
+// any of the /lookup formats).  It doesn't query DNS, so domain owners can
+// check a record before publishing it.
+func (s *Server) rehydrateHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "use POST")
+
+		return
+	}
+
+	domain := strings.TrimSuffix(req.FormValue("domain"), ".")
+	dehydrated := req.FormValue("dehydrated")
+
+	if domain == "" || dehydrated == "" {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "missing domain or dehydrated certificate")
+
+		return
+	}
+
+	der, err := rehydrate(domain, []byte(dehydrated))
+	if err != nil {
+		log.Debuge(err, "Unable to rehydrate certificate")
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+
+		return
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	})
+
+	s.writeLookupCerts(w, req, []lookupCert{
+		newLookupCert(der, string(certPem), sourceRehydrated, nil),
+	})
+}
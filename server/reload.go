@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// loadCAs applies the settings that can change at runtime: it configures
+// the DNS resolver, and loads the root and TLD CAs, the previous CA
+// generation and the listen certificate.
+func (s *Server) loadCAs() error {
+	err := s.initResolver()
+	if err != nil {
+		return fmt.Errorf("unable to configure DNS transport: %w", err)
+	}
+
+	err = s.loadRootCert()
+	if err != nil {
+		return fmt.Errorf("unable to load root CA: %w", err)
+	}
+
+	err = s.loadRootKey()
+	if err != nil {
+		return fmt.Errorf("unable to load root CA private key: %w", err)
+	}
+
+	err = s.loadTLDCAs()
+	if err != nil {
+		return fmt.Errorf("unable to load TLD CA: %w", err)
+	}
+
+	s.policy, err = s.cfg.issuancePolicy()
+	if err != nil {
+		return fmt.Errorf("invalid issuance policy: %w", err)
+	}
+
+	s.crlValidity, err = time.ParseDuration(s.cfg.CRLValidity)
+	if err != nil {
+		return fmt.Errorf("invalid CRL validity %s: %w", s.cfg.CRLValidity, err)
+	}
+
+	s.crls = map[string]*cachedCRL{}
+
+	err = s.loadLifetimes()
+	if err != nil {
+		return fmt.Errorf("invalid certificate lifetime settings: %w", err)
+	}
+
+	if s.servesTLS() {
+		err = s.loadListenCert()
+		if err != nil {
+			return fmt.Errorf("unable to load listen certificate: %w", err)
+		}
+	}
+
+	return s.loadPreviousGeneration()
+}
+
+// serveLocked serves a request with the read side of reloadMutex held, so
+// that handlers never see a half-applied Reload.  It also applies the
+// server-side request deadline, identifies the client for the audit log and
+// traces the request.
+func (s *Server) serveLocked(w http.ResponseWriter, req *http.Request) {
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+
+	req = req.WithContext(withAuditRequest(req.Context(), s.clientIP(req), req.URL.Path))
+
+	if s.requestTimeout != 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), s.requestTimeout)
+		defer cancel()
+
+		req = req.WithContext(ctx)
+	}
+
+	s.traceHTTP(w, req, s.mux)
+}
+
+// LoadConfig builds a new config for Reload from args and environ, like the
+// package's LoadConfig, reading the config file found at startup (if the
+// server's config came from LoadConfig).  After chrooting, the file is read
+// from inside the chroot directory.
+func (s *Server) LoadConfig(args []string, environ []string) (*Config, error) {
+	return s.loadConfig(args, environ, os.DirFS("/"))
+}
+
+// loadConfig is LoadConfig with root as the file system seen after
+// chrooting.
+func (s *Server) loadConfig(args []string, environ []string, root fs.FS) (*Config, error) {
+	s.reloadMutex.RLock()
+	source := s.cfg.source
+	s.reloadMutex.RUnlock()
+
+	readFile := ioutil.ReadFile
+	if s.chrootDir != "" {
+		readFile = chrootReadFile(s.chrootDir, root)
+	}
+
+	if source.path == "" {
+		return loadConfig(args, environ, "", nil, readFile)
+	}
+
+	return loadConfig(args, environ, "", &source, readFile)
+}
+
+// Reload applies cfg to the running server: the DNS settings, root and TLD
+// CAs, previous CA generation, listen certificate, URLs and lifetimes are
+// re-read, and the certificate caches are flushed if the root CA changed.
+// Listener addresses, the store and the key endpoints can only be changed by
+// restarting.  If anything fails to load, the server keeps running with its
+// old settings.
+func (s *Server) Reload(cfg *Config) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+
+	next := &Server{
+		cfg:       *cfg,
+		listeners: s.listeners,
+		chrootDir: s.chrootDir,
+
+		rootKeyPassphrase: s.rootKeyPassphrase,
+	}
+
+	next.cfg.processPaths()
+
+	if s.chrootDir != "" {
+		err = next.cfg.chrootPaths(s.chrootDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	s.keepRestartOnlySettings(&next.cfg)
+
+	err = next.loadCAs()
+	if err != nil {
+		next.closeKeys()
+
+		return err
+	}
+
+	rootChanged := !bytes.Equal(s.rootCert, next.rootCert)
+
+	s.closeKeys()
+
+	s.cfg = next.cfg
+	s.dnsTLSConfig = next.dnsTLSConfig
+	s.dnsTimeout = next.dnsTimeout
+	s.dnsCacheMaxTTL = next.dnsCacheMaxTTL
+	s.dohClient = next.dohClient
+	s.rootCert = next.rootCert
+	s.rootCertParsed = next.rootCertParsed
+	s.rootPriv = next.rootPriv
+	s.rootCertPem = next.rootCertPem
+	s.rootCertPemString = next.rootCertPemString
+	s.rootPrivPem = next.rootPrivPem
+	s.rootKeyPassphrase = next.rootKeyPassphrase
+	s.tlds = next.tlds
+	s.tldNames = next.tldNames
+	s.policy = next.policy
+	s.previous = next.previous
+	s.rotationOverlap = next.rotationOverlap
+	s.crlValidity = next.crlValidity
+	s.domainCertValidity = next.domainCertValidity
+	s.listenCertValidity = next.listenCertValidity
+	s.listenCertRenewBefore = next.listenCertRenewBefore
+	s.domainCacheTTL = next.domainCacheTTL
+	s.cacheRefreshWindow = next.cacheRefreshWindow
+	s.cacheRefreshIdle = next.cacheRefreshIdle
+	s.requestTimeout = next.requestTimeout
+	s.watchInterval = next.watchInterval
+
+	s.crlsMutex.Lock()
+	s.crls = next.crls
+	s.crlsMutex.Unlock()
+
+	if next.listenCert != nil {
+		s.listenCertMutex.Lock()
+		s.listenCert = next.listenCert
+		s.listenCertMutex.Unlock()
+	}
+
+	s.scheduleListenCertRenewal()
+
+	if rootChanged {
+		// Everything we've issued or cached chains to the old root.
+		log.Info("Root CA changed; flushing certificate caches")
+
+		s.domainCertCache.flush()
+		s.negativeCertCache.flush()
+		s.issuedCertCache.flush()
+
+		if s.store != nil {
+			err = s.store.clear(storeBucketNegative)
+			if err != nil {
+				log.Warne(err, "Unable to clear negative certs from store")
+			}
+		}
+	} else {
+		// Cached domain certs may have been issued under old settings.
+		s.domainCertCache.flush()
+	}
+
+	// The DNS servers may have changed.
+	s.dnsCache.flush()
+
+	log.Info("Reloaded configuration")
+
+	return nil
+}
+
+// keepRestartOnlySettings copies the settings that only take effect on
+// startup from the running config into cfg, warning if they differ.
+func (s *Server) keepRestartOnlySettings(cfg *Config) {
+	if cfg.ListenIP != s.cfg.ListenIP || cfg.ListenPort != s.cfg.ListenPort ||
+		cfg.ListenTLSPort != s.cfg.ListenTLSPort || cfg.ListenUnixSocket != s.cfg.ListenUnixSocket ||
+		cfg.ListenUnixSocketMode != s.cfg.ListenUnixSocketMode || cfg.Store != s.cfg.Store ||
+		cfg.KeyEndpoints != s.cfg.KeyEndpoints || cfg.KeyEndpointsClientCA != s.cfg.KeyEndpointsClientCA ||
+		cfg.AdminEndpoints != s.cfg.AdminEndpoints || cfg.DNSCacheMaxEntries != s.cfg.DNSCacheMaxEntries ||
+		cfg.VirtualHosts != s.cfg.VirtualHosts || cfg.APIHosts != s.cfg.APIHosts ||
+		cfg.CacheMaxEntries != s.cfg.CacheMaxEntries || cfg.CacheMaxBytes != s.cfg.CacheMaxBytes ||
+		cfg.RateLimit != s.cfg.RateLimit || cfg.RateLimitBurst != s.cfg.RateLimitBurst ||
+		cfg.MaxConcurrentLookups != s.cfg.MaxConcurrentLookups || cfg.TrustedProxies != s.cfg.TrustedProxies ||
+		cfg.User != s.cfg.User || cfg.Group != s.cfg.Group || cfg.Chroot != s.cfg.Chroot ||
+		cfg.GRPCPort != s.cfg.GRPCPort || cfg.GRPCTLS != s.cfg.GRPCTLS ||
+		cfg.TLSMinVersion != s.cfg.TLSMinVersion || cfg.TLSCipherSuites != s.cfg.TLSCipherSuites ||
+		cfg.TLSCurves != s.cfg.TLSCurves || cfg.TLSHTTP2 != s.cfg.TLSHTTP2 ||
+		cfg.TLSSessionTickets != s.cfg.TLSSessionTickets ||
+		cfg.TLSSessionTicketRotation != s.cfg.TLSSessionTicketRotation ||
+		cfg.TransparencyLog != s.cfg.TransparencyLog || cfg.TransparencyLogKey != s.cfg.TransparencyLogKey ||
+		cfg.TransparencyLogMaxEntries != s.cfg.TransparencyLogMaxEntries ||
+		cfg.AuditLog != s.cfg.AuditLog || cfg.AuditLogMaxSize != s.cfg.AuditLogMaxSize ||
+		cfg.AuditLogMaxBackups != s.cfg.AuditLogMaxBackups || cfg.RootKeyPassphrase != s.cfg.RootKeyPassphrase ||
+		cfg.TracingEndpoint != s.cfg.TracingEndpoint || cfg.TracingSampleRatio != s.cfg.TracingSampleRatio ||
+		cfg.TracingServiceName != s.cfg.TracingServiceName || cfg.Compression != s.cfg.Compression ||
+		cfg.ResponseSigning != s.cfg.ResponseSigning || cfg.MaxRequestSize != s.cfg.MaxRequestSize ||
+		cfg.ACME != s.cfg.ACME || cfg.ACMEURL != s.cfg.ACMEURL || cfg.HTTP3 != s.cfg.HTTP3 ||
+		cfg.AccessLog != s.cfg.AccessLog || cfg.AccessLogFormat != s.cfg.AccessLogFormat {
+		log.Warn("Listener, TLS, store, key and admin endpoint, cache size and rate limit settings only change on restart")
+	}
+
+	cfg.ListenIP = s.cfg.ListenIP
+	cfg.ListenPort = s.cfg.ListenPort
+	cfg.ListenTLSPort = s.cfg.ListenTLSPort
+	cfg.HTTP3 = s.cfg.HTTP3
+	cfg.ListenUnixSocket = s.cfg.ListenUnixSocket
+	cfg.ListenUnixSocketMode = s.cfg.ListenUnixSocketMode
+	cfg.Store = s.cfg.Store
+	cfg.KeyEndpoints = s.cfg.KeyEndpoints
+	cfg.KeyEndpointsClientCA = s.cfg.KeyEndpointsClientCA
+	cfg.AdminEndpoints = s.cfg.AdminEndpoints
+	cfg.VirtualHosts = s.cfg.VirtualHosts
+	cfg.APIHosts = s.cfg.APIHosts
+	cfg.DNSCacheMaxEntries = s.cfg.DNSCacheMaxEntries
+	cfg.CacheMaxEntries = s.cfg.CacheMaxEntries
+	cfg.CacheMaxBytes = s.cfg.CacheMaxBytes
+	cfg.RateLimit = s.cfg.RateLimit
+	cfg.RateLimitBurst = s.cfg.RateLimitBurst
+	cfg.MaxConcurrentLookups = s.cfg.MaxConcurrentLookups
+	cfg.TrustedProxies = s.cfg.TrustedProxies
+	cfg.User = s.cfg.User
+	cfg.Group = s.cfg.Group
+	cfg.Chroot = s.cfg.Chroot
+	cfg.GRPCPort = s.cfg.GRPCPort
+	cfg.GRPCTLS = s.cfg.GRPCTLS
+	cfg.TLSMinVersion = s.cfg.TLSMinVersion
+	cfg.TLSCipherSuites = s.cfg.TLSCipherSuites
+	cfg.TLSCurves = s.cfg.TLSCurves
+	cfg.TLSHTTP2 = s.cfg.TLSHTTP2
+	cfg.TLSSessionTickets = s.cfg.TLSSessionTickets
+	cfg.TLSSessionTicketRotation = s.cfg.TLSSessionTicketRotation
+	cfg.TransparencyLog = s.cfg.TransparencyLog
+	cfg.TransparencyLogKey = s.cfg.TransparencyLogKey
+	cfg.TransparencyLogMaxEntries = s.cfg.TransparencyLogMaxEntries
+	cfg.AuditLog = s.cfg.AuditLog
+	cfg.AuditLogMaxSize = s.cfg.AuditLogMaxSize
+	cfg.AuditLogMaxBackups = s.cfg.AuditLogMaxBackups
+	cfg.RootKeyPassphrase = s.cfg.RootKeyPassphrase
+	cfg.TracingEndpoint = s.cfg.TracingEndpoint
+	cfg.TracingSampleRatio = s.cfg.TracingSampleRatio
+	cfg.TracingServiceName = s.cfg.TracingServiceName
+	cfg.Compression = s.cfg.Compression
+	cfg.ResponseSigning = s.cfg.ResponseSigning
+	cfg.MaxRequestSize = s.cfg.MaxRequestSize
+	cfg.ACME = s.cfg.ACME
+	cfg.ACMEURL = s.cfg.ACMEURL
+	cfg.AccessLog = s.cfg.AccessLog
+	cfg.AccessLogFormat = s.cfg.AccessLogFormat
+}
+
+// closeKeys closes the root CA private keys that are held open on a hardware
+// token.
+func (s *Server) closeKeys() {
+	if closer, ok := s.rootPriv.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			log.Warne(err, "Unable to close root key")
+		}
+	}
+
+	if s.previous != nil {
+		if closer, ok := s.previous.rootPriv.(io.Closer); ok {
+			err := closer.Close()
+			if err != nil {
+				log.Warne(err, "Unable to close previous root key")
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chrootedTestServer returns a server as it is after New chrooted into the
+// directory from which cfg was loaded, with the file system seen from inside
+// the chroot.  The directory is moved away, so that its files can't be read
+// by their paths from before chrooting.
+func chrootedTestServer(t *testing.T, cfg *Config) (*Server, string) {
+	t.Helper()
+
+	s := &Server{cfg: *cfg}
+	s.cfg.processPaths()
+	s.chrootDir = cfg.ConfigDir
+
+	err := s.cfg.chrootPaths(s.chrootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	view := filepath.Join(t.TempDir(), "root")
+
+	err = os.Rename(s.chrootDir, view)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, view
+}
+
+func TestChrootedReload(t *testing.T) {
+	root := t.TempDir()
+	writeTestConfig(t, root, "crlvalidity = \"24h\"\npolicymaxlabels = 3\n")
+
+	cfg, err := LoadConfig([]string{"-policymaxlabels=4"}, nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, view := chrootedTestServer(t, cfg)
+
+	// The file changes before the reload.
+	err = ioutil.WriteFile(filepath.Join(view, defaultConfigFile), []byte("crlvalidity = \"48h\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := s.loadConfig([]string{"-policymaxlabels=4"}, nil, os.DirFS(view))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reloaded.CRLValidity != "48h" {
+		t.Errorf("CRLValidity is %s after reloading, want 48h from the config file", reloaded.CRLValidity)
+	}
+
+	if reloaded.PolicyMaxLabels != 4 {
+		t.Errorf("PolicyMaxLabels is %d after reloading, want 4 from the command line", reloaded.PolicyMaxLabels)
+	}
+
+	if reloaded.ConfigDir != root {
+		t.Errorf("ConfigDir is %s after reloading, want %s", reloaded.ConfigDir, root)
+	}
+}
+
+func TestChrootedReloadOutsideChroot(t *testing.T) {
+	root := t.TempDir()
+
+	outside := t.TempDir()
+	writeTestConfig(t, outside, "crlvalidity = \"24h\"\n")
+
+	cfg, err := LoadConfig([]string{
+		"-configdir", root,
+		"-conf", filepath.Join(outside, defaultConfigFile),
+	}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, view := chrootedTestServer(t, cfg)
+
+	_, err = s.loadConfig(nil, nil, os.DirFS(view))
+	if !errors.Is(err, ErrOutsideChroot) {
+		t.Errorf("got %v, want %v", err, ErrOutsideChroot)
+	}
+}
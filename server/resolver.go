@@ -0,0 +1,563 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/qlib"
+)
+
+// Values of Config.DNSTransport.
+const (
+	transportUDP   = "udp"
+	transportTCP   = "tcp"
+	transportTLS   = "tls"
+	transportHTTPS = "https"
+)
+
+// The service looked up when a request doesn't specify a port and protocol.
+const (
+	defaultTLSAPort     = 443
+	defaultTLSAProtocol = "tcp"
+)
+
+// maxDoHResponseSize is the largest DNS message that can be represented on
+// the wire.
+const maxDoHResponseSize = 65535
+
+var (
+	// ErrNoDNSResponse is returned when the upstream DNS server didn't
+	// answer.
+	ErrNoDNSResponse = errors.New("no DNS response")
+
+	// ErrDNSTransport is returned when the configured DNS transport is
+	// invalid.
+	ErrDNSTransport = errors.New("invalid DNS transport")
+
+	// ErrSPKIPinMismatch is returned when a DNS server's key doesn't match
+	// any of the pinned SPKI hashes.
+	ErrSPKIPinMismatch = errors.New("DNS server key doesn't match any pinned SPKI hash")
+
+	// ErrInvalidService is returned when a request's port or protocol
+	// parameter is invalid.
+	ErrInvalidService = errors.New("invalid port or protocol")
+)
+
+// initResolver validates the DNS transport settings and prepares the TLS and
+// HTTP clients used by the encrypted transports.
+func (s *Server) initResolver() error {
+	s.cfg.DNSTransport = strings.ToLower(s.cfg.DNSTransport)
+
+	if s.cfg.DNSTimeout != "" {
+		var err error
+
+		s.dnsTimeout, err = time.ParseDuration(s.cfg.DNSTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid DNS timeout %s: %w", s.cfg.DNSTimeout, err)
+		}
+	}
+
+	if s.cfg.DNSCacheMaxTTL != "" {
+		var err error
+
+		s.dnsCacheMaxTTL, err = time.ParseDuration(s.cfg.DNSCacheMaxTTL)
+		if err != nil {
+			return fmt.Errorf("invalid DNS cache TTL %s: %w", s.cfg.DNSCacheMaxTTL, err)
+		}
+	}
+
+	switch s.cfg.DNSTransport {
+	case transportUDP, transportTCP:
+		return nil
+	case transportTLS, transportHTTPS:
+	default:
+		return fmt.Errorf("%w: %s", ErrDNSTransport, s.cfg.DNSTransport)
+	}
+
+	if s.cfg.DNSAddress == "" {
+		return fmt.Errorf("%w: the %s transport requires DNSAddress", ErrDNSTransport, s.cfg.DNSTransport)
+	}
+
+	if s.cfg.DNSTransport == transportHTTPS {
+		for _, server := range s.dnsServers() {
+			_, err := url.Parse(server)
+			if err != nil {
+				return fmt.Errorf("invalid DoH URL %s: %w", server, err)
+			}
+		}
+	}
+
+	// If DNSServerName is empty, each server's certificate is validated
+	// against its own hostname; see queryTLS.  net/http does the same
+	// for DoH URLs.
+	s.dnsTLSConfig = &tls.Config{
+		ServerName: s.cfg.DNSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if s.cfg.DNSPinnedSPKI != "" {
+		pins := [][]byte{}
+
+		for _, pin := range strings.Split(s.cfg.DNSPinnedSPKI, ",") {
+			pinBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pin))
+			if err != nil || len(pinBytes) != sha256.Size {
+				return fmt.Errorf("%w: invalid SPKI pin %s", ErrDNSTransport, pin)
+			}
+
+			pins = append(pins, pinBytes)
+		}
+
+		// The pins replace chain validation, which allows using a
+		// resolver with a self-signed certificate.
+		//nolint:gosec // G402 Verified by VerifyPeerCertificate
+		s.dnsTLSConfig.InsecureSkipVerify = true
+		s.dnsTLSConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifySPKIPins(rawCerts, pins)
+		}
+	}
+
+	if s.cfg.DNSTransport == transportHTTPS {
+		// Like the other transports, each query gets a fresh
+		// connection, so that queries on behalf of different isolation
+		// keys don't share one.
+		s.dohClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   s.dnsTLSConfig,
+				ForceAttemptHTTP2: true,
+				DisableKeepAlives: true,
+			},
+		}
+	}
+
+	return nil
+}
+
+func verifySPKIPins(rawCerts [][]byte, pins [][]byte) error {
+	if len(rawCerts) == 0 {
+		return ErrSPKIPinMismatch
+	}
+
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("unable to parse DNS server certificate: %w", err)
+	}
+
+	spkiHash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+
+	for _, pin := range pins {
+		if bytes.Equal(spkiHash[:], pin) {
+			return nil
+		}
+	}
+
+	return ErrSPKIPinMismatch
+}
+
+// queryTLSA looks up the TLSA records of domain for service (e.g.
+// "_443._tcp"), falling back to the Namecoin-form records of all protocols
+// and all ports of domain if there are none at the service-specific owner
+// name.  wildcard reports whether the answer is that of the fallback query
+// at *.domain, whose records also apply to the subdomains of domain that
+// don't publish records of their own.  (The owner names of its answers
+// don't tell, e.g. if they were synthesized or reached through a CNAME.)
+// Answers may come from the DNS answer cache of isolation.
+func (s *Server) queryTLSA(ctx context.Context, domain, service, isolation string) (msg *dns.Msg,
+	wildcard bool, err error) {
+	msg, err = s.queryNameCached(ctx, service+"."+domain, isolation)
+	if err != nil || hasTLSAAnswer(msg) {
+		return msg, false, err
+	}
+
+	// Set qname to all protocols and all ports of requested hostname
+	msg, err = s.queryNameCached(ctx, "*."+domain, isolation)
+
+	return msg, true, err
+}
+
+// wildcardCacheKeySuffix is appended to the domain cert cache keys of
+// lookups that asked for wildcard certs.  (Domains never contain spaces.)
+const wildcardCacheKeySuffix = " wildcard"
+
+// hasTLSAAnswer reports whether a successful response contains any TLSA
+// records.
+func hasTLSAAnswer(msg *dns.Msg) bool {
+	if msg.Rcode != dns.RcodeSuccess {
+		return false
+	}
+
+	for _, rr := range msg.Answer {
+		if _, ok := rr.(*dns.TLSA); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// queryName looks up the TLSA records at qname.  Each query is made over a
+// fresh connection, so queries made on behalf of different isolation keys
+// never share upstream state.  The query is abandoned when ctx is done.
+//
+// Each configured DNS server is tried in order (with DNSRetries retries
+// each), moving on when one fails or answers SERVFAIL/REFUSED; with
+// DNSRace, all of them are queried at once and the first usable answer
+// wins.  With DNSProxy, the connections go through the proxy, isolated by
+// isolation (see dnsProxyDialer).
+func (s *Server) queryName(ctx context.Context, qname, isolation string) (*dns.Msg, error) {
+	servers := s.dnsServers()
+	if s.cfg.DNSRace && len(servers) > 1 {
+		return s.queryRace(ctx, qname, isolation, servers)
+	}
+
+	var (
+		msg *dns.Msg
+		err error
+	)
+
+	for _, server := range servers {
+		msg, err = s.queryServerWithRetries(ctx, qname, isolation, server)
+		if usableDNSResponse(msg, err) || ctx.Err() != nil {
+			break
+		}
+
+		log.Debugef(err, "DNS server %s failed", server)
+	}
+
+	return msg, err
+}
+
+// tlsaService returns the TLSA owner name prefix (e.g. "_443._tcp") for the
+// request's optional port and protocol parameters, which default to 443 and
+// tcp.
+func tlsaService(req *http.Request) (string, error) {
+	port := 0
+	if portParam := req.FormValue("port"); portParam != "" {
+		var err error
+
+		port, err = strconv.Atoi(portParam)
+		if err != nil {
+			return "", fmt.Errorf("%w: port %q", ErrInvalidService, portParam)
+		}
+	}
+
+	return tlsaServiceName(port, req.FormValue("protocol"))
+}
+
+// tlsaServiceName returns the TLSA owner name prefix for port and protocol.
+// A zero port or empty protocol selects the default.
+func tlsaServiceName(port int, protocol string) (string, error) {
+	if port == 0 {
+		port = defaultTLSAPort
+	}
+
+	if port < 1 || port > 65535 {
+		return "", fmt.Errorf("%w: port %d", ErrInvalidService, port)
+	}
+
+	if protocol == "" {
+		protocol = defaultTLSAProtocol
+	}
+
+	protocol = strings.ToLower(protocol)
+	if protocol != "tcp" && protocol != "udp" && protocol != "sctp" {
+		return "", fmt.Errorf("%w: protocol %q", ErrInvalidService, protocol)
+	}
+
+	return fmt.Sprintf("_%d._%s", port, protocol), nil
+}
+
+// dnsServers returns DNSAddress followed by the DNSFallbackAddresses.  An
+// empty DNSAddress stands for the system resolver.
+func (s *Server) dnsServers() []string {
+	servers := []string{s.cfg.DNSAddress}
+
+	for _, server := range strings.Split(s.cfg.DNSFallbackAddresses, ",") {
+		server = strings.TrimSpace(server)
+		if server != "" {
+			servers = append(servers, server)
+		}
+	}
+
+	return servers
+}
+
+// usableDNSResponse reports whether a query succeeded well enough that
+// there's no point asking another server.
+func usableDNSResponse(msg *dns.Msg, err error) bool {
+	if err != nil || msg == nil {
+		return false
+	}
+
+	return msg.Rcode != dns.RcodeServerFailure && msg.Rcode != dns.RcodeRefused
+}
+
+func (s *Server) queryServerWithRetries(ctx context.Context, qname, isolation, server string) (*dns.Msg, error) {
+	var (
+		msg *dns.Msg
+		err error
+	)
+
+	for attempt := 0; attempt <= s.cfg.DNSRetries; attempt++ {
+		msg, err = s.queryServer(ctx, qname, isolation, server)
+		if usableDNSResponse(msg, err) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return msg, err
+}
+
+// queryRace queries all servers at once, returning the first usable answer,
+// or the last failure if none of them answer usably.
+func (s *Server) queryRace(ctx context.Context, qname, isolation string, servers []string) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Buffered so that the losers don't block after we return.
+	results := make(chan dnsResult, len(servers))
+
+	for _, server := range servers {
+		go func(server string) {
+			msg, err := s.queryServerWithRetries(ctx, qname, isolation, server)
+			results <- dnsResult{msg: msg, err: err}
+		}(server)
+	}
+
+	var result dnsResult
+
+	for range servers {
+		result = <-results
+		if usableDNSResponse(result.msg, result.err) {
+			break
+		}
+	}
+
+	return result.msg, result.err
+}
+
+// queryServer makes a single query to server, within DNSTimeout.
+func (s *Server) queryServer(ctx context.Context, qname, isolation, server string) (*dns.Msg, error) {
+	if s.dnsTimeout != 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.dnsTimeout)
+		defer cancel()
+	}
+
+	switch {
+	case s.cfg.DNSTransport == transportHTTPS:
+		return s.queryHTTPS(ctx, qname, isolation, server)
+	case s.cfg.DNSProxy != "":
+		return s.queryProxied(ctx, qname, isolation, server)
+	case s.cfg.DNSTransport == transportTLS:
+		return s.queryTLS(ctx, qname, server)
+	default:
+		return s.queryQlibContext(ctx, qname, server)
+	}
+}
+
+type dnsResult struct {
+	msg *dns.Msg
+	err error
+}
+
+// queryQlibContext runs a qlib query, returning early if ctx is done.  qlib
+// can't be cancelled, so the query itself runs to completion in the
+// background, but its result is discarded.
+func (s *Server) queryQlibContext(ctx context.Context, qname, server string) (*dns.Msg, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// Buffered so that an abandoned query doesn't leak its goroutine.
+	done := make(chan dnsResult, 1)
+
+	go func() {
+		msg, err := s.queryQlib(qname, server)
+		done <- dnsResult{msg: msg, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.msg, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Server) queryQlib(qname, server string) (*dns.Msg, error) {
+	qparams := qlib.DefaultParams()
+	qparams.Port = s.cfg.DNSPort
+	qparams.Ad = true
+	qparams.Fallback = true
+	// Workaround for https://github.com/miekg/exdns/issues/19
+	qparams.Tcp = s.cfg.DNSTransport == transportTCP
+
+	args := []string{}
+	// Set the custom DNS server if requested
+	if server != "" {
+		args = append(args, "@"+server)
+	}
+	// Set qtype to TLSA
+	args = append(args, "TLSA")
+	args = append(args, qname)
+
+	result, err := qparams.Do(args)
+	if err != nil {
+		return nil, fmt.Errorf("qlib error: %w", err)
+	}
+
+	if result.ResponseMsg == nil {
+		return nil, ErrNoDNSResponse
+	}
+
+	return result.ResponseMsg, nil
+}
+
+func newTLSAQuery(qname string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(qname), dns.TypeTLSA)
+	msg.AuthenticatedData = true
+
+	return msg
+}
+
+func (s *Server) queryTLS(ctx context.Context, qname, server string) (*dns.Msg, error) {
+	tlsConfig := s.dnsTLSConfig
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = server
+	}
+
+	client := &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: tlsConfig,
+	}
+
+	addr := net.JoinHostPort(server, strconv.Itoa(s.cfg.DNSPort))
+
+	response, _, err := client.ExchangeContext(ctx, newTLSAQuery(qname), addr)
+	if err != nil {
+		return nil, fmt.Errorf("DNS-over-TLS error: %w", err)
+	}
+
+	if response == nil {
+		return nil, ErrNoDNSResponse
+	}
+
+	return response, nil
+}
+
+// queryHTTPS performs an RFC 8484 DNS-over-HTTPS query.
+func (s *Server) queryHTTPS(ctx context.Context, qname, isolation, server string) (*dns.Msg, error) {
+	query := newTLSAQuery(qname)
+	// RFC 8484 section 4.1 recommends ID 0 for cache friendliness.
+	query.Id = 0
+
+	queryBytes, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("unable to pack DNS query: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(queryBytes))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create DoH request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := s.dohClientFor(isolation).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DNS-over-HTTPS error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: DoH server returned HTTP %d", ErrNoDNSResponse, resp.StatusCode)
+	}
+
+	responseBytes, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read DoH response: %w", err)
+	}
+
+	response := new(dns.Msg)
+
+	err = response.Unpack(responseBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unpack DoH response: %w", err)
+	}
+
+	return response, nil
+}
+
+// trustedTLSA returns the TLSA records of domain for service, and whether
+// they're the records at *.domain (see queryTLSA).  As in the HTTP handlers,
+// an NXDOMAIN or an unauthenticated, non-authoritative answer yields no
+// records rather than an error.  It's used by the server's own background
+// checks, which share the unisolated DNS answer cache.
+func (s *Server) trustedTLSA(ctx context.Context, domain, service string) ([]*dns.TLSA, bool, error) {
+	dnsResponse, wildcard, err := s.queryTLSA(ctx, domain, service, "")
+	if err != nil {
+		return nil, false, err
+	}
+
+	if dnsResponse.MsgHdr.Rcode == dns.RcodeNameError {
+		return nil, false, nil
+	}
+
+	if dnsResponse.MsgHdr.Rcode != dns.RcodeSuccess {
+		return nil, false, fmt.Errorf("%w: rcode %s", ErrNoDNSResponse,
+			dns.RcodeToString[dnsResponse.MsgHdr.Rcode])
+	}
+
+	if !dnsResponse.MsgHdr.AuthenticatedData && !dnsResponse.MsgHdr.Authoritative {
+		return nil, false, nil
+	}
+
+	records := []*dns.TLSA{}
+
+	for _, rr := range dnsResponse.Answer {
+		tlsa, ok := rr.(*dns.TLSA)
+		if !ok {
+			continue
+		}
+
+		records = append(records, tlsa)
+	}
+
+	return records, wildcard, nil
+}
+
+// writeDNSError responds to a request whose DNS lookup failed.  A lookup
+// that ran out of time gets 504 and other DNS failures 502; if the client
+// went away, nothing is written.
+func writeDNSError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		log.Debuge(err, "client went away during DNS lookup")
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Debuge(err, "DNS lookup timed out")
+		writeError(w, http.StatusGatewayTimeout, errCodeDNSTimeout, "DNS lookup timed out")
+	default:
+		log.Debuge(err, "DNS error")
+		writeError(w, http.StatusBadGateway, errCodeDNSError, err.Error())
+	}
+}
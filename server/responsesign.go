@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// responseSignatureHeader carries the detached JWS (RFC 7515 Appendix F) of
+// a plaintext response.  Its protected header holds:
+//
+//   - alg: always ES256
+//   - x5c: the response signing cert, followed by the root CA that issued it
+//   - encaya_uri: the request URI the response is for, so that a response
+//     can't be replayed for a different request
+//   - iat: when the response was signed
+//
+// Clients verify the signature over the base64url-encoded response body
+// (after removing any Content-Encoding), check that x5c[0] chains to a root
+// CA they trust and has the id-kp-documentSigning extended key usage, and
+// check that encaya_uri matches their request.
+const responseSignatureHeader = "X-JWS-Signature"
+
+// responseSigningValidity is the lifetime of the in-memory response signing
+// certs.  A new one is issued once half of it has passed.
+const responseSigningValidity = 7 * 24 * time.Hour
+
+// oidExtKeyUsageDocumentSigning is id-kp-documentSigning (RFC 9336), which
+// keeps the response signing cert from being valid for TLS.
+var oidExtKeyUsageDocumentSigning = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 36}
+
+// responseSigner holds the key that signs plaintext responses, and its cert
+// issued by the root CA.  Neither is ever written to disk.
+type responseSigner struct {
+	mu       sync.Mutex
+	key      *ecdsa.PrivateKey
+	x5c      []string
+	root     []byte
+	notAfter time.Time
+}
+
+type responseSignatureHeaderJSON struct {
+	Alg       string   `json:"alg"`
+	X5C       []string `json:"x5c"`
+	EncayaURI string   `json:"encaya_uri"`
+	IAT       int64    `json:"iat"`
+}
+
+// current returns the signing key and its x5c chain, issuing a new cert if
+// the root CA changed or the current cert is half-way through its lifetime.
+func (r *responseSigner) current(rootCert []byte, rootParsed *x509.Certificate,
+	rootPriv crypto.Signer, serialBits int) (*ecdsa.PrivateKey, []string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.key != nil && bytes.Equal(r.root, rootCert) &&
+		time.Until(r.notAfter) > responseSigningValidity/2 {
+		return r.key, r.x5c, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate response signing key: %w", err)
+	}
+
+	serialNumber, err := randomSerial(serialBits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate serial number: %w", err)
+	}
+
+	notAfter := time.Now().Add(responseSigningValidity)
+	if notAfter.After(rootParsed.NotAfter) {
+		notAfter = rootParsed.NotAfter
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   "Encaya Response Signing",
+			SerialNumber: "Namecoin Response Signing Certificate",
+		},
+		NotBefore: time.Now().Add(-1 * time.Hour),
+		NotAfter:  notAfter,
+
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		UnknownExtKeyUsage:    []asn1.ObjectIdentifier{oidExtKeyUsageDocumentSigning},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, rootParsed, key.Public(), rootPriv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create response signing cert: %w", err)
+	}
+
+	r.key = key
+	r.x5c = []string{
+		base64.StdEncoding.EncodeToString(der),
+		base64.StdEncoding.EncodeToString(rootCert),
+	}
+	r.root = rootCert
+	r.notAfter = notAfter
+
+	return r.key, r.x5c, nil
+}
+
+// signResponse returns the detached JWS of body, a response to uri.
+func (s *Server) signResponse(uri string, body []byte) (string, error) {
+	// The middleware runs outside of serveLocked.
+	s.reloadMutex.RLock()
+	rootCert, rootParsed, rootPriv := s.rootCert, s.rootCertParsed, s.rootPriv
+	s.reloadMutex.RUnlock()
+
+	key, x5c, err := s.responseSigner.current(rootCert, rootParsed, rootPriv, s.cfg.SerialBits)
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(responseSignatureHeaderJSON{
+		Alg:       "ES256",
+		X5C:       x5c,
+		EncayaURI: uri,
+		IAT:       time.Now().Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	digest := sha256.Sum256([]byte(protected + "." + base64.RawURLEncoding.EncodeToString(body)))
+
+	r, sig, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign response: %w", err)
+	}
+
+	// JWS uses the fixed-size R || S encoding.
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	sig.FillBytes(signature[32:])
+
+	return protected + ".." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// bufferedResponse holds back a response until its body is complete, so
+// that it can be signed.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	// Informational responses are followed by the real one.
+	if status < http.StatusOK {
+		b.ResponseWriter.WriteHeader(status)
+
+		return
+	}
+
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
+
+// signHandler attaches a responseSignatureHeader to the responses to
+// requests that didn't arrive over TLS.  /watch streams aren't signed.
+func (s *Server) signHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil || req.URL.Path == "/watch" {
+			next.ServeHTTP(w, req)
+
+			return
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: w}
+		next.ServeHTTP(buffered, req)
+
+		if buffered.status == 0 {
+			buffered.status = http.StatusOK
+		}
+
+		signature, err := s.signResponse(req.RequestURI, buffered.body.Bytes())
+		if err != nil {
+			// Clients that verify signatures will reject the
+			// response.
+			log.Errore(err, "Unable to sign response")
+		} else {
+			w.Header().Set(responseSignatureHeader, signature)
+		}
+
+		w.Header().Del("Content-Length")
+		w.WriteHeader(buffered.status)
+
+		if buffered.body.Len() == 0 {
+			return
+		}
+
+		_, err = w.Write(buffered.body.Bytes())
+		if err != nil {
+			log.Debuge(err, "write error")
+		}
+	})
+}
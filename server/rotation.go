@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// generationPrevious is the value of the "generation" parameter that selects
+// the previous root CA generation during a rotation.
+const generationPrevious = "previous"
+
+// loadPreviousGeneration loads the root CA that was replaced by the most
+// recent rotation, if its files exist, along with a TLD CA for each TLD
+// signed by it.  The previous generation is represented as a Server that
+// only has its root and TLD CA fields set.
+func (s *Server) loadPreviousGeneration() error {
+	if s.cfg.PreviousRootCert == "" {
+		return nil
+	}
+
+	_, err := os.Stat(s.cfg.PreviousRootCert)
+	if os.IsNotExist(err) {
+		// Not rotating
+		return nil
+	}
+
+	previous := &Server{
+		cfg:         s.cfg,
+		crlValidity: s.crlValidity,
+		crls:        map[string]*cachedCRL{},
+
+		rootKeyPassphrase: s.rootKeyPassphrase,
+	}
+	previous.cfg.RootCert = s.cfg.PreviousRootCert
+	previous.cfg.RootKey = s.cfg.PreviousRootKey
+	previous.cfg.TLDCert = s.cfg.PreviousTLDCert
+	previous.cfg.TLDKey = s.cfg.PreviousTLDKey
+
+	if previous.cfg.CRLURL != "" {
+		separator := "?"
+		if strings.Contains(previous.cfg.CRLURL, "?") {
+			separator = "&"
+		}
+
+		previous.cfg.CRLURL += separator + "generation=" + generationPrevious
+	}
+
+	err = previous.loadRootCert()
+	if err != nil {
+		return fmt.Errorf("previous root CA: %w", err)
+	}
+
+	err = previous.loadRootKey()
+	if err != nil {
+		return fmt.Errorf("previous root CA: %w", err)
+	}
+
+	s.rootKeyPassphrase = previous.rootKeyPassphrase
+
+	err = previous.loadTLDCAs()
+	if err != nil {
+		return fmt.Errorf("previous root CA: %w", err)
+	}
+
+	s.rotationOverlap, err = time.ParseDuration(s.cfg.RotationOverlap)
+	if err != nil {
+		return fmt.Errorf("invalid rotation overlap %s: %w", s.cfg.RotationOverlap, err)
+	}
+
+	s.previous = previous
+
+	if s.rotating() {
+		log.Infof("CA rotation in progress until %s", s.rotationEnd())
+	}
+
+	return nil
+}
+
+// rotationEnd returns the end of the overlap window, which starts when the
+// current root CA becomes valid.
+func (s *Server) rotationEnd() time.Time {
+	return s.rootCertParsed.NotBefore.Add(s.rotationOverlap)
+}
+
+// rotating reports whether certs chaining to the previous root CA should
+// still be served.
+func (s *Server) rotating() bool {
+	return s.previous != nil && time.Now().Before(s.rotationEnd())
+}
+
+// previousTLD returns the previous generation's CA for the same TLD as tld,
+// or nil if no rotation is in progress.
+func (s *Server) previousTLD(tld *tldCA) *tldCA {
+	if !s.rotating() {
+		return nil
+	}
+
+	return s.previous.tlds[tld.name]
+}
+
+// withoutGeneration returns a copy of req with the "generation" parameter
+// removed, for delegating to the previous generation's handlers.
+func withoutGeneration(req *http.Request) *http.Request {
+	form := url.Values{}
+
+	for key, values := range req.Form {
+		if key != "generation" {
+			form[key] = values
+		}
+	}
+
+	result := req.Clone(req.Context())
+	result.Form = form
+
+	return result
+}
+
+// rotateRootFiles moves the current root and TLD CA files aside as the
+// previous generation, so that GenerateCerts can write a new root CA.
+func (cfg *Config) rotateRootFiles() error {
+	err := os.Rename(cfg.RootCert, cfg.PreviousRootCert)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(cfg.RootKey, cfg.PreviousRootKey)
+	if err != nil {
+		return err
+	}
+
+	for _, tldName := range cfg.tldList() {
+		err = renameIfExists(cfg.tldCertPath(tldName), strings.ReplaceAll(cfg.PreviousTLDCert, "%s", tldName))
+		if err != nil {
+			return err
+		}
+
+		err = renameIfExists(cfg.tldKeyPath(tldName), strings.ReplaceAll(cfg.PreviousTLDKey, "%s", tldName))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func renameIfExists(oldPath, newPath string) error {
+	err := os.Rename(oldPath, newPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// stagedFiles maps new files, written next to the files they replace with a
+// .new suffix, to the paths they replace.  GenerateCerts stages every file
+// before replacing any, so that a failure leaves the old ones in place.
+type stagedFiles map[string]string
+
+// stageFiles writes each of files (by path) to its staging path.
+func stageFiles(files map[string][]byte) (stagedFiles, error) {
+	staged := stagedFiles{}
+
+	for path, data := range files {
+		stagedPath := path + ".new"
+
+		err := ioutil.WriteFile(stagedPath, data, 0600)
+		if err != nil {
+			staged.discard()
+
+			return nil, fmt.Errorf("unable to write %s: %w", stagedPath, err)
+		}
+
+		staged[stagedPath] = path
+	}
+
+	return staged, nil
+}
+
+// commit moves the staged files into place.
+func (f stagedFiles) commit() error {
+	for stagedPath, path := range f {
+		err := os.Rename(stagedPath, path)
+		if err != nil {
+			return fmt.Errorf("unable to replace %s: %w", path, err)
+		}
+
+		delete(f, stagedPath)
+	}
+
+	return nil
+}
+
+// discard removes the staged files that haven't been committed.
+func (f stagedFiles) discard() {
+	for stagedPath := range f {
+		err := os.Remove(stagedPath)
+		if err != nil {
+			log.Debuge(err, "Unable to remove staged file")
+		}
+	}
+}
+
+type rotationRoot struct {
+	SHA256    string    `json:"sha256"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+type rotationStatus struct {
+	Rotating         bool          `json:"rotating"`
+	CurrentRoot      rotationRoot  `json:"current_root"`
+	PreviousRoot     *rotationRoot `json:"previous_root,omitempty"`
+	OverlapEnds      *time.Time    `json:"overlap_ends,omitempty"`
+	OverlapRemaining float64       `json:"overlap_remaining_seconds,omitempty"`
+}
+
+func newRotationRoot(s *Server) rotationRoot {
+	fingerprint := sha256.Sum256(s.rootCert)
+
+	return rotationRoot{
+		SHA256:    hex.EncodeToString(fingerprint[:]),
+		NotBefore: s.rootCertParsed.NotBefore,
+		NotAfter:  s.rootCertParsed.NotAfter,
+	}
+}
+
+func (s *Server) rotationStatusHandler(w http.ResponseWriter, req *http.Request) {
+	status := rotationStatus{
+		Rotating:    s.rotating(),
+		CurrentRoot: newRotationRoot(s),
+	}
+
+	if s.previous != nil {
+		previousRoot := newRotationRoot(s.previous)
+		overlapEnds := s.rotationEnd()
+
+		status.PreviousRoot = &previousRoot
+		status.OverlapEnds = &overlapEnds
+
+		if status.Rotating {
+			status.OverlapRemaining = time.Until(overlapEnds).Seconds()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
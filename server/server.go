@@ -2,75 +2,342 @@ package server
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"context"
+	"crypto"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"math/big"
+	"net"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/hlandau/xlog"
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 
 	"github.com/namecoin/crosssign"
-	"github.com/namecoin/qlib"
 	"github.com/namecoin/safetlsa"
 )
 
 var log, logPublic = xlog.New("ncdns.server")
 
+var (
+	// ErrNotFound is returned when a requested CA or cert doesn't exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrInvalidKey is returned when a private key supplied by a client
+	// can't be parsed.
+	ErrInvalidKey = errors.New("invalid private key")
+
+	// ErrInvalidPEM is returned when PEM data supplied by a client holds
+	// the wrong type of block or a malformed cert.
+	ErrInvalidPEM = errors.New("invalid PEM data")
+)
+
 var Log = logPublic
 
 type cachedCert struct {
+	// Zero if the cert never expires
 	expiration time.Time
 	certPem    string
+
+	// Set by certCache.add
+	added time.Time
+
+	// Only set for domain certs
+	domain  string
+	service string
+	certDer []byte
+	tlsa    *dns.TLSA
 }
 
 type Server struct {
 	cfg Config
+	mux *http.ServeMux
+
+	dnsTLSConfig *tls.Config
+	dnsTimeout   time.Duration
+	dohClient    *http.Client
+
+	// Upstream DNS answers, keyed by isolation key and owner name
+	dnsCache       *dnsCache
+	dnsCacheMaxTTL time.Duration
 
 	rootCert          []byte
-	rootPriv          interface{}
+	rootCertParsed    *x509.Certificate
+	rootPriv          crypto.Signer
 	rootCertPem       []byte
 	rootCertPemString string
 	rootPrivPem       []byte
-	tldCert           []byte
-	tldPriv           interface{}
-	tldCertPem        []byte
-	tldCertPemString  string
 
-	// These caches don't yet support stream isolation; see
-	// https://github.com/namecoin/encaya/issues/8
-	domainCertCache        map[string][]cachedCert
-	domainCertCacheMutex   sync.RWMutex
-	negativeCertCache      map[string][]cachedCert
-	negativeCertCacheMutex sync.RWMutex
-	originalCertCache      map[string][]cachedCert
-	originalCertCacheMutex sync.RWMutex
+	// Decrypts RootKey and PreviousRootKey; read from RootKeyPassphrase
+	// when first needed
+	rootKeyPassphrase []byte
+
+	// Keyed by TLD, without leading dot
+	tlds     map[string]*tldCA
+	tldNames []string
+
+	// Which domains certs are generated for; nil if unrestricted
+	policy *issuancePolicy
+
+	domainCertValidity    time.Duration
+	listenCertValidity    time.Duration
+	listenCertRenewBefore time.Duration
+	domainCacheTTL        time.Duration
+	cacheRefreshWindow    time.Duration
+	cacheRefreshIdle      time.Duration
+	requestTimeout        time.Duration
+	watchInterval         time.Duration
+
+	// Served by the HTTPS listeners; replaced when renewed
+	listenCert      *tls.Certificate
+	listenCertTimer *time.Timer
+	listenCertMutex sync.RWMutex
+
+	// Session ticket keys of the TLS listeners, if TLSSessionTicketRotation
+	// is set
+	ticketKeys *sessionTicketKeys
+
+	// Bound in New (or passed by systemd, if activated is set), and
+	// served from Start until Stop
+	listeners        listenerSet
+	activated        bool
+	httpServers      []*http.Server
+	http3Servers     []*http3.Server
+	httpServersMutex sync.Mutex
+
+	// Receives the first error that stops a listener (see Failed)
+	failed chan error
+
+	// Domains subscribed to via /watch
+	watches *watchHub
+
+	// Domains whose cached certs are refreshed in the background
+	refresher *cacheRefresher
+
+	// Serves the gRPC API on listeners.grpc
+	grpcServer *grpc.Server
+
+	// The directory we chrooted into, if Chroot is set
+	chrootDir string
+
+	rateLimiter    *rateLimiter
+	lookupSlots    chan struct{}
+	trustedProxies []*net.IPNet
+
+	// Names the API endpoints are served under; nil unless VirtualHosts
+	// is set
+	apiHosts map[string]bool
+
+	// Exports spans if TracingEndpoint is set; otherwise both are nil and
+	// spans are no-ops
+	tracerProvider *sdktrace.TracerProvider
+	tracer         trace.Tracer
+
+	// Held for writing while Reload swaps in new CAs and settings, and
+	// for reading by every request
+	reloadMutex sync.RWMutex
+	handler     http.Handler
+
+	// The root CA generation being rotated out, if any; see
+	// loadPreviousGeneration
+	previous        *Server
+	rotationOverlap time.Duration
+
+	// Cache keys are partitioned by the client's stream isolation key; see
+	// isolatedKey.
+	domainCertCache   *certCache
+	negativeCertCache *certCache
+	originalCertCache *certCache
+
+	// Domain certs we've issued, keyed by serial number, for answering
+	// OCSP requests
+	issuedCertCache *certCache
+
+	crlValidity time.Duration
+	crls        map[string]*cachedCRL
+	crlsMutex   sync.Mutex
+
+	// Persistent backing for negativeCertCache and originalCertCache; nil
+	// if disabled
+	store *store
+
+	// Log of the certs we issue; nil if disabled
+	transLog *transLog
+
+	// Log of who was issued what; nil if disabled
+	auditLog *auditLog
+
+	// Log of HTTP requests; nil if disabled
+	accessLog *accessLog
+
+	// Signs plaintext responses if ResponseSigning is set
+	responseSigner *responseSigner
+
+	// Accounts, orders and nonces of the ACME server; nil if disabled
+	acme *acmeState
 }
 
 //nolint:lll
 type Config struct {
 	DNSAddress string `default:"" usage:"Use this DNS server for DNS lookups.  (If left empty, the system resolver will be used.)"`
-	DNSPort    int    `default:"53" usage:"Use this port for DNS lookups."`
-	ListenIP   string `default:"127.127.127.127" usage:"Listen on this IP address."`
+	DNSPort    int    `default:"53" usage:"Use this port for DNS lookups.  (Usually 853 for the tls transport.)"`
+
+	DNSTransport  string `default:"tcp" usage:"Use this transport for DNS lookups: udp, tcp, tls (DNS-over-TLS) or https (DNS-over-HTTPS).  For https, DNSAddress is the full URL of the DoH endpoint."`
+	DNSServerName string `default:"" usage:"Validate the DNS server's TLS certificate against this name.  (If left empty, the host of DNSAddress is used.)"`
+	DNSPinnedSPKI string `default:"" usage:"Comma-separated base64 SHA-256 hashes of the DNS server's SubjectPublicKeyInfo.  If set, the tls and https transports accept only a server key matching one of these, instead of validating the certificate chain."`
+
+	DNSFallbackAddresses string `default:"" usage:"Comma-separated DNS servers to try, in order, when DNSAddress fails or answers SERVFAIL.  They use the same transport and port as DNSAddress."`
+	DNSRace              bool   `default:"false" usage:"Query DNSAddress and all DNSFallbackAddresses at once, and use the first usable answer, instead of trying them in order."`
+	DNSTimeout           string `default:"5s" usage:"Give up on a DNS query to one server after this long.  (If left empty, only the request deadline applies.)"`
+	DNSRetries           int    `default:"1" usage:"Retry a failed DNS query to each server this many times before moving on."`
+
+	DNSProxy          string `default:"" usage:"Connect to the DNS servers through this SOCKS5 proxy (host:port), e.g. Tor's 127.0.0.1:9050.  The proxy resolves the servers' names.  (Requires DNSAddress and the tcp, tls or https transport.)"`
+	DNSProxyIsolation bool   `default:"true" usage:"Send the isolation key of each request to DNSProxy as SOCKS5 credentials, so that Tor uses separate circuits for separate isolation keys."`
+
+	DNSCacheMaxTTL     string `default:"5m" usage:"Cache DNS answers (including NXDOMAIN) for their TTL, but at most this long.  (If left empty, every lookup queries the DNS server.)"`
+	DNSCacheMaxEntries int    `default:"10000" usage:"Cache at most this many DNS answers.  (0 means unlimited.)"`
+
+	RequestTimeout string `default:"30s" usage:"Abandon a request's DNS lookups and signing after this long, responding with HTTP 504.  (If left empty, requests have no server-side deadline.)"`
+
+	TLDs string `default:"bit" usage:"Comma-separated list of TLDs to issue certificates for, each with its own TLD CA."`
+
+	ListenIP      string `default:"127.127.127.127" usage:"Listen on these IP addresses (comma-separated; IPv6 literals are allowed).  (Ignored when socket-activated by systemd; sockets named https or tls are served over TLS, others as plain HTTP.)"`
+	ListenPort    int    `default:"80" usage:"Listen for HTTP on this port."`
+	ListenTLSPort int    `default:"443" usage:"Listen for HTTPS on this port."`
+	HTTP3         bool   `default:"false" usage:"Also serve HTTP/3 (QUIC) on UDP port ListenTLSPort of each ListenIP, with the listen certificate, and advertise it in an Alt-Svc header of the HTTPS responses.  (Not available when socket-activated.)"`
+
+	TLSMinVersion            string `default:"1.2" usage:"Accept this TLS version and newer on the HTTPS and gRPC listeners: 1.2 or 1.3."`
+	TLSCipherSuites          string `default:"" usage:"Comma-separated TLS 1.2 cipher suites to accept, by their Go names (e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256).  (If left empty, Go's defaults are used.  TLS 1.3 suites aren't configurable.)"`
+	TLSCurves                string `default:"" usage:"Comma-separated key exchange curves, in order of preference: X25519, P256, P384 or P521.  (If left empty, Go's defaults are used.)"`
+	TLSHTTP2                 bool   `default:"true" usage:"Offer HTTP/2 via ALPN on the HTTPS listeners."`
+	TLSSessionTickets        bool   `default:"true" usage:"Allow TLS session resumption with session tickets."`
+	TLSSessionTicketRotation string `default:"" usage:"Replace the session ticket key this often, e.g. 24h.  (If left empty, Go's automatic rotation is used.)"`
+
+	VirtualHosts bool   `default:"false" usage:"Serve /aia, /ocsp and /crl only to requests for aia.x--nmc.bit, and the other endpoints only to requests for APIHosts (or over the Unix socket), so that they can be exposed differently.  TLS clients asking for other names are refused."`
+	APIHosts     string `default:"" usage:"Comma-separated host names and IPs the API endpoints are served under when VirtualHosts is set.  (If left empty, the ListenIP addresses are used.)"`
+
+	ListenUnixSocket     string `default:"" usage:"Also listen for HTTP on this Unix domain socket path.  (Set ListenIP to empty to disable the TCP listeners.)"`
+	ListenUnixSocketMode string `default:"0660" usage:"File permissions (octal) of the Unix domain socket."`
+
+	User   string `default:"" usage:"After binding the listeners, switch to this unprivileged user.  (Unix only; requires starting as root.)"`
+	Group  string `default:"" usage:"After binding the listeners, switch to this group.  (Unix only; defaults to User's primary group.)"`
+	Chroot bool   `default:"false" usage:"After binding the listeners, chroot to the config directory.  (Unix only; all configured files must be inside it, and config reloads are read relative to it.)"`
 
 	RootCert    string `default:"root_cert.pem" usage:"Sign with this root CA certificate."`
-	RootKey     string `default:"root_key.pem" usage:"Sign with this root CA private key."`
+	RootKey     string `default:"root_key.pem" usage:"Sign with this root CA private key: a PKCS#8 PEM file (optionally encrypted; see RootKeyPassphrase), or an RFC 7512 PKCS#11 URI (pkcs11:token=...;object=...?module-path=...&pin-source=...) for a key on a hardware token."`
 	ListenChain string `default:"listen_chain.pem" usage:"Listen with this TLS certificate chain."`
 	ListenKey   string `default:"listen_key.pem" usage:"Listen with this TLS private key."`
 
+	RootKeyPassphrase string `default:"" usage:"Decrypt an encrypted (ENCRYPTED PRIVATE KEY) RootKey and PreviousRootKey with the passphrase from this source: prompt (ask on the terminal at startup), env:VAR (the environment variable VAR, which is then unset), fd:N (read file descriptor N until EOF) or file:PATH.  When generating certs, RootKey is written encrypted with it.  (If left empty, RootKey must be unencrypted.)"`
+
+	TLDCert          string `default:"tld_%s_cert.pem" usage:"Issue domain certs with the TLD CA certificate stored in this file.  (%s is replaced by the TLD.  Missing TLD CAs are generated at startup; existing ones are only replaced by encayagen.)"`
+	TLDKey           string `default:"tld_%s_key.pem" usage:"Issue domain certs with the TLD CA private key stored in this file.  (%s is replaced by the TLD.)"`
+	GenerateTLDsOnly bool   `default:"false" usage:"When generating certs, keep the existing root CA and listen certificate, and only regenerate the TLD CAs."`
+
+	PreviousRootCert string `default:"previous_root_cert.pem" usage:"During a root CA rotation, also serve certs chaining to this previous root CA certificate.  (Ignored if the file doesn't exist.)"`
+	PreviousRootKey  string `default:"previous_root_key.pem" usage:"Private key of the previous root CA."`
+	PreviousTLDCert  string `default:"previous_tld_%s_cert.pem" usage:"TLD CA certificates of the previous root CA.  (%s is replaced by the TLD.)"`
+	PreviousTLDKey   string `default:"previous_tld_%s_key.pem" usage:"TLD CA private keys of the previous root CA.  (%s is replaced by the TLD.)"`
+	RotationOverlap  string `default:"720h" usage:"Serve certs chaining to the previous root CA for this long after the current root CA becomes valid."`
+	Rotate           bool   `default:"false" usage:"When generating certs, keep the current root CA as the previous root CA instead of discarding it."`
+
+	TrustStores      string `default:"" usage:"When generating certs, install the new root CA into these trust stores (comma-separated): nss (the user's NSS databases, e.g. Firefox profiles, via certutil), p11-kit (the system anchors on most Linux distributions, via trust) and windows (the local machine's Root store, via certutil.exe).  The root CA being discarded is removed from them."`
+	TrustStoreNSSDBs string `default:"" usage:"Comma-separated NSS database directories to update for the nss trust store.  (If left empty, ~/.pki/nssdb and the Firefox profiles are used.)"`
+	UninstallRootCA  bool   `default:"false" usage:"Instead of generating certs, remove the root CA and previous root CA from TrustStores."`
+
+	KeyAlgorithm string `default:"ecdsa" usage:"Generate the root CA and listen keys with this algorithm: ecdsa, rsa or ed25519."`
+	KeyCurve     string `default:"P256" usage:"Use this curve for ecdsa keys: P256, P384 or P521."`
+	KeyBits      int    `default:"3072" usage:"Use this modulus size for rsa keys."`
+
+	CacheMaxEntries int `default:"10000" usage:"Keep at most this many names in each certificate cache.  (0 means unlimited.)"`
+	CacheMaxBytes   int `default:"67108864" usage:"Keep at most approximately this many bytes of certificates in each certificate cache.  (0 means unlimited.)"`
+
+	DANEEE               bool   `default:"false" usage:"Also generate certs from DANE-EE (usage 3) TLSA records: a leaf cert for the domain and the published key, issued by the TLD CA and valid for 90 days unless DomainCertValidity is set.  (Otherwise only the Namecoin form, DANE-TA records, is used.)"`
+	DomainCertValidity   string `default:"" usage:"Generated domain certs are valid for this long (e.g. 9552h for 398 days), capped at the TLD CA's expiry.  (If left empty, safetlsa's default is kept.)"`
+	DomainCertSerialBits int    `default:"0" usage:"Give generated domain certs random serial numbers of this many bits (64 to 159).  (If 0, safetlsa's serial number is kept.)"`
+	DomainCacheTTL       string `default:"2m" usage:"Cache generated domain certs for this long before querying DNS again."`
+	CacheRefreshWindow   string `default:"" usage:"Re-resolve recently requested domains in the background this long before their cached certs would be re-resolved by the next request (half of DomainCacheTTL after they were generated), so that they're always served from cache.  Must be less than half of DomainCacheTTL.  (If left empty, cached certs are only re-resolved by requests.)"`
+	CacheRefreshIdle     string `default:"10m" usage:"Stop refreshing a domain in the background once it hasn't been requested for this long."`
+	ListenCertValidity   string `default:"43800h" usage:"Generated listen certificates are valid for this long."`
+	ListenCertNames      string `default:"" usage:"Comma-separated host names and IP addresses (e.g. localhost or the ListenIP addresses) to include in generated listen certificates, besides aia.x--nmc.bit.  They must be allowed by the name constraints of the TLD and root CAs.  (A listen certificate lacking any of them is renewed if ListenCertRenew is set.)"`
+	ListenCertRenew      string `default:"720h" usage:"Renew the listen certificate from the TLD CA this long before it expires, without restarting the listeners.  (If left empty, it's never renewed automatically.)"`
+	AutoRegenerate       bool   `default:"false" usage:"If the listen certificate is missing, doesn't match ListenKey, doesn't chain to the root CA or has expired, issue a new one from the TLD CA at startup (or reload) instead of failing."`
+	SerialBits           int    `default:"128" usage:"When generating certs, give the listen certificate a random serial number of this many bits (64 to 159)."`
+
+	PolicyAllow       string `default:"" usage:"Only generate certs for domains matching one of these comma-separated glob patterns (e.g. example.bit,*.example.bit).  (If neither this nor PolicyAllowRegexp is set, all domains are allowed.)"`
+	PolicyAllowRegexp string `default:"" usage:"Also allow domains matching this regular expression (matched against the whole lower-case domain, without a trailing dot)."`
+	PolicyDeny        string `default:"" usage:"Never generate certs for domains matching one of these comma-separated glob patterns, even if they're allowed."`
+	PolicyDenyRegexp  string `default:"" usage:"Never generate certs for domains matching this regular expression."`
+	PolicyMaxLabels   int    `default:"0" usage:"Never generate certs for domains with more than this many labels (e.g. 3 allows www.example.bit but not a.www.example.bit).  (0 means unlimited.)"`
+
+	OCSPURL     string `default:"http://aia.x--nmc.bit/ocsp" usage:"Embed this OCSP responder URL in generated domain certs.  (If left empty, no URL is embedded.)"`
+	CRLURL      string `default:"http://aia.x--nmc.bit/crl" usage:"Embed this CRL distribution point in the TLD CAs, exclusion CAs and generated domain certs.  (If left empty, no CRL distribution point is embedded.)"`
+	CRLValidity string `default:"168h" usage:"Duration for which each served CRL is valid.  CRLs are regenerated when half of this has elapsed."`
+
+	RateLimit            int    `default:"0" usage:"Allow each client IP this many requests per minute to the endpoints that query DNS (e.g. /lookup, /aia and /ocsp).  (0 means unlimited.)"`
+	RateLimitBurst       int    `default:"20" usage:"Allow each client IP bursts of this many requests above RateLimit."`
+	MaxConcurrentLookups int    `default:"0" usage:"Serve at most this many requests to the endpoints that query DNS at once; further requests get HTTP 429.  (0 means unlimited.)"`
+	TrustedProxies       string `default:"" usage:"Comma-separated IPs and CIDR ranges of reverse proxies whose X-Forwarded-For header identifies the client for rate limiting."`
+
+	GRPCPort int  `default:"0" usage:"Also serve the gRPC API on this port of each ListenIP.  (0 disables it.  When socket-activated, the socket named grpc is used instead.)"`
+	GRPCTLS  bool `default:"true" usage:"Serve the gRPC API over TLS with the listen certificate."`
+
+	WatchInterval string `default:"1m" usage:"Re-resolve domains watched via /watch this often."`
+	MaxWatchers   int    `default:"1000" usage:"Allow at most this many /watch streams at once.  (0 means unlimited.)"`
+
+	KeyEndpoints            bool   `default:"false" usage:"Enable /get-new-negative-ca and /cross-sign-ca, which generate and accept CA private keys."`
+	KeyEndpointsAllowRemote bool   `default:"false" usage:"Allow non-loopback clients to use the key endpoints.  (Requests from TrustedProxies, or with forwarding headers such as X-Forwarded-For, count as non-loopback.)"`
+	KeyEndpointsToken       string `default:"" usage:"Require this bearer token (Authorization: Bearer ...) for the key endpoints."`
+	KeyEndpointsClientCA    string `default:"" usage:"Require a TLS client certificate issued by a CA in this PEM file for the key endpoints.  (Only the HTTPS listeners can satisfy this.)"`
+
+	AdminEndpoints            bool   `default:"false" usage:"Enable /admin/cache/stats and /admin/cache/flush, which report and invalidate the certificate caches."`
+	AdminEndpointsAllowRemote bool   `default:"false" usage:"Allow non-loopback clients to use the admin endpoints.  (Requests from TrustedProxies, or with forwarding headers such as X-Forwarded-For, count as non-loopback.)"`
+	AdminEndpointsToken       string `default:"" usage:"Require this bearer token (Authorization: Bearer ...) for the admin endpoints."`
+
+	ACME    bool   `default:"false" usage:"Serve an ACME server (RFC 8555) under /acme/ (directory at /acme/directory), so that clients such as certbot and lego can obtain certs.  Instead of completing a challenge, each domain must publish a DANE-EE (usage 3) TLSA record at _443._tcp for the key of the CSR, so clients must reuse that key.  (Accounts are kept in Store, if set.)"`
+	ACMEURL string `default:"" usage:"Public URL of the ACME server (e.g. https://encaya.example/acme), which clients sign their requests for.  (If left empty, it's derived from the request; set it when behind a reverse proxy or mounted under a prefix.)"`
+
+	TransparencyLog    bool   `default:"false" usage:"Record every issued domain cert and cross-signed CA in an append-only RFC 6962 style Merkle tree log, served under /ct/.  (Persisted in Store, if set.)"`
+	TransparencyLogKey string `default:"translog_key.pem" usage:"Sign the transparency log's tree heads with this private key.  (Generated if it doesn't exist.)"`
+
+	TransparencyLogMaxEntries int `default:"1000000" usage:"Refuse to issue new certs once the transparency log holds this many, rather than issue unlogged ones.  (Reissued certs that are already logged don't count.  0 means unlimited.)"`
+
+	AuditLog           string `default:"" usage:"Append a JSON line to this file for every domain cert issued and CA cross-signed, recording the client, domain, TLSA record, cert fingerprint, serial number and timing.  (If left empty, no audit log is written.  Must be writable by User.)"`
+	AuditLogMaxSize    int    `default:"104857600" usage:"Rotate the audit log when it would grow beyond this many bytes.  (0 means never.)"`
+	AuditLogMaxBackups int    `default:"10" usage:"Keep this many rotated audit logs, named AuditLog.1 (the newest) to AuditLog.N."`
+
+	ResponseSigning bool   `default:"false" usage:"Sign the responses to requests that don't arrive over TLS (e.g. on ListenPort) with a key whose cert is issued by the root CA, putting a detached JWS of the body in the X-JWS-Signature header."`
+	MaxRequestSize  int    `default:"1048576" usage:"Reject request bodies larger than this many bytes with HTTP 413.  (0 means unlimited.)"`
+	Compression     bool   `default:"true" usage:"Compress responses with gzip or deflate for clients that accept it.  (The key endpoints and /watch are never compressed.)"`
+	AccessLog       string `default:"" usage:"Log every HTTP request to this file, or to standard error if set to -.  (If left empty, no access log is written.  Must be writable by User.)"`
+	AccessLogFormat string `default:"common" usage:"Format of the access log: common or combined (as written by Apache), or json (which also records the request ID and duration)."`
+
+	TracingEndpoint    string `default:"" usage:"Export OpenTelemetry trace spans of HTTP and gRPC requests, DNS queries, TLSA matching and cert signing to this OTLP/HTTP collector URL (e.g. http://localhost:4318/v1/traces).  (If left empty, tracing is disabled.)"`
+	TracingSampleRatio string `default:"1" usage:"Trace this fraction (0 to 1) of requests that don't carry a sampling decision in a traceparent header."`
+	TracingServiceName string `default:"encaya" usage:"Report spans under this service.name."`
+
+	Store string `default:"" usage:"Persist cross-signed CAs and their originals in this database file, so that lookups of originals (by serial, fingerprint or SKID) survive restarts.  (If left empty, they are only kept in memory.)"`
+
 	ConfigDir string // path to interpret filenames relative to
+
+	// Where LoadConfig looked for the config file
+	source configSource
 }
 
 func (cfg *Config) cpath(s string) string {
@@ -79,511 +346,1021 @@ func (cfg *Config) cpath(s string) string {
 
 func (cfg *Config) processPaths() {
 	cfg.RootCert = cfg.cpath(cfg.RootCert)
-	cfg.RootKey = cfg.cpath(cfg.RootKey)
+	if !isPKCS11URI(cfg.RootKey) {
+		cfg.RootKey = cfg.cpath(cfg.RootKey)
+	}
+
+	cfg.PreviousRootCert = cfg.cpath(cfg.PreviousRootCert)
+	if !isPKCS11URI(cfg.PreviousRootKey) {
+		cfg.PreviousRootKey = cfg.cpath(cfg.PreviousRootKey)
+	}
+
 	cfg.ListenChain = cfg.cpath(cfg.ListenChain)
 	cfg.ListenKey = cfg.cpath(cfg.ListenKey)
+	cfg.TLDCert = cfg.cpath(cfg.TLDCert)
+	cfg.TLDKey = cfg.cpath(cfg.TLDKey)
+	cfg.PreviousTLDCert = cfg.cpath(cfg.PreviousTLDCert)
+	cfg.PreviousTLDKey = cfg.cpath(cfg.PreviousTLDKey)
+	cfg.TransparencyLogKey = cfg.cpath(cfg.TransparencyLogKey)
+
+	if cfg.Store != "" {
+		cfg.Store = cfg.cpath(cfg.Store)
+	}
+
+	if cfg.KeyEndpointsClientCA != "" {
+		cfg.KeyEndpointsClientCA = cfg.cpath(cfg.KeyEndpointsClientCA)
+	}
+
+	if cfg.AuditLog != "" {
+		cfg.AuditLog = cfg.cpath(cfg.AuditLog)
+	}
+
+	if cfg.AccessLog != "" && cfg.AccessLog != "-" {
+		cfg.AccessLog = cfg.cpath(cfg.AccessLog)
+	}
+
+	if cfg.ListenUnixSocket != "" && !filepath.IsAbs(cfg.ListenUnixSocket) {
+		cfg.ListenUnixSocket = cfg.cpath(cfg.ListenUnixSocket)
+	}
 }
 
-func New(cfg *Config) (s *Server, err error) {
-	s = &Server{
-		cfg: *cfg,
+// New binds the listeners, loads the CAs and opens the store and logs.  If
+// anything fails, whatever was acquired is released again and the error is
+// returned.
+func New(cfg *Config) (_ *Server, err error) {
+	s := &Server{
+		cfg:    *cfg,
+		failed: make(chan error, 1),
 	}
 
 	s.cfg.processPaths()
 
+	defer func() {
+		if err != nil {
+			s.release()
+		}
+	}()
+
+	err = s.initTracing()
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up tracing: %w", err)
+	}
+
+	err = s.loadActivatedListeners()
+	if err != nil {
+		return nil, fmt.Errorf("unable to use sockets passed by systemd: %w", err)
+	}
+
+	err = s.bindListeners()
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen: %w", err)
+	}
+
+	err = s.loadCAs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load CAs: %w", err)
+	}
+
+	s.domainCertCache = newCertCache(s.cfg.CacheMaxEntries, s.cfg.CacheMaxBytes)
+	s.negativeCertCache = newCertCache(s.cfg.CacheMaxEntries, s.cfg.CacheMaxBytes)
+	s.originalCertCache = newCertCache(s.cfg.CacheMaxEntries, s.cfg.CacheMaxBytes)
+	s.issuedCertCache = newCertCache(s.cfg.CacheMaxEntries, s.cfg.CacheMaxBytes)
+	s.dnsCache = newDNSCache(s.cfg.DNSCacheMaxEntries)
+	s.refresher = newCacheRefresher()
+
+	if s.cfg.Store != "" {
+		s.store, err = openStore(s.cfg.Store)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %s: %w", s.cfg.Store, err)
+		}
+	}
+
+	if s.cfg.TransparencyLog {
+		logKey, err := s.loadLogKey()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load transparency log key: %w", err)
+		}
+
+		s.transLog, err = openTransLog(logKey, s.store, s.cfg.TransparencyLogMaxEntries)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load transparency log: %w", err)
+		}
+	}
+
+	if s.cfg.RateLimit > 0 {
+		s.rateLimiter = newRateLimiter(s.cfg.RateLimit, s.cfg.RateLimitBurst)
+	}
+
+	if s.cfg.MaxConcurrentLookups > 0 {
+		s.lookupSlots = make(chan struct{}, s.cfg.MaxConcurrentLookups)
+	}
+
+	s.trustedProxies, err = parseTrustedProxies(s.cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TrustedProxies: %w", err)
+	}
+
+	if s.cfg.TLSSessionTickets && s.cfg.TLSSessionTicketRotation != "" {
+		rotation, err := parseValidity(s.cfg.TLSSessionTicketRotation)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLSSessionTicketRotation: %w", err)
+		}
+
+		s.ticketKeys, err = newSessionTicketKeys(rotation)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate TLS session ticket key: %w", err)
+		}
+	}
+
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/lookup", s.rateLimited(s.lookupHandler))
+	s.mux.HandleFunc("/aia", s.rateLimited(s.aiaHandler))
+
+	// These endpoints hand out or accept CA private keys, so they're
+	// opt-in and access-controlled.
+	if s.cfg.KeyEndpoints {
+		s.mux.HandleFunc("/get-new-negative-ca", s.requireKeyAccess(s.getNewNegativeCAHandler))
+		s.mux.HandleFunc("/cross-sign-ca", s.requireKeyAccess(s.crossSignCAHandler))
+	}
+
+	if s.cfg.AdminEndpoints {
+		s.mux.HandleFunc("/admin/cache/stats", s.requireAdminAccess(s.cacheStatsHandler))
+		s.mux.HandleFunc("/admin/cache/flush", s.requireAdminAccess(s.cacheFlushHandler))
+	}
+
+	s.mux.HandleFunc("/original-from-serial", s.rateLimited(s.originalFromSerialHandler))
+	s.mux.HandleFunc("/original-from-fingerprint", s.rateLimited(s.originalFromFingerprintHandler))
+	s.mux.HandleFunc("/original-from-skid", s.rateLimited(s.originalFromSKIDHandler))
+	s.mux.HandleFunc("/ct/get-sth", s.clientRateLimited(s.getSTHHandler))
+	s.mux.HandleFunc("/ct/get-sth-consistency", s.clientRateLimited(s.getSTHConsistencyHandler))
+	s.mux.HandleFunc("/ct/get-proof-by-hash", s.clientRateLimited(s.getProofByHashHandler))
+	s.mux.HandleFunc("/ct/get-entries", s.clientRateLimited(s.getEntriesHandler))
+	s.mux.HandleFunc("/ct/get-public-key", s.clientRateLimited(s.getLogKeyHandler))
+	s.mux.HandleFunc("/rehydrate", s.clientRateLimited(s.rehydrateHandler))
+	s.mux.HandleFunc("/ocsp", s.rateLimited(s.ocspHandler))
+	s.mux.HandleFunc("/ocsp/", s.rateLimited(s.ocspHandler))
+	s.mux.HandleFunc("/crl", s.crlHandler)
+	s.mux.HandleFunc("/rotation-status", s.rotationStatusHandler)
+
+	if s.cfg.ACME {
+		s.acme = newACMEState()
+		s.mux.HandleFunc("/acme/", s.rateLimited(s.acmeHandler))
+	}
+
+	// /watch streams are long-lived, so they're served without
+	// reloadMutex held and without the request deadline.
+	s.watches = newWatchHub()
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/watch", s.clientRateLimited(s.watchHandler))
+	handler.HandleFunc("/", s.serveLocked)
+	s.handler = handler
+
+	if s.cfg.VirtualHosts {
+		s.apiHosts = s.cfg.parseAPIHosts()
+		s.handler = s.routeVirtualHosts(handler)
+	}
+
+	s.responseSigner = &responseSigner{}
+	s.handler = s.middleware(s.handler)
+
+	err = s.dropPrivileges()
+	if err != nil {
+		return nil, fmt.Errorf("unable to drop privileges: %w", err)
+	}
+
+	// The audit log is rotated by the unprivileged user, so it's opened
+	// by them too.
+	if s.cfg.AuditLog != "" {
+		s.auditLog, err = openAuditLog(s.cfg.AuditLog, int64(s.cfg.AuditLogMaxSize), s.cfg.AuditLogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %s: %w", s.cfg.AuditLog, err)
+		}
+	}
+
+	if s.cfg.AccessLog != "" {
+		s.accessLog, err = openAccessLog(s.cfg.AccessLog, s.cfg.AccessLogFormat)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %s: %w", s.cfg.AccessLog, err)
+		}
+	}
+
+	return s, nil
+}
+
+// release closes what a failed New had already opened.
+func (s *Server) release() {
+	s.listeners.close()
+	s.closeKeys()
+
+	if s.store != nil {
+		err := s.store.close()
+		if err != nil {
+			log.Warne(err, "Unable to close store")
+		}
+	}
+
+	if s.auditLog != nil {
+		err := s.auditLog.close()
+		if err != nil {
+			log.Warne(err, "Unable to close audit log")
+		}
+	}
+
+	if s.accessLog != nil {
+		err := s.accessLog.close()
+		if err != nil {
+			log.Warne(err, "Unable to close access log")
+		}
+	}
+
+	s.shutdownTracing()
+}
+
+// Handler returns the http.Handler that serves this Server's API.  It is
+// independent of http.DefaultServeMux, so several Servers can coexist in one
+// program.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Mount registers this Server's API on mux under prefix (e.g. "/encaya").
+// An empty prefix mounts the API at the root of mux.
+func (s *Server) Mount(mux *http.ServeMux, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		mux.Handle("/", s.handler)
+
+		return
+	}
+
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, s.handler))
+}
+
+// loadRootCert loads the root CA certificate from a PEM file.
+func (s *Server) loadRootCert() error {
+	var err error
+
 	s.rootCertPem, err = ioutil.ReadFile(s.cfg.RootCert)
 	if err != nil {
-		log.Fatalef(err, "Unable to read %s", s.cfg.RootCert)
+		return err
 	}
 
 	s.rootCertPemString = string(s.rootCertPem)
 
 	rootCertBlock, _ := pem.Decode(s.rootCertPem)
-	//nolint:staticcheck // SA5011 Unreachable if nil due to log.Fatal
 	if rootCertBlock == nil {
-		log.Fatalef(err, "Unable to decode %s", s.cfg.RootCert)
+		return fmt.Errorf("%w: %s", ErrNoPEM, s.cfg.RootCert)
 	}
 
-	//nolint:staticcheck // SA5011 Unreachable if nil due to log.Fatal
 	s.rootCert = rootCertBlock.Bytes
 
+	s.rootCertParsed, err = x509.ParseCertificate(s.rootCert)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %w", s.cfg.RootCert, err)
+	}
+
+	return nil
+}
+
+// loadRootKey loads the root CA private key from a PEM file or PKCS#11
+// token.
+func (s *Server) loadRootKey() error {
+	if isPKCS11URI(s.cfg.RootKey) {
+		var err error
+
+		s.rootPriv, err = newPKCS11Signer(s.cfg.RootKey, s.rootCertParsed.PublicKey)
+		if err != nil {
+			return fmt.Errorf("unable to open PKCS#11 root key: %w", err)
+		}
+
+		return nil
+	}
+
+	return s.loadRootKeyPEM()
+}
+
+// loadRootKeyPEM loads the root CA private key from a PKCS#8 PEM file,
+// which may be encrypted.
+func (s *Server) loadRootKeyPEM() error {
+	var err error
+
 	s.rootPrivPem, err = ioutil.ReadFile(s.cfg.RootKey)
 	if err != nil {
-		log.Fatalef(err, "Unable to read %s", s.cfg.RootKey)
+		return err
 	}
 
 	rootPrivBlock, _ := pem.Decode(s.rootPrivPem)
-	//nolint:staticcheck // SA5011 Unreachable if nil due to log.Fatal
 	if rootPrivBlock == nil {
-		log.Fatalef(err, "Unable to decode %s", s.cfg.RootKey)
+		return fmt.Errorf("%w: %s", ErrNoPEM, s.cfg.RootKey)
 	}
 
-	//nolint:staticcheck // SA5011 Unreachable if nil due to log.Fatal
 	rootPrivBytes := rootPrivBlock.Bytes
 
-	s.rootPriv, err = x509.ParsePKCS8PrivateKey(rootPrivBytes)
+	if rootPrivBlock.Type == "ENCRYPTED PRIVATE KEY" {
+		passphrase, err := s.getRootKeyPassphrase(false)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt %s: %w", s.cfg.RootKey, err)
+		}
+
+		rootPrivBytes, err = decryptPKCS8(rootPrivBytes, passphrase)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt %s: %w", s.cfg.RootKey, err)
+		}
+	}
+
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootPrivBytes)
 	if err != nil {
-		log.Fatalef(err, "Unable to parse %s", s.cfg.RootKey)
+		return fmt.Errorf("unable to parse %s: %w", s.cfg.RootKey, err)
 	}
 
-	s.tldCert, s.tldPriv, err = safetlsa.GenerateTLDCA("bit", s.rootCert, s.rootPriv)
+	s.rootPriv, err = asSigner(rootPriv)
 	if err != nil {
-		log.Fatale(err, "Couldn't generate TLD CA")
+		return fmt.Errorf("unable to use %s: %w", s.cfg.RootKey, err)
 	}
 
-	s.tldCertPem = pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: s.tldCert,
-	})
-	s.tldCertPemString = string(s.tldCertPem)
+	return nil
+}
 
-	s.domainCertCache = map[string][]cachedCert{}
-	s.negativeCertCache = map[string][]cachedCert{}
-	s.originalCertCache = map[string][]cachedCert{}
+// Start serves the listeners bound by New.  It doesn't block.
+func (s *Server) Start() error {
+	s.scheduleListenCertRenewal()
 
-	http.HandleFunc("/lookup", s.lookupHandler)
-	http.HandleFunc("/aia", s.aiaHandler)
-	http.HandleFunc("/get-new-negative-ca", s.getNewNegativeCAHandler)
-	http.HandleFunc("/cross-sign-ca", s.crossSignCAHandler)
-	http.HandleFunc("/original-from-serial", s.originalFromSerialHandler)
+	go s.runCacheRefresher()
 
-	return s, nil
-}
+	if s.ticketKeys != nil {
+		s.ticketKeys.start()
+	}
 
-func (s *Server) Start() error {
-	go s.doRunListenerTCP()
-	go s.doRunListenerTLS()
+	for _, listener := range s.listeners.http {
+		go s.serve(listener, nil)
+	}
+
+	for _, listener := range s.listeners.tls {
+		tlsConfig, err := s.listenTLSConfig()
+		if err != nil {
+			return fmt.Errorf("unable to configure TLS listener: %w", err)
+		}
+
+		go s.serve(listener, tlsConfig)
+	}
+
+	for _, conn := range s.listeners.http3 {
+		tlsConfig, err := s.listenTLSConfig()
+		if err != nil {
+			return fmt.Errorf("unable to configure HTTP/3 listener: %w", err)
+		}
+
+		go s.serveHTTP3(conn, tlsConfig)
+	}
+
+	if len(s.listeners.grpc) > 0 {
+		err := s.startGRPC()
+		if err != nil {
+			return err
+		}
+	}
 
 	log.Info("Listeners started")
 
 	return nil
 }
 
+// Failed returns a channel that receives the error of a listener that
+// stopped serving for any reason but Stop.  The caller should then Stop the
+// server, e.g.:
+//
+//	select {
+//	case <-shutdown:
+//	case err = <-srv.Failed():
+//	}
+//
+//	srv.Stop()
+func (s *Server) Failed() <-chan error {
+	return s.failed
+}
+
+// fail reports a listener error through Failed.  Only the first error is
+// kept; the caller is expected to stop the server after it.
+func (s *Server) fail(err error) {
+	select {
+	case s.failed <- err:
+	default:
+	}
+}
+
+// Stop gracefully shuts down the listeners, then releases the keys and
+// store.
 func (s *Server) Stop() error {
-	// Currently this doesn't actually stop the listeners, see
-	// https://github.com/namecoin/encaya/issues/14
+	close(s.watches.done)
+	close(s.refresher.done)
+
+	err := s.shutdownListeners()
+	if err != nil {
+		log.Warne(err, "Unable to shut down listeners cleanly")
+	}
+
+	s.listenCertMutex.Lock()
+	if s.listenCertTimer != nil {
+		s.listenCertTimer.Stop()
+	}
+	s.listenCertMutex.Unlock()
+
+	if s.ticketKeys != nil {
+		s.ticketKeys.stop()
+	}
+
+	s.closeKeys()
+
+	if s.auditLog != nil {
+		err = s.auditLog.close()
+		if err != nil {
+			log.Warne(err, "Unable to close audit log")
+		}
+	}
+
+	if s.accessLog != nil {
+		err = s.accessLog.close()
+		if err != nil {
+			log.Warne(err, "Unable to close access log")
+		}
+	}
+
+	s.shutdownTracing()
+
+	if s.store != nil {
+		return s.store.close()
+	}
+
 	return nil
 }
 
-func (s *Server) doRunListenerTCP() {
-	err := http.ListenAndServe(s.cfg.ListenIP+":80", nil)
-	log.Fatale(err)
+// isolatedKey returns the cache key of name for the stream identified by
+// isolation, so that e.g. Tor streams with different isolation credentials
+// never observe each other's cache state.
+func isolatedKey(isolation, name string) string {
+	return isolation + "\x00" + name
 }
 
-func (s *Server) doRunListenerTLS() {
-	err := http.ListenAndServeTLS(s.cfg.ListenIP+":443",
-		s.cfg.ListenChain, s.cfg.ListenKey, nil)
-	log.Fatale(err)
+// isolationKey returns the stream isolation key requested by the client, or
+// the empty string (the shared stream) if none was requested.
+func isolationKey(req *http.Request) string {
+	return req.FormValue("isolation")
 }
 
-func (s *Server) getCachedDomainCerts(commonName string) (string, bool) {
+func (s *Server) getCachedDomainCerts(commonName string) ([]lookupCert, bool) {
 	needRefresh := true
-	results := ""
+	results := []lookupCert{}
 
-	s.domainCertCacheMutex.RLock()
-	for _, cert := range s.domainCertCache[commonName] {
-		if time.Until(cert.expiration) > 1*time.Minute {
+	for _, cert := range s.domainCertCache.get(commonName) {
+		// Query DNS again once half of the TTL has elapsed.
+		if time.Until(cert.expiration) > s.domainCacheTTL/2 {
 			needRefresh = false
 		}
 
-		results = results + cert.certPem + "\n\n"
+		result := newLookupCert(cert.certDer, cert.certPem, sourceCache, cert.tlsa)
+		expiration := cert.expiration
+		result.CachedUntil = &expiration
+
+		results = append(results, result)
 	}
-	s.domainCertCacheMutex.RUnlock()
 
 	return results, needRefresh
 }
 
-func (s *Server) cacheDomainCert(commonName, certPem string) {
-	cert := cachedCert{
-		expiration: time.Now().Add(2 * time.Minute),
-		certPem:    certPem,
+func (s *Server) cacheDomainCert(commonName string, result lookupCert) {
+	s.domainCertCache.add(commonName, cachedCert{
+		expiration: time.Now().Add(s.domainCacheTTL),
+		certPem:    result.PEM,
+		certDer:    result.DER,
+		tlsa:       result.tlsa,
+	})
+}
+
+func (s *Server) getCachedNegativeCerts(commonName string) (string, bool) {
+	// Negative certs don't expire, and we only need 1 negative cert
+	certs := s.negativeCertCache.get(commonName)
+	if len(certs) > 0 {
+		return certs[0].certPem + "\n\n", false
 	}
 
-	s.domainCertCacheMutex.Lock()
-	if s.domainCertCache[commonName] == nil {
-		s.domainCertCache[commonName] = []cachedCert{cert}
-	} else {
-		s.domainCertCache[commonName] = append(s.domainCertCache[commonName], cert)
+	certPem, ok := s.loadStored(storeBucketNegative, commonName)
+	if ok {
+		s.negativeCertCache.add(commonName, cachedCert{certPem: certPem})
+
+		return certPem + "\n\n", false
 	}
-	s.domainCertCacheMutex.Unlock()
+
+	return "", true
 }
 
-func (s *Server) popCachedDomainCertLater(commonName string) {
-	time.Sleep(2 * time.Minute)
+func (s *Server) cacheNegativeCert(commonName, certPem string) {
+	s.negativeCertCache.add(commonName, cachedCert{certPem: certPem})
+	s.saveStored(storeBucketNegative, commonName, certPem)
+}
 
-	s.domainCertCacheMutex.Lock()
-	if s.domainCertCache[commonName] != nil {
-		if len(s.domainCertCache[commonName]) > 1 {
-			s.domainCertCache[commonName] = s.domainCertCache[commonName][1:]
-		} else {
-			delete(s.domainCertCache, commonName)
-		}
+func (s *Server) getCachedOriginalFromSerial(serial string) (string, bool) {
+	// Original certs don't expire, and we only need 1 original cert
+	certs := s.originalCertCache.get(serial)
+	if len(certs) > 0 {
+		return certs[0].certPem + "\n\n", false
+	}
+
+	certPem, ok := s.loadStored(storeBucketOriginal, serial)
+	if ok {
+		s.originalCertCache.add(serial, cachedCert{certPem: certPem})
+
+		return certPem + "\n\n", false
 	}
-	s.domainCertCacheMutex.Unlock()
+
+	return "", true
 }
 
-func (s *Server) getCachedNegativeCerts(commonName string) (string, bool) {
-	needRefresh := true
-	results := ""
+func (s *Server) cacheOriginalFromSerial(serial, certPem string) {
+	s.originalCertCache.add(serial, cachedCert{certPem: certPem})
+	s.saveStored(storeBucketOriginal, serial, certPem)
+}
 
-	s.negativeCertCacheMutex.RLock()
-	for _, cert := range s.negativeCertCache[commonName] {
-		// Negative certs don't expire
-		needRefresh = false
+// lookup returns the certs for domain: the root or a TLD CA if domain is its
+// common name, or else certs generated from the domain's TLSA records for
+// service.  Hashed TLSA records are matched against candidates (see
+// issuableTLSA).  With wildcard, certs generated from records published at
+// *.domain also cover *.domain, so that one lookup serves every subdomain
+// that the records apply to.  Results are cached per isolation key.
+func (s *Server) lookup(ctx context.Context, domain, service, isolation string,
+	candidates []*x509.Certificate, wildcard bool) ([]lookupCert, error) {
+	if domain == "Namecoin Root CA" {
+		results := []lookupCert{
+			newLookupCert(s.rootCert, s.rootCertPemString, sourceRoot, nil),
+		}
 
-		results = results + cert.certPem + "\n\n"
+		if s.rotating() {
+			results = append(results, newLookupCert(s.previous.rootCert, s.previous.rootCertPemString, sourceRoot, nil))
+		}
 
-		// We only need 1 negative cert
-		break
+		return results, nil
 	}
-	s.negativeCertCacheMutex.RUnlock()
 
-	return results, needRefresh
-}
+	if tld := s.tldForCAName(domain); tld != nil {
+		results := []lookupCert{
+			newLookupCert(tld.cert, tld.certPemString, sourceTLD, nil),
+		}
 
-func (s *Server) cacheNegativeCert(commonName, certPem string) {
-	cert := cachedCert{
-		expiration: time.Now().Add(2 * time.Minute),
-		certPem:    certPem,
+		if previousTLD := s.previousTLD(tld); previousTLD != nil {
+			results = append(results, newLookupCert(previousTLD.cert, previousTLD.certPemString, sourceTLD, nil))
+		}
+
+		return results, nil
 	}
 
-	s.negativeCertCacheMutex.Lock()
-	if s.negativeCertCache[commonName] == nil {
-		s.negativeCertCache[commonName] = []cachedCert{cert}
-	} else {
-		s.negativeCertCache[commonName] = append(s.negativeCertCache[commonName], cert)
+	domain = strings.TrimSuffix(domain, " Domain CA")
+
+	if strings.Contains(domain, " ") {
+		// CommonNames that contain a space are usually CA's.  We
+		// already stripped the suffixes of Namecoin-formatted CA's, so
+		// if a space remains, just return.
+		return nil, nil
 	}
-	s.negativeCertCacheMutex.Unlock()
-}
 
-func (s *Server) getCachedOriginalFromSerial(serial string) (string, bool) {
-	needRefresh := true
-	results := ""
+	tld := s.tldForDomain(domain)
+	if tld == nil {
+		// We don't issue certs for this TLD.
+		return nil, nil
+	}
 
-	s.originalCertCacheMutex.RLock()
-	for _, cert := range s.originalCertCache[serial] {
-		// Original certs don't expire
-		needRefresh = false
+	err := s.policy.check(domain)
+	if err != nil {
+		return nil, err
+	}
 
-		results = results + cert.certPem + "\n\n"
+	ctx, span := s.startSpan(ctx, "encaya.lookup", attrDomain.String(domain), attrService.String(service))
+	defer span.End()
 
-		// We only need 1 original cert
-		break
+	cacheKey := isolatedKey(isolation, service+"."+domain)
+	if wildcard {
+		cacheKey += wildcardCacheKeySuffix
 	}
-	s.originalCertCacheMutex.RUnlock()
 
-	return results, needRefresh
+	var cacheResults []lookupCert
+
+	if len(candidates) == 0 {
+		// Candidates may unlock hashed records that the cached
+		// results were generated without.
+		var needRefresh bool
+
+		cacheResults, needRefresh = s.getCachedDomainCerts(cacheKey)
+		if !needRefresh {
+			span.SetAttributes(attrCacheHit.Bool(true), attrCertCount.Int(len(cacheResults)))
+			s.noteLookup(cacheKey, domain, service, isolation, wildcard, false)
+
+			return cacheResults, nil
+		}
+	}
+
+	span.SetAttributes(attrCacheHit.Bool(false))
+
+	results, err := s.resolveDomainCerts(ctx, domain, service, isolation, cacheKey, tld, wildcard, candidates,
+		cacheResults)
+	if err != nil {
+		return nil, err
+	}
+
+	s.noteLookup(cacheKey, domain, service, isolation, wildcard, true)
+
+	span.SetAttributes(attrCertCount.Int(len(results)))
+
+	return results, nil
 }
 
-func (s *Server) cacheOriginalFromSerial(serial, certPem string) {
-	cert := cachedCert{
-		expiration: time.Now().Add(2 * time.Minute),
-		certPem:    certPem,
+// resolveDomainCerts queries the TLSA records of domain for service and
+// issues certs for them, appending them to results and caching them under
+// cacheKey.  It's the part of lookup that runs on a cache miss, and is also
+// used by the background cache refresher.
+func (s *Server) resolveDomainCerts(ctx context.Context, domain, service, isolation, cacheKey string, tld *tldCA,
+	wildcard bool, candidates []*x509.Certificate, results []lookupCert) ([]lookupCert, error) {
+	dnsResponse, wildcardRecords, err := s.queryTLSA(ctx, domain, service, isolation)
+	if err != nil {
+		return nil, err
 	}
 
-	s.originalCertCacheMutex.Lock()
-	if s.originalCertCache[serial] == nil {
-		s.originalCertCache[serial] = []cachedCert{cert}
-	} else {
-		s.originalCertCache[serial] = append(s.originalCertCache[serial], cert)
+	if dnsResponse.MsgHdr.Rcode != dns.RcodeSuccess && dnsResponse.MsgHdr.Rcode != dns.RcodeNameError {
+		// A DNS error occurred (return code wasn't Success or NXDOMAIN).
+		return nil, fmt.Errorf("%w: rcode %s", ErrNoDNSResponse, dns.RcodeToString[dnsResponse.MsgHdr.Rcode])
+	}
+
+	if dnsResponse.MsgHdr.Rcode == dns.RcodeNameError {
+		// Neither the service nor the wildcard subdomain exists.
+		// That means the domain doesn't use DANE.
+		// Return an empty cert list
+		return nil, nil
 	}
-	s.originalCertCacheMutex.Unlock()
+
+	if !dnsResponse.MsgHdr.AuthenticatedData && !dnsResponse.MsgHdr.Authoritative {
+		// For security reasons, we only trust records that are
+		// authenticated (e.g. server is Unbound and has verified
+		// DNSSEC sigs) or authoritative (e.g. server is ncdns and is
+		// the owner of the requested zone).  If neither is the case,
+		// then return an empty cert list.
+		return nil, nil
+	}
+
+	for _, rr := range dnsResponse.Answer {
+		published, ok := rr.(*dns.TLSA)
+		if !ok {
+			// Record isn't a TLSA record
+			continue
+		}
+
+		tlsa := s.issuableTLSA(ctx, published, candidates, isolation)
+		if tlsa == nil {
+			// No certificate matches the hashed TLSA record
+			continue
+		}
+
+		// Only records that apply to every subdomain justify a
+		// wildcard cert.
+		wildcardCert := wildcard && wildcardRecords
+
+		issuers := []*tldCA{tld}
+		if previousTLD := s.previousTLD(tld); previousTLD != nil {
+			// During a rotation, also issue a cert chaining to the
+			// previous root, for clients that don't trust the new
+			// one yet.
+			issuers = append(issuers, previousTLD)
+		}
+
+		for _, issuer := range issuers {
+			if ctx.Err() != nil {
+				// The client went away or the request timed
+				// out; don't sign certs nobody will receive.
+				return nil, ctx.Err()
+			}
+
+			safeCert, err := s.issueDomainCert(ctx, domain, service, published, tlsa, issuer, wildcardCert)
+			if err != nil {
+				continue
+			}
+
+			safeCertPemBytes := pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: safeCert,
+			})
+
+			result := newLookupCert(safeCert, string(safeCertPemBytes), sourceDNS, published)
+			results = append(results, result)
+
+			s.cacheDomainCert(cacheKey, result)
+		}
+	}
+
+	return results, nil
 }
 
 func (s *Server) lookupHandler(w http.ResponseWriter, req *http.Request) {
-	var err error
+	service, err := tlsaService(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
 
-	domain := req.FormValue("domain")
+		return
+	}
 
-	if domain == "Namecoin Root CA" {
-		_, err = io.WriteString(w, s.rootCertPemString)
-		if err != nil {
-			log.Debuge(err, "write error")
-		}
+	candidates, err := parseCandidates(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidPEM, err.Error())
 
 		return
 	}
 
-	if domain == ".bit TLD CA" {
-		_, err = io.WriteString(w, s.tldCertPemString)
-		if err != nil {
-			log.Debuge(err, "write error")
-		}
+	wildcard, _ := strconv.ParseBool(req.FormValue("wildcard"))
+
+	results, err := s.lookup(req.Context(), req.FormValue("domain"), service, isolationKey(req), candidates,
+		wildcard)
+	if errors.Is(err, ErrPolicyDenied) {
+		writePolicyError(w, err)
 
 		return
 	}
 
-	cacheResults, needRefresh := s.getCachedDomainCerts(domain)
-	if !needRefresh {
-		_, err = io.WriteString(w, cacheResults)
-		if err != nil {
-			log.Debuge(err, "write error")
-		}
+	if err != nil {
+		// A DNS error occurred.
+		writeDNSError(w, err)
 
 		return
 	}
 
-	domain = strings.TrimSuffix(domain, " Domain CA")
+	s.writeLookupCerts(w, req, results)
+}
+
+// aia returns the DER cert that /aia serves for domain: the root or a TLD CA
+// of the given generation if domain is its common name, or else the domain
+// AIA parent CA whose public key hash is pubSHA256.  The cert is followed by
+// its issuers up to the root.  Hashed TLSA records are matched against
+// candidates (see issuableTLSA).  If the domain publishes no matching TLSA
+// record, it returns nil.
+func (s *Server) aia(ctx context.Context, domain, generationName, service, isolation string, pubSHA256 []byte,
+	candidates []*x509.Certificate) ([][]byte, error) {
+	// The CA generation to serve from; during a rotation, the
+	// "previous" generation selects the previous root.
+	generation := s
+	if generationName == generationPrevious {
+		if !s.rotating() {
+			return nil, ErrNotFound
+		}
+
+		generation = s.previous
+	}
+
+	if domain == "Namecoin Root CA" {
+		return [][]byte{generation.rootCert}, nil
+	}
+
+	if tld := generation.tldForCAName(domain); tld != nil {
+		return [][]byte{tld.cert, generation.rootCert}, nil
+	}
+
+	domain = strings.TrimSuffix(domain, " Domain AIA Parent CA")
 
 	if strings.Contains(domain, " ") {
 		// CommonNames that contain a space are usually CA's.  We
 		// already stripped the suffixes of Namecoin-formatted CA's, so
 		// if a space remains, just return.
-		return
+		return nil, ErrNotFound
 	}
 
-	qparams := qlib.DefaultParams()
-	qparams.Port = s.cfg.DNSPort
-	qparams.Ad = true
-	qparams.Fallback = true
-	qparams.Tcp = true // Workaround for https://github.com/miekg/exdns/issues/19
-
-	args := []string{}
-	// Set the custom DNS server if requested
-	if s.cfg.DNSAddress != "" {
-		args = append(args, "@"+s.cfg.DNSAddress)
+	tld := generation.tldForDomain(domain)
+	if tld == nil {
+		// We don't issue certs for this TLD.
+		return nil, ErrNotFound
 	}
-	// Set qtype to TLSA
-	args = append(args, "TLSA")
-	// Set qname to all protocols and all ports of requested hostname
-	args = append(args, "*."+domain)
 
-	result, err := qparams.Do(args)
+	err := s.policy.check(domain)
 	if err != nil {
-		// A DNS error occurred.
-		log.Debuge(err, "qlib error")
-		w.WriteHeader(500)
-
-		return
+		return nil, err
 	}
 
-	if result.ResponseMsg == nil {
-		// A DNS error occurred (nil response).
-		w.WriteHeader(500)
+	ctx, span := s.startSpan(ctx, "encaya.aia", attrDomain.String(domain), attrService.String(service))
+	defer span.End()
 
-		return
+	dnsResponse, _, err := s.queryTLSA(ctx, domain, service, isolation)
+	if err != nil {
+		return nil, err
 	}
 
-	dnsResponse := result.ResponseMsg
 	if dnsResponse.MsgHdr.Rcode != dns.RcodeSuccess && dnsResponse.MsgHdr.Rcode != dns.RcodeNameError {
 		// A DNS error occurred (return code wasn't Success or NXDOMAIN).
-		w.WriteHeader(500)
-
-		return
+		return nil, fmt.Errorf("%w: rcode %s", ErrNoDNSResponse, dns.RcodeToString[dnsResponse.MsgHdr.Rcode])
 	}
 
 	if dnsResponse.MsgHdr.Rcode == dns.RcodeNameError {
-		// Wildcard subdomain doesn't exist.
-		// That means the domain doesn't use Namecoin-form DANE.
-		// Return an empty cert list
-		return
+		// Neither the service nor the wildcard subdomain exists.
+		// That means the domain doesn't use DANE.
+		return nil, ErrNotFound
 	}
 
 	if !dnsResponse.MsgHdr.AuthenticatedData && !dnsResponse.MsgHdr.Authoritative {
 		// For security reasons, we only trust records that are
 		// authenticated (e.g. server is Unbound and has verified
 		// DNSSEC sigs) or authoritative (e.g. server is ncdns and is
-		// the owner of the requested zone).  If neither is the case,
-		// then return an empty cert list.
-		return
+		// the owner of the requested zone).
+		return nil, ErrNotFound
 	}
 
 	for _, rr := range dnsResponse.Answer {
-		tlsa, ok := rr.(*dns.TLSA)
+		published, ok := rr.(*dns.TLSA)
 		if !ok {
 			// Record isn't a TLSA record
 			continue
 		}
 
-		safeCert, err := safetlsa.GetCertFromTLSA(domain, tlsa, s.tldCert, s.tldPriv)
-		if err != nil {
+		tlsa := s.issuableTLSA(ctx, published, candidates, isolation)
+		if tlsa == nil {
+			// No certificate matches the hashed TLSA record
 			continue
 		}
 
-		safeCertPemBytes := pem.EncodeToMemory(&pem.Block{
-			Type:  "CERTIFICATE",
-			Bytes: safeCert,
-		})
+		// CA not in user's trust store; public key; not hashed
+		if tlsa.Usage == tlsaUsageDANETA && tlsa.Selector == tlsaSelectorSPKI && tlsa.MatchingType == tlsaMatchingFull {
+			tlsaPubBytes, err := hex.DecodeString(tlsa.Certificate)
+			if err != nil {
+				// TLSA record is malformed
+				continue
+			}
+
+			tlsaPubSHA256 := sha256.Sum256(tlsaPubBytes)
+			if !bytes.Equal(pubSHA256, tlsaPubSHA256[:]) {
+				// TLSA record doesn't match requested public key hash
+				continue
+			}
+		} else {
+			// TLSA record isn't in the Namecoin CA form
+			continue
+		}
 
-		safeCertPem := string(safeCertPemBytes)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 
-		_, err = io.WriteString(w, cacheResults+"\n\n"+safeCertPem)
+		safeCert, err := s.issueDomainCert(ctx, domain, service, published, tlsa, tld, false)
 		if err != nil {
-			log.Debuge(err, "write error")
+			continue
 		}
 
-		go s.cacheDomainCert(domain, safeCertPem)
-		go s.popCachedDomainCertLater(domain)
+		return [][]byte{safeCert, tld.cert, generation.rootCert}, nil
 	}
+
+	return nil, nil
 }
 
 func (s *Server) aiaHandler(w http.ResponseWriter, req *http.Request) {
-	var err error
-
 	w.Header().Set("Content-Type", "application/pkix-cert")
+	w.Header().Add("Vary", "Accept")
 
-	domain := req.FormValue("domain")
-
-	if domain == "Namecoin Root CA" {
-		_, err = io.WriteString(w, string(s.rootCert))
-		if err != nil {
-			log.Debuge(err, "write error")
-		}
+	service, err := tlsaService(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
 
 		return
 	}
 
-	if domain == ".bit TLD CA" {
-		_, err = io.WriteString(w, string(s.tldCert))
-		if err != nil {
-			log.Debuge(err, "write error")
-		}
+	pubSHA256, err := hex.DecodeString(req.FormValue("pubsha256"))
+	if err != nil {
+		// Requested public key hash is malformed.
+		writeError(w, http.StatusNotFound, errCodeNotFound, "malformed public key hash")
 
 		return
 	}
 
-	domain = strings.TrimSuffix(domain, " Domain AIA Parent CA")
-
-	if strings.Contains(domain, " ") {
-		// CommonNames that contain a space are usually CA's.  We
-		// already stripped the suffixes of Namecoin-formatted CA's, so
-		// if a space remains, just return.
-		w.WriteHeader(404)
+	candidates, err := parseCandidates(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidPEM, err.Error())
 
 		return
 	}
 
-	qparams := qlib.DefaultParams()
-	qparams.Port = s.cfg.DNSPort
-	qparams.Ad = true
-	qparams.Fallback = true
-	qparams.Tcp = true // Workaround for https://github.com/miekg/exdns/issues/19
+	chain, err := s.aia(req.Context(), req.FormValue("domain"), req.FormValue("generation"), service,
+		isolationKey(req), pubSHA256, candidates)
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "unknown CA")
 
-	args := []string{}
-	// Set the custom DNS server if requested
-	if s.cfg.DNSAddress != "" {
-		args = append(args, "@"+s.cfg.DNSAddress)
+		return
 	}
-	// Set qtype to TLSA
-	args = append(args, "TLSA")
-	// Set qname to all protocols and all ports of requested hostname
-	args = append(args, "*."+domain)
 
-	result, err := qparams.Do(args)
-	if err != nil {
-		// A DNS error occurred.
-		log.Debuge(err, "qlib error")
-		w.WriteHeader(500)
+	if errors.Is(err, ErrPolicyDenied) {
+		writePolicyError(w, err)
 
 		return
 	}
 
-	if result.ResponseMsg == nil {
-		// A DNS error occurred (nil response).
-		w.WriteHeader(500)
+	if err != nil {
+		// A DNS error occurred.
+		writeDNSError(w, err)
 
 		return
 	}
 
-	dnsResponse := result.ResponseMsg
-	if dnsResponse.MsgHdr.Rcode != dns.RcodeSuccess && dnsResponse.MsgHdr.Rcode != dns.RcodeNameError {
-		// A DNS error occurred (return code wasn't Success or NXDOMAIN).
-		w.WriteHeader(500)
+	if chain == nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "no matching TLSA record")
 
 		return
 	}
 
-	if dnsResponse.MsgHdr.Rcode == dns.RcodeNameError {
-		// Wildcard subdomain doesn't exist.
-		// That means the domain doesn't use Namecoin-form DANE.
-		// Return an empty cert list
-		w.WriteHeader(404)
+	if wantsAIAChain(req) {
+		bundle, err := certsOnlyPKCS7(chain)
+		if err != nil {
+			log.Debuge(err, "Unable to create PKCS#7 bundle")
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "unable to create PKCS#7 bundle")
 
-		return
-	}
+			return
+		}
 
-	if !dnsResponse.MsgHdr.AuthenticatedData && !dnsResponse.MsgHdr.Authoritative {
-		// For security reasons, we only trust records that are
-		// authenticated (e.g. server is Unbound and has verified
-		// DNSSEC sigs) or authoritative (e.g. server is ncdns and is
-		// the owner of the requested zone).  If neither is the case,
-		// then return an empty cert list.
-		w.WriteHeader(404)
+		w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+
+		_, err = w.Write(bundle)
+		if err != nil {
+			log.Debuge(err, "write error")
+		}
 
 		return
 	}
 
-	pubSHA256Hex := req.FormValue("pubsha256")
-
-	pubSHA256, err := hex.DecodeString(pubSHA256Hex)
+	_, err = w.Write(chain[0])
 	if err != nil {
-		// Requested public key hash is malformed.
-		w.WriteHeader(404)
-
-		return
+		log.Debuge(err, "write error")
 	}
+}
 
-	for _, rr := range dnsResponse.Answer {
-		tlsa, ok := rr.(*dns.TLSA)
-		if !ok {
-			// Record isn't a TLSA record
-			continue
-		}
+// newNegativeCA generates a TLD exclusion CA for tldName (or the first TLD,
+// if empty), returning its PEM certificate and private key.
+func (s *Server) newNegativeCA(tldName string) (string, string, error) {
+	if tldName == "" {
+		tldName = s.tldNames[0]
+	}
 
-		// CA not in user's trust store; public key; not hashed
-		if tlsa.Usage == 2 && tlsa.Selector == 1 && tlsa.MatchingType == 0 {
-			tlsaPubBytes, err := hex.DecodeString(tlsa.Certificate)
-			if err != nil {
-				// TLSA record is malformed
-				continue
-			}
+	if s.tlds[tldName] == nil {
+		// We don't issue certs for this TLD.
+		return "", "", ErrNotFound
+	}
 
-			tlsaPubSHA256 := sha256.Sum256(tlsaPubBytes)
-			if !bytes.Equal(pubSHA256, tlsaPubSHA256[:]) {
-				// TLSA record doesn't match requested public key hash
-				continue
-			}
-		} else {
-			// TLSA record isn't in the Namecoin CA form
-			continue
-		}
+	restrictCert, restrictPriv, err := safetlsa.GenerateTLDExclusionCA(tldName, s.rootCert, s.rootPriv)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating TLD exclusion CA: %w", err)
+	}
 
-		safeCert, err := safetlsa.GetCertFromTLSA(domain, tlsa, s.tldCert, s.tldPriv)
+	if s.cfg.CRLURL != "" {
+		restrictCert, err = reissueCert(restrictCert, s.rootCertParsed, s.rootPriv, func(template *x509.Certificate) {
+			template.CRLDistributionPoints = []string{s.cfg.CRLURL}
+		})
 		if err != nil {
-			continue
+			return "", "", fmt.Errorf("unable to add CRL distribution point to TLD exclusion CA: %w", err)
 		}
+	}
 
-		_, err = io.WriteString(w, string(safeCert))
-		if err != nil {
-			log.Debuge(err, "write error")
-		}
+	restrictCertPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: restrictCert,
+	})
 
-		break
+	restrictPrivPem, err := marshalPrivateKeyPEM(restrictPriv)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to marshal private key: %w", err)
 	}
+
+	return string(restrictCertPem), string(restrictPrivPem), nil
 }
 
 func (s *Server) getNewNegativeCAHandler(w http.ResponseWriter, req *http.Request) {
-	restrictCert, restrictPriv, err := safetlsa.GenerateTLDExclusionCA("bit", s.rootCert, s.rootPriv)
-	if err != nil {
-		log.Debuge(err, "Error generating TLD exclusion CA")
+	passphrase, p12, ok := wantsPKCS12(w, req)
+	if !ok {
+		return
 	}
 
-	restrictCertPem := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: restrictCert,
-	})
-	restrictCertPemString := string(restrictCertPem)
+	restrictCertPemString, restrictPrivPemString, err := s.newNegativeCA(req.FormValue("tld"))
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "unknown TLD")
+
+		return
+	}
 
-	restrictPrivBytes, err := x509.MarshalECPrivateKey(restrictPriv.(*ecdsa.PrivateKey))
 	if err != nil {
-		log.Debuge(err, "Unable to marshal ECDSA private key")
+		log.Debuge(err, "Unable to generate negative CA")
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "unable to generate negative CA")
+
+		return
 	}
 
-	restrictPrivPem := pem.EncodeToMemory(&pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: restrictPrivBytes,
-	})
-	restrictPrivPemString := string(restrictPrivPem)
+	if p12 {
+		bundle, err := negativeCAPKCS12(restrictCertPemString, restrictPrivPemString, passphrase)
+		if err != nil {
+			log.Debuge(err, "Unable to create PKCS#12 bundle")
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "unable to create PKCS#12 bundle")
+
+			return
+		}
+
+		writePKCS12(w, bundle, "negative-ca.p12")
+
+		return
+	}
 
 	_, err = io.WriteString(w, restrictCertPemString)
 	if err != nil {
@@ -601,42 +1378,69 @@ func (s *Server) getNewNegativeCAHandler(w http.ResponseWriter, req *http.Reques
 	}
 }
 
-func (s *Server) crossSignCAHandler(w http.ResponseWriter, req *http.Request) {
-	var err error
-
-	toSignPEM := req.FormValue("to-sign")
-	signerCertPEM := req.FormValue("signer-cert")
-	signerKeyPEM := req.FormValue("signer-key")
-
+// crossSignCA cross-signs the PEM cert toSignPEM with the given signer,
+// returning the PEM result.  toSignPEM may instead be a CSR, from which a CA
+// cert is built (see crossSignCSR).  Results are cached per isolation key,
+// and the original cert can then be looked up by the result's serial number,
+// fingerprint or Subject Key Identifier.
+func (s *Server) crossSignCA(ctx context.Context, toSignPEM, signerCertPEM, signerKeyPEM,
+	isolation string) (result string, err error) {
 	cacheKeyArray := sha256.Sum256([]byte(toSignPEM + "\n\n" + signerCertPEM + "\n\n" + signerKeyPEM + "\n\n"))
-	cacheKey := hex.EncodeToString(cacheKeyArray[:])
+	cacheKey := isolatedKey(isolation, hex.EncodeToString(cacheKeyArray[:]))
 
 	cacheResults, needRefresh := s.getCachedNegativeCerts(cacheKey)
 	if !needRefresh {
-		_, err = io.WriteString(w, cacheResults)
-		if err != nil {
-			log.Debuge(err, "write error")
-		}
+		return cacheResults, nil
+	}
 
-		return
+	event := newAuditEvent(ctx, auditCrossSignCA, time.Now())
+
+	_, span := s.startSpan(ctx, "cert.cross_sign")
+
+	defer func() {
+		event.finish(err)
+		s.audit(event)
+		endSpan(span, err)
+	}()
+
+	toSignBlock, err := decodeClientPEM("to-sign", toSignPEM)
+	if err != nil {
+		return "", err
+	}
+
+	signerCertBlock, err := decodeClientPEM("signer-cert", signerCertPEM)
+	if err != nil {
+		return "", err
 	}
 
-	toSignBlock, _ := pem.Decode([]byte(toSignPEM))
-	signerCertBlock, _ := pem.Decode([]byte(signerCertPEM))
 	signerKeyBlock, _ := pem.Decode([]byte(signerKeyPEM))
+	if signerKeyBlock == nil {
+		return "", fmt.Errorf("%w in signer-key", ErrNoPEM)
+	}
 
-	signerKey, err := x509.ParseECPrivateKey(signerKeyBlock.Bytes)
+	signerKey, err := parsePrivateKeyBlock(signerKeyBlock)
 	if err != nil {
-		log.Debuge(err, "Unable to parse ECDSA private key")
+		return "", fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
 
-		return
+	// Parsed by decodeClientPEM, so this can't fail.
+	signerCert, _ := x509.ParseCertificate(signerCertBlock.Bytes)
+
+	signerPub, ok := signerKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !signerPub.Equal(signerCert.PublicKey) {
+		return "", fmt.Errorf("%w: signer-key doesn't match signer-cert", ErrInvalidKey)
 	}
 
-	resultBytes, err := crosssign.CrossSign(toSignBlock.Bytes, signerCertBlock.Bytes, signerKey)
-	if err != nil {
-		log.Debuge(err, "Unable to cross-sign")
+	var resultBytes []byte
 
-		return
+	if isCSRBlock(toSignBlock) {
+		resultBytes, err = s.crossSignCSR(toSignBlock.Bytes, signerCertBlock.Bytes, signerKey)
+	} else {
+		resultBytes, err = crosssign.CrossSign(toSignBlock.Bytes, signerCertBlock.Bytes, signerKey)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("unable to cross-sign: %w", err)
 	}
 
 	resultPEM := pem.EncodeToMemory(&pem.Block{
@@ -647,36 +1451,131 @@ func (s *Server) crossSignCAHandler(w http.ResponseWriter, req *http.Request) {
 
 	resultParsed, err := x509.ParseCertificate(resultBytes)
 	if err != nil {
-		log.Debuge(err, "Unable to extract serial number from cross-signed CA")
+		return "", fmt.Errorf("unable to extract serial number from cross-signed CA: %w", err)
 	}
 
-	_, err = io.WriteString(w, resultPEMString)
+	event.setCert(resultBytes)
+
+	err = s.logIssued(resultBytes, signerCertBlock.Bytes)
 	if err != nil {
-		log.Debuge(err, "write error")
+		return "", err
 	}
 
 	s.cacheNegativeCert(cacheKey, resultPEMString)
-	s.cacheOriginalFromSerial(resultParsed.SerialNumber.String(), toSignPEM)
+
+	if isCSRBlock(toSignBlock) {
+		// There's no original cert to look up.
+		return resultPEMString, nil
+	}
+
+	s.rememberOriginal(isolation, resultBytes, resultParsed.SerialNumber.String(), resultParsed.SubjectKeyId, toSignPEM)
+
+	// Let hashed TLSA records of the original be resolved too.
+	toSignParsed, err := x509.ParseCertificate(toSignBlock.Bytes)
+	if err == nil {
+		s.rememberOriginalByHash(isolation, toSignParsed)
+	}
+
+	return resultPEMString, nil
 }
 
-func (s *Server) originalFromSerialHandler(w http.ResponseWriter, req *http.Request) {
-	serial := req.FormValue("serial")
+// decodeClientPEM decodes the first block of a PEM field of a cross-signing
+// request, which must be a cert (or, for to-sign, a CSR) that parses.
+// Anything following the first block is ignored.
+func decodeClientPEM(field, data string) (*pem.Block, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("%w in %s", ErrNoPEM, field)
+	}
 
-	cacheResults, needRefresh := s.getCachedOriginalFromSerial(serial)
-	if !needRefresh {
-		_, err := io.WriteString(w, cacheResults)
+	if field == "to-sign" && isCSRBlock(block) {
+		// Parsed by crossSignCSR, which reports ErrInvalidCSR.
+		return block, nil
+	}
+
+	if block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%w: %s holds a %s block", ErrInvalidPEM, field, block.Type)
+	}
+
+	_, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidPEM, field, err)
+	}
+
+	return block, nil
+}
+
+func (s *Server) crossSignCAHandler(w http.ResponseWriter, req *http.Request) {
+	passphrase, p12, ok := wantsPKCS12(w, req)
+	if !ok {
+		return
+	}
+
+	result, err := s.crossSignCA(req.Context(), req.FormValue("to-sign"), req.FormValue("signer-cert"),
+		req.FormValue("signer-key"), isolationKey(req))
+	switch {
+	case errors.Is(err, ErrNoPEM) || errors.Is(err, ErrInvalidPEM):
+		writeError(w, http.StatusBadRequest, errCodeInvalidPEM, err.Error())
+
+		return
+	case errors.Is(err, ErrInvalidKey):
+		writeError(w, http.StatusBadRequest, errCodeInvalidKey, err.Error())
+
+		return
+	case errors.Is(err, ErrInvalidCSR):
+		writeError(w, http.StatusBadRequest, errCodeInvalidCSR, err.Error())
+
+		return
+	case errors.Is(err, ErrLogFull):
+		log.Errore(err, "Unable to cross-sign CA")
+		writeError(w, http.StatusServiceUnavailable, errCodeInternal, err.Error())
+
+		return
+	case err != nil:
+		log.Debuge(err, "Unable to cross-sign CA")
+		writeError(w, http.StatusUnprocessableEntity, errCodeSigningFailed, err.Error())
+
+		return
+	}
+
+	if p12 {
+		bundle, err := crossSignedPKCS12(result, req.FormValue("signer-cert"), passphrase)
 		if err != nil {
-			log.Debuge(err, "write error")
+			log.Debuge(err, "Unable to create PKCS#12 bundle")
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "unable to create PKCS#12 bundle")
+
+			return
 		}
+
+		writePKCS12(w, bundle, "cross-signed-ca.p12")
+
+		return
+	}
+
+	_, err = io.WriteString(w, result)
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
+
+func (s *Server) originalFromSerialHandler(w http.ResponseWriter, req *http.Request) {
+	serial := req.FormValue("serial")
+
+	if serial == "" {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "missing serial")
+
+		return
 	}
+
+	s.writeOriginal(w, req, isolatedKey(isolationKey(req), serial), serialMatcher(serial))
 }
 
-func GenerateCerts(cfg *Config) {
-	var (
-		err                 error
-		listenCertPem       []byte
-		listenCertPemString string
-	)
+// GenerateCerts generates a root CA, TLD CAs and listen certificate, writes
+// them to the configured files, and installs the root CA into TrustStores.
+// With GenerateTLDsOnly, only the TLD CAs are regenerated; with
+// UninstallRootCA, the root CAs are only removed from TrustStores.
+func GenerateCerts(cfg *Config) error {
+	var err error
 
 	s := &Server{
 		cfg: *cfg,
@@ -684,113 +1583,181 @@ func GenerateCerts(cfg *Config) {
 
 	s.cfg.processPaths()
 
-	s.rootCert, s.rootPriv, err = safetlsa.GenerateRootCA("Namecoin")
-	if err != nil {
-		log.Fatale(err, "Couldn't generate root CA")
+	if s.cfg.UninstallRootCA {
+		return s.cfg.uninstallRootCAs()
 	}
 
-	rootPrivBytes, err := x509.MarshalPKCS8PrivateKey(s.rootPriv)
+	err = s.loadLifetimes()
 	if err != nil {
-		log.Fatale(err, "Unable to marshal private key")
+		return fmt.Errorf("invalid certificate lifetime settings: %w", err)
 	}
 
-	s.rootCertPem = pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: s.rootCert,
-	})
-	s.rootCertPemString = string(s.rootCertPem)
-
-	s.rootPrivPem = pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: rootPrivBytes,
-	})
+	if s.cfg.GenerateTLDsOnly {
+		err = s.loadRootCert()
+		if err != nil {
+			return fmt.Errorf("unable to load root CA: %w", err)
+		}
 
-	s.tldCert, s.tldPriv, err = safetlsa.GenerateTLDCA("bit", s.rootCert, s.rootPriv)
-	if err != nil {
-		log.Fatale(err, "Couldn't generate TLD CA")
-	}
+		err = s.loadRootKey()
+		if err != nil {
+			return fmt.Errorf("unable to load root CA private key: %w", err)
+		}
 
-	s.tldCertPem = pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: s.tldCert,
-	})
-	s.tldCertPemString = string(s.tldCertPem)
+		err = s.generateTLDCAs()
+		if err != nil {
+			return fmt.Errorf("couldn't generate TLD CA: %w", err)
+		}
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+		return s.saveTLDCAs()
+	}
 
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		log.Fatale(err, "Unable to generate serial number")
+	if isPKCS11URI(s.cfg.RootKey) {
+		return ErrPKCS11Generate
 	}
 
-	listenPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	// Everything is generated and written next to the existing files
+	// before those and the trust stores are touched, so that a failure
+	// leaves the current root CA in place and trusted.
+	rootCert, rootPriv, err := safetlsa.GenerateRootCA("Namecoin")
 	if err != nil {
-		log.Fatale(err, "Unable to generate listening key")
+		return fmt.Errorf("couldn't generate root CA: %w", err)
 	}
 
-	listenPrivBytes, err := x509.MarshalPKCS8PrivateKey(listenPriv)
+	s.rootCert = rootCert
+
+	s.rootPriv, err = asSigner(rootPriv)
 	if err != nil {
-		log.Fatale(err, "Unable to marshal private key")
+		return fmt.Errorf("couldn't use root CA private key: %w", err)
 	}
 
-	listenTemplate := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			CommonName:   "aia.x--nmc.bit",
-			SerialNumber: "Namecoin TLS Certificate",
-		},
-		NotBefore: time.Now().Add(-1 * time.Hour),
-		NotAfter:  time.Now().Add(43800 * time.Hour),
+	// safetlsa always generates an ECDSA P-256 root; swap in a key of the
+	// configured type unless that's what was requested.
+	if !strings.EqualFold(s.cfg.KeyAlgorithm, keyAlgorithmECDSA) || !strings.EqualFold(s.cfg.KeyCurve, "P256") {
+		s.rootPriv, err = s.cfg.generateKey()
+		if err != nil {
+			return fmt.Errorf("unable to generate root CA key: %w", err)
+		}
 
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
+		s.rootCert, err = rekeySelfSigned(s.rootCert, s.rootPriv)
+		if err != nil {
+			return fmt.Errorf("unable to re-sign root CA: %w", err)
+		}
+	}
 
-		DNSNames: []string{"aia.x--nmc.bit"},
+	s.rootCert, err = allowCRLSigning(s.rootCert, s.rootPriv)
+	if err != nil {
+		return fmt.Errorf("couldn't enable CRL signing for root CA: %w", err)
 	}
 
-	tldCertParsed, err := x509.ParseCertificate(s.tldCert)
+	s.rootCertParsed, err = x509.ParseCertificate(s.rootCert)
 	if err != nil {
-		log.Fatale(err, "Unable to parse TLD cert")
+		return fmt.Errorf("unable to parse root CA: %w", err)
 	}
 
-	listenCert, err := x509.CreateCertificate(rand.Reader, &listenTemplate,
-		tldCertParsed, &listenPriv.PublicKey, s.tldPriv)
+	rootPrivBytes, err := x509.MarshalPKCS8PrivateKey(s.rootPriv)
 	if err != nil {
-		log.Fatale(err, "Unable to create listening cert")
+		return fmt.Errorf("unable to marshal private key: %w", err)
 	}
 
-	listenCertPem = pem.EncodeToMemory(&pem.Block{
+	s.rootCertPem = pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
-		Bytes: listenCert,
+		Bytes: s.rootCert,
 	})
-	listenCertPemString = string(listenCertPem)
+	s.rootCertPemString = string(s.rootCertPem)
+
+	rootPrivType := "PRIVATE KEY"
+
+	if s.cfg.RootKeyPassphrase != "" {
+		passphrase, err := s.getRootKeyPassphrase(true)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt root CA private key: %w", err)
+		}
+
+		rootPrivBytes, err = encryptPKCS8(rootPrivBytes, passphrase)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt root CA private key: %w", err)
+		}
 
-	listenPrivPem := pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: listenPrivBytes,
+		rootPrivType = "ENCRYPTED PRIVATE KEY"
+	}
+
+	s.rootPrivPem = pem.EncodeToMemory(&pem.Block{
+		Type:  rootPrivType,
+		Bytes: rootPrivBytes,
 	})
 
-	err = ioutil.WriteFile(s.cfg.RootCert, s.rootCertPem, 0600)
+	err = s.generateTLDCAs()
 	if err != nil {
-		log.Fatalef(err, "Unable to write %s", s.cfg.RootCert)
+		return fmt.Errorf("couldn't generate TLD CA: %w", err)
+	}
+
+	listenChainPem, listenPrivPem, err := s.issueListenCert()
+	if err != nil {
+		return fmt.Errorf("unable to create listening cert: %w", err)
+	}
+
+	files := map[string][]byte{
+		s.cfg.RootCert:    s.rootCertPem,
+		s.cfg.RootKey:     s.rootPrivPem,
+		s.cfg.ListenChain: listenChainPem,
+		s.cfg.ListenKey:   listenPrivPem,
+	}
+
+	for _, tldName := range s.tldNames {
+		tldFiles, err := s.tldCAFiles(s.tlds[tldName])
+		if err != nil {
+			return fmt.Errorf("unable to write TLD CA for %s: %w", tldName, err)
+		}
+
+		for path, data := range tldFiles {
+			files[path] = data
+		}
 	}
 
-	err = ioutil.WriteFile(s.cfg.RootKey, s.rootPrivPem, 0600)
+	staged, err := stageFiles(files)
 	if err != nil {
-		log.Fatalef(err, "Unable to write %s", s.cfg.RootKey)
+		return err
+	}
+	defer staged.discard()
+
+	// The previous root CA is overwritten when rotating, and the current
+	// one otherwise, so keep it to remove from the trust stores once the
+	// new one is trusted.
+	discardedRootCert := s.cfg.RootCert
+	if s.cfg.Rotate {
+		discardedRootCert = s.cfg.PreviousRootCert
+	}
+
+	discardedRootPem, err := ioutil.ReadFile(discardedRootCert)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read %s: %w", discardedRootCert, err)
 	}
 
-	listenChainPemString := listenCertPemString + "\n\n" + s.tldCertPemString + "\n\n" + s.rootCertPemString
-	listenChainPem := []byte(listenChainPemString)
+	if s.cfg.Rotate {
+		err = s.cfg.rotateRootFiles()
+		if err != nil {
+			return fmt.Errorf("unable to keep the current root CA as the previous root CA: %w", err)
+		}
+	}
 
-	err = ioutil.WriteFile(s.cfg.ListenChain, listenChainPem, 0600)
+	err = staged.commit()
 	if err != nil {
-		log.Fatalef(err, "Unable to write %s", s.cfg.ListenChain)
+		return err
 	}
 
-	err = ioutil.WriteFile(s.cfg.ListenKey, listenPrivPem, 0600)
+	err = s.cfg.updateTrustStores(s.cfg.RootCert, true)
 	if err != nil {
-		log.Fatalef(err, "Unable to write %s", s.cfg.ListenKey)
+		return fmt.Errorf("unable to install root CA into trust stores: %w", err)
+	}
+
+	if discardedRootPem != nil {
+		// It may never have been installed, so failing to remove it
+		// isn't fatal.
+		err = s.cfg.removeDiscardedRootCA(discardedRootPem)
+		if err != nil {
+			log.Warne(err, "Unable to remove old root CA from trust stores")
+		}
 	}
+
+	return nil
 }
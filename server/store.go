@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// storeSchemaVersion is bumped whenever the layout of the store changes
+// incompatibly.
+const storeSchemaVersion = 1
+
+var (
+	storeBucketMeta     = []byte("meta")
+	storeBucketNegative = []byte("negative")
+	storeBucketOriginal = []byte("original")
+
+	storeKeySchemaVersion = []byte("schema_version")
+)
+
+// ErrStoreSchema is returned when the store was written by an incompatible
+// version of encaya.
+var ErrStoreSchema = errors.New("unsupported store schema version")
+
+// store is an on-disk key/value store backing the caches whose contents
+// can't be regenerated from DNS.
+type store struct {
+	db *bolt.DB
+}
+
+func openStore(path string) (*store, error) {
+	// The timeout prevents hanging forever if another encaya instance
+	// holds the lock.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(storeBucketMeta)
+		if err != nil {
+			return err
+		}
+
+		versionBytes := meta.Get(storeKeySchemaVersion)
+		if versionBytes == nil {
+			versionBytes = make([]byte, 8)
+			binary.BigEndian.PutUint64(versionBytes, storeSchemaVersion)
+
+			err = meta.Put(storeKeySchemaVersion, versionBytes)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(versionBytes) != 8 || binary.BigEndian.Uint64(versionBytes) != storeSchemaVersion {
+			return fmt.Errorf("%w: %x", ErrStoreSchema, versionBytes)
+		}
+
+		for _, bucket := range [][]byte{storeBucketNegative, storeBucketOriginal, storeBucketLog,
+			storeBucketACMEAccount} {
+			_, err = tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return &store{db: db}, nil
+}
+
+func (st *store) get(bucket []byte, key string) (string, bool, error) {
+	var (
+		value string
+		found bool
+	)
+
+	err := st.db.View(func(tx *bolt.Tx) error {
+		valueBytes := tx.Bucket(bucket).Get([]byte(key))
+		if valueBytes != nil {
+			// valueBytes is only valid during the transaction, so
+			// copy it.
+			value = string(valueBytes)
+			found = true
+		}
+
+		return nil
+	})
+
+	return value, found, err
+}
+
+func (st *store) put(bucket []byte, key, value string) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), []byte(value))
+	})
+}
+
+// clear removes every key from bucket.
+func (st *store) clear(bucket []byte) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(bucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucket(bucket)
+
+		return err
+	})
+}
+
+// deleteMatching removes the keys of bucket that match selects, returning how
+// many were removed.
+func (st *store) deleteMatching(bucket []byte, match func(key string) bool) (int, error) {
+	removed := 0
+
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+
+		// Deleting while iterating with a cursor can skip keys.
+		keys := [][]byte{}
+
+		err := b.ForEach(func(key, _ []byte) error {
+			if match(string(key)) {
+				keys = append(keys, append([]byte{}, key...))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = b.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		removed = len(keys)
+
+		return nil
+	})
+
+	return removed, err
+}
+
+// forEach calls fn for each key of bucket, in key order.  The key and value
+// are only valid during the call.
+func (st *store) forEach(bucket []byte, fn func(key, value []byte) error) error {
+	return st.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(fn)
+	})
+}
+
+func (st *store) close() error {
+	return st.db.Close()
+}
+
+// loadStored returns the persisted value of key, if the store is enabled and
+// has one.
+func (s *Server) loadStored(bucket []byte, key string) (string, bool) {
+	if s.store == nil {
+		return "", false
+	}
+
+	value, found, err := s.store.get(bucket, key)
+	if err != nil {
+		log.Warne(err, "Unable to read from store")
+
+		return "", false
+	}
+
+	return value, found
+}
+
+// saveStored persists key if the store is enabled.
+func (s *Server) saveStored(bucket []byte, key, value string) {
+	if s.store == nil {
+		return
+	}
+
+	err := s.store.put(bucket, key, value)
+	if err != nil {
+		log.Warne(err, "Unable to write to store")
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/namecoin/safetlsa"
+)
+
+// aiaHostname is the hostname the listen certificate is issued for.
+const aiaHostname = "aia.x--nmc.bit"
+
+var (
+	// ErrNoTLDs is returned when the TLDs config option is empty.
+	ErrNoTLDs = errors.New("no TLDs configured")
+
+	// ErrNoPEM is returned when a persisted TLD CA file doesn't contain
+	// PEM data.
+	ErrNoPEM = errors.New("no PEM data found")
+
+	// ErrTLDNotFromRoot is returned when a persisted TLD CA wasn't issued
+	// by the configured root CA.
+	ErrTLDNotFromRoot = errors.New("TLD CA wasn't issued by the root CA; regenerate it with encayagen")
+)
+
+type tldCA struct {
+	name          string
+	cert          []byte
+	parsed        *x509.Certificate
+	priv          crypto.Signer
+	certPem       []byte
+	certPemString string
+
+	// CRL distribution point of the domain certs issued by this CA
+	crlURL string
+}
+
+// tldList returns the configured TLDs, lowercased and without leading dots.
+func (cfg *Config) tldList() []string {
+	tlds := []string{}
+
+	for _, tld := range strings.Split(cfg.TLDs, ",") {
+		tld = strings.ToLower(strings.Trim(strings.TrimSpace(tld), "."))
+		if tld == "" {
+			continue
+		}
+
+		tlds = append(tlds, tld)
+	}
+
+	return tlds
+}
+
+// tldCertPath returns the file the TLD CA certificate for tldName is
+// persisted in.
+func (cfg *Config) tldCertPath(tldName string) string {
+	return strings.ReplaceAll(cfg.TLDCert, "%s", tldName)
+}
+
+// tldKeyPath returns the file the TLD CA private key for tldName is
+// persisted in.
+func (cfg *Config) tldKeyPath(tldName string) string {
+	return strings.ReplaceAll(cfg.TLDKey, "%s", tldName)
+}
+
+// generateTLDCAs generates a TLD CA, signed by the root CA, for each
+// configured TLD.
+func (s *Server) generateTLDCAs() error {
+	s.tldNames = s.cfg.tldList()
+	if len(s.tldNames) == 0 {
+		return ErrNoTLDs
+	}
+
+	s.tlds = map[string]*tldCA{}
+
+	for _, tldName := range s.tldNames {
+		tld, err := s.generateTLDCA(tldName)
+		if err != nil {
+			return fmt.Errorf("TLD %s: %w", tldName, err)
+		}
+
+		s.tlds[tldName] = tld
+	}
+
+	return nil
+}
+
+// loadTLDCAs loads the persisted TLD CA of each configured TLD.  A TLD CA
+// that hasn't been generated yet (e.g. a newly configured TLD) is generated
+// and persisted now; existing ones are never replaced, so that chains
+// clients have cached stay valid across restarts.
+func (s *Server) loadTLDCAs() error {
+	s.tldNames = s.cfg.tldList()
+	if len(s.tldNames) == 0 {
+		return ErrNoTLDs
+	}
+
+	s.tlds = map[string]*tldCA{}
+
+	for _, tldName := range s.tldNames {
+		tld, err := s.loadTLDCA(tldName)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Warnf("No TLD CA found for %s; generating one", tldName)
+
+			tld, err = s.generateTLDCA(tldName)
+			if err == nil {
+				saveErr := s.saveTLDCA(tld)
+				if saveErr != nil {
+					log.Warne(saveErr, "Unable to persist TLD CA; it will change on restart")
+				}
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("TLD %s: %w", tldName, err)
+		}
+
+		s.tlds[tldName] = tld
+	}
+
+	return nil
+}
+
+// generateTLDCA generates a TLD CA for tldName, signed by the root CA.
+func (s *Server) generateTLDCA(tldName string) (*tldCA, error) {
+	cert, tldPriv, err := safetlsa.GenerateTLDCA(tldName, s.rootCert, s.rootPriv)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, err := asSigner(tldPriv)
+	if err != nil {
+		return nil, err
+	}
+
+	// The TLD CA signs the CRL for the domain certs it issues, and is
+	// itself covered by the root CA's CRL.
+	cert, err = reissueCert(cert, s.rootCertParsed, s.rootPriv, func(template *x509.Certificate) {
+		template.KeyUsage |= x509.KeyUsageCRLSign
+
+		if s.cfg.CRLURL != "" {
+			template.CRLDistributionPoints = []string{s.cfg.CRLURL}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.newTLDCA(tldName, cert, priv)
+}
+
+// loadTLDCA loads the persisted TLD CA for tldName, and checks that it was
+// issued by the current root CA.
+func (s *Server) loadTLDCA(tldName string) (*tldCA, error) {
+	certPath := s.cfg.tldCertPath(tldName)
+	keyPath := s.cfg.tldKeyPath(tldName)
+
+	certPem, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPem)
+	if certBlock == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoPEM, certPath)
+	}
+
+	privPem, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	privBlock, _ := pem.Decode(privPem)
+	if privBlock == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoPEM, keyPath)
+	}
+
+	priv, err := parsePrivateKeyBlock(privBlock)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+
+	tld, err := s.newTLDCA(tldName, certBlock.Bytes, priv)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+
+	err = tld.parsed.CheckSignatureFrom(s.rootCertParsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTLDNotFromRoot, certPath)
+	}
+
+	return tld, nil
+}
+
+// saveTLDCA persists tld so that it's reused on the next startup.
+func (s *Server) saveTLDCA(tld *tldCA) error {
+	files, err := s.tldCAFiles(tld)
+	if err != nil {
+		return err
+	}
+
+	for path, data := range files {
+		err = ioutil.WriteFile(path, data, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tldCAFiles returns the contents of the key and cert files of tld, by path.
+func (s *Server) tldCAFiles(tld *tldCA) (map[string][]byte, error) {
+	privPem, err := marshalPrivateKeyPEM(tld.priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		s.cfg.tldKeyPath(tld.name):  privPem,
+		s.cfg.tldCertPath(tld.name): tld.certPem,
+	}, nil
+}
+
+// saveTLDCAs persists all TLD CAs, for GenerateCerts.
+func (s *Server) saveTLDCAs() error {
+	for _, tldName := range s.tldNames {
+		err := s.saveTLDCA(s.tlds[tldName])
+		if err != nil {
+			return fmt.Errorf("unable to write TLD CA for %s: %w", tldName, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) newTLDCA(tldName string, cert []byte, priv crypto.Signer) (*tldCA, error) {
+	parsed, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert,
+	})
+
+	return &tldCA{
+		name:          tldName,
+		cert:          cert,
+		parsed:        parsed,
+		priv:          priv,
+		certPem:       certPem,
+		certPemString: string(certPem),
+		crlURL:        s.cfg.crlURL(tldName),
+	}, nil
+}
+
+// tldForDomain returns the TLD CA responsible for domain, or nil if domain
+// isn't under any configured TLD.  If several configured TLDs match (e.g. a
+// transitional name nested under another TLD), the longest one wins.
+func (s *Server) tldForDomain(domain string) *tldCA {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	var (
+		best    *tldCA
+		bestLen int
+	)
+
+	for _, tldName := range s.tldNames {
+		if !strings.HasSuffix(domain, "."+tldName) || len(tldName) <= bestLen {
+			continue
+		}
+
+		best = s.tlds[tldName]
+		bestLen = len(tldName)
+	}
+
+	return best
+}
+
+// tldForCAName returns the TLD CA whose CommonName is name (e.g.
+// ".bit TLD CA"), or nil if there is none.
+func (s *Server) tldForCAName(name string) *tldCA {
+	if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, " TLD CA") {
+		return nil
+	}
+
+	return s.tlds[strings.TrimSuffix(strings.TrimPrefix(name, "."), " TLD CA")]
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTLSVersion is returned for an unknown TLSMinVersion.
+	ErrTLSVersion = errors.New("unsupported TLS version")
+
+	// ErrCipherSuite is returned for an unknown or insecure cipher suite
+	// in TLSCipherSuites.
+	ErrCipherSuite = errors.New("unsupported cipher suite")
+
+	// ErrCurve is returned for an unknown curve in TLSCurves.
+	ErrCurve = errors.New("unsupported curve")
+)
+
+// tlsCurves maps the names accepted by TLSCurves to curve IDs.
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+func parseTLSVersion(value string) (uint16, error) {
+	switch value {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrTLSVersion, value)
+	}
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names.  Go
+// considers some suites insecure; those are rejected.
+func parseCipherSuites(value string) ([]uint16, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	suites := []uint16{}
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+
+		found := false
+
+		for _, suite := range tls.CipherSuites() {
+			if strings.EqualFold(suite.Name, name) {
+				suites = append(suites, suite.ID)
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrCipherSuite, name)
+		}
+	}
+
+	return suites, nil
+}
+
+// parseCurves parses a comma-separated list of curve names.
+func parseCurves(value string) ([]tls.CurveID, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	curves := []tls.CurveID{}
+
+	for _, name := range strings.Split(value, ",") {
+		curve, ok := tlsCurves[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrCurve, name)
+		}
+
+		curves = append(curves, curve)
+	}
+
+	return curves, nil
+}
+
+// applyTLSSettings applies the TLS* settings to the tls.Config of a
+// listener.
+func (s *Server) applyTLSSettings(tlsConfig *tls.Config) error {
+	var err error
+
+	tlsConfig.MinVersion, err = parseTLSVersion(s.cfg.TLSMinVersion)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig.CipherSuites, err = parseCipherSuites(s.cfg.TLSCipherSuites)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig.CurvePreferences, err = parseCurves(s.cfg.TLSCurves)
+	if err != nil {
+		return err
+	}
+
+	if !s.cfg.TLSSessionTickets {
+		tlsConfig.SessionTicketsDisabled = true
+
+		return nil
+	}
+
+	if s.ticketKeys != nil {
+		s.ticketKeys.install(tlsConfig)
+	}
+
+	return nil
+}
+
+// sessionTicketKeys encrypts the session tickets of the TLS listeners with
+// keys that it rotates every interval.  The previous key is kept for
+// decryption, so that tickets issued just before a rotation still resume.
+//
+// net/http and gRPC clone the tls.Configs they're given, so rather than
+// setting keys on them, their WrapSession and UnwrapSession go through
+// keyConfig, whose only purpose is to hold the current keys.
+type sessionTicketKeys struct {
+	mu        sync.Mutex
+	keyConfig *tls.Config
+	keys      [][32]byte
+	interval  time.Duration
+	timer     *time.Timer
+}
+
+func newSessionTicketKeys(interval time.Duration) (*sessionTicketKeys, error) {
+	keys := &sessionTicketKeys{
+		keyConfig: &tls.Config{},
+		interval:  interval,
+	}
+
+	err := keys.rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// install makes tlsConfig, and any clones of it, use the rotated keys.
+func (k *sessionTicketKeys) install(tlsConfig *tls.Config) {
+	tlsConfig.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		return k.keyConfig.EncryptTicket(cs, ss)
+	}
+
+	tlsConfig.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		return k.keyConfig.DecryptTicket(identity, cs)
+	}
+}
+
+// rotate generates a new key for encrypting tickets.
+func (k *sessionTicketKeys) rotate() error {
+	var key [32]byte
+
+	_, err := rand.Read(key[:])
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = append([][32]byte{key}, k.keys...)
+	if len(k.keys) > 2 {
+		k.keys = k.keys[:2]
+	}
+
+	k.keyConfig.SetSessionTicketKeys(k.keys)
+
+	return nil
+}
+
+// start rotates the keys every interval until stop is called.
+func (k *sessionTicketKeys) start() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.timer = time.AfterFunc(k.interval, k.rotationDue)
+}
+
+func (k *sessionTicketKeys) rotationDue() {
+	err := k.rotate()
+	if err != nil {
+		log.Errore(err, "Unable to rotate TLS session ticket keys")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.timer != nil {
+		k.timer = time.AfterFunc(k.interval, k.rotationDue)
+	}
+}
+
+func (k *sessionTicketKeys) stop() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.timer != nil {
+		k.timer.Stop()
+		k.timer = nil
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/namecoin/encaya/server"
+
+// tracingShutdownTimeout bounds how long Stop waits for buffered spans to
+// be exported.
+const tracingShutdownTimeout = 5 * time.Second
+
+// Span attributes.  The OpenTelemetry semantic conventions are used where
+// they exist.
+const (
+	attrDomain         = attribute.Key("encaya.domain")
+	attrService        = attribute.Key("encaya.service")
+	attrCacheHit       = attribute.Key("encaya.cache_hit")
+	attrCertCount      = attribute.Key("encaya.cert_count")
+	attrSerial         = attribute.Key("encaya.serial")
+	attrTLSAUsage      = attribute.Key("encaya.tlsa.usage")
+	attrTLSASelector   = attribute.Key("encaya.tlsa.selector")
+	attrTLSAMatching   = attribute.Key("encaya.tlsa.matching_type")
+	attrTLSAIssuable   = attribute.Key("encaya.tlsa.issuable")
+	attrDNSQuestion    = attribute.Key("dns.question.name")
+	attrDNSRcode       = attribute.Key("dns.response.rcode")
+	attrHTTPMethod     = attribute.Key("http.request.method")
+	attrHTTPRoute      = attribute.Key("http.route")
+	attrHTTPStatusCode = attribute.Key("http.response.status_code")
+	attrRPCMethod      = attribute.Key("rpc.method")
+)
+
+// noopTracer is used when tracing is disabled, and by the Servers that only
+// hold a CA generation or a half-applied reload.
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// tracePropagator reads the W3C Trace Context headers of incoming requests,
+// so that our spans join the caller's trace.
+var tracePropagator = propagation.TraceContext{}
+
+// tracingSampleRatio parses TracingSampleRatio.
+func (cfg *Config) tracingSampleRatio() (float64, error) {
+	ratio, err := strconv.ParseFloat(cfg.TracingSampleRatio, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: TracingSampleRatio must be a number", ErrConfigOption)
+	}
+
+	if ratio < 0 || ratio > 1 {
+		return 0, fmt.Errorf("%w: TracingSampleRatio must be between 0 and 1", ErrConfigOption)
+	}
+
+	return ratio, nil
+}
+
+// initTracing sets up the OTLP exporter if TracingEndpoint is set.
+func (s *Server) initTracing() error {
+	if s.cfg.TracingEndpoint == "" {
+		return nil
+	}
+
+	ratio, err := s.cfg.tracingSampleRatio()
+	if err != nil {
+		return err
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(s.cfg.TracingEndpoint))
+	if err != nil {
+		return fmt.Errorf("unable to create OTLP exporter: %w", err)
+	}
+
+	s.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", s.cfg.TracingServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	s.tracer = s.tracerProvider.Tracer(tracerName)
+
+	return nil
+}
+
+// shutdownTracing exports the spans that are still buffered.
+func (s *Server) shutdownTracing() {
+	if s.tracerProvider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+
+	err := s.tracerProvider.Shutdown(ctx)
+	if err != nil {
+		log.Warne(err, "Unable to export remaining trace spans")
+	}
+}
+
+// startSpan starts a span as a child of the one in ctx, if any.
+func (s *Server) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context,
+	trace.Span) {
+	tracer := s.tracer
+	if tracer == nil {
+		tracer = noopTracer
+	}
+
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// traceHTTP serves req with next inside a span named after the route.
+func (s *Server) traceHTTP(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	if s.tracerProvider == nil {
+		next.ServeHTTP(w, req)
+
+		return
+	}
+
+	ctx := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	_, route := s.mux.Handler(req)
+	if route == "" {
+		route = "unknown"
+	}
+
+	ctx, span := s.startSpan(ctx, req.Method+" "+route,
+		attrHTTPMethod.String(req.Method),
+		attrHTTPRoute.String(route),
+	)
+	defer span.End()
+
+	// Don't parse the body just for this.
+	if domain := req.URL.Query().Get("domain"); domain != "" {
+		span.SetAttributes(attrDomain.String(domain))
+	}
+
+	recorder := newResponseRecorder(w)
+	next.ServeHTTP(recorder, req.WithContext(ctx))
+
+	span.SetAttributes(attrHTTPStatusCode.Int(recorder.status))
+
+	if recorder.status >= http.StatusInternalServerError {
+		span.SetStatus(otelcodes.Error, http.StatusText(recorder.status))
+	}
+}
@@ -0,0 +1,513 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxLogEntriesPerRequest caps the entries returned by one get-entries
+// request, like CT logs do.
+const maxLogEntriesPerRequest = 1000
+
+// TLS HashAlgorithm and SignatureAlgorithm values of DigitallySigned
+// structs (RFC 5246 section 7.4.1.4.1 and RFC 8422 section 5.1.3).
+const (
+	tlsHashSHA256       = 4
+	tlsHashIntrinsic    = 8
+	tlsSignatureRSA     = 1
+	tlsSignatureECDSA   = 3
+	tlsSignatureEd25519 = 7
+)
+
+var (
+	storeBucketLog = []byte("translog")
+
+	// ErrLogKeyType is returned when the transparency log key can't be
+	// used for tree head signatures.
+	ErrLogKeyType = errors.New("unsupported transparency log key type")
+
+	// ErrLogFull is returned when a cert can't be issued because the
+	// transparency log has reached TransparencyLogMaxEntries.
+	ErrLogFull = errors.New("transparency log is full")
+)
+
+// transLogEntry is an RFC 6962 log entry of type x509_entry.
+type transLogEntry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+// transLog is an append-only RFC 6962 style Merkle tree log of the certs we
+// issue, so that domain owners can audit what an instance has issued for
+// their names.  Entries are persisted in the store, if enabled.  Each cert
+// is logged once, however often it's reissued, and the log holds at most
+// maxEntries (if nonzero) certs.
+type transLog struct {
+	signer     crypto.Signer
+	store      *store
+	maxEntries int
+
+	mu        sync.Mutex
+	entries   []transLogEntry
+	tree      merkleTree
+	leafIndex map[string]int
+	certs     map[[sha256.Size]byte]struct{}
+}
+
+// signedTreeHead is the get-sth response.
+type signedTreeHead struct {
+	TreeSize          uint64 `json:"tree_size"`
+	Timestamp         uint64 `json:"timestamp"`
+	SHA256RootHash    []byte `json:"sha256_root_hash"`
+	TreeHeadSignature []byte `json:"tree_head_signature"`
+}
+
+// loadLogKey loads the transparency log's signing key, generating it if it
+// doesn't exist yet.
+func (s *Server) loadLogKey() (crypto.Signer, error) {
+	keyPem, err := ioutil.ReadFile(s.cfg.TransparencyLogKey)
+	if os.IsNotExist(err) {
+		log.Infof("Generating transparency log key %s", s.cfg.TransparencyLogKey)
+
+		priv, err := s.cfg.generateKey()
+		if err != nil {
+			return nil, err
+		}
+
+		keyPem, err = marshalPrivateKeyPEM(priv)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ioutil.WriteFile(s.cfg.TransparencyLogKey, keyPem, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		return priv, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoPEM, s.cfg.TransparencyLogKey)
+	}
+
+	return parsePrivateKeyBlock(block)
+}
+
+// openTransLog returns the transparency log, with the entries persisted in
+// st (which may be nil).
+func openTransLog(signer crypto.Signer, st *store, maxEntries int) (*transLog, error) {
+	tl := &transLog{
+		signer:     signer,
+		store:      st,
+		maxEntries: maxEntries,
+		leafIndex:  map[string]int{},
+		certs:      map[[sha256.Size]byte]struct{}{},
+	}
+
+	if st == nil {
+		return tl, nil
+	}
+
+	err := st.forEach(storeBucketLog, func(key, value []byte) error {
+		entry := transLogEntry{}
+
+		err := json.Unmarshal(value, &entry)
+		if err != nil {
+			return fmt.Errorf("transparency log entry %x: %w", key, err)
+		}
+
+		tl.add(entry)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tl, nil
+}
+
+func (tl *transLog) add(entry transLogEntry) {
+	leafHash := merkleLeafHash(entry.LeafInput)
+
+	tl.leafIndex[string(leafHash)] = len(tl.entries)
+	tl.entries = append(tl.entries, entry)
+	tl.tree.append(leafHash)
+
+	der, ok := leafCert(entry.LeafInput)
+	if ok {
+		tl.certs[sha256.Sum256(der)] = struct{}{}
+	}
+}
+
+// leafCert returns the cert of a leaf_input written by appendCert.
+func leafCert(leafInput []byte) ([]byte, bool) {
+	// Version, leaf type, timestamp and entry type
+	const header = 2 + 8 + 2
+
+	if len(leafInput) < header+3 {
+		return nil, false
+	}
+
+	length := int(leafInput[header])<<16 | int(leafInput[header+1])<<8 | int(leafInput[header+2])
+	if len(leafInput) < header+3+length {
+		return nil, false
+	}
+
+	return leafInput[header+3 : header+3+length], true
+}
+
+// appendCert logs an issued cert, with the certs of its issuers as the
+// entry's chain.  It returns ErrLogFull if the cert isn't logged yet and
+// there's no room for it; the caller must then not hand it out.
+func (tl *transLog) appendCert(der []byte, chain ...[]byte) error {
+	fingerprint := sha256.Sum256(der)
+
+	leaf := &bytes.Buffer{}
+	leaf.Write([]byte{0, 0}) // v1, timestamped_entry
+	_ = binary.Write(leaf, binary.BigEndian, uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	leaf.Write([]byte{0, 0}) // x509_entry
+	writeUint24Prefixed(leaf, der)
+	leaf.Write([]byte{0, 0}) // no extensions
+
+	chainBytes := &bytes.Buffer{}
+	for _, cert := range chain {
+		writeUint24Prefixed(chainBytes, cert)
+	}
+
+	extra := &bytes.Buffer{}
+	writeUint24Prefixed(extra, chainBytes.Bytes())
+
+	entry := transLogEntry{
+		LeafInput: leaf.Bytes(),
+		ExtraData: extra.Bytes(),
+	}
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	// Certs are deterministic unless randomized by the issuance settings,
+	// so a cert reissued for another isolation key is usually known.
+	if _, ok := tl.certs[fingerprint]; ok {
+		return nil
+	}
+
+	if tl.maxEntries != 0 && len(tl.entries) >= tl.maxEntries {
+		return fmt.Errorf("%w: %d entries", ErrLogFull, len(tl.entries))
+	}
+
+	if tl.store != nil {
+		value, err := json.Marshal(entry)
+		if err == nil {
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(len(tl.entries)))
+
+			err = tl.store.put(storeBucketLog, string(key), string(value))
+		}
+
+		if err != nil {
+			log.Warne(err, "Unable to persist transparency log entry")
+		}
+	}
+
+	tl.add(entry)
+
+	return nil
+}
+
+func writeUint24Prefixed(buf *bytes.Buffer, data []byte) {
+	buf.Write([]byte{byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))})
+	buf.Write(data)
+}
+
+// treeHead returns a signed tree head for the current tree.
+func (tl *transLog) treeHead() (*signedTreeHead, error) {
+	tl.mu.Lock()
+	treeSize := tl.tree.size()
+	rootHash := tl.tree.rootHash(treeSize)
+	tl.mu.Unlock()
+
+	sth := &signedTreeHead{
+		TreeSize:       uint64(treeSize),
+		Timestamp:      uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		SHA256RootHash: rootHash,
+	}
+
+	// TreeHeadSignature (RFC 6962 section 3.5)
+	signed := &bytes.Buffer{}
+	signed.Write([]byte{0, 1}) // v1, tree_hash
+	_ = binary.Write(signed, binary.BigEndian, sth.Timestamp)
+	_ = binary.Write(signed, binary.BigEndian, sth.TreeSize)
+	signed.Write(sth.SHA256RootHash)
+
+	var err error
+
+	sth.TreeHeadSignature, err = tl.digitallySign(signed.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return sth, nil
+}
+
+// digitallySign returns a TLS DigitallySigned struct over message.
+func (tl *transLog) digitallySign(message []byte) ([]byte, error) {
+	var (
+		hashAlgorithm      byte = tlsHashSHA256
+		signatureAlgorithm byte
+		signature          []byte
+		err                error
+	)
+
+	digest := sha256.Sum256(message)
+
+	switch tl.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		signatureAlgorithm = tlsSignatureECDSA
+		signature, err = tl.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case *rsa.PublicKey:
+		signatureAlgorithm = tlsSignatureRSA
+		signature, err = tl.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		hashAlgorithm = tlsHashIntrinsic
+		signatureAlgorithm = tlsSignatureEd25519
+		signature, err = tl.signer.Sign(rand.Reader, message, crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrLogKeyType, tl.signer.Public())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := []byte{hashAlgorithm, signatureAlgorithm, byte(len(signature) >> 8), byte(len(signature))}
+
+	return append(result, signature...), nil
+}
+
+// logIssued records an issued cert in the transparency log, if enabled.
+func (s *Server) logIssued(der []byte, chain ...[]byte) error {
+	if s.transLog == nil {
+		return nil
+	}
+
+	return s.transLog.appendCert(der, chain...)
+}
+
+// requireTransLog responds with 404 if the transparency log is disabled.
+func (s *Server) requireTransLog(w http.ResponseWriter) bool {
+	if s.transLog == nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "transparency log is disabled")
+
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
+
+// parseIndexParam parses a non-negative integer form parameter.
+func parseIndexParam(req *http.Request, name string) (int, error) {
+	value, err := strconv.Atoi(req.FormValue(name))
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+
+	return value, nil
+}
+
+func (s *Server) getSTHHandler(w http.ResponseWriter, req *http.Request) {
+	if !s.requireTransLog(w) {
+		return
+	}
+
+	sth, err := s.transLog.treeHead()
+	if err != nil {
+		log.Errore(err, "Unable to sign tree head")
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "unable to sign tree head")
+
+		return
+	}
+
+	writeJSON(w, sth)
+}
+
+func (s *Server) getEntriesHandler(w http.ResponseWriter, req *http.Request) {
+	if !s.requireTransLog(w) {
+		return
+	}
+
+	start, err := parseIndexParam(req, "start")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+
+		return
+	}
+
+	end, err := parseIndexParam(req, "end")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+
+		return
+	}
+
+	s.transLog.mu.Lock()
+	entries := s.transLog.entries
+	s.transLog.mu.Unlock()
+
+	if end >= len(entries) {
+		end = len(entries) - 1
+	}
+
+	if end-start >= maxLogEntriesPerRequest {
+		end = start + maxLogEntriesPerRequest - 1
+	}
+
+	if start > end {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "start must not exceed end or the tree size")
+
+		return
+	}
+
+	writeJSON(w, map[string][]transLogEntry{
+		"entries": entries[start : end+1],
+	})
+}
+
+func (s *Server) getProofByHashHandler(w http.ResponseWriter, req *http.Request) {
+	if !s.requireTransLog(w) {
+		return
+	}
+
+	leafHash, err := base64.StdEncoding.DecodeString(req.FormValue("hash"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "hash must be base64")
+
+		return
+	}
+
+	treeSize, err := parseIndexParam(req, "tree_size")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+
+		return
+	}
+
+	s.transLog.mu.Lock()
+	size := s.transLog.tree.size()
+	index, found := s.transLog.leafIndex[string(leafHash)]
+
+	var auditPath [][]byte
+	if found && index < treeSize && treeSize <= size {
+		auditPath = s.transLog.tree.auditPath(index, treeSize)
+	}
+
+	s.transLog.mu.Unlock()
+
+	if treeSize > size {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "tree_size exceeds the tree size")
+
+		return
+	}
+
+	if !found || index >= treeSize {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "no such leaf in the tree")
+
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"leaf_index": index,
+		"audit_path": auditPath,
+	})
+}
+
+func (s *Server) getSTHConsistencyHandler(w http.ResponseWriter, req *http.Request) {
+	if !s.requireTransLog(w) {
+		return
+	}
+
+	first, err := parseIndexParam(req, "first")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+
+		return
+	}
+
+	second, err := parseIndexParam(req, "second")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+
+		return
+	}
+
+	s.transLog.mu.Lock()
+	size := s.transLog.tree.size()
+
+	var proof [][]byte
+	if first <= second && second <= size {
+		proof = s.transLog.tree.consistencyProof(first, second)
+	}
+
+	s.transLog.mu.Unlock()
+
+	if first > second || second > size {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "first must not exceed second, nor second the tree size")
+
+		return
+	}
+
+	writeJSON(w, map[string][][]byte{
+		"consistency": proof,
+	})
+}
+
+func (s *Server) getLogKeyHandler(w http.ResponseWriter, req *http.Request) {
+	if !s.requireTransLog(w) {
+		return
+	}
+
+	pubDer, err := x509.MarshalPKIXPublicKey(s.transLog.signer.Public())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+
+		return
+	}
+
+	err = pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})
+	if err != nil {
+		log.Debuge(err, "write error")
+	}
+}
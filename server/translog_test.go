@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestTransLogAppendCert(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tl, err := openTransLog(priv, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, der := range [][]byte{[]byte("first"), []byte("second"), []byte("first")} {
+		err = tl.appendCert(der, []byte("issuer"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(tl.entries) != 2 {
+		t.Fatalf("%d entries logged, want 2 (reissued certs are logged once)", len(tl.entries))
+	}
+
+	der, ok := leafCert(tl.entries[1].LeafInput)
+	if !ok || string(der) != "second" {
+		t.Errorf("leaf cert is %q, want %q", der, "second")
+	}
+
+	err = tl.appendCert([]byte("third"))
+	if !errors.Is(err, ErrLogFull) {
+		t.Errorf("got %v, want %v", err, ErrLogFull)
+	}
+
+	// Certs already logged can still be handed out.
+	err = tl.appendCert([]byte("second"))
+	if err != nil {
+		t.Errorf("logged cert rejected by a full log: %v", err)
+	}
+}
+
+func TestTransLogTreeHead(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tl, err := openTransLog(priv, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, der := range [][]byte{[]byte("a"), []byte("b"), []byte("c")} {
+		err = tl.appendCert(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sth, err := tl.treeHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := &merkleTree{}
+	for _, entry := range tl.entries {
+		tree.append(merkleLeafHash(entry.LeafInput))
+	}
+
+	if sth.TreeSize != 3 || !bytes.Equal(sth.SHA256RootHash, tree.rootHash(3)) {
+		t.Errorf("tree head is for %d entries with root %x, want 3 with root %x",
+			sth.TreeSize, sth.SHA256RootHash, tree.rootHash(3))
+	}
+
+	signature := sth.TreeHeadSignature
+	if len(signature) < 4 || signature[0] != tlsHashSHA256 || signature[1] != tlsSignatureECDSA ||
+		int(signature[2])<<8|int(signature[3]) != len(signature)-4 {
+		t.Fatalf("malformed DigitallySigned struct %x", signature)
+	}
+
+	signed := &bytes.Buffer{}
+	signed.Write([]byte{0, 1})
+	_ = binary.Write(signed, binary.BigEndian, sth.Timestamp)
+	_ = binary.Write(signed, binary.BigEndian, sth.TreeSize)
+	signed.Write(sth.SHA256RootHash)
+
+	digest := sha256.Sum256(signed.Bytes())
+	if !ecdsa.VerifyASN1(&priv.PublicKey, digest[:], signature[4:]) {
+		t.Error("tree head signature doesn't verify")
+	}
+}
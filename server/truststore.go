@@ -0,0 +1,331 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Trust stores supported by TrustStores.
+const (
+	trustStoreNSS     = "nss"
+	trustStoreP11Kit  = "p11-kit"
+	trustStoreWindows = "windows"
+)
+
+// ErrTrustStore is returned when the root CA couldn't be installed into or
+// removed from some of the TrustStores.
+var ErrTrustStore = errors.New("trust store update failed")
+
+// trustStore installs and removes root CAs in one platform trust store.
+// Both methods get the path of a PEM file containing the cert, as well as
+// the parsed cert.
+type trustStore interface {
+	name() string
+	install(certPath string, cert *x509.Certificate) error
+	remove(certPath string, cert *x509.Certificate) error
+}
+
+// trustStoreNames returns the names listed in TrustStores.
+func (cfg *Config) trustStoreNames() ([]string, error) {
+	var result []string
+
+	for _, name := range strings.Split(cfg.TrustStores, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		switch name {
+		case "":
+			continue
+		case trustStoreNSS, trustStoreP11Kit:
+		case trustStoreWindows:
+			if runtime.GOOS != "windows" {
+				return nil, fmt.Errorf("%w: the windows trust store is only available on Windows", ErrTrustStore)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown trust store %q (must be nss, p11-kit or windows)", ErrTrustStore, name)
+		}
+
+		result = append(result, name)
+	}
+
+	return result, nil
+}
+
+// trustStores returns the stores listed in TrustStores.
+func (cfg *Config) trustStores() ([]trustStore, error) {
+	names, err := cfg.trustStoreNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []trustStore
+
+	for _, name := range names {
+		switch name {
+		case trustStoreNSS:
+			dbs, err := cfg.nssDBs()
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, &nssTrustStore{dbs: dbs})
+		case trustStoreP11Kit:
+			result = append(result, p11KitTrustStore{})
+		case trustStoreWindows:
+			result = append(result, windowsTrustStore{})
+		}
+	}
+
+	return result, nil
+}
+
+// nssDBs returns the NSS databases to update: TrustStoreNSSDBs if set,
+// otherwise the user's shared database and Firefox profiles.
+func (cfg *Config) nssDBs() ([]string, error) {
+	if cfg.TrustStoreNSSDBs != "" {
+		var dbs []string
+
+		for _, db := range strings.Split(cfg.TrustStoreNSSDBs, ",") {
+			db = strings.TrimSpace(db)
+			if db != "" {
+				dbs = append(dbs, db)
+			}
+		}
+
+		return dbs, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to find NSS databases: %s", ErrTrustStore, err.Error())
+	}
+
+	patterns := []string{
+		filepath.Join(home, ".pki", "nssdb"),
+		filepath.Join(home, ".mozilla", "firefox", "*"),
+		filepath.Join(home, "snap", "firefox", "common", ".mozilla", "firefox", "*"),
+	}
+
+	var dbs []string
+
+	for _, pattern := range patterns {
+		// Only SQL databases (cert9.db) are supported by current NSS.
+		matches, err := filepath.Glob(filepath.Join(pattern, "cert9.db"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, match := range matches {
+			dbs = append(dbs, filepath.Dir(match))
+		}
+	}
+
+	return dbs, nil
+}
+
+// rootCANickname identifies a root CA we installed, so that it can be
+// removed again without touching anything else.
+func rootCANickname(cert *x509.Certificate) string {
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	return "Namecoin Encaya Root CA " + hex.EncodeToString(fingerprint[:8])
+}
+
+// nssTrustStore uses NSS's certutil on each database in dbs, e.g. Firefox
+// profiles.
+type nssTrustStore struct {
+	dbs []string
+}
+
+func (t *nssTrustStore) name() string {
+	return trustStoreNSS
+}
+
+func (t *nssTrustStore) install(certPath string, cert *x509.Certificate) error {
+	if len(t.dbs) == 0 {
+		return fmt.Errorf("%w: no NSS databases found; set TrustStoreNSSDBs", ErrTrustStore)
+	}
+
+	for _, db := range t.dbs {
+		err := runTrustCommand("certutil", "-d", "sql:"+db, "-A", "-t", "C,,", "-n", rootCANickname(cert), "-i", certPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", db, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *nssTrustStore) remove(certPath string, cert *x509.Certificate) error {
+	nickname := rootCANickname(cert)
+
+	for _, db := range t.dbs {
+		// certutil fails if the nickname isn't there, so check first.
+		if runTrustCommand("certutil", "-d", "sql:"+db, "-L", "-n", nickname) != nil {
+			continue
+		}
+
+		err := runTrustCommand("certutil", "-d", "sql:"+db, "-D", "-n", nickname)
+		if err != nil {
+			return fmt.Errorf("%s: %w", db, err)
+		}
+	}
+
+	return nil
+}
+
+// p11KitTrustStore uses p11-kit's trust tool, which updates the system-wide
+// anchors used by most Linux distributions (and usually requires root).
+type p11KitTrustStore struct{}
+
+func (p11KitTrustStore) name() string {
+	return trustStoreP11Kit
+}
+
+func (p11KitTrustStore) install(certPath string, cert *x509.Certificate) error {
+	return runTrustCommand("trust", "anchor", "--store", certPath)
+}
+
+func (p11KitTrustStore) remove(certPath string, cert *x509.Certificate) error {
+	return runTrustCommand("trust", "anchor", "--remove", certPath)
+}
+
+// windowsTrustStore uses certutil.exe on the local machine's Root store
+// (which requires an elevated prompt).
+type windowsTrustStore struct{}
+
+func (windowsTrustStore) name() string {
+	return trustStoreWindows
+}
+
+func (windowsTrustStore) install(certPath string, cert *x509.Certificate) error {
+	return runTrustCommand("certutil.exe", "-addstore", "-f", "Root", certPath)
+}
+
+func (windowsTrustStore) remove(certPath string, cert *x509.Certificate) error {
+	return runTrustCommand("certutil.exe", "-delstore", "Root", hex.EncodeToString(cert.SerialNumber.Bytes()))
+}
+
+func runTrustCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// removeDiscardedRootCA removes a root CA whose file has been replaced from
+// every configured trust store, using a temporary copy of its old file.
+func (cfg *Config) removeDiscardedRootCA(certPem []byte) error {
+	file, err := ioutil.TempFile("", "encaya-old-root-*.pem")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(certPem)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return cfg.updateTrustStores(file.Name(), false)
+}
+
+// readRootCAFile reads and parses the root CA at path, returning nil if it
+// doesn't exist.
+func readRootCAFile(path string) (*x509.Certificate, error) {
+	certPem, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoPEM, path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// updateTrustStores installs (or removes) the root CA stored at certPath in
+// every configured trust store.  A store that fails doesn't stop the others
+// from being updated.
+func (cfg *Config) updateTrustStores(certPath string, install bool) error {
+	stores, err := cfg.trustStores()
+	if err != nil {
+		return err
+	}
+
+	if len(stores) == 0 {
+		return nil
+	}
+
+	cert, err := readRootCAFile(certPath)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", certPath, err)
+	}
+
+	if cert == nil {
+		return nil
+	}
+
+	var failed []string
+
+	for _, store := range stores {
+		if install {
+			err = store.install(certPath, cert)
+		} else {
+			err = store.remove(certPath, cert)
+		}
+
+		if err != nil {
+			log.Errore(err, "Unable to update trust store "+store.name())
+
+			failed = append(failed, store.name())
+
+			continue
+		}
+
+		if install {
+			log.Infof("Installed %s into trust store %s", certPath, store.name())
+		} else {
+			log.Infof("Removed %s from trust store %s", certPath, store.name())
+		}
+	}
+
+	if len(failed) != 0 {
+		return fmt.Errorf("%w: %s", ErrTrustStore, strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// uninstallRootCAs removes the current and previous root CAs from the
+// configured trust stores.
+func (cfg *Config) uninstallRootCAs() error {
+	err := cfg.updateTrustStores(cfg.RootCert, false)
+	if err != nil {
+		return err
+	}
+
+	return cfg.updateTrustStores(cfg.PreviousRootCert, false)
+}
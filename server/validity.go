@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	// CA/Browser Forum Baseline Requirements: at least 64 bits of
+	// entropy.
+	minSerialBits = 64
+
+	// RFC 5280: serial numbers are positive and at most 20 octets.
+	maxSerialBits = 159
+)
+
+var (
+	// ErrSerialBits is returned when a configured serial number size is
+	// out of range.
+	ErrSerialBits = errors.New("serial number bits must be between 64 and 159")
+
+	// ErrValidity is returned when a configured validity period isn't
+	// positive.
+	ErrValidity = errors.New("validity period must be positive")
+)
+
+// loadLifetimes parses the configured validity periods, cache TTL, request
+// timeout and serial number sizes.
+func (s *Server) loadLifetimes() error {
+	var err error
+
+	if s.cfg.DomainCertValidity != "" {
+		s.domainCertValidity, err = parseValidity(s.cfg.DomainCertValidity)
+		if err != nil {
+			return fmt.Errorf("domain cert validity: %w", err)
+		}
+	}
+
+	s.listenCertValidity, err = parseValidity(s.cfg.ListenCertValidity)
+	if err != nil {
+		return fmt.Errorf("listen cert validity: %w", err)
+	}
+
+	if s.cfg.ListenCertRenew != "" {
+		s.listenCertRenewBefore, err = parseValidity(s.cfg.ListenCertRenew)
+		if err != nil {
+			return fmt.Errorf("listen cert renewal: %w", err)
+		}
+	}
+
+	if s.cfg.RequestTimeout != "" {
+		s.requestTimeout, err = parseValidity(s.cfg.RequestTimeout)
+		if err != nil {
+			return fmt.Errorf("request timeout: %w", err)
+		}
+	}
+
+	s.domainCacheTTL, err = parseValidity(s.cfg.DomainCacheTTL)
+	if err != nil {
+		return fmt.Errorf("domain cert cache TTL: %w", err)
+	}
+
+	s.watchInterval, err = parseValidity(s.cfg.WatchInterval)
+	if err != nil {
+		return fmt.Errorf("watch interval: %w", err)
+	}
+
+	s.cacheRefreshWindow = 0
+
+	if s.cfg.CacheRefreshWindow != "" {
+		s.cacheRefreshWindow, err = parseValidity(s.cfg.CacheRefreshWindow)
+		if err != nil {
+			return fmt.Errorf("cache refresh window: %w", err)
+		}
+
+		// Otherwise refreshed certs would be due again straight away.
+		if s.cacheRefreshWindow >= s.domainCacheTTL/2 {
+			return fmt.Errorf("%w: cache refresh window must be less than half of the domain cert cache TTL",
+				ErrValidity)
+		}
+	}
+
+	s.cacheRefreshIdle, err = parseValidity(s.cfg.CacheRefreshIdle)
+	if err != nil {
+		return fmt.Errorf("cache refresh idle time: %w", err)
+	}
+
+	err = checkSerialBits(s.cfg.SerialBits)
+	if err != nil {
+		return err
+	}
+
+	if s.cfg.DomainCertSerialBits != 0 {
+		err = checkSerialBits(s.cfg.DomainCertSerialBits)
+		if err != nil {
+			return fmt.Errorf("domain cert: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func parseValidity(value string) (time.Duration, error) {
+	validity, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if validity <= 0 {
+		return 0, fmt.Errorf("%w: %s", ErrValidity, value)
+	}
+
+	return validity, nil
+}
+
+func checkSerialBits(bits int) error {
+	if bits < minSerialBits || bits > maxSerialBits {
+		return fmt.Errorf("%w: %d", ErrSerialBits, bits)
+	}
+
+	return nil
+}
+
+// randomSerial returns a random positive serial number of at most bits bits.
+func randomSerial(bits int) (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+
+	for {
+		serial, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		if serial.Sign() > 0 {
+			return serial, nil
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrUnknownServerName is returned to TLS clients that ask (via SNI) for a
+// name that VirtualHosts doesn't serve.
+var ErrUnknownServerName = errors.New("no certificate for server name")
+
+// aiaPaths are the endpoints that generated certs point to, and are
+// therefore served under aiaHostname when VirtualHosts is set.
+var aiaPaths = []string{"/aia", "/ocsp", "/ocsp/", "/crl"}
+
+func isAIAPath(path string) bool {
+	for _, aiaPath := range aiaPaths {
+		if path == aiaPath || (strings.HasSuffix(aiaPath, "/") && strings.HasPrefix(path, aiaPath)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeHost returns a Host header or server name without its port and
+// trailing dot, in lower case.
+func normalizeHost(host string) string {
+	hostOnly, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = hostOnly
+	}
+
+	host = strings.TrimPrefix(host, "[")
+	host = strings.TrimSuffix(host, "]")
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// parseAPIHosts returns the set of names the API endpoints answer to: the
+// comma-separated APIHosts, or the ListenIP addresses if it's empty.
+func (cfg *Config) parseAPIHosts() map[string]bool {
+	list := cfg.APIHosts
+	if list == "" {
+		list = cfg.ListenIP
+	}
+
+	hosts := map[string]bool{}
+
+	for _, host := range strings.Split(list, ",") {
+		host = normalizeHost(strings.TrimSpace(host))
+		if host != "" {
+			hosts[host] = true
+		}
+	}
+
+	return hosts
+}
+
+// routeVirtualHosts wraps the API handler, serving the AIA endpoints only
+// under aiaHostname and the other endpoints only under the API hosts (or
+// over the Unix socket), so that each can be exposed differently, e.g. by a
+// reverse proxy.  Over TLS, the Host must also match the SNI server name.
+func (s *Server) routeVirtualHosts(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := normalizeHost(req.Host)
+
+		if req.TLS != nil && req.TLS.ServerName != "" && normalizeHost(req.TLS.ServerName) != host {
+			writeError(w, http.StatusMisdirectedRequest, errCodeMisdirected,
+				"Host doesn't match the TLS server name")
+
+			return
+		}
+
+		var allowed bool
+
+		if isAIAPath(req.URL.Path) {
+			allowed = host == aiaHostname
+		} else {
+			_, _, err := net.SplitHostPort(req.RemoteAddr)
+			unixSocket := err != nil
+
+			allowed = unixSocket || s.apiHosts[host]
+		}
+
+		if !allowed {
+			writeError(w, http.StatusMisdirectedRequest, errCodeMisdirected,
+				fmt.Sprintf("%s isn't served under %s", req.URL.Path, host))
+
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// checkServerName rejects TLS handshakes for names that VirtualHosts doesn't
+// serve.  Clients connecting by IP address send no server name.
+func (s *Server) checkServerName(hello *tls.ClientHelloInfo) error {
+	if s.apiHosts == nil || hello.ServerName == "" {
+		return nil
+	}
+
+	name := normalizeHost(hello.ServerName)
+	if name == aiaHostname || s.apiHosts[name] {
+		return nil
+	}
+
+	return fmt.Errorf("%w %s", ErrUnknownServerName, hello.ServerName)
+}
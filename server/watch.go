@@ -0,0 +1,330 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// watchKeepalive is how often an idle /watch stream gets a comment line, so
+// that proxies don't time it out.
+const watchKeepalive = 30 * time.Second
+
+// watchHub tracks the domains being watched.  Each watched domain and
+// service is re-resolved by a single goroutine, however many clients are
+// subscribed to it.
+type watchHub struct {
+	mu          sync.Mutex
+	watches     map[string]*domainWatch
+	subscribers int
+
+	// Closed by Stop, to end all streams.
+	done chan struct{}
+}
+
+type domainWatch struct {
+	domain  string
+	service string
+
+	subscribers map[chan []byte]struct{}
+
+	// The last event sent, replayed to new subscribers.
+	lastEvent []byte
+
+	stop chan struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watches: map[string]*domainWatch{},
+		done:    make(chan struct{}),
+	}
+}
+
+// watchHandler serves /watch?domain=example.bit as a Server-Sent Events
+// stream.  A "certs" event carrying the JSON /lookup representation of the
+// domain's certs is sent straight away and then whenever its TLSA records
+// (or our CAs) change.  It runs without reloadMutex held, since the stream
+// is long-lived.
+func (s *Server) watchHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "streaming unsupported")
+
+		return
+	}
+
+	domain := req.FormValue("domain")
+
+	s.reloadMutex.RLock()
+	tld := s.tldForDomain(domain)
+	policyErr := s.policy.check(domain)
+	maxWatchers := s.cfg.MaxWatchers
+	s.reloadMutex.RUnlock()
+
+	if tld == nil || strings.Contains(domain, " ") {
+		// We don't issue certs for this TLD.
+		writeError(w, http.StatusNotFound, errCodeNotFound, "unknown TLD")
+
+		return
+	}
+
+	if policyErr != nil {
+		writePolicyError(w, policyErr)
+
+		return
+	}
+
+	service, err := tlsaService(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+
+		return
+	}
+
+	events, ok := s.watches.subscribe(s, domain, service, maxWatchers)
+	if !ok {
+		tooManyRequests(w, watchKeepalive)
+
+		return
+	}
+	defer s.watches.unsubscribe(domain, service, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(watchKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			_, err = w.Write(event)
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case <-req.Context().Done():
+			return
+		case <-s.watches.done:
+			return
+		}
+
+		if err != nil {
+			log.Debuge(err, "write error")
+
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// subscribe returns a channel of events for domain and service, starting a
+// watch goroutine if there isn't one yet.  It fails if MaxWatchers streams
+// are already open.
+func (h *watchHub) subscribe(s *Server, domain, service string, maxWatchers int) (chan []byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if maxWatchers > 0 && h.subscribers >= maxWatchers {
+		return nil, false
+	}
+
+	key := service + "." + domain
+
+	watch, ok := h.watches[key]
+	if !ok {
+		watch = &domainWatch{
+			domain:      domain,
+			service:     service,
+			subscribers: map[chan []byte]struct{}{},
+			stop:        make(chan struct{}),
+		}
+		h.watches[key] = watch
+
+		go s.runWatch(watch)
+	}
+
+	// Buffered so that a slow client only ever misses intermediate
+	// states, never the latest one.
+	events := make(chan []byte, 1)
+	if watch.lastEvent != nil {
+		events <- watch.lastEvent
+	}
+
+	watch.subscribers[events] = struct{}{}
+	h.subscribers++
+
+	return events, true
+}
+
+func (h *watchHub) unsubscribe(domain, service string, events chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := service + "." + domain
+
+	watch := h.watches[key]
+	delete(watch.subscribers, events)
+	h.subscribers--
+
+	if len(watch.subscribers) == 0 {
+		close(watch.stop)
+		delete(h.watches, key)
+	}
+}
+
+// publish sends event to every subscriber of watch, replacing any event
+// they haven't received yet.
+func (h *watchHub) publish(watch *domainWatch, event []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	watch.lastEvent = event
+
+	for events := range watch.subscribers {
+		select {
+		case <-events:
+		default:
+		}
+
+		events <- event
+	}
+}
+
+// runWatch re-resolves a watched domain every WatchInterval until its last
+// subscriber goes away, publishing an event whenever the result changes.
+func (s *Server) runWatch(watch *domainWatch) {
+	var state string
+
+	s.reloadMutex.RLock()
+	ticker := time.NewTicker(s.watchInterval)
+	s.reloadMutex.RUnlock()
+
+	defer ticker.Stop()
+
+	for {
+		newState, certs, err := s.resolveWatch(watch, state)
+
+		switch {
+		case err != nil:
+			log.Debugef(err, "Unable to re-resolve watched domain %s", watch.domain)
+		case newState != state:
+			state = newState
+
+			event, err := watchEvent(certs)
+			if err != nil {
+				log.Warne(err, "Unable to encode watch event")
+			} else {
+				s.watches.publish(watch, event)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-watch.stop:
+			return
+		case <-s.watches.done:
+			return
+		}
+	}
+}
+
+// resolveWatch looks up a watched domain's TLSA records.  If they or the
+// issuing TLD CAs differ from state, the certs are re-issued; otherwise
+// certs is nil.
+func (s *Server) resolveWatch(watch *domainWatch, state string) (string, []lookupCert, error) {
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+
+	ctx := withAuditRequest(context.Background(), "", "/watch")
+
+	if s.requestTimeout != 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+	}
+
+	tld := s.tldForDomain(watch.domain)
+	if tld == nil {
+		return "", nil, nil
+	}
+
+	issuers := []*tldCA{tld}
+	if previousTLD := s.previousTLD(tld); previousTLD != nil {
+		issuers = append(issuers, previousTLD)
+	}
+
+	records, _, err := s.trustedTLSA(ctx, watch.domain, watch.service)
+	if err != nil {
+		return state, nil, err
+	}
+
+	newState := watchState(records, issuers)
+	if newState == state {
+		return state, nil, nil
+	}
+
+	certs := []lookupCert{}
+
+	for _, published := range records {
+		tlsa := s.issuableTLSA(ctx, published, nil, "")
+		if tlsa == nil {
+			continue
+		}
+
+		for _, issuer := range issuers {
+			safeCert, err := s.issueDomainCert(ctx, watch.domain, watch.service, published, tlsa, issuer, false)
+			if err != nil {
+				continue
+			}
+
+			safeCertPemBytes := pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: safeCert,
+			})
+
+			certs = append(certs, newLookupCert(safeCert, string(safeCertPemBytes), sourceDNS, published))
+		}
+	}
+
+	return newState, certs, nil
+}
+
+// watchState summarizes the inputs a watched domain's certs are derived
+// from.  TTLs are left out, since they count down in caching resolvers.
+func watchState(records []*dns.TLSA, issuers []*tldCA) string {
+	lines := make([]string, 0, len(records)+len(issuers))
+
+	for _, tlsa := range records {
+		lines = append(lines, fmt.Sprintf("%d %d %d %s", tlsa.Usage, tlsa.Selector, tlsa.MatchingType, strings.ToLower(tlsa.Certificate)))
+	}
+
+	sort.Strings(lines)
+
+	for _, issuer := range issuers {
+		lines = append(lines, fmt.Sprintf("%x", sha256.Sum256(issuer.cert)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func watchEvent(certs []lookupCert) ([]byte, error) {
+	data, err := json.Marshal(certs)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte("event: certs\ndata: " + string(data) + "\n\n"), nil
+}